@@ -27,6 +27,9 @@ const adminRole = "admin"
 // The name of the header the Session Manager expects to contain the shared admin key.
 const adminKeyHeader = "X-Admin-Key"
 
+// The name of the header used to tell the Session Manager which administrator is making a request, for its audit log.
+const adminUserHeader = "X-Admin-User"
+
 // The location of the Session Manager service, running on the host machine. "host.docker.internal"
 // is the standard Docker way to refer to the host from inside a container.
 const sessionManagerURL = "http://host.docker.internal:8091"
@@ -61,15 +64,23 @@ func main() {
 	}
 
 	// A helper that proxies a request through to the Session Manager's admin API, adding the shared
-	// admin key and passing the method, body and status code straight back to the caller.
+	// admin key and passing the method, query string, body and status code straight back to the caller.
+	// Server-sent event streams (such as session logs) are passed back as they arrive.
 	proxyToSessionManager := func(w http.ResponseWriter, r *http.Request, sessionManagerPath string) {
-		sessionManagerRequest, requestErr := http.NewRequest(r.Method, sessionManagerURL+sessionManagerPath, r.Body)
+		sessionManagerTarget := sessionManagerURL + sessionManagerPath
+		if r.URL.RawQuery != "" {
+			sessionManagerTarget = sessionManagerTarget + "?" + r.URL.RawQuery
+		}
+		// Tie the request to the caller's, so a stream is closed at the Session Manager end when the page closes it.
+		sessionManagerRequest, requestErr := http.NewRequestWithContext(r.Context(), r.Method, sessionManagerTarget, r.Body)
 		if requestErr != nil {
 			http.Error(w, "Error building Session Manager request: "+requestErr.Error(), http.StatusInternalServerError)
 			return
 		}
 		// ...adding the shared admin key as a header.
 		sessionManagerRequest.Header.Set(adminKeyHeader, adminKey)
+		// ...and the administrator's username, so the Session Manager's audit log can say who did what.
+		sessionManagerRequest.Header.Set(adminUserHeader, r.Header.Get("Remote-User"))
 		if contentType := r.Header.Get("Content-Type"); contentType != "" {
 			sessionManagerRequest.Header.Set("Content-Type", contentType)
 		}
@@ -83,6 +94,29 @@ func main() {
 		}
 		defer sessionManagerResponse.Body.Close()
 
+		// An event stream is passed back a chunk at a time, as the Session Manager sends it.
+		if strings.HasPrefix(sessionManagerResponse.Header.Get("Content-Type"), "text/event-stream") {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.WriteHeader(sessionManagerResponse.StatusCode)
+			flusher, _ := w.(http.Flusher)
+			streamBuffer := make([]byte, 32*1024)
+			for {
+				readCount, readErr := sessionManagerResponse.Body.Read(streamBuffer)
+				if readCount > 0 {
+					if _, writeErr := w.Write(streamBuffer[:readCount]); writeErr != nil {
+						return
+					}
+					if flusher != nil {
+						flusher.Flush()
+					}
+				}
+				if readErr != nil {
+					return
+				}
+			}
+		}
+
 		// Pass the response (and the status code) straight back to the dashboard page.
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(sessionManagerResponse.StatusCode)
@@ -112,6 +146,66 @@ func main() {
 		proxyToSessionManager(w, r, "/admin/autostart")
 	}))
 
+	// The endpoint that streams a user session's log output (as server-sent events), passing requests through to
+	// the Session Manager.
+	http.HandleFunc("/api/sessionLogs", adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		proxyToSessionManager(w, r, "/admin/sessionLogs")
+	}))
+
+	// The JSON API endpoint that stops, restarts, pauses, unpauses, removes or recreates a single user session,
+	// passing requests through to the Session Manager.
+	http.HandleFunc("/api/sessionAction", adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		proxyToSessionManager(w, r, "/admin/sessionAction")
+	}))
+
+	// The JSON API endpoint that starts an "upgrade all idle sessions" run (POST), or reports its progress (GET),
+	// passing requests through to the Session Manager.
+	http.HandleFunc("/api/upgradeSessions", adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		proxyToSessionManager(w, r, "/admin/upgradeSessions")
+	}))
+
+	// The JSON API endpoint that searches the Session Manager's audit log of session and admin events, by user,
+	// action and date range, passing requests through to the Session Manager.
+	http.HandleFunc("/api/audit", adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		proxyToSessionManager(w, r, "/admin/audit")
+	}))
+
+	// The JSON API endpoints that list a user's backups, and restore a folder (or a single path in it) from one,
+	// passing requests through to the Session Manager.
+	http.HandleFunc("/api/backups", adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		proxyToSessionManager(w, r, "/admin/backups")
+	}))
+	http.HandleFunc("/api/restore", adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		proxyToSessionManager(w, r, "/admin/restore")
+	}))
+
+	// The JSON API endpoint that deprovisions a user who has left (or, as a dry run, lists what that would do),
+	// passing requests through to the Session Manager.
+	http.HandleFunc("/api/deprovision", adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		proxyToSessionManager(w, r, "/admin/deprovision")
+	}))
+
+	// The JSON API endpoint that provisions the users listed in an uploaded CSV file, passing requests through to the
+	// Session Manager.
+	http.HandleFunc("/api/provision", adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		proxyToSessionManager(w, r, "/admin/provision")
+	}))
+
+	// The JSON API endpoints invigilators use to list, start, extend and end exams, passing requests through to the
+	// Session Manager.
+	http.HandleFunc("/api/exams", adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		proxyToSessionManager(w, r, "/admin/exams")
+	}))
+	http.HandleFunc("/api/exams/start", adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		proxyToSessionManager(w, r, "/admin/exams/start")
+	}))
+	http.HandleFunc("/api/exams/extend", adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		proxyToSessionManager(w, r, "/admin/exams/extend")
+	}))
+	http.HandleFunc("/api/exams/end", adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		proxyToSessionManager(w, r, "/admin/exams/end")
+	}))
+
 	// Execution starts here.
 	log.Println("adminPanel starting on :8080...")
 	if err := http.ListenAndServe(":8080", nil); err != nil {
@@ -39,6 +39,20 @@ cp /root/docker-calc-xstartup /home/$1/.config/tigervnc/xstartup
 chown $1:$1 /home/$1/.config/tigervnc/xstartup
 chmod u+x /home/$1/.config/tigervnc/xstartup
 
+# Pass the web proxy settings given by the Session Manager (from the user's egress policy, if any) on to the user -
+# "su -" below starts the user's session with a clean environment, but reads /etc/environment. Settings from an
+# earlier start are cleared first, in case the container was started with different ones.
+sed -i '/^\(HTTP_PROXY\|HTTPS_PROXY\|NO_PROXY\|http_proxy\|https_proxy\|no_proxy\|NODE_EXTRA_CA_CERTS\|REQUESTS_CA_BUNDLE\)=/d' /etc/environment
+for proxyVariable in HTTP_PROXY HTTPS_PROXY NO_PROXY http_proxy https_proxy no_proxy NODE_EXTRA_CA_CERTS REQUESTS_CA_BUNDLE; do
+  if [ -n "${!proxyVariable}" ]; then
+    echo "$proxyVariable=\"${!proxyVariable}\"" >> /etc/environment
+  fi
+done
+# Trust the CA certificate used by the school's web filter for TLS inspection, if the Session Manager mounted one.
+if [ -f /usr/local/share/ca-certificates/puws-egress-ca.crt ]; then
+  update-ca-certificates
+fi
+
 # Set up and run the user startup script, as the user.
 cp /root/docker-calc-user-startup.sh /home/$1/startup.sh
 chown $1:$1 /home/$1/startup.sh
@@ -75,8 +75,14 @@ public class GuacAutoConnect extends SimpleAuthenticationProvider {
 
     // Call the Session Manager service to tell it the user wants to connect to a VM instance via VNC.
     // We pass in the username, if there's a free slot available we should get back a password we can use to connect to the VNC session.
+    // The Session Manager only accepts calls from trusted components, so we pass the token we were given (via the "SESSION_MANAGER_TOKEN"
+    // environment variable, set by the install script) in the "Authorization" header.
+    String sessionManagerToken = System.getenv("SESSION_MANAGER_TOKEN");
+    if (sessionManagerToken == null) {
+      sessionManagerToken = "";
+    }
     HttpClient sessionManagerClient = HttpClient.newHttpClient();
-    HttpRequest sessionManagerRequest = HttpRequest.newBuilder().uri(URI.create("http://host.docker.internal:8091/connectToSession")).header("Content-Type", "application/x-www-form-urlencoded").POST(BodyPublishers.ofString("username=" + username + "&image=" + imageName + "&start=true")).build();
+    HttpRequest sessionManagerRequest = HttpRequest.newBuilder().uri(URI.create("http://host.docker.internal:8091/connectToSession")).header("Content-Type", "application/x-www-form-urlencoded").header("Authorization", "Bearer " + sessionManagerToken).POST(BodyPublishers.ofString("username=" + username + "&image=" + imageName + "&start=true")).build();
     try {
       HttpResponse<String> sessionManagerResponse = sessionManagerClient.send(sessionManagerRequest, HttpResponse.BodyHandlers.ofString());
       logger.info("Session Manager responded: " + sessionManagerResponse.body());
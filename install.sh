@@ -227,6 +227,11 @@ fi
 if [ ! -f "/usr/bin/fusermount" ]; then
     apt-get install -y fuse
 fi
+# Let users' own rclone mounts (run as the user, for remotes they set up themselves) be used from inside their session
+# container, as the Session Manager's own mounts are.
+if ! grep -q "^user_allow_other" /etc/fuse.conf 2>/dev/null; then
+    echo "user_allow_other" >> /etc/fuse.conf
+fi
 
 # Make sure rclone (for accessing / mounting cloud storage services such as Google Drive) is installed.
 if [ ! -f "/usr/bin/rclone" ]; then
@@ -584,8 +589,36 @@ if [ $INSTALL_PANGOLIN = true ]; then
         SESSIONPROXY_IDENTITY_SALT=`grep "^identitySalt:" /etc/puws/config.yml | head -1 | cut -d ' ' -f2`
     fi
 
+    # Make sure the Session Manager config file has tokens for the components allowed to call its session endpoints -
+    # the Guacamole extension (which may start sessions from any image) and the session proxy (which may only start
+    # "desktop" sessions). Generated once and re-used on subsequent runs.
+    if ! grep -q "^callers:" /etc/puws/config.yml; then
+        GUACAMOLE_SESSION_MANAGER_TOKEN=`cat /dev/urandom | tr -dc 'a-f0-9' | head -c 64`
+        SESSIONPROXY_SESSION_MANAGER_TOKEN=`cat /dev/urandom | tr -dc 'a-f0-9' | head -c 64`
+        echo "callers:" >> /etc/puws/config.yml
+        echo "  - name: guacamole" >> /etc/puws/config.yml
+        echo "    token: $GUACAMOLE_SESSION_MANAGER_TOKEN" >> /etc/puws/config.yml
+        echo "    images: [\"*\"]" >> /etc/puws/config.yml
+        echo "  - name: sessionproxy" >> /etc/puws/config.yml
+        echo "    token: $SESSIONPROXY_SESSION_MANAGER_TOKEN" >> /etc/puws/config.yml
+        echo "    images: [desktop]" >> /etc/puws/config.yml
+    else
+        # Read the tokens back with the Session Manager itself, which parses the config file properly (whatever the
+        # order or indentation of the YAML).
+        GUACAMOLE_SESSION_MANAGER_TOKEN=`per-user-web-server/sessionManager/sessionManager -config /etc/puws/config.yml -caller-token guacamole`
+        SESSIONPROXY_SESSION_MANAGER_TOKEN=`per-user-web-server/sessionManager/sessionManager -config /etc/puws/config.yml -caller-token sessionproxy`
+    fi
+    # An empty token would leave the component unable to call the Session Manager at all, so stop rather than carry on.
+    if [ -z "$GUACAMOLE_SESSION_MANAGER_TOKEN" ] || [ -z "$SESSIONPROXY_SESSION_MANAGER_TOKEN" ]; then
+        echo "Problem reading the guacamole and sessionproxy caller tokens from /etc/puws/config.yml - stopping."
+        echo "Check the \"callers\" section lists both, each with a token."
+        exit 1
+    fi
+
     sed -i "s/{{ADMINPANEL_ADMIN_KEY}}/$ADMINPANEL_ADMIN_KEY/g" docker-compose.yml
     sed -i "s/{{SESSIONPROXY_IDENTITY_SALT}}/$SESSIONPROXY_IDENTITY_SALT/g" docker-compose.yml
+    sed -i "s/{{GUACAMOLE_SESSION_MANAGER_TOKEN}}/$GUACAMOLE_SESSION_MANAGER_TOKEN/g" docker-compose.yml
+    sed -i "s/{{SESSIONPROXY_SESSION_MANAGER_TOKEN}}/$SESSIONPROXY_SESSION_MANAGER_TOKEN/g" docker-compose.yml
     sed -i "s/{{CLOUDFLARED_TOKEN}}/$CLOUDFLARED_TOKEN/g" docker-compose.yml
 
     # Start up the Docker containers.
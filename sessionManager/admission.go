@@ -0,0 +1,302 @@
+// Admission control for the Session Manager. When a whole class logs in at once, starting every session straight away
+// can push the host into swap and slow everyone's desktop to a crawl. Admission control sets a ceiling on the number
+// of sessions and a minimum amount of free memory to keep in reserve - session starts beyond those limits wait in a
+// first-come, first-served queue (with their queue position reported via the startup progress stream) until there is
+// room. Groups can have a number of sessions reserved for them, so one class logging in can't lock out another.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/moby/moby/client"
+)
+
+// A number of sessions reserved for members of a (host) user group.
+type GroupReservation struct {
+	Group    string `yaml:"group"`
+	Sessions int    `yaml:"sessions"`
+}
+
+// The admission control settings from the config file.
+type AdmissionConfig struct {
+	// The maximum number of sessions (running or paused) at once. Zero means no limit.
+	MaxSessions int `yaml:"maxSessions"`
+	// The amount of memory to keep free on the host (e.g. "4g") - no new sessions are started while less is available.
+	MinFreeMemory string `yaml:"minFreeMemory"`
+	// Sessions reserved for particular groups, out of the maximum number of sessions.
+	Reservations []GroupReservation `yaml:"reservations"`
+}
+
+// The interval between re-checks of the queue, to pick up room freed by sessions stopping.
+const admissionCheckInterval = 5 * time.Second
+
+// A session start waiting in the admission queue.
+type AdmissionTicket struct {
+	imageName string
+	username  string
+	groups    []string
+	queuedAt  time.Time
+	admitted  chan struct{}
+}
+
+// An entry in the admission queue, as reported to the admin panel.
+type QueueEntry struct {
+	Username string    `json:"username"`
+	Image    string    `json:"image"`
+	Position int       `json:"position"`
+	QueuedAt time.Time `json:"queuedAt"`
+}
+
+// AdmissionQueue holds the session starts waiting for room, in the order they arrived, and the tickets of the
+// sessions that have been admitted but haven't finished starting yet (so don't show up as running containers, or use
+// much memory yet). Protected by a mutex, as starts happen from many goroutines.
+type AdmissionQueue struct {
+	mu       sync.Mutex
+	waiting  []*AdmissionTicket
+	starting map[string]*AdmissionTicket
+	// Set while a hibernated session is being stopped to make room, so only one is stopped at a time.
+	makingRoom bool
+}
+
+// newAdmissionQueue initialises an empty admission queue.
+func newAdmissionQueue() *AdmissionQueue {
+	return &AdmissionQueue{
+		starting: make(map[string]*AdmissionTicket),
+	}
+}
+
+// The global admission queue.
+var sessionAdmissions = newAdmissionQueue()
+
+// admissionEnabled reports whether any admission limits are set in the config file.
+func admissionEnabled(admissionConfig AdmissionConfig) bool {
+	return admissionConfig.MaxSessions > 0 || admissionConfig.MinFreeMemory != ""
+}
+
+// canAdmit decides whether a user with the given groups can start a new session, given the groups of the users
+// whose sessions already take up room. Each existing session is counted against the first of its user's groups that
+// has a reserved session free, or otherwise against the shared (unreserved) sessions. A new session is admitted if
+// one of the user's groups has a reserved session free, or if there is a shared session free.
+func canAdmit(admissionConfig AdmissionConfig, sessionGroups [][]string, newUserGroups []string) bool {
+	if admissionConfig.MaxSessions <= 0 {
+		return true
+	}
+	reservedFree := make(map[string]int)
+	totalReserved := 0
+	for _, reservation := range admissionConfig.Reservations {
+		reservedFree[reservation.Group] = reservedFree[reservation.Group] + reservation.Sessions
+		totalReserved = totalReserved + reservation.Sessions
+	}
+	// takeReserved uses up a reserved session for one of the given groups, if any are free.
+	takeReserved := func(groups []string) bool {
+		for _, group := range groups {
+			if reservedFree[group] > 0 {
+				reservedFree[group] = reservedFree[group] - 1
+				return true
+			}
+		}
+		return false
+	}
+	sharedUsed := 0
+	for _, groups := range sessionGroups {
+		if !takeReserved(groups) {
+			sharedUsed = sharedUsed + 1
+		}
+	}
+	if takeReserved(newUserGroups) {
+		return true
+	}
+	return sharedUsed < admissionConfig.MaxSessions-totalReserved
+}
+
+// occupyingSessions returns the groups of the users whose session containers currently take up room - running or
+// paused - keyed by session. Sessions admitted but still starting are added by admitWaiting.
+func occupyingSessions(cli *client.Client) (map[string][]string, error) {
+	containers, containersErr := cli.ContainerList(context.Background(), client.ContainerListOptions{All: true})
+	if containersErr != nil {
+		return nil, containersErr
+	}
+	occupying := make(map[string][]string)
+	for _, item := range containers.Items {
+		imageName, username, isSession := sessionFromContainer(item)
+		if isSession && (item.State == "running" || item.State == "paused") {
+			occupying[sessionKey(imageName, username)] = userGroups(username)
+		}
+	}
+	return occupying, nil
+}
+
+// expectedMemory returns the memory a session is expected to use once started - its memory limit, if its resource
+// profile sets one.
+func expectedMemory(config Config, imageName string, groups []string) int64 {
+	if resourceProfile := selectResourceProfile(config.ResourceProfiles, imageName, groups); resourceProfile != nil {
+		memoryLimit, _ := parseByteSize(resourceProfile.Memory)
+		return memoryLimit
+	}
+	return 0
+}
+
+// process goes through the queue in order, admitting every waiting start there is room for, and reports the queue
+// position of those still waiting to the startup tracker. If starts are still waiting, the session hibernated longest
+// ago is stopped in the background to make room - one at a time, so the next pass can see whether that was enough.
+// The containers and free memory are looked at before taking the queue's mutex, so other starts, and the admin
+// panel's view of the queue, aren't held up waiting on Docker.
+func (aq *AdmissionQueue) process(cli *client.Client, config Config) {
+	aq.mu.Lock()
+	waitingCount := len(aq.waiting)
+	aq.mu.Unlock()
+	if waitingCount == 0 {
+		return
+	}
+
+	occupying, occupyingErr := occupyingSessions(cli)
+	if occupyingErr != nil {
+		log.Println("Error listing containers for admission control: " + occupyingErr.Error())
+		return
+	}
+	memAvailable := int64(0)
+	if memoryReserve, _ := parseByteSize(config.Admission.MinFreeMemory); memoryReserve > 0 {
+		var memErr error
+		_, memAvailable, _, _, memErr = readMemoryInfo()
+		if memErr != nil {
+			log.Println("Error reading memory info for admission control: " + memErr.Error())
+			return
+		}
+	}
+	aq.mu.Lock()
+	defer aq.mu.Unlock()
+	aq.admitWaiting(config, occupying, memAvailable*1024)
+	if len(aq.waiting) > 0 && !aq.makingRoom {
+		aq.makingRoom = true
+		go func() {
+			stopOldestHibernatedSession(cli)
+			aq.mu.Lock()
+			aq.makingRoom = false
+			aq.mu.Unlock()
+		}()
+	}
+}
+
+// admitWaiting admits every waiting start there is room for, given the session containers currently taking up room
+// (plus the sessions admitted but still starting) and the memory available on the host (in bytes). Must be called
+// with the queue's mutex held.
+func (aq *AdmissionQueue) admitWaiting(config Config, occupying map[string][]string, memAvailable int64) {
+	for startingKey, ticket := range aq.starting {
+		occupying[startingKey] = ticket.groups
+	}
+	var sessionGroups [][]string
+	for _, groups := range occupying {
+		sessionGroups = append(sessionGroups, groups)
+	}
+
+	// Work out how much memory is free above the reserve. Each session admitted but still starting - whether in this
+	// pass or an earlier one - is assumed to use up to its memory limit (if it has one), as it won't be using much
+	// memory yet, so a burst of logins doesn't all get admitted against the same free memory.
+	memoryReserve, _ := parseByteSize(config.Admission.MinFreeMemory)
+	memorySpare := memAvailable - memoryReserve
+	for _, ticket := range aq.starting {
+		memorySpare = memorySpare - expectedMemory(config, ticket.imageName, ticket.groups)
+	}
+
+	var stillWaiting []*AdmissionTicket
+	for _, ticket := range aq.waiting {
+		// A start needs room for the memory it is expected to use on top of the reserve - or, with no memory limit to
+		// go on, at least some memory to spare.
+		ticketMemory := expectedMemory(config, ticket.imageName, ticket.groups)
+		memoryOK := memoryReserve <= 0 || (memorySpare > 0 && memorySpare >= ticketMemory)
+		if memoryOK && canAdmit(config.Admission, sessionGroups, ticket.groups) {
+			sessionGroups = append(sessionGroups, ticket.groups)
+			aq.starting[sessionKey(ticket.imageName, ticket.username)] = ticket
+			memorySpare = memorySpare - ticketMemory
+			close(ticket.admitted)
+			continue
+		}
+		stillWaiting = append(stillWaiting, ticket)
+		sessionStartups.reportQueued(ticket.imageName, ticket.username, len(stillWaiting))
+	}
+	aq.waiting = stillWaiting
+}
+
+// remove takes a ticket out of the queue, if it is still waiting.
+func (aq *AdmissionQueue) remove(ticket *AdmissionTicket) {
+	aq.mu.Lock()
+	defer aq.mu.Unlock()
+	for index, waitingTicket := range aq.waiting {
+		if waitingTicket == ticket {
+			aq.waiting = append(aq.waiting[:index], aq.waiting[index+1:]...)
+			return
+		}
+	}
+}
+
+// admit waits until there is room to start the given session, queueing behind any other starts already waiting.
+// Returns an error if there is still no room after the given timeout. Once admitted, the caller must call finished
+// when the start is complete (whether or not it worked).
+func (aq *AdmissionQueue) admit(cli *client.Client, config Config, imageName string, username string, timeout time.Duration) error {
+	if !admissionEnabled(config.Admission) {
+		return nil
+	}
+	ticket := &AdmissionTicket{imageName: imageName, username: username, groups: userGroups(username), queuedAt: time.Now(), admitted: make(chan struct{})}
+	aq.mu.Lock()
+	aq.waiting = append(aq.waiting, ticket)
+	aq.mu.Unlock()
+
+	deadline := time.After(timeout)
+	for {
+		aq.process(cli, config)
+		select {
+		case <-ticket.admitted:
+			return nil
+		case <-deadline:
+			aq.remove(ticket)
+			// The ticket might have been admitted just as we timed out - if so, go ahead with the start after all.
+			select {
+			case <-ticket.admitted:
+				return nil
+			default:
+			}
+			return errors.New("The server is at capacity - timed out waiting for room to start a session, please try again later")
+		case <-time.After(admissionCheckInterval):
+		}
+	}
+}
+
+// finished records that an admitted session has finished starting, so it is counted from its container from now on.
+func (aq *AdmissionQueue) finished(imageName string, username string) {
+	aq.mu.Lock()
+	defer aq.mu.Unlock()
+	delete(aq.starting, sessionKey(imageName, username))
+}
+
+// entries returns the starts waiting in the queue, in order, for the admin panel.
+func (aq *AdmissionQueue) entries() []QueueEntry {
+	aq.mu.Lock()
+	defer aq.mu.Unlock()
+	var queueEntries []QueueEntry
+	for index, ticket := range aq.waiting {
+		queueEntries = append(queueEntries, QueueEntry{Username: ticket.username, Image: ticket.imageName, Position: index + 1, QueuedAt: ticket.queuedAt})
+	}
+	return queueEntries
+}
+
+// reportQueued records that a session start is waiting in the admission queue at the given position. Only reported
+// when the position changes, so the progress stream isn't filled with repeats.
+func (st *StartupTracker) reportQueued(imageName string, username string, position int) {
+	st.mu.Lock()
+	sessionProgress := st.progress(imageName, username)
+	if len(sessionProgress.events) > 0 {
+		lastEvent := sessionProgress.events[len(sessionProgress.events)-1]
+		if lastEvent.State == startupQueued && lastEvent.QueuePosition == position {
+			st.mu.Unlock()
+			return
+		}
+	}
+	st.mu.Unlock()
+	st.reportEvent(imageName, username, StartupEvent{State: startupQueued, Time: time.Now(), Message: "Position " + strconv.Itoa(position) + " in queue", QueuePosition: position})
+}
@@ -0,0 +1,409 @@
+// The audit log for the Session Manager. Safeguarding policy means we need to be able to say who started which
+// session and when, and who changed what - so session starts, stops and connections, admin actions and rejected
+// requests are each recorded as one line of JSON in an append-only audit log file. The file is rotated once it gets too
+// big or too old, keeping a set number of old files, and the "/admin/audit" endpoint searches the current and rotated
+// files by user, action and date.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The audit log settings from the config file.
+type AuditConfig struct {
+	// The audit log file. Defaults to /var/log/puws/audit.jsonl. Rotated files are kept alongside it, named with the
+	// time they were rotated (e.g. "audit-20260302-091500.000000.jsonl").
+	Path string `yaml:"path"`
+	// Rotate the file once it is bigger than this many megabytes. Defaults to 10.
+	MaxSizeMB int `yaml:"maxSizeMB"`
+	// Rotate the file once its first entry is older than this many hours. Defaults to 24.
+	RotateHours int `yaml:"rotateHours"`
+	// The number of rotated files to keep. Defaults to 90.
+	MaxFiles int `yaml:"maxFiles"`
+}
+
+// The default audit log settings.
+const defaultAuditPath = "/var/log/puws/audit.jsonl"
+const defaultAuditMaxSizeMB = 10
+const defaultAuditRotateHours = 24
+const defaultAuditMaxFiles = 90
+
+// The maximum number of entries returned by a single audit log search, if the caller doesn't say.
+const defaultAuditQueryLimit = 1000
+
+// The sources of audit events that don't come from a caller or the admin panel.
+const (
+	auditSourceAutoStart      = "autostart"
+	auditSourceIdleCulling    = "idle-culling"
+	auditSourceMemoryPressure = "memory-pressure"
+	auditSourceAdminPanel     = "admin-panel"
+	auditSourceSchedule       = "schedule"
+	auditSourceExam           = "exam"
+	auditSourceHibernation    = "hibernation"
+	auditSourceAdmission      = "admission"
+)
+
+// The actor recorded for events the Session Manager does by itself (culling, auto-start and so on).
+const auditActorSystem = "system"
+
+// The header the admin panel uses to pass on the username of the administrator making a request.
+const adminUserHeader = "X-Admin-User"
+
+// One entry in the audit log.
+type AuditEvent struct {
+	Time time.Time `json:"time"`
+	// What happened - for instance "session-start", "session-connect", "session-stop" or "autostart-update".
+	Action string `json:"action"`
+	// Who did it - the user connecting, the administrator, or "system".
+	Actor string `json:"actor"`
+	// The user whose session was acted on, if any.
+	Target string `json:"target,omitempty"`
+	// The session's image, if any.
+	Image string `json:"image,omitempty"`
+	// The component the action came from - a caller name (e.g. "guacamole"), "admin-panel", "autostart", etc.
+	Source string `json:"source"`
+	// "ok", "failed" or "denied".
+	Result string `json:"result"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Who is responsible for a session start, recorded in the audit log.
+type AuditActor struct {
+	Name   string
+	Source string
+}
+
+// AuditLog appends events to the audit log file, rotating it as needed. Protected by a mutex, as events are recorded
+// from HTTP handlers and background goroutines at the same time.
+type AuditLog struct {
+	mu       sync.Mutex
+	config   AuditConfig
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+// newAuditLog initialises an audit log with the default settings. The file is opened when the first event is recorded.
+func newAuditLog() *AuditLog {
+	return &AuditLog{}
+}
+
+// The global audit log.
+var sessionAudit = newAuditLog()
+
+// configure applies the audit log settings from the config file, filling in defaults for any not set.
+func (al *AuditLog) configure(auditConfig AuditConfig) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	auditConfig = withAuditDefaults(auditConfig)
+	if al.file != nil && auditConfig.Path != al.config.Path {
+		al.file.Close()
+		al.file = nil
+	}
+	al.config = auditConfig
+}
+
+// withAuditDefaults fills in the default for any audit log setting not set in the config file.
+func withAuditDefaults(auditConfig AuditConfig) AuditConfig {
+	if auditConfig.Path == "" {
+		auditConfig.Path = defaultAuditPath
+	}
+	if auditConfig.MaxSizeMB <= 0 {
+		auditConfig.MaxSizeMB = defaultAuditMaxSizeMB
+	}
+	if auditConfig.RotateHours <= 0 {
+		auditConfig.RotateHours = defaultAuditRotateHours
+	}
+	if auditConfig.MaxFiles <= 0 {
+		auditConfig.MaxFiles = defaultAuditMaxFiles
+	}
+	return auditConfig
+}
+
+// settings returns the audit log settings, with defaults filled in if configure hasn't been called. Must be called
+// with the mutex held.
+func (al *AuditLog) settings() AuditConfig {
+	return withAuditDefaults(al.config)
+}
+
+// rotatedPattern returns the glob pattern matching the rotated copies of the given audit log file.
+func rotatedPattern(auditPath string) string {
+	return strings.TrimSuffix(auditPath, filepath.Ext(auditPath)) + "-*" + filepath.Ext(auditPath)
+}
+
+// open opens (or creates) the audit log file for appending, working out its size and when its first entry was
+// written, so we know when it is due to be rotated. Must be called with the mutex held.
+func (al *AuditLog) open(auditConfig AuditConfig) error {
+	if mkdirErr := os.MkdirAll(filepath.Dir(auditConfig.Path), 0750); mkdirErr != nil {
+		return mkdirErr
+	}
+	auditFile, openErr := os.OpenFile(auditConfig.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if openErr != nil {
+		return openErr
+	}
+	fileInfo, statErr := auditFile.Stat()
+	if statErr != nil {
+		auditFile.Close()
+		return statErr
+	}
+	al.file = auditFile
+	al.size = fileInfo.Size()
+	al.openedAt = time.Now()
+	// An existing file was started when its first entry was written.
+	if existingFile, readErr := os.Open(auditConfig.Path); readErr == nil {
+		firstLineScanner := bufio.NewScanner(existingFile)
+		var firstEvent AuditEvent
+		if firstLineScanner.Scan() && json.Unmarshal(firstLineScanner.Bytes(), &firstEvent) == nil && !firstEvent.Time.IsZero() {
+			al.openedAt = firstEvent.Time
+		}
+		existingFile.Close()
+	}
+	return nil
+}
+
+// rotate renames the current audit log file out of the way, named with the current time, and removes the oldest
+// rotated files beyond the number to keep. Must be called with the mutex held.
+func (al *AuditLog) rotate(auditConfig AuditConfig) error {
+	if al.file != nil {
+		al.file.Close()
+		al.file = nil
+	}
+	auditExt := filepath.Ext(auditConfig.Path)
+	// Named with the time to the microsecond, so rotated files sort into date order and never overwrite each other.
+	rotatedPath := strings.TrimSuffix(auditConfig.Path, auditExt) + "-" + time.Now().Format("20060102-150405.000000") + auditExt
+	if renameErr := os.Rename(auditConfig.Path, rotatedPath); renameErr != nil {
+		return renameErr
+	}
+	rotatedFiles, _ := filepath.Glob(rotatedPattern(auditConfig.Path))
+	sort.Strings(rotatedFiles)
+	for len(rotatedFiles) > auditConfig.MaxFiles {
+		if removeErr := os.Remove(rotatedFiles[0]); removeErr != nil {
+			log.Println("Error removing old audit log file " + rotatedFiles[0] + ": " + removeErr.Error())
+		}
+		rotatedFiles = rotatedFiles[1:]
+	}
+	return nil
+}
+
+// write appends an event to the audit log file, rotating the file first if it is too big or too old.
+func (al *AuditLog) write(event AuditEvent) error {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	auditConfig := al.settings()
+	eventData, jsonErr := json.Marshal(event)
+	if jsonErr != nil {
+		return jsonErr
+	}
+	eventData = append(eventData, '\n')
+
+	if al.file == nil {
+		if openErr := al.open(auditConfig); openErr != nil {
+			return openErr
+		}
+	}
+	tooBig := al.size > 0 && al.size+int64(len(eventData)) > int64(auditConfig.MaxSizeMB)*1024*1024
+	tooOld := al.size > 0 && time.Since(al.openedAt) > time.Duration(auditConfig.RotateHours)*time.Hour
+	if tooBig || tooOld {
+		if rotateErr := al.rotate(auditConfig); rotateErr != nil {
+			return rotateErr
+		}
+		if openErr := al.open(auditConfig); openErr != nil {
+			return openErr
+		}
+	}
+
+	writtenCount, writeErr := al.file.Write(eventData)
+	al.size = al.size + int64(writtenCount)
+	return writeErr
+}
+
+// record adds an event to the audit log, timestamped now. The audit log must never hold up (or break) the thing
+// being audited, so errors are logged rather than returned.
+func (al *AuditLog) record(event AuditEvent) {
+	event.Time = time.Now()
+	if event.Result == "" {
+		event.Result = "ok"
+	}
+	if writeErr := al.write(event); writeErr != nil {
+		log.Println("Error writing to audit log: " + writeErr.Error())
+	}
+}
+
+// A search of the audit log. Empty fields match everything.
+type AuditFilter struct {
+	// Matches events where the user is either the actor or the target.
+	User   string
+	Action string
+	From   time.Time
+	To     time.Time
+	Limit  int
+}
+
+// matches reports whether an event matches the filter.
+func (filter AuditFilter) matches(event AuditEvent) bool {
+	if filter.User != "" && event.Actor != filter.User && event.Target != filter.User {
+		return false
+	}
+	if filter.Action != "" && event.Action != filter.Action {
+		return false
+	}
+	if !filter.From.IsZero() && event.Time.Before(filter.From) {
+		return false
+	}
+	if !filter.To.IsZero() && event.Time.After(filter.To) {
+		return false
+	}
+	return true
+}
+
+// parseAuditTime parses a date ("2026-03-02") or a date and time (RFC 3339) for an audit log search. A date on its
+// own means the start of that day or, if endOfDay is set, the end of it.
+func parseAuditTime(value string, endOfDay bool) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if dayTime, dayErr := time.ParseInLocation("2006-01-02", value, time.Local); dayErr == nil {
+		if endOfDay {
+			return dayTime.Add(24*time.Hour - time.Nanosecond), nil
+		}
+		return dayTime, nil
+	}
+	exactTime, exactErr := time.Parse(time.RFC3339, value)
+	if exactErr != nil {
+		return time.Time{}, errors.New("dates should look like \"2026-03-02\" or \"2026-03-02T09:00:00Z\"")
+	}
+	return exactTime, nil
+}
+
+// auditFilterFromRequest builds an audit log search from the "user", "action", "from", "to" and "limit" parameters
+// of a request.
+func auditFilterFromRequest(r *http.Request) (AuditFilter, error) {
+	query := r.URL.Query()
+	filter := AuditFilter{User: strings.TrimSpace(query.Get("user")), Action: strings.TrimSpace(query.Get("action")), Limit: defaultAuditQueryLimit}
+	var fromErr, toErr error
+	filter.From, fromErr = parseAuditTime(query.Get("from"), false)
+	if fromErr != nil {
+		return filter, fromErr
+	}
+	filter.To, toErr = parseAuditTime(query.Get("to"), true)
+	if toErr != nil {
+		return filter, toErr
+	}
+	if limitValue := strings.TrimSpace(query.Get("limit")); limitValue != "" {
+		limit, limitErr := strconv.Atoi(limitValue)
+		if limitErr != nil || limit <= 0 {
+			return filter, errors.New("\"limit\" should be a positive number")
+		}
+		filter.Limit = limit
+	}
+	return filter, nil
+}
+
+// search returns the events matching the filter from the current and rotated audit log files, oldest first. If more
+// events match than the filter's limit, the most recent ones are returned.
+func (al *AuditLog) search(filter AuditFilter) ([]AuditEvent, error) {
+	al.mu.Lock()
+	auditConfig := al.settings()
+	al.mu.Unlock()
+
+	// Rotated files are named with the time they were rotated, so sort into date order - the current file comes last.
+	auditFiles, _ := filepath.Glob(rotatedPattern(auditConfig.Path))
+	sort.Strings(auditFiles)
+	auditFiles = append(auditFiles, auditConfig.Path)
+
+	// Only the most recent matches are kept while scanning, so a broad search over a long history doesn't hold every
+	// matching event in memory - once the limit is reached, the oldest match is dropped as each new one is found.
+	var matchingEvents []AuditEvent
+	for _, auditPath := range auditFiles {
+		auditFile, openErr := os.Open(auditPath)
+		if errors.Is(openErr, os.ErrNotExist) {
+			continue
+		}
+		if openErr != nil {
+			return nil, openErr
+		}
+		auditScanner := bufio.NewScanner(auditFile)
+		auditScanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for auditScanner.Scan() {
+			var event AuditEvent
+			if json.Unmarshal(auditScanner.Bytes(), &event) != nil {
+				continue
+			}
+			if !filter.matches(event) {
+				continue
+			}
+			if filter.Limit > 0 && len(matchingEvents) >= filter.Limit {
+				matchingEvents = matchingEvents[len(matchingEvents)-filter.Limit+1:]
+			}
+			matchingEvents = append(matchingEvents, event)
+		}
+		auditFile.Close()
+		if scanErr := auditScanner.Err(); scanErr != nil {
+			return nil, scanErr
+		}
+	}
+	return matchingEvents, nil
+}
+
+// adminActor returns the administrator making a request via the admin panel, for the audit log. Only trusted on
+// requests that have already been checked for the admin key.
+func adminActor(r *http.Request) string {
+	if adminUser := strings.TrimSpace(r.Header.Get(adminUserHeader)); adminUser != "" {
+		return adminUser
+	}
+	return "admin"
+}
+
+// auditResult returns the result and detail to record in the audit log for an error message (empty for success).
+func auditResult(errorMessage string) (string, string) {
+	if errorMessage != "" {
+		return "failed", errorMessage
+	}
+	return "ok", ""
+}
+
+// describeAutoStartChanges describes the difference between the old and new auto-start lists for the audit log, for
+// instance "added desktop-jane.doe; removed desktop-john.smith".
+func describeAutoStartChanges(oldSessions []AutoStartEntry, newSessions []AutoStartEntry) string {
+	inOld := make(map[string]bool)
+	for _, entry := range oldSessions {
+		inOld[sessionKey(entry.Image, entry.Username)] = true
+	}
+	inNew := make(map[string]bool)
+	var added, removed []string
+	for _, entry := range newSessions {
+		inNew[sessionKey(entry.Image, entry.Username)] = true
+		if !inOld[sessionKey(entry.Image, entry.Username)] {
+			added = append(added, entry.Image+"-"+entry.Username)
+		}
+	}
+	for _, entry := range oldSessions {
+		if !inNew[sessionKey(entry.Image, entry.Username)] {
+			removed = append(removed, entry.Image+"-"+entry.Username)
+		}
+	}
+	var changes []string
+	if len(added) > 0 {
+		changes = append(changes, "added "+strings.Join(added, ", "))
+	}
+	if len(removed) > 0 {
+		changes = append(changes, "removed "+strings.Join(removed, ", "))
+	}
+	if len(changes) == 0 {
+		return "no changes"
+	}
+	return strings.Join(changes, "; ")
+}
@@ -0,0 +1,440 @@
+// Scheduled backups of user folders for the Session Manager. Each user's home folder and website ("www") folder are
+// backed up on a schedule, as compressed tar files in a folder set in the config file (ideally on a separate disk).
+// Backups can be incremental: a full backup every so often, and in between only what has changed since the last
+// backup. Old backups are deleted once they are past the retention period.
+//
+// Backups are taken with GNU tar, which keeps track of what has changed (including deleted files) between
+// incremental backups. An admin can list a user's backups ("snapshots") and restore a whole folder, or a single
+// path, as it was at any snapshot, into a "restored" folder alongside the user's files.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The interval between checks for backups that are due.
+const backupCheckInterval = 15 * time.Minute
+
+// Defaults for settings not given in the config file.
+const (
+	defaultBackupIntervalHours = 24
+	defaultFullBackupEveryDays = 7
+	defaultBackupKeepDays      = 30
+)
+
+// The kinds of snapshot - a full backup of the folder, or an incremental backup of what changed since the last one.
+const (
+	snapshotFull        = "full"
+	snapshotIncremental = "incremental"
+)
+
+// The folder, inside each backed up folder, that restored files are put in.
+const restoredFolderName = "restored"
+
+// The name of the file GNU tar keeps its record of the files backed up so far in, for incremental backups.
+const backupStateFile = "tar.snar"
+
+// Snapshot IDs are the (UTC) time the backup was taken and its kind, also used as the file name.
+var snapshotIDPattern = regexp.MustCompile(`^(\d{8}-\d{6})-(full|incremental)$`)
+
+// The folders backed up for each user, by the name used for them in backups.
+var backupFolders = map[string]string{
+	"home": homeFoldersRoot,
+	"www":  wwwFoldersRoot,
+}
+
+// The backup settings from the config file.
+type BackupConfig struct {
+	// The folder backups are written to. If empty, backups are disabled.
+	Target string `yaml:"target"`
+	// How often each folder is backed up, in hours. Defaults to 24.
+	IntervalHours int `yaml:"intervalHours"`
+	// Back up only what has changed since the last backup, with a full backup every "fullEveryDays" days (default
+	// 7). If false, every backup is a full backup.
+	Incremental   bool `yaml:"incremental"`
+	FullEveryDays int  `yaml:"fullEveryDays"`
+	// How long backups are kept, in days. Defaults to 30. Incremental backups need the backups before them, back to
+	// the last full backup, so are only deleted along with them - and the latest full backup is always kept.
+	KeepDays int `yaml:"keepDays"`
+}
+
+// A backup of one of a user's folders.
+type Snapshot struct {
+	ID     string    `json:"id"`
+	Folder string    `json:"folder"`
+	Time   time.Time `json:"time"`
+	Kind   string    `json:"kind"`
+	Size   int64     `json:"size"`
+}
+
+// A request to restore a folder, or a single path within it, from a snapshot.
+type RestoreRequest struct {
+	Username string `json:"username"`
+	Folder   string `json:"folder"`
+	Snapshot string `json:"snapshot"`
+	// A file or folder, relative to the backed up folder. If empty, the whole folder is restored.
+	Path string `json:"path"`
+}
+
+// BackupRunner records the outcome of the last backup of each folder, for the admin panel. Backups are run by the
+// background loop while HTTP handlers read the results, so protected by a mutex. Only one backup or restore runs at
+// once, so they don't compete for the disk.
+type BackupRunner struct {
+	mu       sync.Mutex
+	lastRun  time.Time
+	failures map[string]string
+	working  sync.Mutex
+}
+
+var sessionBackups = newBackupRunner()
+
+func newBackupRunner() *BackupRunner {
+	return &BackupRunner{failures: make(map[string]string)}
+}
+
+// recordResult records the outcome of backing up one folder.
+func (br *BackupRunner) recordResult(username string, folder string, backupErr error) {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	key := username + "/" + folder
+	delete(br.failures, key)
+	if backupErr != nil {
+		br.failures[key] = backupErr.Error()
+	}
+}
+
+// status returns when backups were last checked, and the folders whose last backup failed.
+func (br *BackupRunner) status() map[string]interface{} {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	failures := make(map[string]string, len(br.failures))
+	for key, failure := range br.failures {
+		failures[key] = failure
+	}
+	return map[string]interface{}{"lastRun": br.lastRun, "failures": failures}
+}
+
+// backupInterval returns how often each folder is backed up.
+func backupInterval(backupConfig BackupConfig) time.Duration {
+	if backupConfig.IntervalHours > 0 {
+		return time.Duration(backupConfig.IntervalHours) * time.Hour
+	}
+	return defaultBackupIntervalHours * time.Hour
+}
+
+// fullBackupInterval returns how often a full backup is taken, when backups are incremental.
+func fullBackupInterval(backupConfig BackupConfig) time.Duration {
+	if backupConfig.FullEveryDays > 0 {
+		return time.Duration(backupConfig.FullEveryDays) * 24 * time.Hour
+	}
+	return defaultFullBackupEveryDays * 24 * time.Hour
+}
+
+// backupKeepTime returns how long backups are kept.
+func backupKeepTime(backupConfig BackupConfig) time.Duration {
+	if backupConfig.KeepDays > 0 {
+		return time.Duration(backupConfig.KeepDays) * 24 * time.Hour
+	}
+	return defaultBackupKeepDays * 24 * time.Hour
+}
+
+// snapshotFolder returns the folder a user's backups of one of their folders are kept in.
+func snapshotFolder(backupConfig BackupConfig, username string, folder string) string {
+	return filepath.Join(backupConfig.Target, username, folder)
+}
+
+// listSnapshots returns the backups of one of a user's folders, oldest first.
+func listSnapshots(backupConfig BackupConfig, username string, folder string) ([]Snapshot, error) {
+	entries, readErr := os.ReadDir(snapshotFolder(backupConfig, username, folder))
+	if os.IsNotExist(readErr) {
+		return nil, nil
+	} else if readErr != nil {
+		return nil, readErr
+	}
+	var snapshots []Snapshot
+	for _, entry := range entries {
+		snapshotID, isArchive := strings.CutSuffix(entry.Name(), ".tar.gz")
+		idParts := snapshotIDPattern.FindStringSubmatch(snapshotID)
+		if !isArchive || idParts == nil {
+			continue
+		}
+		snapshotTime, timeErr := time.ParseInLocation("20060102-150405", idParts[1], time.UTC)
+		if timeErr != nil {
+			continue
+		}
+		snapshot := Snapshot{ID: snapshotID, Folder: folder, Time: snapshotTime, Kind: idParts[2]}
+		if info, infoErr := entry.Info(); infoErr == nil {
+			snapshot.Size = info.Size()
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	// A full backup taken in the same second as an incremental one (the first full backup, say) comes first.
+	sort.Slice(snapshots, func(i, j int) bool {
+		if !snapshots[i].Time.Equal(snapshots[j].Time) {
+			return snapshots[i].Time.Before(snapshots[j].Time)
+		}
+		return snapshots[i].Kind == snapshotFull && snapshots[j].Kind != snapshotFull
+	})
+	return snapshots, nil
+}
+
+// listUserSnapshots returns the backups of all a user's folders, newest first.
+func listUserSnapshots(backupConfig BackupConfig, username string) ([]Snapshot, error) {
+	var snapshots []Snapshot
+	for folder := range backupFolders {
+		folderSnapshots, listErr := listSnapshots(backupConfig, username, folder)
+		if listErr != nil {
+			return nil, listErr
+		}
+		snapshots = append(snapshots, folderSnapshots...)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		if !snapshots[i].Time.Equal(snapshots[j].Time) {
+			return snapshots[i].Time.After(snapshots[j].Time)
+		}
+		return snapshots[i].Folder < snapshots[j].Folder
+	})
+	return snapshots, nil
+}
+
+// nextSnapshotKind works out whether a folder is due a backup, and if so whether it should be a full or incremental
+// one, given its existing backups (oldest first). Returns "" if no backup is due.
+func nextSnapshotKind(backupConfig BackupConfig, snapshots []Snapshot, now time.Time) string {
+	if len(snapshots) == 0 {
+		return snapshotFull
+	}
+	if now.Sub(snapshots[len(snapshots)-1].Time) < backupInterval(backupConfig) {
+		return ""
+	}
+	if !backupConfig.Incremental {
+		return snapshotFull
+	}
+	for index := len(snapshots) - 1; index >= 0; index-- {
+		if snapshots[index].Kind == snapshotFull {
+			if now.Sub(snapshots[index].Time) < fullBackupInterval(backupConfig) {
+				return snapshotIncremental
+			}
+			return snapshotFull
+		}
+	}
+	return snapshotFull
+}
+
+// expiredSnapshots returns the backups (oldest first) past the retention period. A full backup and the incremental
+// backups after it are only deleted together, once the newest of them has expired and there is a later full backup.
+func expiredSnapshots(backupConfig BackupConfig, snapshots []Snapshot, now time.Time) []Snapshot {
+	var chains [][]Snapshot
+	for _, snapshot := range snapshots {
+		if snapshot.Kind == snapshotFull || len(chains) == 0 {
+			chains = append(chains, nil)
+		}
+		chains[len(chains)-1] = append(chains[len(chains)-1], snapshot)
+	}
+	var expired []Snapshot
+	for index := 0; index < len(chains)-1; index++ {
+		chain := chains[index]
+		if now.Sub(chain[len(chain)-1].Time) > backupKeepTime(backupConfig) {
+			expired = append(expired, chain...)
+		}
+	}
+	return expired
+}
+
+// restoreChain returns the snapshots (oldest first) that have to be extracted, in order, to restore a folder as it
+// was at the given snapshot - the last full backup before it, and the incremental backups from there on.
+func restoreChain(snapshots []Snapshot, snapshotID string) ([]Snapshot, error) {
+	for index := range snapshots {
+		if snapshots[index].ID != snapshotID {
+			continue
+		}
+		for start := index; start >= 0; start-- {
+			if snapshots[start].Kind == snapshotFull {
+				return snapshots[start : index+1], nil
+			}
+		}
+		return nil, errors.New("The full backup snapshot " + snapshotID + " depends on has been deleted")
+	}
+	return nil, errors.New("No snapshot " + snapshotID)
+}
+
+// backupFolder takes a backup of one of a user's folders. Only the folder's own file system is backed up, so cloud
+// storage mounted inside it isn't. For incremental backups, GNU tar's record of what has been backed up is updated
+// only once the backup has succeeded, so a failed backup doesn't break the chain.
+func backupFolder(backupConfig BackupConfig, username string, folder string, kind string) error {
+	sourceFolder := filepath.Join(backupFolders[folder], username)
+	if _, statErr := os.Stat(sourceFolder); os.IsNotExist(statErr) {
+		return nil
+	}
+	targetFolder := snapshotFolder(backupConfig, username, folder)
+	if mkdirErr := os.MkdirAll(targetFolder, 0700); mkdirErr != nil {
+		return mkdirErr
+	}
+	snapshotID := time.Now().UTC().Format("20060102-150405") + "-" + kind
+	archivePath := filepath.Join(targetFolder, snapshotID+".tar.gz")
+	statePath := filepath.Join(targetFolder, backupStateFile)
+	workingStatePath := statePath + ".new"
+	os.Remove(workingStatePath)
+	tarArgs := []string{"--create", "--gzip", "--one-file-system", "--file", archivePath}
+	if backupConfig.Incremental {
+		if kind == snapshotIncremental {
+			stateData, readErr := os.ReadFile(statePath)
+			if readErr != nil {
+				return errors.New("Error reading incremental backup state: " + readErr.Error())
+			}
+			if writeErr := os.WriteFile(workingStatePath, stateData, 0600); writeErr != nil {
+				return writeErr
+			}
+		}
+		tarArgs = append(tarArgs, "--listed-incremental", workingStatePath)
+	}
+	tarArgs = append(tarArgs, "--directory", sourceFolder, ".")
+
+	tarOutput, tarErr := exec.Command("tar", tarArgs...).CombinedOutput()
+	// GNU tar exits with status 1 if files changed while they were being read, which is to be expected for a
+	// folder that might be in use - the backup is still usable.
+	var exitErr *exec.ExitError
+	if tarErr != nil && !(errors.As(tarErr, &exitErr) && exitErr.ExitCode() == 1) {
+		os.Remove(archivePath)
+		os.Remove(workingStatePath)
+		return errors.New("tar failed: " + lastOutputLine(tarOutput))
+	}
+	if backupConfig.Incremental {
+		if renameErr := os.Rename(workingStatePath, statePath); renameErr != nil {
+			return renameErr
+		}
+	}
+	return nil
+}
+
+// lastOutputLine returns the last non-empty line of a command's output.
+func lastOutputLine(output []byte) string {
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// runBackups backs up every user's folders that are due a backup, then deletes expired backups.
+func runBackups(config Config) {
+	backupConfig := config.Backups
+	if backupConfig.Target == "" {
+		return
+	}
+	sessionBackups.working.Lock()
+	defer sessionBackups.working.Unlock()
+	for _, username := range diskUsageUsers() {
+		for folder := range backupFolders {
+			snapshots, listErr := listSnapshots(backupConfig, username, folder)
+			if listErr != nil {
+				sessionBackups.recordResult(username, folder, listErr)
+				continue
+			}
+			if kind := nextSnapshotKind(backupConfig, snapshots, time.Now()); kind != "" {
+				backupErr := backupFolder(backupConfig, username, folder, kind)
+				if backupErr != nil {
+					log.Println("Error backing up " + folder + " folder of user " + username + ": " + backupErr.Error())
+				}
+				sessionBackups.recordResult(username, folder, backupErr)
+				snapshots, _ = listSnapshots(backupConfig, username, folder)
+			}
+			for _, snapshot := range expiredSnapshots(backupConfig, snapshots, time.Now()) {
+				fmt.Println("Deleting expired backup " + snapshot.ID + " of " + folder + " folder of user " + username)
+				os.Remove(filepath.Join(snapshotFolder(backupConfig, username, folder), snapshot.ID+".tar.gz"))
+			}
+		}
+	}
+	sessionBackups.mu.Lock()
+	sessionBackups.lastRun = time.Now()
+	sessionBackups.mu.Unlock()
+}
+
+// isValidBackupUsername reports whether a username can safely be used in the path of a user's backups.
+func isValidBackupUsername(username string) bool {
+	return username != "" && filepath.IsLocal(username) && !strings.Contains(username, "/")
+}
+
+// checkRestoreRequest checks a restore request, returning an error message, or "" if the request is valid.
+func checkRestoreRequest(restoreRequest RestoreRequest) string {
+	if !isValidBackupUsername(restoreRequest.Username) {
+		return "Invalid username"
+	}
+	if _, validFolder := backupFolders[restoreRequest.Folder]; !validFolder {
+		return "Invalid folder: must be \"home\" or \"www\""
+	}
+	if !snapshotIDPattern.MatchString(restoreRequest.Snapshot) {
+		return "Invalid snapshot ID"
+	}
+	if restoreRequest.Path != "" && !filepath.IsLocal(restoreRequest.Path) {
+		return "Invalid path: must be relative to the folder, e.g. \"Documents/essay.odt\""
+	}
+	return ""
+}
+
+// restoreSnapshot restores a user's folder, or a single path within it, as it was at the given snapshot, into
+// "restored/<snapshot ID>" in that folder. Returns where the files were restored to. tar runs as the user, reading
+// the backups passed to it, so a restore can't put files anywhere the user couldn't.
+func restoreSnapshot(backupConfig BackupConfig, restoreRequest RestoreRequest) (string, error) {
+	snapshots, listErr := listSnapshots(backupConfig, restoreRequest.Username, restoreRequest.Folder)
+	if listErr != nil {
+		return "", listErr
+	}
+	chain, chainErr := restoreChain(snapshots, restoreRequest.Snapshot)
+	if chainErr != nil {
+		return "", chainErr
+	}
+	hostUser, lookupErr := user.Lookup(restoreRequest.Username)
+	if lookupErr != nil {
+		return "", lookupErr
+	}
+	userUID, _ := strconv.Atoi(hostUser.Uid)
+	userGID, _ := strconv.Atoi(hostUser.Gid)
+
+	// Restore into a new folder, so nothing the user has now is overwritten.
+	userFolder := filepath.Join(backupFolders[restoreRequest.Folder], restoreRequest.Username)
+	restoredPath := filepath.Join(restoredFolderName, restoreRequest.Snapshot)
+	if pathErr := checkUserPath(userFolder, restoredPath, true); pathErr != nil {
+		return "", pathErr
+	}
+	destination := filepath.Join(userFolder, restoredPath)
+	if _, statErr := os.Lstat(destination); statErr == nil {
+		return "", errors.New(destination + " already exists - move or delete it first")
+	}
+	if mkdirErr := mkdirChownInUserFolder(userFolder, restoredPath, userUID, userGID); mkdirErr != nil {
+		return "", mkdirErr
+	}
+
+	sessionBackups.working.Lock()
+	defer sessionBackups.working.Unlock()
+	for _, snapshot := range chain {
+		archive, openErr := os.Open(filepath.Join(snapshotFolder(backupConfig, restoreRequest.Username, restoreRequest.Folder), snapshot.ID+".tar.gz"))
+		if openErr != nil {
+			return "", openErr
+		}
+		tarArgs := []string{"--extract", "--gzip", "--listed-incremental", "/dev/null", "--no-same-owner", "--directory", destination, "--file", "-"}
+		if restoreRequest.Path != "" {
+			tarArgs = append(tarArgs, "./"+filepath.Clean(restoreRequest.Path))
+		}
+		tarCommand := exec.Command("tar", tarArgs...)
+		tarCommand.Stdin = archive
+		tarCommand.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: uint32(userUID), Gid: uint32(userGID)}}
+		tarOutput, tarErr := tarCommand.CombinedOutput()
+		archive.Close()
+		// The path being restored needn't be in every snapshot - an incremental backup only holds what changed.
+		if tarErr != nil && !(restoreRequest.Path != "" && strings.Contains(string(tarOutput), "Not found in archive")) {
+			return "", errors.New("tar failed restoring " + snapshot.ID + ": " + lastOutputLine(tarOutput))
+		}
+	}
+	return destination, nil
+}
@@ -14,8 +14,8 @@ go get golang.org/x/crypto/argon2
 # Clear out any previously-compile binary.
 rm sessionManager
 
-# Build the executable.
-go build sessionManager.go
+# Build the executable. The Session Manager is split over several source files, so build the whole package.
+go build -o sessionManager .
 
 # Exit if we didn't manage to build the executable.
 [ ! -f sessionManager ] && { echo "Error: sessionManager not compiled."; exit 1; }
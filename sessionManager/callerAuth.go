@@ -0,0 +1,103 @@
+// Caller authentication for the Session Manager. The "/connectToSession" endpoint starts users' sessions and hands
+// back their VNC passwords, so only the trusted components of the system (the Guacamole extension and the session
+// proxy) should be able to call it. Each component holds its own token, set in the config file, along with the
+// images it is allowed to connect to - the session proxy only ever needs "desktop" sessions, for instance.
+
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// A component allowed to call the Session Manager's session endpoints, as defined in the config file.
+type CallerCredential struct {
+	// A name for the caller, used in log messages.
+	Name string `yaml:"name"`
+	// The token the caller presents in an "Authorization: Bearer ..." header.
+	Token string `yaml:"token"`
+	// The images the caller may connect to (and start) sessions for. "*" allows any image in the image catalogue.
+	Images []string `yaml:"images"`
+}
+
+// warnIfNoCallers logs an error if the config file lists no callers with a token - every request to the session
+// endpoints would be refused, which is otherwise easy to miss after upgrading from a version without caller tokens.
+func warnIfNoCallers(config Config) {
+	for _, caller := range config.Callers {
+		if caller.Token != "" {
+			return
+		}
+	}
+	log.Println("Error: no callers (with a token) are listed in the config file, so every /connectToSession and /sessionActivity request will be refused. Re-run install.sh to add them, or see \"Session Manager Caller Tokens\" in the installation documentation.")
+}
+
+// printCallerToken prints the token of the named caller from the config file, for the install script to pass on to
+// that component. Returns false (after printing an error to stderr) if the caller isn't listed, or has no token.
+func printCallerToken(config Config, callerName string) bool {
+	for _, caller := range config.Callers {
+		if caller.Name == callerName && caller.Token != "" {
+			fmt.Println(caller.Token)
+			return true
+		}
+	}
+	fmt.Fprintln(os.Stderr, "No token for caller \""+callerName+"\" in the config file")
+	return false
+}
+
+// requestToken returns the bearer token presented by the caller of a request, or an empty string if there isn't one.
+func requestToken(r *http.Request) string {
+	authHeader := strings.TrimSpace(r.Header.Get("Authorization"))
+	if len(authHeader) < 7 || !strings.EqualFold(authHeader[:7], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(authHeader[7:])
+}
+
+// authenticateCaller returns the caller whose token was presented with the request, or nil if no valid token was
+// presented. Tokens are compared in a timing-safe way, and every configured token is checked (even after a match)
+// so the time taken doesn't give away which caller a token belongs to. Callers with a blank token are ignored.
+func authenticateCaller(r *http.Request, callers []CallerCredential) *CallerCredential {
+	token := requestToken(r)
+	if token == "" {
+		return nil
+	}
+	var matchedCaller *CallerCredential
+	for index := range callers {
+		if callers[index].Token == "" {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(callers[index].Token)) == 1 && matchedCaller == nil {
+			matchedCaller = &callers[index]
+		}
+	}
+	return matchedCaller
+}
+
+// allowsImage reports whether the caller may connect to sessions of the given image.
+func (caller *CallerCredential) allowsImage(imageName string) bool {
+	return listContains(caller.Images, "*") || listContains(caller.Images, imageName)
+}
+
+// checkCaller checks a request to one of the session endpoints comes from a known caller that is allowed to use the
+// given image, sending an error response and logging the rejection if not. Returns the caller, or nil if the request
+// was rejected.
+func checkCaller(httpResponse http.ResponseWriter, r *http.Request, config Config, imageName string) *CallerCredential {
+	caller := authenticateCaller(r, config.Callers)
+	if caller == nil {
+		log.Println("Rejected " + r.URL.Path + " request from " + r.RemoteAddr + ": missing or invalid token.")
+		sessionAudit.record(AuditEvent{Action: "caller-rejected", Actor: r.RemoteAddr, Target: r.FormValue("username"), Image: imageName, Source: r.URL.Path, Result: "denied", Detail: "Missing or invalid token"})
+		http.Error(httpResponse, "Unauthorized", http.StatusUnauthorized)
+		return nil
+	}
+	if !caller.allowsImage(imageName) {
+		log.Println("Rejected " + r.URL.Path + " request from caller " + caller.Name + " (" + r.RemoteAddr + "): not allowed to use image \"" + imageName + "\".")
+		sessionAudit.record(AuditEvent{Action: "caller-rejected", Actor: caller.Name, Target: r.FormValue("username"), Image: imageName, Source: r.URL.Path, Result: "denied", Detail: "Not allowed to use image"})
+		http.Error(httpResponse, "Forbidden: caller not allowed to use image \""+imageName+"\"", http.StatusForbidden)
+		return nil
+	}
+	return caller
+}
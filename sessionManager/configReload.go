@@ -0,0 +1,388 @@
+// Config loading, validation and hot-reloading for the Session Manager. The config file is checked before it is used -
+// unknown keys (usually a typo, silently ignored otherwise), missing required fields, bad sizes and unknown
+// placeholders are all reported together. Once running, the config is reloaded on SIGHUP or when the file changes, so
+// changing rclone mounts or the admin key doesn't mean restarting the Session Manager and losing its in-memory state
+// (activity times, the admission queue, stats and so on). A new config that fails validation is rejected, and the
+// running config kept. The "-check-config" command-line option runs the same checks, for admins to use before
+// deploying a new config file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The default location of the config file.
+const defaultConfigPath = "/etc/puws/config.yml"
+
+// How often the config file is checked for changes.
+const configCheckInterval = 5 * time.Second
+
+// The placeholders that can be used in config values, filled in for each session.
+var configPlaceholders = []string{"{{USERNAME}}"}
+
+// Matches a placeholder - anything between double curly brackets.
+var placeholderPattern = regexp.MustCompile(`\{\{[^{}]*\}\}`)
+
+// Matches the YAML library's description of an unknown key, to reword it in terms an admin will recognise.
+var unknownFieldPattern = regexp.MustCompile(`field (\S+) not found in type \S+`)
+
+// ConfigStore holds the running config, so it can be replaced when the config file is reloaded. Protected by a mutex,
+// as each request reads the config while a reload may be replacing it. Each request or background check takes a copy
+// of the config when it starts, so it sees one consistent config throughout even if a reload happens part way.
+type ConfigStore struct {
+	mu     sync.Mutex
+	config Config
+	// The config file contents the running config was loaded from, to tell whether the file has changed.
+	configData []byte
+	// The contents of the last config file rejected, so the same problems aren't reported every few seconds.
+	rejectedData []byte
+}
+
+// newConfigStore initialises a config store with an empty (default) config.
+func newConfigStore() *ConfigStore {
+	return &ConfigStore{}
+}
+
+// The global running config.
+var runningConfig = newConfigStore()
+
+// get returns a copy of the running config.
+func (cs *ConfigStore) get() Config {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.config
+}
+
+// set replaces the running config, recording the file contents it was loaded from.
+func (cs *ConfigStore) set(config Config, configData []byte) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.config = config
+	cs.configData = configData
+}
+
+// reject records the contents of a config file that failed validation.
+func (cs *ConfigStore) reject(configData []byte) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.rejectedData = configData
+}
+
+// seen reports whether the running config was loaded from the given file contents, and whether they are the contents
+// of the last config file rejected.
+func (cs *ConfigStore) seen(configData []byte) (bool, bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return bytes.Equal(cs.configData, configData), cs.rejectedData != nil && bytes.Equal(cs.rejectedData, configData)
+}
+
+// checkPlaceholders checks a config value only uses known placeholders, adding a problem to the list for any that
+// aren't, or for unclosed curly brackets.
+func checkPlaceholders(problems []string, field string, value string) []string {
+	for _, placeholder := range placeholderPattern.FindAllString(value, -1) {
+		if !listContains(configPlaceholders, placeholder) {
+			problems = append(problems, field+": unknown placeholder "+placeholder+" (should be one of: "+strings.Join(configPlaceholders, ", ")+")")
+		}
+	}
+	if remainder := placeholderPattern.ReplaceAllString(value, ""); strings.Contains(remainder, "{{") || strings.Contains(remainder, "}}") {
+		problems = append(problems, field+": badly formed placeholder in \""+value+"\"")
+	}
+	return problems
+}
+
+// checkByteSize checks a config value is a valid size (such as "512m" or "2g"), adding a problem to the list if not.
+func checkByteSize(problems []string, field string, value string) []string {
+	if _, sizeErr := parseByteSize(value); sizeErr != nil {
+		problems = append(problems, field+": "+sizeErr.Error())
+	}
+	return problems
+}
+
+// checkRequired adds a problem to the list if a required config value is missing.
+func checkRequired(problems []string, field string, value string) []string {
+	if strings.TrimSpace(value) == "" {
+		problems = append(problems, field+": missing")
+	}
+	return problems
+}
+
+// validateConfig checks a parsed config for missing required fields, bad values and unknown placeholders, returning
+// a list of problems (empty if the config is valid).
+func validateConfig(config Config) []string {
+	var problems []string
+
+	for index, rcloneMount := range config.RcloneMounts {
+		field := "rcloneMounts[" + strconv.Itoa(index) + "]"
+		problems = checkRequired(problems, field+".local", rcloneMount.Local)
+		problems = checkRequired(problems, field+".remote", rcloneMount.Remote)
+		problems = checkPlaceholders(problems, field+".username", rcloneMount.Username)
+		problems = checkPlaceholders(problems, field+".local", rcloneMount.Local)
+		problems = checkPlaceholders(problems, field+".remote", rcloneMount.Remote)
+	}
+
+	if config.RcloneMountTimeoutSeconds < 0 {
+		problems = append(problems, "rcloneMountTimeoutSeconds: can't be negative")
+	}
+	if config.StartTimeoutSeconds < 0 {
+		problems = append(problems, "startTimeoutSeconds: can't be negative")
+	}
+	if config.IdleTimeoutMinutes < 0 {
+		problems = append(problems, "idleTimeoutMinutes: can't be negative")
+	}
+	if !listContains([]string{"", "stop", "hibernate", "pause"}, config.IdleAction) {
+		problems = append(problems, "idleAction: should be \"stop\" or \"hibernate\", not \""+config.IdleAction+"\"")
+	}
+
+	for index, profile := range config.ResourceProfiles {
+		field := "resourceProfiles[" + strconv.Itoa(index) + "]"
+		problems = checkRequired(problems, field+".name", profile.Name)
+		problems = checkByteSize(problems, field+".memory", profile.Memory)
+		problems = checkByteSize(problems, field+".memorySwap", profile.MemorySwap)
+		problems = checkByteSize(problems, field+".shmSize", profile.ShmSize)
+		if profile.CPUs < 0 || profile.CPUShares < 0 {
+			problems = append(problems, field+": CPU limits can't be negative")
+		}
+	}
+
+	imageNames := make(map[string]bool)
+	for index, catalogueImage := range config.Images {
+		field := "images[" + strconv.Itoa(index) + "]"
+		problems = checkRequired(problems, field+".name", catalogueImage.Name)
+		// The image name forms the first part of the container name ("imageName-username"), and usernames can contain
+		// "-", so image names can't - otherwise two users' sessions could get the same container name.
+		if catalogueImage.Name != "" && !catalogueNamePattern.MatchString(catalogueImage.Name) {
+			problems = append(problems, field+".name: \""+catalogueImage.Name+"\" can only contain lower case letters, numbers and \"_\"")
+		}
+		if imageNames[catalogueImage.Name] {
+			problems = append(problems, field+".name: \""+catalogueImage.Name+"\" is listed more than once")
+		}
+		imageNames[catalogueImage.Name] = true
+		for mountIndex, extraMount := range catalogueImage.Mounts {
+			mountField := field + ".mounts[" + strconv.Itoa(mountIndex) + "]"
+			problems = checkRequired(problems, mountField+".source", extraMount.Source)
+			problems = checkRequired(problems, mountField+".target", extraMount.Target)
+			problems = checkPlaceholders(problems, mountField+".source", extraMount.Source)
+			problems = checkPlaceholders(problems, mountField+".target", extraMount.Target)
+		}
+	}
+
+	callerNames := make(map[string]bool)
+	callerTokens := make(map[string]bool)
+	for index, caller := range config.Callers {
+		field := "callers[" + strconv.Itoa(index) + "]"
+		problems = checkRequired(problems, field+".name", caller.Name)
+		problems = checkRequired(problems, field+".token", caller.Token)
+		if callerNames[caller.Name] {
+			problems = append(problems, field+".name: \""+caller.Name+"\" is listed more than once")
+		}
+		if caller.Token != "" && callerTokens[caller.Token] {
+			problems = append(problems, field+".token: the same token is used by more than one caller")
+		}
+		callerNames[caller.Name] = true
+		callerTokens[caller.Token] = true
+	}
+
+	if config.Admission.MaxSessions < 0 {
+		problems = append(problems, "admission.maxSessions: can't be negative")
+	}
+	problems = checkByteSize(problems, "admission.minFreeMemory", config.Admission.MinFreeMemory)
+	for index, reservation := range config.Admission.Reservations {
+		field := "admission.reservations[" + strconv.Itoa(index) + "]"
+		problems = checkRequired(problems, field+".group", reservation.Group)
+		if reservation.Sessions < 0 {
+			problems = append(problems, field+".sessions: can't be negative")
+		}
+	}
+	problems = checkByteSize(problems, "hibernation.minFreeMemory", config.Hibernation.MinFreeMemory)
+	if config.Hibernation.MinIdleMinutes < 0 {
+		problems = append(problems, "hibernation.minIdleMinutes: can't be negative")
+	}
+	if config.Hibernation.MaxHibernatedMinutes < 0 {
+		problems = append(problems, "hibernation.maxHibernatedMinutes: can't be negative")
+	}
+	if config.UserRemotes.MaxMounts < 0 {
+		problems = append(problems, "userRemotes.maxMounts: can't be negative")
+	}
+	if config.UserRemotes.Folder != "" && (!filepath.IsLocal(config.UserRemotes.Folder) || strings.Contains(config.UserRemotes.Folder, "/")) {
+		problems = append(problems, "userRemotes.folder: must be the name of a folder in the user's home folder, e.g. \"Cloud\"")
+	}
+	for index, allowedType := range config.UserRemotes.AllowedTypes {
+		problems = checkRequired(problems, "userRemotes.allowedTypes["+strconv.Itoa(index)+"]", allowedType)
+	}
+	if config.Backups.Target != "" && !filepath.IsAbs(config.Backups.Target) {
+		problems = append(problems, "backups.target: must be an absolute path, e.g. \"/srv/backups/puws\"")
+	}
+	if config.Backups.IntervalHours < 0 || config.Backups.FullEveryDays < 0 || config.Backups.KeepDays < 0 {
+		problems = append(problems, "backups: intervalHours, fullEveryDays and keepDays can't be negative")
+	}
+	if config.Deprovision.ArchiveFolder != "" && !filepath.IsAbs(config.Deprovision.ArchiveFolder) {
+		problems = append(problems, "deprovision.archiveFolder: must be an absolute path, e.g. \"/srv/archive/puws\"")
+	}
+	for _, imageName := range config.Exams.Images {
+		if findCatalogueImage(config, imageName) == nil {
+			problems = append(problems, "exams.images: \""+imageName+"\" isn't in the image catalogue")
+		}
+	}
+	for index, policy := range config.SessionNetworks.Egress {
+		field := "sessionNetworks.egress[" + strconv.Itoa(index) + "]"
+		problems = checkRequired(problems, field+".name", policy.Name)
+		if policy.Egress != "" && policy.Egress != egressAllowed && policy.Egress != egressProxied && policy.Egress != egressBlocked {
+			problems = append(problems, field+".egress: must be \""+egressAllowed+"\", \""+egressProxied+"\" or \""+egressBlocked+"\"")
+		}
+		if policy.Egress == egressProxied && policy.ProxyContainer == "" {
+			problems = append(problems, field+".proxyContainer: required for \""+egressProxied+"\" egress")
+		}
+		if proxyErr := checkProxyURL(policy.HTTPProxy); proxyErr != nil {
+			problems = append(problems, field+".httpProxy: "+proxyErr.Error())
+		}
+		if proxyErr := checkProxyURL(policy.HTTPSProxy); proxyErr != nil {
+			problems = append(problems, field+".httpsProxy: "+proxyErr.Error())
+		}
+		if certificateErr := checkCACertificate(policy.CACertificate); certificateErr != nil {
+			problems = append(problems, field+".caCertificate: "+certificateErr.Error())
+		}
+	}
+	if config.Provisioning.MinUID < 0 || config.Provisioning.MaxUID < 0 {
+		problems = append(problems, "provisioning: minUid and maxUid can't be negative")
+	} else if minUID, maxUID := uidRange(config.Provisioning); minUID < 1000 || minUID > maxUID {
+		problems = append(problems, "provisioning: minUid must be at least 1000 and no more than maxUid")
+	}
+	for index, quota := range config.DiskQuotas {
+		field := "diskQuotas[" + strconv.Itoa(index) + "]"
+		problems = checkByteSize(problems, field+".softLimit", quota.SoftLimit)
+		problems = checkByteSize(problems, field+".hardLimit", quota.HardLimit)
+		softLimit, softErr := parseByteSize(quota.SoftLimit)
+		hardLimit, hardErr := parseByteSize(quota.HardLimit)
+		if softErr == nil && hardErr == nil && softLimit > 0 && hardLimit > 0 && softLimit > hardLimit {
+			problems = append(problems, field+": softLimit can't be more than hardLimit")
+		}
+		if quota.HardLimitAction != "" && quota.HardLimitAction != hardLimitRefuseStart && quota.HardLimitAction != hardLimitReadOnlyWWW {
+			problems = append(problems, field+".hardLimitAction: must be \""+hardLimitRefuseStart+"\" or \""+hardLimitReadOnlyWWW+"\"")
+		}
+	}
+	return problems
+}
+
+// parseConfig parses and validates config file contents, returning the config and a list of problems (empty if the
+// config is valid). Keys the Session Manager doesn't know about are reported as problems, as they are usually typos.
+func parseConfig(configData []byte) (Config, []string) {
+	var config Config
+	configDecoder := yaml.NewDecoder(bytes.NewReader(configData))
+	configDecoder.KnownFields(true)
+	decodeErr := configDecoder.Decode(&config)
+	var typeErr *yaml.TypeError
+	switch {
+	case decodeErr == nil:
+	case errors.As(decodeErr, &typeErr):
+		// Unknown keys and values of the wrong type - decoding carries on past these, so report them all.
+		var problems []string
+		for _, typeProblem := range typeErr.Errors {
+			problems = append(problems, unknownFieldPattern.ReplaceAllString(typeProblem, "unknown key \"$1\""))
+		}
+		return config, append(problems, validateConfig(config)...)
+	case errors.Is(decodeErr, io.EOF):
+		// An empty config file - everything is left at its default.
+	default:
+		return config, []string{decodeErr.Error()}
+	}
+	return config, validateConfig(config)
+}
+
+// loadConfigFile reads, parses and validates the config file. A missing config file isn't an error - everything is
+// left at its default. Returns the config, the file contents, and a list of problems (empty if the config is valid).
+func loadConfigFile(configPath string) (Config, []byte, []string) {
+	configData, readErr := os.ReadFile(configPath)
+	if errors.Is(readErr, os.ErrNotExist) {
+		return Config{}, nil, nil
+	}
+	if readErr != nil {
+		return Config{}, nil, []string{readErr.Error()}
+	}
+	config, problems := parseConfig(configData)
+	return config, configData, problems
+}
+
+// checkConfigFile validates the config file for the "-check-config" command-line option, printing any problems.
+// Returns true if the config is valid.
+func checkConfigFile(configPath string) bool {
+	_, configData, problems := loadConfigFile(configPath)
+	if len(problems) > 0 {
+		fmt.Println("Problems found in " + configPath + ":")
+		for _, problem := range problems {
+			fmt.Println("  " + problem)
+		}
+		return false
+	}
+	if configData == nil {
+		fmt.Println("No config file found at " + configPath + ", default values would be used.")
+	} else {
+		fmt.Println("Config file " + configPath + " is valid.")
+	}
+	return true
+}
+
+// applyConfig makes a newly loaded config the running config, updating the settings held outside it.
+func applyConfig(config Config, configData []byte) {
+	runningConfig.set(config, configData)
+	sessionAudit.configure(config.Audit)
+	warnIfNoCallers(config)
+}
+
+// reloadConfig reloads the config file if it has changed since the running config was loaded from it. A config with
+// problems is rejected, keeping the running config - the problems are reported once when the file changes, and again
+// on each SIGHUP. The reason is "SIGHUP" or "file changed", for the log.
+func reloadConfig(configPath string, reason string) {
+	configData, readErr := os.ReadFile(configPath)
+	if readErr != nil {
+		// Keep the running config if the file has gone (perhaps part way through being replaced by an editor).
+		log.Println("Not reloading config (" + reason + "), error reading " + configPath + ": " + readErr.Error())
+		return
+	}
+	loaded, rejected := runningConfig.seen(configData)
+	if loaded || (rejected && reason != "SIGHUP") {
+		return
+	}
+	config, problems := parseConfig(configData)
+	if len(problems) > 0 {
+		log.Println("Not reloading config (" + reason + "), problems found in " + configPath + ": " + strings.Join(problems, "; "))
+		sessionAudit.record(AuditEvent{Action: "config-reload", Actor: auditActorSystem, Source: reason, Result: "failed", Detail: strings.Join(problems, "; ")})
+		runningConfig.reject(configData)
+		return
+	}
+	applyConfig(config, configData)
+	fmt.Println("Config reloaded from " + configPath + " (" + reason + ")")
+	sessionAudit.record(AuditEvent{Action: "config-reload", Actor: auditActorSystem, Source: reason})
+}
+
+// watchConfig reloads the config file whenever the Session Manager is sent SIGHUP, or the file changes. Runs forever,
+// so should be called in its own goroutine.
+func watchConfig(configPath string) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	fileCheck := time.NewTicker(configCheckInterval)
+	defer fileCheck.Stop()
+	for {
+		select {
+		case <-hangups:
+			reloadConfig(configPath, "SIGHUP")
+		case <-fileCheck.C:
+			reloadConfig(configPath, "file changed")
+		}
+	}
+}
@@ -0,0 +1,171 @@
+// Container log streaming for the Session Manager. A session's startup script and desktop write their output to the
+// container's stdout and stderr, which is where to look when a user's session fails to start or misbehaves. The
+// "/admin/sessionLogs" endpoint streams that output to the admin panel as server-sent events, one event per line,
+// starting with the last few lines and (optionally) following new output as it is written.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moby/moby/api/pkg/stdcopy"
+	"github.com/moby/moby/client"
+)
+
+// The number of lines sent from the end of the log, if the caller doesn't say.
+const defaultLogTail = "200"
+
+// One line of a container's log output.
+type LogLine struct {
+	// "stdout" or "stderr".
+	Stream string    `json:"stream"`
+	Time   time.Time `json:"time"`
+	Text   string    `json:"text"`
+}
+
+// logTailOption checks the "tail" option passed by the caller - a number of lines, or "all" - returning the default
+// if none was passed.
+func logTailOption(tail string) (string, error) {
+	tail = strings.TrimSpace(tail)
+	if tail == "" {
+		return defaultLogTail, nil
+	}
+	if tail == "all" {
+		return tail, nil
+	}
+	tailLines, parseErr := strconv.Atoi(tail)
+	if parseErr != nil || tailLines < 0 {
+		return "", errors.New("\"tail\" should be a number of lines, or \"all\"")
+	}
+	return strconv.Itoa(tailLines), nil
+}
+
+// parseLogLine splits a line of Docker log output, fetched with timestamps, into the timestamp and the text.
+func parseLogLine(stream string, rawLine string) LogLine {
+	logLine := LogLine{Stream: stream, Text: rawLine}
+	timestamp, text, found := strings.Cut(rawLine, " ")
+	if !found {
+		return logLine
+	}
+	if lineTime, parseErr := time.Parse(time.RFC3339Nano, timestamp); parseErr == nil {
+		logLine.Time = lineTime
+		logLine.Text = text
+	}
+	return logLine
+}
+
+// scanLogLines reads lines from one of a container's output streams, passing each one on to the given channel, until
+// the stream ends or the done channel is closed.
+func scanLogLines(stream string, reader io.Reader, logLines chan<- LogLine, done <-chan struct{}) {
+	logScanner := bufio.NewScanner(reader)
+	// Allow for long lines - some programs write a lot of output without a line break.
+	logScanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for logScanner.Scan() {
+		select {
+		case logLines <- parseLogLine(stream, logScanner.Text()):
+		case <-done:
+			return
+		}
+	}
+	// Drain anything left, so the demultiplexer writing to us doesn't block if we stopped on an over-long line.
+	io.Copy(io.Discard, reader)
+}
+
+// writeLogEvent writes an event to a log stream, in server-sent event format.
+func writeLogEvent(httpResponse http.ResponseWriter, eventName string, eventValue any) error {
+	eventData, jsonErr := json.Marshal(eventValue)
+	if jsonErr != nil {
+		return jsonErr
+	}
+	_, writeErr := fmt.Fprintf(httpResponse, "event: %s\ndata: %s\n\n", eventName, eventData)
+	return writeErr
+}
+
+// streamSessionLogs streams a container's stdout and stderr to the caller as server-sent "log" events, starting with
+// the given number of lines from the end of the log. If follow is set, new output is streamed as it is written, until
+// the container stops or the caller goes away. An "end" event is sent once there is nothing more to send.
+func streamSessionLogs(httpResponse http.ResponseWriter, r *http.Request, cli *client.Client, containerID string, tail string, follow bool) {
+	flusher, canFlush := httpResponse.(http.Flusher)
+	if !canFlush {
+		http.Error(httpResponse, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	logReader, logReaderErr := cli.ContainerLogs(r.Context(), containerID, client.ContainerLogsOptions{ShowStdout: true, ShowStderr: true, Follow: follow, Timestamps: true, Tail: tail})
+	if logReaderErr != nil {
+		http.Error(httpResponse, "Error reading container logs: "+logReaderErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer logReader.Close()
+
+	httpResponse.Header().Set("Content-Type", "text/event-stream")
+	httpResponse.Header().Set("Cache-Control", "no-cache")
+	httpResponse.Header().Set("Connection", "keep-alive")
+	httpResponse.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// Session containers don't use a TTY, so Docker sends stdout and stderr multiplexed together - split them apart
+	// again, reading each a line at a time.
+	stdoutReader, stdoutWriter := io.Pipe()
+	stderrReader, stderrWriter := io.Pipe()
+	go func() {
+		_, copyErr := stdcopy.StdCopy(stdoutWriter, stderrWriter, logReader)
+		stdoutWriter.CloseWithError(copyErr)
+		stderrWriter.CloseWithError(copyErr)
+	}()
+	logLines := make(chan LogLine, 64)
+	done := make(chan struct{})
+	var scanners sync.WaitGroup
+	scanners.Add(2)
+	go func() {
+		defer scanners.Done()
+		scanLogLines("stdout", stdoutReader, logLines, done)
+	}()
+	go func() {
+		defer scanners.Done()
+		scanLogLines("stderr", stderrReader, logLines, done)
+	}()
+	go func() {
+		scanners.Wait()
+		close(logLines)
+	}()
+	// If we return early (the caller went away), stop the scanners and the demultiplexer so they don't leak.
+	defer stdoutReader.Close()
+	defer stderrReader.Close()
+	defer close(done)
+
+	keepAlive := time.NewTicker(progressKeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, writeErr := fmt.Fprint(httpResponse, ": keep-alive\n\n"); writeErr != nil {
+				return
+			}
+			flusher.Flush()
+		case logLine, open := <-logLines:
+			if !open {
+				writeLogEvent(httpResponse, "end", map[string]string{})
+				flusher.Flush()
+				return
+			}
+			if writeLogEvent(httpResponse, "log", logLine) != nil {
+				return
+			}
+			// Flush once any backlog of lines has been written, rather than after every single line.
+			if len(logLines) == 0 {
+				flusher.Flush()
+			}
+		}
+	}
+}
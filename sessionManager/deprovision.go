@@ -0,0 +1,261 @@
+// User deprovisioning for the Session Manager. When a user leaves (a pupil leaving the school, say), everything set
+// up for them - their session containers, home, www and Web Console tasks folders, auto-start entries and host
+// account - would otherwise stay behind forever. Deprovisioning a user removes all of that, first archiving their
+// folders to a dated tarball so nothing is lost.
+//
+// A deprovision is planned first, as a list of steps. A dry run just returns the plan, so an admin can see everything
+// that would be touched. Otherwise the steps are carried out in order, stopping at the first that fails - in
+// particular, no folder is deleted unless the archive was written.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/moby/moby/client"
+)
+
+// Where the archives of deprovisioned users' folders are written, if not set in the config file.
+const defaultArchiveFolder = "/var/lib/puws/archive"
+
+// The steps of a deprovision, in the order they are carried out. Auto-start entries are removed first, so the
+// auto-start loop doesn't start the user's sessions again as they are removed.
+const (
+	deprovisionRemoveAutoStart = "remove-autostart"
+	deprovisionRemoveContainer = "remove-container"
+	deprovisionUnmount         = "unmount"
+	deprovisionArchive         = "archive"
+	deprovisionDeleteFolder    = "delete-folder"
+	deprovisionDeleteAccount   = "delete-account"
+)
+
+// The deprovisioning settings from the config file.
+type DeprovisionConfig struct {
+	// The folder deprovisioned users' folders are archived to. Defaults to /var/lib/puws/archive.
+	ArchiveFolder string `yaml:"archiveFolder"`
+}
+
+// A request to deprovision a user. Unless it is a dry run, "confirm" must repeat the username.
+type DeprovisionRequest struct {
+	Username      string `json:"username"`
+	DryRun        bool   `json:"dryRun"`
+	DeleteAccount bool   `json:"deleteAccount"`
+	Confirm       string `json:"confirm"`
+}
+
+// One step of a deprovision - what is done, to what, and (once carried out) how it went.
+type DeprovisionStep struct {
+	Action string `json:"action"`
+	Target string `json:"target"`
+	Detail string `json:"detail,omitempty"`
+	// "planned" in a dry run, otherwise "ok", "failed", or "skipped" for steps after a failure.
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+	// The container to remove (and its network, if it has one of its own), or the folders to archive.
+	containerID string
+	network     string
+	folders     []string
+}
+
+// archiveFolder returns the folder deprovisioned users' folders are archived to.
+func archiveFolder(deprovisionConfig DeprovisionConfig) string {
+	if deprovisionConfig.ArchiveFolder != "" {
+		return deprovisionConfig.ArchiveFolder
+	}
+	return defaultArchiveFolder
+}
+
+// checkDeprovisionRequest checks a deprovision request, returning an error message, or "" if the request is valid.
+func checkDeprovisionRequest(deprovisionRequest DeprovisionRequest) string {
+	if !isValidBackupUsername(deprovisionRequest.Username) {
+		return "Invalid username"
+	}
+	if !deprovisionRequest.DryRun && deprovisionRequest.Confirm != deprovisionRequest.Username {
+		return "Deprovisioning a user can't be undone - confirm by passing the username as \"confirm\""
+	}
+	return ""
+}
+
+// planDeprovision works out the steps needed to deprovision a user.
+func planDeprovision(cli *client.Client, config Config, deprovisionRequest DeprovisionRequest, now time.Time) ([]DeprovisionStep, error) {
+	username := deprovisionRequest.Username
+	var steps []DeprovisionStep
+
+	autoStartSessions, autoStartErr := loadAutoStart()
+	if autoStartErr != nil {
+		return nil, errors.New("Error reading auto-start list: " + autoStartErr.Error())
+	}
+	for _, entry := range autoStartSessions {
+		if entry.Username == username {
+			steps = append(steps, DeprovisionStep{Action: deprovisionRemoveAutoStart, Target: entry.Image})
+		}
+	}
+
+	containers, containersErr := cli.ContainerList(context.Background(), client.ContainerListOptions{All: true})
+	if containersErr != nil {
+		return nil, errors.New("Error listing containers: " + containersErr.Error())
+	}
+	for _, item := range containers.Items {
+		if imageName, containerUsername, isSession := sessionFromContainer(item); isSession && containerUsername == username {
+			steps = append(steps, DeprovisionStep{Action: deprovisionRemoveContainer, Target: imageName + "-" + username, Detail: string(item.State), containerID: item.ID, network: containerNetwork(item)})
+		}
+	}
+
+	for _, mountStatus := range rcloneMounts.statuses()[username] {
+		steps = append(steps, DeprovisionStep{Action: deprovisionUnmount, Target: mountStatus.Local, Detail: mountStatus.Remote})
+	}
+
+	var userFolders []string
+	for _, root := range []string{homeFoldersRoot, wwwFoldersRoot, tasksFoldersRoot} {
+		folder := filepath.Join(root, username)
+		if info, statErr := os.Lstat(folder); statErr == nil && info.IsDir() {
+			userFolders = append(userFolders, folder)
+		}
+	}
+	if len(userFolders) > 0 {
+		archivePath := filepath.Join(archiveFolder(config.Deprovision), username+"-"+now.Format("20060102-150405")+".tar.gz")
+		steps = append(steps, DeprovisionStep{Action: deprovisionArchive, Target: archivePath, Detail: strings.Join(userFolders, ", "), folders: userFolders})
+		for _, folder := range userFolders {
+			steps = append(steps, DeprovisionStep{Action: deprovisionDeleteFolder, Target: folder})
+		}
+	}
+
+	if deprovisionRequest.DeleteAccount {
+		if _, lookupErr := user.Lookup(username); lookupErr == nil {
+			steps = append(steps, DeprovisionStep{Action: deprovisionDeleteAccount, Target: username})
+		}
+	}
+	return steps, nil
+}
+
+// archiveUserFolders writes the given folders to a compressed tarball, with paths relative to the root folder. Cloud
+// storage mounted inside the folders isn't included.
+func archiveUserFolders(archivePath string, folders []string) error {
+	if mkdirErr := os.MkdirAll(filepath.Dir(archivePath), 0700); mkdirErr != nil {
+		return mkdirErr
+	}
+	tarArgs := []string{"--create", "--gzip", "--one-file-system", "--file", archivePath, "--directory", "/"}
+	for _, folder := range folders {
+		tarArgs = append(tarArgs, strings.TrimPrefix(folder, "/"))
+	}
+	tarOutput, tarErr := exec.Command("tar", tarArgs...).CombinedOutput()
+	// As with backups, files changing while being read (exit status 1) still leaves a usable archive.
+	var exitErr *exec.ExitError
+	if tarErr != nil && !(errors.As(tarErr, &exitErr) && exitErr.ExitCode() == 1) {
+		os.Remove(archivePath)
+		return errors.New("tar failed: " + lastOutputLine(tarOutput))
+	}
+	return nil
+}
+
+// deleteUserFolder deletes one of a user's folders. Anything still mounted inside it (cloud storage that couldn't be
+// unmounted, say) would be deleted along with it, so the folder is left alone if so.
+func deleteUserFolder(folder string) error {
+	mountPoints, mountsErr := readMountPoints()
+	if mountsErr != nil {
+		return mountsErr
+	}
+	for mountPoint := range mountPoints {
+		if mountPoint == folder || strings.HasPrefix(mountPoint, folder+"/") {
+			return errors.New(mountPoint + " is still mounted")
+		}
+	}
+	return os.RemoveAll(folder)
+}
+
+// runDeprovisionStep carries out one step of a deprovision.
+func runDeprovisionStep(cli *client.Client, username string, step DeprovisionStep) error {
+	switch step.Action {
+	case deprovisionRemoveAutoStart:
+		return updateAutoStart(func(autoStartSessions []AutoStartEntry) []AutoStartEntry {
+			var keptSessions []AutoStartEntry
+			for _, entry := range autoStartSessions {
+				if entry.Username != username || entry.Image != step.Target {
+					keptSessions = append(keptSessions, entry)
+				}
+			}
+			return keptSessions
+		})
+	case deprovisionRemoveContainer:
+		if _, removeErr := cli.ContainerRemove(context.Background(), step.containerID, client.ContainerRemoveOptions{Force: true}); removeErr != nil {
+			return removeErr
+		}
+		sessionActivity.forget(strings.TrimSuffix(step.Target, "-"+username), username)
+		if removeErr := removeSessionNetwork(cli, step.network); removeErr != nil {
+			return errors.New("Error removing network " + step.network + ": " + removeErr.Error())
+		}
+	case deprovisionUnmount:
+		rcloneMounts.unmount(step.Target)
+		if isMounted(step.Target) {
+			return errors.New("still mounted")
+		}
+	case deprovisionArchive:
+		return archiveUserFolders(step.Target, step.folders)
+	case deprovisionDeleteFolder:
+		return deleteUserFolder(step.Target)
+	case deprovisionDeleteAccount:
+		if userdelOutput, userdelErr := exec.Command("userdel", username).CombinedOutput(); userdelErr != nil {
+			return errors.New(strings.TrimSpace(string(userdelOutput)))
+		}
+	}
+	return nil
+}
+
+// deprovisionUser plans a user's deprovision and, unless it is a dry run, carries it out, stopping at the first step
+// that fails. Returns the steps, each with its result.
+func deprovisionUser(cli *client.Client, config Config, deprovisionRequest DeprovisionRequest) ([]DeprovisionStep, error) {
+	if sessionStarts.userStarting(deprovisionRequest.Username) {
+		return nil, errors.New("A session is being started for user " + deprovisionRequest.Username + " - try again once it has started")
+	}
+	steps, planErr := planDeprovision(cli, config, deprovisionRequest, time.Now())
+	if planErr != nil {
+		return nil, planErr
+	}
+	failed := false
+	for index := range steps {
+		switch {
+		case deprovisionRequest.DryRun:
+			steps[index].Result = "planned"
+		case failed:
+			steps[index].Result = "skipped"
+		default:
+			if stepErr := runDeprovisionStep(cli, deprovisionRequest.Username, steps[index]); stepErr != nil {
+				steps[index].Result = "failed"
+				steps[index].Error = stepErr.Error()
+				failed = true
+				continue
+			}
+			steps[index].Result = "ok"
+			fmt.Println("Deprovision user " + deprovisionRequest.Username + ": " + steps[index].Action + " " + steps[index].Target)
+		}
+	}
+	if !deprovisionRequest.DryRun && !failed {
+		diskUsage.forget(deprovisionRequest.Username)
+	}
+	return steps, nil
+}
+
+// describeDeprovisionSteps summarises the steps of a deprovision for the audit log, e.g. "archive
+// /var/lib/puws/archive/jane-20260701-090000.tar.gz ok; delete-folder /home/jane failed: ...".
+func describeDeprovisionSteps(steps []DeprovisionStep) string {
+	if len(steps) == 0 {
+		return "nothing to do"
+	}
+	var descriptions []string
+	for _, step := range steps {
+		description := step.Action + " " + step.Target + " " + step.Result
+		if step.Error != "" {
+			description = description + ": " + step.Error
+		}
+		descriptions = append(descriptions, description)
+	}
+	return strings.Join(descriptions, "; ")
+}
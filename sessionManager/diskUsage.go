@@ -0,0 +1,323 @@
+// Per-user disk usage accounting and quotas for the Session Manager. All users' files share the host's disk, so one
+// user downloading a lot of videos can fill it for everyone. The disk space used by each user's folders - their home
+// folder, their website ("www") folder and their Web Console tasks folder - is added up periodically, and compared
+// against the limits set for the user's groups in the config file.
+//
+// Over the soft limit, the user is warned when their session starts, and the admin panel shows them. Over the hard
+// limit, depending on the quota, either the user's sessions won't start, or their sessions are started with the www
+// folder read-only so their website can't grow any further.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The interval between counts of the disk space used by each user. Counting walks every file, so isn't done often.
+const diskUsageInterval = 10 * time.Minute
+
+// The folders on the host counted towards each user's disk usage.
+const (
+	homeFoldersRoot  = "/home"
+	wwwFoldersRoot   = "/var/www"
+	tasksFoldersRoot = "/etc/webconsole/tasks"
+)
+
+// What happens to a user over their hard limit.
+const (
+	hardLimitRefuseStart = "refuse-start"
+	hardLimitReadOnlyWWW = "readonly-www"
+)
+
+// The states of a user's disk usage, compared against their quota.
+const (
+	diskUsageOK       = "ok"
+	diskUsageOverSoft = "over-soft"
+	diskUsageOverHard = "over-hard"
+)
+
+// The label recording whether a session container's www folder was mounted read-only, so a container can be
+// recreated when the user goes over (or back under) a hard limit with the "readonly-www" action.
+const sessionWWWReadOnlyLabel = "uk.co.sansay.puws.wwwReadOnly"
+
+// A disk quota, as defined in the config file. Sizes are given as a number with an optional "k", "m" or "g" suffix
+// (e.g. "5g"), and a limit left blank isn't applied.
+type DiskQuota struct {
+	// The (host) user groups this quota applies to. An empty list matches any group.
+	Groups    []string `yaml:"groups"`
+	SoftLimit string   `yaml:"softLimit"`
+	HardLimit string   `yaml:"hardLimit"`
+	// What happens over the hard limit: "refuse-start" (the default) or "readonly-www".
+	HardLimitAction string `yaml:"hardLimitAction"`
+}
+
+// The disk space used by one user's folders, in bytes, and when it was counted.
+type UserDiskUsage struct {
+	Username  string    `json:"username"`
+	Home      int64     `json:"home"`
+	WWW       int64     `json:"www"`
+	Tasks     int64     `json:"tasks"`
+	Total     int64     `json:"total"`
+	CheckedAt time.Time `json:"checkedAt"`
+	// The user's limits from the quota that applies to them (zero if none), and how their usage compares.
+	SoftLimit int64  `json:"softLimit,omitempty"`
+	HardLimit int64  `json:"hardLimit,omitempty"`
+	State     string `json:"state"`
+}
+
+// The outcome of checking a user's disk usage against their quota when their session starts.
+type QuotaCheck struct {
+	State string
+	// What happens over the hard limit, from the user's quota.
+	HardLimitAction string
+	// The message shown to the user, if they are over a limit.
+	Message string
+}
+
+// DiskUsageTracker holds the last count of each user's disk usage. Written by the background counting loop and read
+// by HTTP handlers and session starts, so protected by a mutex.
+type DiskUsageTracker struct {
+	mu    sync.Mutex
+	users map[string]UserDiskUsage
+}
+
+var diskUsage = newDiskUsageTracker()
+
+func newDiskUsageTracker() *DiskUsageTracker {
+	return &DiskUsageTracker{users: make(map[string]UserDiskUsage)}
+}
+
+// set records the latest count of a user's disk usage.
+func (dt *DiskUsageTracker) set(usage UserDiskUsage) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	dt.users[usage.Username] = usage
+}
+
+// get returns the latest count of a user's disk usage, or false if they haven't been counted yet.
+func (dt *DiskUsageTracker) get(username string) (UserDiskUsage, bool) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	usage, exists := dt.users[username]
+	return usage, exists
+}
+
+// forget removes a user's disk usage, once their folders have been deleted.
+func (dt *DiskUsageTracker) forget(username string) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	delete(dt.users, username)
+}
+
+// all returns the disk usage of every user, largest first, compared against each user's current quota.
+func (dt *DiskUsageTracker) all(config Config) []UserDiskUsage {
+	dt.mu.Lock()
+	var usages []UserDiskUsage
+	for _, usage := range dt.users {
+		usages = append(usages, usage)
+	}
+	dt.mu.Unlock()
+	for index := range usages {
+		usages[index] = withQuota(usages[index], selectDiskQuota(config.DiskQuotas, userGroups(usages[index].Username)))
+	}
+	sort.Slice(usages, func(i, j int) bool {
+		if usages[i].Total != usages[j].Total {
+			return usages[i].Total > usages[j].Total
+		}
+		return usages[i].Username < usages[j].Username
+	})
+	return usages
+}
+
+// selectDiskQuota returns the first disk quota in the config file that matches the user's groups, so more specific
+// quotas should be listed first. Returns nil if no quota matches.
+func selectDiskQuota(quotas []DiskQuota, userGroups []string) *DiskQuota {
+	for index := range quotas {
+		if matchesImageAndGroups(nil, quotas[index].Groups, "", userGroups) {
+			return &quotas[index]
+		}
+	}
+	return nil
+}
+
+// hardLimitAction returns what happens to a user over the quota's hard limit.
+func (quota *DiskQuota) hardLimitAction() string {
+	if quota.HardLimitAction != "" {
+		return quota.HardLimitAction
+	}
+	return hardLimitRefuseStart
+}
+
+// withQuota fills in a user's limits from their quota (which may be nil), and how their usage compares.
+func withQuota(usage UserDiskUsage, quota *DiskQuota) UserDiskUsage {
+	usage.SoftLimit = 0
+	usage.HardLimit = 0
+	usage.State = diskUsageOK
+	if quota == nil {
+		return usage
+	}
+	// Sizes are checked when the config file is loaded, so can't fail here.
+	usage.SoftLimit, _ = parseByteSize(quota.SoftLimit)
+	usage.HardLimit, _ = parseByteSize(quota.HardLimit)
+	switch {
+	case usage.HardLimit > 0 && usage.Total >= usage.HardLimit:
+		usage.State = diskUsageOverHard
+	case usage.SoftLimit > 0 && usage.Total >= usage.SoftLimit:
+		usage.State = diskUsageOverSoft
+	}
+	return usage
+}
+
+// formatBytes formats a number of bytes for people to read, e.g. "4.2 GB".
+func formatBytes(bytes int64) string {
+	switch {
+	case bytes >= 1024*1024*1024:
+		return fmt.Sprintf("%.1f GB", float64(bytes)/(1024*1024*1024))
+	case bytes >= 1024*1024:
+		return fmt.Sprintf("%.1f MB", float64(bytes)/(1024*1024))
+	}
+	return fmt.Sprintf("%d KB", bytes/1024)
+}
+
+// checkDiskQuota compares a user's last counted disk usage against their quota, when their session starts. Users who
+// haven't been counted yet (new users, or just after the Session Manager starts) are always let through.
+func checkDiskQuota(config Config, username string) QuotaCheck {
+	usage, counted := diskUsage.get(username)
+	quota := selectDiskQuota(config.DiskQuotas, userGroups(username))
+	if !counted || quota == nil {
+		return QuotaCheck{State: diskUsageOK}
+	}
+	usage = withQuota(usage, quota)
+	quotaCheck := QuotaCheck{State: usage.State, HardLimitAction: quota.hardLimitAction()}
+	switch {
+	case usage.State == diskUsageOverHard && quotaCheck.HardLimitAction == hardLimitReadOnlyWWW:
+		quotaCheck.Message = "You are using " + formatBytes(usage.Total) + " of disk space, over your limit of " + formatBytes(usage.HardLimit) + ". Your www folder is read-only until you delete some files."
+	case usage.State == diskUsageOverHard:
+		quotaCheck.Message = "You are using " + formatBytes(usage.Total) + " of disk space, over your limit of " + formatBytes(usage.HardLimit) + ". Please ask an administrator to free up some space."
+	case usage.State == diskUsageOverSoft:
+		quotaCheck.Message = "You are using " + formatBytes(usage.Total) + " of disk space, nearing your limit of " + formatBytes(usage.HardLimit) + ". Please delete any files you no longer need."
+		if usage.HardLimit == 0 {
+			quotaCheck.Message = "You are using " + formatBytes(usage.Total) + " of disk space, over the recommended " + formatBytes(usage.SoftLimit) + ". Please delete any files you no longer need."
+		}
+	}
+	return quotaCheck
+}
+
+// refusesStart reports whether the user's sessions can't be started because of their disk usage.
+func (quotaCheck QuotaCheck) refusesStart() bool {
+	return quotaCheck.State == diskUsageOverHard && quotaCheck.HardLimitAction == hardLimitRefuseStart
+}
+
+// wwwReadOnly reports whether the user's www folder should be mounted read-only because of their disk usage.
+func (quotaCheck QuotaCheck) wwwReadOnly() bool {
+	return quotaCheck.State == diskUsageOverHard && quotaCheck.HardLimitAction == hardLimitReadOnlyWWW
+}
+
+// folderUsage adds up the disk space used by the files in a folder, in bytes. Symlinks aren't followed, and anything
+// mounted inside the folder (such as rclone mounts of cloud storage) is skipped. Files with several hard links are
+// only counted once. A missing folder uses no space.
+func folderUsage(folder string) (int64, error) {
+	var rootStat syscall.Stat_t
+	if statErr := syscall.Lstat(folder, &rootStat); statErr != nil {
+		if errors.Is(statErr, fs.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, statErr
+	}
+	type inode struct{ device, number uint64 }
+	seen := make(map[inode]bool)
+	var total int64
+	walkErr := filepath.WalkDir(folder, func(path string, entry fs.DirEntry, entryErr error) error {
+		if entryErr != nil {
+			// A file deleted while we were counting, or a folder we can't read - count what we can.
+			if entry != nil && entry.IsDir() && path != folder {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		var fileStat syscall.Stat_t
+		if statErr := syscall.Lstat(path, &fileStat); statErr != nil {
+			return nil
+		}
+		if uint64(fileStat.Dev) != uint64(rootStat.Dev) {
+			return fs.SkipDir
+		}
+		if fileStat.Nlink > 1 && !entry.IsDir() {
+			key := inode{device: uint64(fileStat.Dev), number: uint64(fileStat.Ino)}
+			if seen[key] {
+				return nil
+			}
+			seen[key] = true
+		}
+		total = total + int64(fileStat.Blocks)*512
+		return nil
+	})
+	return total, walkErr
+}
+
+// diskUsageUsers returns the users whose disk usage is counted - everyone the Session Manager has set up folders for.
+func diskUsageUsers() []string {
+	users := make(map[string]bool)
+	for _, root := range []string{wwwFoldersRoot, tasksFoldersRoot} {
+		entries, _ := os.ReadDir(root)
+		for _, entry := range entries {
+			if entry.IsDir() && !users[entry.Name()] {
+				if _, lookupErr := user.Lookup(entry.Name()); lookupErr == nil {
+					users[entry.Name()] = true
+				}
+			}
+		}
+	}
+	var usernames []string
+	for username := range users {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+	return usernames
+}
+
+// countUserDiskUsage counts the disk space used by one user's folders.
+func countUserDiskUsage(username string) (UserDiskUsage, error) {
+	usage := UserDiskUsage{Username: username}
+	var countErr error
+	if usage.Home, countErr = folderUsage(filepath.Join(homeFoldersRoot, username)); countErr != nil {
+		return usage, countErr
+	}
+	if usage.WWW, countErr = folderUsage(filepath.Join(wwwFoldersRoot, username)); countErr != nil {
+		return usage, countErr
+	}
+	if usage.Tasks, countErr = folderUsage(filepath.Join(tasksFoldersRoot, username)); countErr != nil {
+		return usage, countErr
+	}
+	usage.Total = usage.Home + usage.WWW + usage.Tasks
+	usage.CheckedAt = time.Now()
+	return usage, nil
+}
+
+// countDiskUsage counts the disk space used by every user, logging anyone who has gone over their hard limit.
+func countDiskUsage(config Config) {
+	for _, username := range diskUsageUsers() {
+		usage, countErr := countUserDiskUsage(username)
+		if countErr != nil {
+			log.Println("Error counting disk usage for user " + username + ": " + countErr.Error())
+			continue
+		}
+		previous, _ := diskUsage.get(username)
+		diskUsage.set(usage)
+		quota := selectDiskQuota(config.DiskQuotas, userGroups(username))
+		usage = withQuota(usage, quota)
+		if usage.State == diskUsageOverHard && withQuota(previous, quota).State != diskUsageOverHard {
+			fmt.Println("User " + username + " is over their hard disk limit, using " + formatBytes(usage.Total) + " of " + formatBytes(usage.HardLimit))
+		}
+	}
+}
@@ -0,0 +1,115 @@
+// Web proxy settings for session containers. Schools often have to send pupils' web traffic through a content filter,
+// but a session container inherits no proxy settings from the host. An egress policy (see sessionNetworks.go) can
+// give the sessions it applies to a web proxy - passed to the session as the usual HTTP_PROXY, HTTPS_PROXY and
+// NO_PROXY environment variables - and the CA certificate the filter uses for TLS inspection, which is mounted into
+// the container and added to its trust store by the image's startup script.
+//
+// Proxy settings apply whether or not sessions' networks are isolated. Exam sessions never get them, as they have no
+// egress at all.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/moby/moby/api/types/mount"
+)
+
+// Where an egress policy's CA certificate is mounted in the container, for update-ca-certificates to pick up.
+const egressCACertificatePath = "/usr/local/share/ca-certificates/puws-egress-ca.crt"
+
+// The trust store update-ca-certificates writes, which tools that don't read it by default are pointed at.
+const systemCABundlePath = "/etc/ssl/certs/ca-certificates.crt"
+
+// The label recording a fingerprint of the proxy settings a session container was created with.
+const sessionEgressSettingsLabel = "uk.co.sansay.puws.egressSettings"
+
+// Hosts always reached directly, rather than through the proxy.
+var defaultNoProxy = []string{"localhost", "127.0.0.1", "::1"}
+
+// httpsProxy returns the proxy used for HTTPS traffic, which defaults to the HTTP proxy.
+func (policy *EgressPolicy) httpsProxy() string {
+	if policy.HTTPSProxy != "" {
+		return policy.HTTPSProxy
+	}
+	return policy.HTTPProxy
+}
+
+// environment returns the environment variables giving a session its egress policy's proxy settings. Both the
+// upper and lower case forms are set, as different tools read different ones.
+func (policy *EgressPolicy) environment() []string {
+	var environment []string
+	setVariable := func(name string, value string) {
+		environment = append(environment, name+"="+value, strings.ToLower(name)+"="+value)
+	}
+	if policy.HTTPProxy != "" {
+		setVariable("HTTP_PROXY", policy.HTTPProxy)
+	}
+	if httpsProxy := policy.httpsProxy(); httpsProxy != "" {
+		setVariable("HTTPS_PROXY", httpsProxy)
+	}
+	if len(environment) > 0 {
+		setVariable("NO_PROXY", strings.Join(append(append([]string{}, defaultNoProxy...), policy.NoProxy...), ","))
+	}
+	if policy.CACertificate != "" {
+		// Node.js and Python's requests library keep their own lists of CAs, so are pointed at the certificate too.
+		environment = append(environment, "NODE_EXTRA_CA_CERTS="+egressCACertificatePath, "REQUESTS_CA_BUNDLE="+systemCABundlePath)
+	}
+	return environment
+}
+
+// mounts returns the mount giving a session its egress policy's CA certificate, if it has one.
+func (policy *EgressPolicy) mounts() []mount.Mount {
+	if policy.CACertificate == "" {
+		return nil
+	}
+	return []mount.Mount{{Type: mount.TypeBind, Source: policy.CACertificate, Target: egressCACertificatePath, ReadOnly: true}}
+}
+
+// settingsFingerprint returns a short fingerprint of an egress policy's proxy settings, so a stopped session created
+// with different settings can be recreated with the current ones. Returns "" if the policy has no proxy settings.
+func (policy *EgressPolicy) settingsFingerprint() string {
+	environment := policy.environment()
+	if len(environment) == 0 {
+		return ""
+	}
+	fingerprint := sha256.Sum256([]byte(strings.Join(append(environment, policy.CACertificate), "\n")))
+	return hex.EncodeToString(fingerprint[:6])
+}
+
+// checkProxyURL checks a proxy URL from the config file, returning an error if it isn't an http:// or https:// URL.
+func checkProxyURL(proxyURL string) error {
+	if proxyURL == "" {
+		return nil
+	}
+	parsedURL, parseErr := url.Parse(proxyURL)
+	if parseErr != nil || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") || parsedURL.Host == "" {
+		return errors.New("must be an http:// or https:// URL, e.g. \"http://filter.school.internal:3128\"")
+	}
+	return nil
+}
+
+// checkCACertificate checks a CA certificate file from the config file, returning an error if it isn't a readable
+// PEM certificate.
+func checkCACertificate(certificatePath string) error {
+	if certificatePath == "" {
+		return nil
+	}
+	if !filepath.IsAbs(certificatePath) {
+		return errors.New("must be an absolute path, e.g. \"/etc/puws/filter-ca.crt\"")
+	}
+	certificate, readErr := os.ReadFile(certificatePath)
+	if readErr != nil {
+		return readErr
+	}
+	if !strings.Contains(string(certificate), "-----BEGIN CERTIFICATE-----") {
+		return errors.New("isn't a PEM certificate")
+	}
+	return nil
+}
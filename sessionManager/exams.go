@@ -0,0 +1,466 @@
+// Exam mode for the Session Manager. Sessions from an exam image (by default, "exams") are only available while an
+// invigilator has an exam running for the user, and are locked down while it is: each candidate's session is created
+// on its own internal Docker network, which reaches nothing but the Guacamole gateway - no internet, no other
+// candidates, no Session Manager. Each candidate has a hard end time; once it passes, their session is locked (the
+// container is paused, keeping their work as it was) and they can't connect to it again.
+//
+// Invigilators start an exam for a group of users, can give an individual candidate extra time (unlocking their
+// session if it had already been locked), and can end an exam early, for everyone or for one candidate. Exams are
+// saved to disk, so a restart of the Session Manager doesn't lose track of end times. A day after the last candidate's
+// session was locked, the exam is cleared away: its sessions and their networks are removed (the candidates' files
+// are in their home folders, so are kept).
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moby/moby/client"
+)
+
+// How often candidates' end times are checked.
+const examCheckInterval = 15 * time.Second
+
+// How long a finished exam (and its locked sessions) is kept before being cleared away.
+const examRetention = 24 * time.Hour
+
+// The longest an exam can be started for, or extended by, in one go.
+const maxExamMinutes = 12 * 60
+
+// Where running exams are saved, so they survive a restart.
+const examStatePath = "/var/lib/puws/exams.json"
+
+// The label recording which exam a session container was created for.
+const sessionExamLabel = "uk.co.sansay.puws.exam"
+
+// The names invigilators can give exams.
+var examNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9 _.-]{0,63}$`)
+
+// The exam mode settings from the config file.
+type ExamConfig struct {
+	// The images that are only available during an exam. Defaults to "exams".
+	Images []string `yaml:"images"`
+	// The containers (by name) that exam sessions' networks are connected to, so they can reach the sessions.
+	// Defaults to "guacd", the Guacamole proxy daemon.
+	Gateways []string `yaml:"gateways"`
+}
+
+// An exam, started by an invigilator for the members of a group.
+type Exam struct {
+	Name       string           `json:"name"`
+	Group      string           `json:"group"`
+	Image      string           `json:"image"`
+	StartedBy  string           `json:"startedBy"`
+	Started    time.Time        `json:"started"`
+	Candidates []*ExamCandidate `json:"candidates"`
+}
+
+// One candidate sitting an exam.
+type ExamCandidate struct {
+	Username string    `json:"username"`
+	EndTime  time.Time `json:"endTime"`
+	Locked   bool      `json:"locked"`
+	LockedAt time.Time `json:"lockedAt,omitempty"`
+}
+
+// A request to start an exam for the members of a group.
+type ExamStartRequest struct {
+	Name            string `json:"name"`
+	Group           string `json:"group"`
+	Image           string `json:"image"`
+	DurationMinutes int    `json:"durationMinutes"`
+}
+
+// A request to give a candidate extra time, or (with no username) every candidate in an exam.
+type ExamExtendRequest struct {
+	Name     string `json:"name"`
+	Username string `json:"username"`
+	Minutes  int    `json:"minutes"`
+}
+
+// A request to end an exam early, for one candidate or (with no username) everyone.
+type ExamEndRequest struct {
+	Name     string `json:"name"`
+	Username string `json:"username"`
+}
+
+// Keeps track of the running (and recently finished) exams.
+type ExamRegistry struct {
+	mu        sync.Mutex
+	exams     map[string]*Exam
+	statePath string
+}
+
+// The global exam registry.
+var examSessions = newExamRegistry(examStatePath)
+
+func newExamRegistry(statePath string) *ExamRegistry {
+	return &ExamRegistry{exams: make(map[string]*Exam), statePath: statePath}
+}
+
+// examImages returns the images that are only available during an exam.
+func examImages(examConfig ExamConfig) []string {
+	if len(examConfig.Images) > 0 {
+		return examConfig.Images
+	}
+	return []string{"exams"}
+}
+
+// examGateways returns the containers exam sessions' networks are connected to.
+func examGateways(examConfig ExamConfig) []string {
+	if len(examConfig.Gateways) > 0 {
+		return examConfig.Gateways
+	}
+	return []string{"guacd"}
+}
+
+// isExamImage reports whether an image is only available during an exam.
+func isExamImage(config Config, imageName string) bool {
+	return listContains(examImages(config.Exams), imageName)
+}
+
+// copyExam returns a copy of an exam, safe to use outside the registry's lock.
+func copyExam(exam *Exam) Exam {
+	examCopy := *exam
+	examCopy.Candidates = nil
+	for _, candidate := range exam.Candidates {
+		candidateCopy := *candidate
+		examCopy.Candidates = append(examCopy.Candidates, &candidateCopy)
+	}
+	return examCopy
+}
+
+// load reads the saved exams, if there are any.
+func (registry *ExamRegistry) load() error {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	stateData, readErr := os.ReadFile(registry.statePath)
+	if os.IsNotExist(readErr) {
+		return nil
+	}
+	if readErr != nil {
+		return readErr
+	}
+	var exams []*Exam
+	if unmarshalErr := json.Unmarshal(stateData, &exams); unmarshalErr != nil {
+		return unmarshalErr
+	}
+	for _, exam := range exams {
+		registry.exams[exam.Name] = exam
+	}
+	return nil
+}
+
+// save writes the exams to disk. The registry's lock must be held.
+func (registry *ExamRegistry) save() {
+	var exams []*Exam
+	for _, exam := range registry.exams {
+		exams = append(exams, exam)
+	}
+	stateData, marshalErr := json.Marshal(exams)
+	if marshalErr == nil {
+		if mkdirErr := os.MkdirAll(filepath.Dir(registry.statePath), 0700); mkdirErr != nil {
+			marshalErr = mkdirErr
+		} else {
+			marshalErr = os.WriteFile(registry.statePath, stateData, 0600)
+		}
+	}
+	if marshalErr != nil {
+		log.Println("Error saving exams: " + marshalErr.Error())
+	}
+}
+
+// sittingExam returns the exam (if any) a user is sitting with the given image - the one they were most recently
+// made a candidate in - and their candidacy.
+func (registry *ExamRegistry) sittingExam(imageName string, username string) (*Exam, *ExamCandidate) {
+	var latestExam *Exam
+	var latestCandidate *ExamCandidate
+	for _, exam := range registry.exams {
+		if exam.Image != imageName {
+			continue
+		}
+		for _, candidate := range exam.Candidates {
+			if candidate.Username == username && (latestExam == nil || exam.Started.After(latestExam.Started)) {
+				latestExam, latestCandidate = exam, candidate
+			}
+		}
+	}
+	return latestExam, latestCandidate
+}
+
+// checkStart checks a user can start (or wake up) an exam session, returning the name of their exam, and an error
+// message if they can't.
+func (registry *ExamRegistry) checkStart(imageName string, username string, now time.Time) (string, string) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	exam, candidate := registry.sittingExam(imageName, username)
+	if exam == nil {
+		return "", "No exam has been started for user " + username
+	}
+	if candidate.Locked || !now.Before(candidate.EndTime) {
+		return exam.Name, "The exam \"" + exam.Name + "\" has ended for user " + username
+	}
+	return exam.Name, ""
+}
+
+// isSitting reports whether a user is in the middle of an exam with the given image.
+func (registry *ExamRegistry) isSitting(imageName string, username string, now time.Time) bool {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	_, candidate := registry.sittingExam(imageName, username)
+	return candidate != nil && !candidate.Locked && now.Before(candidate.EndTime)
+}
+
+// start registers a new exam. An exam of the same name can only be started again once it has finished.
+func (registry *ExamRegistry) start(exam *Exam) error {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if existing := registry.exams[exam.Name]; existing != nil {
+		for _, candidate := range existing.Candidates {
+			if !candidate.Locked {
+				return errors.New("The exam \"" + exam.Name + "\" is already running")
+			}
+		}
+	}
+	registry.exams[exam.Name] = exam
+	registry.save()
+	return nil
+}
+
+// candidates returns the candidates in an exam matching the username (or all of them, if it is blank).
+func (registry *ExamRegistry) candidates(name string, username string) (*Exam, []*ExamCandidate, error) {
+	exam := registry.exams[name]
+	if exam == nil {
+		return nil, nil, errors.New("No exam called \"" + name + "\"")
+	}
+	var candidates []*ExamCandidate
+	for _, candidate := range exam.Candidates {
+		if username == "" || candidate.Username == username {
+			candidates = append(candidates, candidate)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, nil, errors.New("User " + username + " isn't sitting the exam \"" + name + "\"")
+	}
+	return exam, candidates, nil
+}
+
+// extend gives candidates extra time. A candidate whose time had already run out gets the extra time from now, and
+// their session is unlocked. Returns the exam's image and the candidates who need unlocking.
+func (registry *ExamRegistry) extend(name string, username string, minutes int, now time.Time) (string, []string, error) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	exam, candidates, candidatesErr := registry.candidates(name, username)
+	if candidatesErr != nil {
+		return "", nil, candidatesErr
+	}
+	var unlocked []string
+	for _, candidate := range candidates {
+		if candidate.EndTime.Before(now) {
+			candidate.EndTime = now
+		}
+		candidate.EndTime = candidate.EndTime.Add(time.Duration(minutes) * time.Minute)
+		if candidate.Locked {
+			candidate.Locked = false
+			candidate.LockedAt = time.Time{}
+			unlocked = append(unlocked, candidate.Username)
+		}
+	}
+	registry.save()
+	return exam.Image, unlocked, nil
+}
+
+// end brings candidates' end time forward to now. Their sessions are locked by the next check.
+func (registry *ExamRegistry) end(name string, username string, now time.Time) error {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	_, candidates, candidatesErr := registry.candidates(name, username)
+	if candidatesErr != nil {
+		return candidatesErr
+	}
+	for _, candidate := range candidates {
+		if now.Before(candidate.EndTime) {
+			candidate.EndTime = now
+		}
+	}
+	registry.save()
+	return nil
+}
+
+// due returns the candidates whose time is up but whose sessions haven't been locked yet, as image / username pairs.
+func (registry *ExamRegistry) due(now time.Time) [][2]string {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	var due [][2]string
+	for _, exam := range registry.exams {
+		for _, candidate := range exam.Candidates {
+			if !candidate.Locked && !now.Before(candidate.EndTime) {
+				due = append(due, [2]string{exam.Image, candidate.Username})
+			}
+		}
+	}
+	return due
+}
+
+// setLocked records that a candidate's session has been locked, in whichever exam they are sitting with the image.
+func (registry *ExamRegistry) setLocked(imageName string, username string, now time.Time) string {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	exam, candidate := registry.sittingExam(imageName, username)
+	if exam == nil {
+		return ""
+	}
+	candidate.Locked = true
+	candidate.LockedAt = now
+	registry.save()
+	return exam.Name
+}
+
+// expired removes and returns the exams whose candidates' sessions were all locked longer ago than the retention time.
+func (registry *ExamRegistry) expired(now time.Time) []Exam {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	var expired []Exam
+	for name, exam := range registry.exams {
+		finished := true
+		for _, candidate := range exam.Candidates {
+			finished = finished && candidate.Locked && now.Sub(candidate.LockedAt) > examRetention
+		}
+		if finished {
+			expired = append(expired, copyExam(exam))
+			delete(registry.exams, name)
+		}
+	}
+	if len(expired) > 0 {
+		registry.save()
+	}
+	return expired
+}
+
+// list returns the exams, most recently started first.
+func (registry *ExamRegistry) list() []Exam {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	exams := []Exam{}
+	for _, exam := range registry.exams {
+		exams = append(exams, copyExam(exam))
+	}
+	sort.Slice(exams, func(i, j int) bool { return exams[i].Started.After(exams[j].Started) })
+	return exams
+}
+
+// checkExamStartRequest checks a request to start an exam, returning an error message, or "" if it is valid.
+func checkExamStartRequest(config Config, examRequest ExamStartRequest) string {
+	if !examNamePattern.MatchString(examRequest.Name) {
+		return "Invalid exam name - use letters, numbers, spaces, \".\", \"_\" and \"-\""
+	}
+	if !accountNamePattern.MatchString(examRequest.Group) {
+		return "Invalid group name"
+	}
+	if !isExamImage(config, examRequest.Image) {
+		return "\"" + examRequest.Image + "\" isn't an exam image - exam images are: " + strings.Join(examImages(config.Exams), ", ")
+	}
+	if findCatalogueImage(config, examRequest.Image) == nil {
+		return "Unknown image \"" + examRequest.Image + "\""
+	}
+	if examRequest.DurationMinutes < 1 || examRequest.DurationMinutes > maxExamMinutes {
+		return "The duration must be between 1 and " + strconv.Itoa(maxExamMinutes) + " minutes"
+	}
+	return ""
+}
+
+// lockExamSession locks a candidate's session once their time is up, by pausing its container - their work is left
+// as it was, but they can't carry on with it.
+func lockExamSession(cli *client.Client, imageName string, username string, now time.Time) string {
+	existingSession, existingErr := findSession(cli, imageName, username)
+	if existingErr != nil {
+		return "Error finding session: " + existingErr.Error()
+	}
+	if existingSession != nil && existingSession.State == "running" {
+		if pauseErr := hibernateSession(cli, existingSession.ID); pauseErr != nil {
+			return "Error pausing container: " + pauseErr.Error()
+		}
+	}
+	examName := examSessions.setLocked(imageName, username, now)
+	sessionAudit.record(AuditEvent{Action: "exam-lock", Actor: auditActorSystem, Target: username, Image: imageName, Source: auditSourceExam, Detail: examName})
+	fmt.Println("Locked exam session for user " + username + " (" + examName + ")")
+	return ""
+}
+
+// unlockExamSession unpauses a candidate's locked session after they have been given extra time.
+func unlockExamSession(cli *client.Client, imageName string, username string) string {
+	existingSession, existingErr := findSession(cli, imageName, username)
+	if existingErr != nil {
+		return "Error finding session: " + existingErr.Error()
+	}
+	if existingSession != nil && existingSession.State == "paused" {
+		if _, unpauseErr := cli.ContainerUnpause(context.Background(), existingSession.ID, client.ContainerUnpauseOptions{}); unpauseErr != nil {
+			return "Error unpausing container: " + unpauseErr.Error()
+		}
+	}
+	return ""
+}
+
+// clearExam removes a finished exam's sessions and their networks.
+func clearExam(cli *client.Client, config Config, exam Exam) {
+	for _, candidate := range exam.Candidates {
+		existingSession, existingErr := findSession(cli, exam.Image, candidate.Username)
+		if existingErr == nil && existingSession != nil && existingSession.Labels[sessionExamLabel] == exam.Name {
+			if removeErr := removeSessionContainer(cli, *existingSession, false); removeErr != nil {
+				log.Println("Error removing exam session for user " + candidate.Username + ": " + removeErr.Error())
+				continue
+			}
+			sessionActivity.forget(exam.Image, candidate.Username)
+		}
+		if examSessions.isSitting(exam.Image, candidate.Username, time.Now()) {
+			continue
+		}
+		removeSessionNetwork(cli, planSessionNetwork(config, exam.Image, candidate.Username, nil).Name)
+	}
+	fmt.Println("Cleared away finished exam: " + exam.Name)
+}
+
+// checkExams locks the sessions of candidates whose time is up, and clears away exams that finished long enough ago.
+func checkExams(cli *client.Client, config Config, now time.Time) {
+	for _, due := range examSessions.due(now) {
+		if lockErr := lockExamSession(cli, due[0], due[1], now); lockErr != "" {
+			log.Println("Error locking exam session for user " + due[1] + ": " + lockErr)
+		}
+	}
+	for _, exam := range examSessions.expired(now) {
+		clearExam(cli, config, exam)
+	}
+}
+
+// startExam starts an exam for the members of a group, starting each candidate's session in the background.
+func startExam(cli *client.Client, config Config, randomSeed []byte, examRequest ExamStartRequest, startedBy string, now time.Time) (Exam, error) {
+	members := groupMembers(examRequest.Group)
+	if len(members) == 0 {
+		return Exam{}, errors.New("Group " + examRequest.Group + " has no members")
+	}
+	exam := &Exam{Name: examRequest.Name, Group: examRequest.Group, Image: examRequest.Image, StartedBy: startedBy, Started: now}
+	endTime := now.Add(time.Duration(examRequest.DurationMinutes) * time.Minute)
+	for _, username := range members {
+		exam.Candidates = append(exam.Candidates, &ExamCandidate{Username: username, EndTime: endTime})
+	}
+	examCopy := copyExam(exam)
+	if startErr := examSessions.start(exam); startErr != nil {
+		return Exam{}, startErr
+	}
+	for _, username := range members {
+		go startAutoStartSession(cli, config, randomSeed, username, examRequest.Image, auditSourceExam)
+	}
+	return examCopy, nil
+}
@@ -0,0 +1,291 @@
+// Session hibernation for the Session Manager. Stopping a session closes all the user's open windows, so instead a
+// session can be "hibernated" - its container paused with Docker's pause, which freezes every process in it. A
+// hibernated session uses no CPU, and as nothing in it touches its memory the kernel can swap that memory out without
+// slowing down anyone else's session. Connecting to a hibernated session unpauses it again, with every window just as
+// the user left it.
+//
+// As well as hibernating idle sessions (see idleCulling.go), sessions can be hibernated when the host runs short of
+// memory, least recently used first.
+//
+// A hibernated session still holds its memory (if only in swap) and counts towards the admission limits, so
+// hibernated sessions are stopped once they have been hibernated for longer than the time set in the config file, and
+// whenever a session start is waiting in the admission queue for room - the session hibernated longest ago first.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/moby/moby/client"
+)
+
+// The interval between checks for memory pressure - shorter than the idle check, as memory can run out quickly when a
+// lot of users log in at once.
+const memoryPressureCheckInterval = 15 * time.Second
+
+// Sessions used more recently than this are never hibernated for memory pressure, if not set in the config file.
+const defaultMinIdleMinutes = 5
+
+// The hibernation settings from the config file.
+type HibernationConfig struct {
+	// Hibernate sessions, least recently used first, while the host has less than this much memory free (e.g. "2g").
+	// If empty, sessions are never hibernated for memory pressure.
+	MinFreeMemory string `yaml:"minFreeMemory"`
+	// Sessions used within this many minutes are never hibernated for memory pressure. Defaults to 5.
+	MinIdleMinutes int `yaml:"minIdleMinutes"`
+	// Hibernated sessions are stopped once they have been hibernated for this many minutes. Zero (the default) means
+	// they are kept until woken up, unless room is needed for a new session.
+	MaxHibernatedMinutes int `yaml:"maxHibernatedMinutes"`
+}
+
+// A hibernated session that could be stopped, and when it was first seen hibernated.
+type HibernatedSession struct {
+	ContainerID string
+	ImageName   string
+	Username    string
+	PausedSince time.Time
+}
+
+// HibernationTracker records when each hibernated session was first seen paused - Docker doesn't record when a
+// container was paused. Accessed from the background checks and the admission queue, so protected by a mutex.
+type HibernationTracker struct {
+	mu          sync.Mutex
+	pausedSince map[string]time.Time
+}
+
+// newHibernationTracker initialises an empty hibernation tracker.
+func newHibernationTracker() *HibernationTracker {
+	return &HibernationTracker{
+		pausedSince: make(map[string]time.Time),
+	}
+}
+
+// The global hibernation tracker.
+var hibernatedSessions = newHibernationTracker()
+
+// update records the sessions (by key) currently paused, returning when each was first seen paused. Sessions not seen
+// before are counted from now, and sessions no longer paused are forgotten, so a session hibernated again later is
+// counted from then.
+func (ht *HibernationTracker) update(pausedKeys []string, now time.Time) map[string]time.Time {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	stillPaused := make(map[string]time.Time)
+	for _, pausedKey := range pausedKeys {
+		pausedSince, seen := ht.pausedSince[pausedKey]
+		if !seen {
+			pausedSince = now
+		}
+		stillPaused[pausedKey] = pausedSince
+	}
+	ht.pausedSince = stillPaused
+	return stillPaused
+}
+
+// A running session that could be hibernated to relieve memory pressure.
+type HibernationCandidate struct {
+	ContainerID  string
+	ImageName    string
+	Username     string
+	LastActivity time.Time
+}
+
+// minIdleTime returns how long a session must have gone unused before it can be hibernated for memory pressure.
+func minIdleTime(hibernationConfig HibernationConfig) time.Duration {
+	if hibernationConfig.MinIdleMinutes > 0 {
+		return time.Duration(hibernationConfig.MinIdleMinutes) * time.Minute
+	}
+	return defaultMinIdleMinutes * time.Minute
+}
+
+// leastRecentlyUsed returns the candidate that was used longest ago, ignoring any used within the given minimum idle
+// time, or nil if there are none.
+func leastRecentlyUsed(candidates []HibernationCandidate, minIdle time.Duration, now time.Time) *HibernationCandidate {
+	var eligible []HibernationCandidate
+	for _, candidate := range candidates {
+		if now.Sub(candidate.LastActivity) >= minIdle {
+			eligible = append(eligible, candidate)
+		}
+	}
+	if len(eligible) == 0 {
+		return nil
+	}
+	sort.SliceStable(eligible, func(i, j int) bool {
+		return eligible[i].LastActivity.Before(eligible[j].LastActivity)
+	})
+	return &eligible[0]
+}
+
+// hibernateSession pauses a session container.
+func hibernateSession(cli *client.Client, containerID string) error {
+	_, pauseErr := cli.ContainerPause(context.Background(), containerID, client.ContainerPauseOptions{})
+	return pauseErr
+}
+
+// relieveMemoryPressure checks whether the host is short of memory and, if so, hibernates the least recently used
+// running session. Only one session is hibernated per check, so the kernel has time to swap out its memory before we
+// decide whether another is needed. Sessions on the auto-start list, exam sessions and sessions with anyone connected are left alone.
+func relieveMemoryPressure(cli *client.Client, config Config) {
+	memoryThreshold, _ := parseByteSize(config.Hibernation.MinFreeMemory)
+	if memoryThreshold <= 0 {
+		return
+	}
+	_, memAvailable, _, _, memErr := readMemoryInfo()
+	if memErr != nil {
+		log.Println("Error reading memory info to check for memory pressure: " + memErr.Error())
+		return
+	}
+	if memAvailable*1024 >= memoryThreshold {
+		return
+	}
+
+	containers, containersErr := cli.ContainerList(context.Background(), client.ContainerListOptions{})
+	if containersErr != nil {
+		log.Println("Error listing containers to relieve memory pressure: " + containersErr.Error())
+		return
+	}
+	autoStartSessions, autoStartErr := loadAutoStart()
+	if autoStartErr != nil {
+		log.Println("Error loading auto-start list to relieve memory pressure: " + autoStartErr.Error())
+		return
+	}
+
+	var candidates []HibernationCandidate
+	for _, item := range containers.Items {
+		imageName, username, isSession := sessionFromContainer(item)
+		if !isSession || item.State != "running" || isAutoStartSession(autoStartSessions, imageName, username) || examSessions.isSitting(imageName, username, time.Now()) {
+			continue
+		}
+		connectionCount, connectionErr := countSessionConnections(cli, item.ID)
+		if connectionErr != nil {
+			log.Println("Error checking connections for session " + imageName + "-" + username + ": " + connectionErr.Error())
+			continue
+		}
+		if connectionCount > 0 {
+			sessionActivity.touch(imageName, username)
+			continue
+		}
+		lastActivity, seen := sessionActivity.lastSeen(imageName, username)
+		if !seen {
+			sessionActivity.touch(imageName, username)
+			continue
+		}
+		candidates = append(candidates, HibernationCandidate{ContainerID: item.ID, ImageName: imageName, Username: username, LastActivity: lastActivity})
+	}
+
+	candidate := leastRecentlyUsed(candidates, minIdleTime(config.Hibernation), time.Now())
+	if candidate == nil {
+		log.Printf("Host is short of memory (%d kB available), but no sessions can be hibernated.\n", memAvailable)
+		return
+	}
+	idleTime := time.Since(candidate.LastActivity)
+	cullEvent := CullEvent{Time: time.Now(), Username: candidate.Username, Image: candidate.ImageName, Action: "hibernate", Reason: "memory pressure", IdleMinutes: int(idleTime.Minutes())}
+	if hibernateErr := hibernateSession(cli, candidate.ContainerID); hibernateErr != nil {
+		cullEvent.Error = hibernateErr.Error()
+		log.Println("Error hibernating session " + candidate.ImageName + "-" + candidate.Username + ": " + hibernateErr.Error())
+	} else {
+		fmt.Printf("Hibernated session %s-%s to relieve memory pressure (%d kB available, idle for %d minutes)\n", candidate.ImageName, candidate.Username, memAvailable, cullEvent.IdleMinutes)
+		sessionActivity.forget(candidate.ImageName, candidate.Username)
+	}
+	sessionCulls.add(cullEvent)
+	result, detail := auditResult(cullEvent.Error)
+	if detail == "" {
+		detail = fmt.Sprintf("%d kB of memory available, idle for %d minutes", memAvailable, cullEvent.IdleMinutes)
+	}
+	sessionAudit.record(AuditEvent{Action: "session-hibernate", Actor: auditActorSystem, Target: candidate.Username, Image: candidate.ImageName, Source: auditSourceMemoryPressure, Result: result, Detail: detail})
+}
+
+// listHibernatedSessions returns the hibernated sessions that can be stopped, hibernated longest ago first. Sessions on
+// the auto-start list and exam sessions (locked once the candidate's time is up) are left alone.
+func listHibernatedSessions(cli *client.Client) ([]HibernatedSession, error) {
+	containers, containersErr := cli.ContainerList(context.Background(), client.ContainerListOptions{})
+	if containersErr != nil {
+		return nil, containersErr
+	}
+	autoStartSessions, autoStartErr := loadAutoStart()
+	if autoStartErr != nil {
+		return nil, autoStartErr
+	}
+	var pausedKeys []string
+	var hibernated []HibernatedSession
+	for _, item := range containers.Items {
+		imageName, username, isSession := sessionFromContainer(item)
+		if !isSession || item.State != "paused" {
+			continue
+		}
+		pausedKeys = append(pausedKeys, sessionKey(imageName, username))
+		if isAutoStartSession(autoStartSessions, imageName, username) || item.Labels[sessionExamLabel] != "" {
+			continue
+		}
+		hibernated = append(hibernated, HibernatedSession{ContainerID: item.ID, ImageName: imageName, Username: username})
+	}
+	pausedSince := hibernatedSessions.update(pausedKeys, time.Now())
+	for index := range hibernated {
+		hibernated[index].PausedSince = pausedSince[sessionKey(hibernated[index].ImageName, hibernated[index].Username)]
+	}
+	sort.SliceStable(hibernated, func(i, j int) bool {
+		return hibernated[i].PausedSince.Before(hibernated[j].PausedSince)
+	})
+	return hibernated, nil
+}
+
+// stopHibernatedSession stops a hibernated session, recording why in the cull log and the audit log. The session is
+// woken up first, so its programs get the chance to shut down cleanly.
+func stopHibernatedSession(cli *client.Client, session HibernatedSession, reason string, source string) {
+	hibernatedMinutes := int(time.Since(session.PausedSince).Minutes())
+	cullEvent := CullEvent{Time: time.Now(), Username: session.Username, Image: session.ImageName, Action: "stop", Reason: reason, IdleMinutes: hibernatedMinutes}
+	_, stopErr := cli.ContainerUnpause(context.Background(), session.ContainerID, client.ContainerUnpauseOptions{})
+	if stopErr == nil {
+		_, stopErr = cli.ContainerStop(context.Background(), session.ContainerID, client.ContainerStopOptions{})
+	}
+	if stopErr != nil {
+		cullEvent.Error = stopErr.Error()
+		log.Println("Error stopping hibernated session " + session.ImageName + "-" + session.Username + ": " + stopErr.Error())
+	} else {
+		fmt.Printf("Stopped hibernated session %s-%s (%s, hibernated for %d minutes)\n", session.ImageName, session.Username, reason, hibernatedMinutes)
+	}
+	sessionCulls.add(cullEvent)
+	result, detail := auditResult(cullEvent.Error)
+	if detail == "" {
+		detail = fmt.Sprintf("Hibernated for %d minutes", hibernatedMinutes)
+	}
+	sessionAudit.record(AuditEvent{Action: "session-stop", Actor: auditActorSystem, Target: session.Username, Image: session.ImageName, Source: source, Result: result, Detail: detail})
+}
+
+// stopLongHibernatedSessions stops every session that has been hibernated for longer than the time set in the config
+// file.
+func stopLongHibernatedSessions(cli *client.Client, config Config) {
+	hibernated, listErr := listHibernatedSessions(cli)
+	if listErr != nil {
+		log.Println("Error listing hibernated sessions: " + listErr.Error())
+		return
+	}
+	if config.Hibernation.MaxHibernatedMinutes <= 0 {
+		return
+	}
+	maxHibernated := time.Duration(config.Hibernation.MaxHibernatedMinutes) * time.Minute
+	for _, session := range hibernated {
+		if time.Since(session.PausedSince) >= maxHibernated {
+			stopHibernatedSession(cli, session, "hibernated too long", auditSourceHibernation)
+		}
+	}
+}
+
+// stopOldestHibernatedSession stops the session hibernated longest ago, to make room for a session start waiting in
+// the admission queue. Returns false if there are no hibernated sessions to stop.
+func stopOldestHibernatedSession(cli *client.Client) bool {
+	hibernated, listErr := listHibernatedSessions(cli)
+	if listErr != nil {
+		log.Println("Error listing hibernated sessions: " + listErr.Error())
+		return false
+	}
+	if len(hibernated) == 0 {
+		return false
+	}
+	stopHibernatedSession(cli, hibernated[0], "room needed for a new session", auditSourceAdmission)
+	return true
+}
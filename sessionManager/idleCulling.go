@@ -0,0 +1,142 @@
+// Idle session culling for the Session Manager. Containers are started on demand when a user connects, but would
+// otherwise stay running forever, slowly using up all the memory on the host. A background loop checks each running
+// session and stops (or hibernates) any that haven't been used for longer than the timeout set in the config file.
+// Sessions on the auto-start list, and exam sessions while the exam is running, are never culled.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/moby/moby/client"
+)
+
+// The interval between checks for idle sessions.
+const idleCheckInterval = 1 * time.Minute
+
+// The number of recent cull events kept in memory, to show in the admin panel.
+const maxCullEvents = 100
+
+// A record of a session being culled, reported to the admin panel.
+type CullEvent struct {
+	Time        time.Time `json:"time"`
+	Username    string    `json:"username"`
+	Image       string    `json:"image"`
+	Action      string    `json:"action"`
+	Reason      string    `json:"reason,omitempty"`
+	IdleMinutes int       `json:"idleMinutes"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// CullLog keeps the most recent cull events, newest last.
+type CullLog struct {
+	mu     sync.Mutex
+	events []CullEvent
+}
+
+// add records a cull event, dropping the oldest event if the log is full.
+func (cl *CullLog) add(event CullEvent) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.events = append(cl.events, event)
+	if len(cl.events) > maxCullEvents {
+		cl.events = cl.events[len(cl.events)-maxCullEvents:]
+	}
+}
+
+// list returns a copy of the recorded cull events.
+func (cl *CullLog) list() []CullEvent {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return append([]CullEvent{}, cl.events...)
+}
+
+// The global cull log.
+var sessionCulls = &CullLog{}
+
+// idleAction returns the action to take on idle sessions, as set in the config file - "stop" (the default) or
+// "hibernate". "pause", the setting's old name for hibernating, is still accepted.
+func idleAction(config Config) string {
+	if config.IdleAction == "hibernate" || config.IdleAction == "pause" {
+		return "hibernate"
+	}
+	return "stop"
+}
+
+// cullSession stops or hibernates a single session container.
+func cullSession(cli *client.Client, containerID string, action string) error {
+	if action == "hibernate" {
+		return hibernateSession(cli, containerID)
+	}
+	_, stopErr := cli.ContainerStop(context.Background(), containerID, client.ContainerStopOptions{})
+	return stopErr
+}
+
+// cullIdleSessions goes through the running sessions and culls any that have been idle for longer than the
+// configured timeout. A session we haven't seen before (for instance, one left running when the Session Manager was
+// restarted) has its idle time counted from the moment we first see it.
+func cullIdleSessions(cli *client.Client, config Config) {
+	if config.IdleTimeoutMinutes <= 0 {
+		return
+	}
+	idleTimeout := time.Duration(config.IdleTimeoutMinutes) * time.Minute
+
+	containers, containersErr := cli.ContainerList(context.Background(), client.ContainerListOptions{})
+	if containersErr != nil {
+		log.Println("Error listing containers to check for idle sessions: " + containersErr.Error())
+		return
+	}
+	autoStartSessions, autoStartErr := loadAutoStart()
+	if autoStartErr != nil {
+		log.Println("Error loading auto-start list to check for idle sessions: " + autoStartErr.Error())
+		return
+	}
+
+	for _, item := range containers.Items {
+		imageName, username, isSession := sessionFromContainer(item)
+		if !isSession || item.State != "running" {
+			continue
+		}
+		if isAutoStartSession(autoStartSessions, imageName, username) || examSessions.isSitting(imageName, username, time.Now()) {
+			continue
+		}
+
+		// Anyone connected via VNC or SSH counts as activity.
+		connectionCount, connectionErr := countSessionConnections(cli, item.ID)
+		if connectionErr != nil {
+			log.Println("Error checking connections for session " + imageName + "-" + username + ": " + connectionErr.Error())
+		} else if connectionCount > 0 {
+			sessionActivity.touch(imageName, username)
+		}
+
+		lastActivity, seen := sessionActivity.lastSeen(imageName, username)
+		if !seen {
+			sessionActivity.touch(imageName, username)
+			continue
+		}
+		idleTime := time.Since(lastActivity)
+		if idleTime < idleTimeout {
+			continue
+		}
+
+		action := idleAction(config)
+		cullEvent := CullEvent{Time: time.Now(), Username: username, Image: imageName, Action: action, Reason: "idle", IdleMinutes: int(idleTime.Minutes())}
+		if cullErr := cullSession(cli, item.ID, action); cullErr != nil {
+			cullEvent.Error = cullErr.Error()
+			log.Println("Error culling idle session " + imageName + "-" + username + ": " + cullErr.Error())
+		} else {
+			fmt.Printf("Culled idle session %s-%s (%s, idle for %d minutes)\n", imageName, username, action, cullEvent.IdleMinutes)
+			sessionActivity.forget(imageName, username)
+		}
+		sessionCulls.add(cullEvent)
+		result, detail := auditResult(cullEvent.Error)
+		if detail == "" {
+			detail = fmt.Sprintf("Idle for %d minutes", cullEvent.IdleMinutes)
+		}
+		sessionAudit.record(AuditEvent{Action: "session-" + action, Actor: auditActorSystem, Target: username, Image: imageName, Source: auditSourceIdleCulling, Result: result, Detail: detail})
+	}
+}
@@ -0,0 +1,145 @@
+// The session image catalogue for the Session Manager. Lists the Docker images users are allowed to start sessions
+// from, and how to start each one, so administrators can roll out new image versions (or add new images) by editing
+// the config file rather than recompiling the Session Manager. Requests for images not in the catalogue are rejected.
+
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/moby/moby/api/types/mount"
+)
+
+// An extra folder to mount into a session container, as defined in the config file. The source and target paths can
+// include the "{{USERNAME}}" placeholder.
+type CatalogueMount struct {
+	Source   string `yaml:"source"`
+	Target   string `yaml:"target"`
+	ReadOnly bool   `yaml:"readOnly"`
+}
+
+// An entry in the session image catalogue.
+type CatalogueImage struct {
+	// The image name used in requests (e.g. "desktop"), which also forms the first part of the container name.
+	Name string `yaml:"name"`
+	// The Docker image reference (registry / repository), without the version tag.
+	Image string `yaml:"image"`
+	// The version (tag) of the Docker image to use.
+	Version string `yaml:"version"`
+	// The script run (as root) inside the container to set up the user and start the session.
+	StartupScript string `yaml:"startupScript"`
+	// The (host) user groups allowed to use this image. An empty list lets everyone use it.
+	Groups []string `yaml:"groups"`
+	// The line in the container's log output that tells us the session is ready to connect to.
+	ReadyMarker string `yaml:"readyMarker"`
+	// Any extra folders to mount into the container, as well as the user's home, www and webconsole folders.
+	Mounts []CatalogueMount `yaml:"mounts"`
+}
+
+// The names images in the catalogue can have. No "-", as that separates the image name from the username in
+// container names.
+var catalogueNamePattern = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// The version of the images built by the install script, used for the default catalogue.
+const defaultImageVersion = "0.1-beta.3"
+
+// legacySessionImageRef returns the Docker image reference that older versions of the Session Manager (before the
+// image catalogue was added) always used for the given image name.
+func legacySessionImageRef(imageName string) string {
+	return "sansay.co.uk-docker" + imageName + ":" + defaultImageVersion
+}
+
+// defaultCatalogue returns the catalogue used if the config file doesn't define one - the session images built by the
+// install script.
+func defaultCatalogue() []CatalogueImage {
+	var catalogue []CatalogueImage
+	for _, imageName := range []string{"desktop", "wine", "calc", "exams"} {
+		catalogue = append(catalogue, CatalogueImage{Name: imageName, Image: "sansay.co.uk-docker" + imageName, Version: defaultImageVersion})
+	}
+	return catalogue
+}
+
+// imageCatalogue returns the session image catalogue from the config file, or the default catalogue if there isn't one.
+func imageCatalogue(config Config) []CatalogueImage {
+	if len(config.Images) == 0 {
+		return defaultCatalogue()
+	}
+	return config.Images
+}
+
+// findCatalogueImage looks up an image name in the catalogue, returning nil if it isn't there.
+func findCatalogueImage(config Config, imageName string) *CatalogueImage {
+	catalogue := imageCatalogue(config)
+	for index := range catalogue {
+		if catalogue[index].Name == imageName {
+			return &catalogue[index]
+		}
+	}
+	return nil
+}
+
+// catalogueImageNames returns the names of all the images in the catalogue.
+func catalogueImageNames(config Config) []string {
+	var imageNames []string
+	for _, catalogueImage := range imageCatalogue(config) {
+		imageNames = append(imageNames, catalogueImage.Name)
+	}
+	return imageNames
+}
+
+// checkImageAllowed checks the given image is in the catalogue and that the user is allowed to use it, returning the
+// catalogue entry. The error message is suitable for passing back to the caller.
+func checkImageAllowed(config Config, imageName string, username string) (*CatalogueImage, error) {
+	catalogueImage := findCatalogueImage(config, imageName)
+	if catalogueImage == nil {
+		return nil, errors.New("unknown image \"" + imageName + "\" - available images are: " + strings.Join(catalogueImageNames(config), ", "))
+	}
+	if !matchesImageAndGroups(nil, catalogueImage.Groups, imageName, userGroups(username)) {
+		return nil, errors.New("user " + username + " is not allowed to use image \"" + imageName + "\"")
+	}
+	return catalogueImage, nil
+}
+
+// reference returns the full Docker image reference (including the version tag) for a catalogue image.
+func (catalogueImage *CatalogueImage) reference() string {
+	imageRef := catalogueImage.Image
+	if imageRef == "" {
+		imageRef = "sansay.co.uk-docker" + catalogueImage.Name
+	}
+	if catalogueImage.Version == "" {
+		return imageRef
+	}
+	return imageRef + ":" + catalogueImage.Version
+}
+
+// startupScript returns the path (inside the container) of the image's startup script.
+func (catalogueImage *CatalogueImage) startupScript() string {
+	if catalogueImage.StartupScript != "" {
+		return catalogueImage.StartupScript
+	}
+	return "/root/docker-" + catalogueImage.Name + "-root-startup.sh"
+}
+
+// readyMarker returns the log line that shows a session from this image is ready to connect to.
+func (catalogueImage *CatalogueImage) readyMarker() string {
+	if catalogueImage.ReadyMarker != "" {
+		return catalogueImage.ReadyMarker
+	}
+	return "Starting VNC server"
+}
+
+// extraMounts returns the image's extra mounts for the given user, with the "{{USERNAME}}" placeholders filled in.
+func (catalogueImage *CatalogueImage) extraMounts(username string) []mount.Mount {
+	var mounts []mount.Mount
+	for _, extraMount := range catalogueImage.Mounts {
+		mounts = append(mounts, mount.Mount{
+			Type:     mount.TypeBind,
+			Source:   strings.ReplaceAll(extraMount.Source, "{{USERNAME}}", username),
+			Target:   strings.ReplaceAll(extraMount.Target, "{{USERNAME}}", username),
+			ReadOnly: extraMount.ReadOnly,
+		})
+	}
+	return mounts
+}
@@ -0,0 +1,243 @@
+// Image upgrades for the Session Manager. Once a user's session container exists it is reused every time they
+// connect, so without this it would carry on running the image it was created from forever, even after the image is
+// rebuilt or the catalogue moves to a new version. Each session container's image ID is compared against the image
+// its catalogue entry currently points to - an outdated session is recreated from the current image the next time it
+// is started (after being stopped), keeping the user's home folder and other bind mounts, which live on the host.
+//
+// The admin panel can also upgrade every idle session in one go, with its progress reported in the status data.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/client"
+)
+
+// A running session used more recently than this isn't idle, so isn't upgraded by "upgrade all idle sessions".
+const upgradeMinIdleTime = 10 * time.Minute
+
+// The result of upgrading one session.
+type UpgradeResult struct {
+	Username string `json:"username"`
+	Image    string `json:"image"`
+	// "upgraded", "skipped" or "failed".
+	Result  string `json:"result"`
+	Message string `json:"message,omitempty"`
+}
+
+// The progress of the most recent "upgrade all idle sessions" run, as reported to the admin panel.
+type UpgradeStatus struct {
+	Running    bool            `json:"running"`
+	StartedAt  time.Time       `json:"startedAt"`
+	FinishedAt time.Time       `json:"finishedAt"`
+	Total      int             `json:"total"`
+	Done       int             `json:"done"`
+	Results    []UpgradeResult `json:"results"`
+}
+
+// UpgradeTracker records the progress of the current (or most recent) upgrade run, protected by a mutex as the run
+// happens in the background while the admin panel polls for its status.
+type UpgradeTracker struct {
+	mu     sync.Mutex
+	status UpgradeStatus
+}
+
+// The global upgrade tracker.
+var sessionUpgrades = &UpgradeTracker{}
+
+// begin starts tracking a new upgrade run of the given number of sessions. Returns false if a run is already going.
+func (ut *UpgradeTracker) begin(total int) bool {
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+	if ut.status.Running {
+		return false
+	}
+	ut.status = UpgradeStatus{Running: true, StartedAt: time.Now(), Total: total}
+	return true
+}
+
+// record adds the result of upgrading one session.
+func (ut *UpgradeTracker) record(result UpgradeResult) {
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+	ut.status.Done = ut.status.Done + 1
+	ut.status.Results = append(ut.status.Results, result)
+}
+
+// finish marks the current upgrade run as finished.
+func (ut *UpgradeTracker) finish() {
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+	ut.status.Running = false
+	ut.status.FinishedAt = time.Now()
+}
+
+// current returns a copy of the progress of the current (or most recent) upgrade run.
+func (ut *UpgradeTracker) current() UpgradeStatus {
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+	currentStatus := ut.status
+	currentStatus.Results = append([]UpgradeResult{}, ut.status.Results...)
+	return currentStatus
+}
+
+// ImageIDCache looks up the ID of the image each catalogue entry currently points to, remembering the answers so a
+// list of sessions can be checked without inspecting the same image over and over. Only used for a single request.
+type ImageIDCache struct {
+	cli      *client.Client
+	config   Config
+	imageIDs map[string]string
+}
+
+// newImageIDCache initialises an empty image ID cache.
+func newImageIDCache(cli *client.Client, config Config) *ImageIDCache {
+	return &ImageIDCache{cli: cli, config: config, imageIDs: make(map[string]string)}
+}
+
+// currentImageID returns the ID of the image the given catalogue entry currently points to, or an empty string if
+// the image isn't in the catalogue or hasn't been built (or pulled) on this host.
+func (ic *ImageIDCache) currentImageID(imageName string) string {
+	if imageID, cached := ic.imageIDs[imageName]; cached {
+		return imageID
+	}
+	imageID := ""
+	if catalogueImage := findCatalogueImage(ic.config, imageName); catalogueImage != nil {
+		inspectResult, inspectErr := ic.cli.ImageInspect(context.Background(), catalogueImage.reference())
+		if inspectErr != nil {
+			log.Println("Error inspecting image " + catalogueImage.reference() + ": " + inspectErr.Error())
+		} else {
+			imageID = inspectResult.ID
+		}
+	}
+	ic.imageIDs[imageName] = imageID
+	return imageID
+}
+
+// isOutdatedImage reports whether a container's image ID differs from the current image ID. If the current image
+// isn't known there is nothing to upgrade to, so the container isn't counted as outdated.
+func isOutdatedImage(containerImageID string, currentImageID string) bool {
+	return currentImageID != "" && containerImageID != currentImageID
+}
+
+// isOutdatedSession reports whether a session container was created from an older image than the one its catalogue
+// entry currently points to.
+func (ic *ImageIDCache) isOutdatedSession(item container.Summary) bool {
+	imageName, _, isSession := sessionFromContainer(item)
+	if !isSession {
+		return false
+	}
+	return isOutdatedImage(item.ImageID, ic.currentImageID(imageName))
+}
+
+// removeSessionContainer removes a session container, so the next start creates a new one. Only a stopped container
+// is removed, unless force is set. The user's files are in bind-mounted folders on the host, so aren't affected. The
+// session's own network (if it is isolated) is removed along with it, as nothing else uses it - the next start
+// creates it again.
+func removeSessionContainer(cli *client.Client, item container.Summary, force bool) error {
+	if _, removeErr := cli.ContainerRemove(context.Background(), item.ID, client.ContainerRemoveOptions{Force: force}); removeErr != nil {
+		return removeErr
+	}
+	if networkErr := removeSessionNetwork(cli, containerNetwork(item)); networkErr != nil {
+		log.Println("Error removing network " + containerNetwork(item) + ": " + networkErr.Error())
+	}
+	return nil
+}
+
+// upgradeSession upgrades a single outdated session, if it is idle. A stopped session's container is removed, to be
+// recreated from the current image when the user next connects. An idle running session is stopped, removed and
+// started again from the current image (via the start coordinator, so a user connecting at the same moment waits for
+// the upgrade rather than racing it). Hibernated sessions, and sessions in use, are skipped, as upgrading them would
+// close the user's open windows. So is a session its user was already starting. Sessions started again are recorded
+// in the audit log as started by startedBy.
+func upgradeSession(cli *client.Client, config Config, randomSeed []byte, item container.Summary, startedBy AuditActor) UpgradeResult {
+	imageName, username, _ := sessionFromContainer(item)
+	result := UpgradeResult{Username: username, Image: imageName}
+
+	switch item.State {
+	case "paused":
+		result.Result = "skipped"
+		result.Message = "Session is hibernated"
+		return result
+	case "running":
+		connectionCount, connectionErr := countSessionConnections(cli, item.ID)
+		if connectionErr != nil {
+			result.Result = "failed"
+			result.Message = "Error checking connections: " + connectionErr.Error()
+			return result
+		}
+		lastActivity, seen := sessionActivity.lastSeen(imageName, username)
+		if connectionCount > 0 || (seen && time.Since(lastActivity) < upgradeMinIdleTime) {
+			result.Result = "skipped"
+			result.Message = "Session is in use"
+			return result
+		}
+		upgradeErr, joined := sessionStarts.start(imageName, username, startTimeout(config), func() string {
+			if _, stopErr := cli.ContainerStop(context.Background(), item.ID, client.ContainerStopOptions{}); stopErr != nil {
+				return "Error stopping container: " + stopErr.Error()
+			}
+			if removeErr := removeSessionContainer(cli, item, false); removeErr != nil {
+				return "Error removing container: " + removeErr.Error()
+			}
+			return createOrStartSession(cli, config, randomSeed, username, imageName, startedBy)
+		})
+		// If the user started the session at the same moment, we waited for their start instead, and the old
+		// container is left as it was.
+		if joined {
+			result.Result = "skipped"
+			result.Message = "Start in progress"
+			return result
+		}
+		if upgradeErr != "" {
+			result.Result = "failed"
+			result.Message = upgradeErr
+			return result
+		}
+		result.Result = "upgraded"
+		return result
+	default:
+		if removeErr := removeSessionContainer(cli, item, false); removeErr != nil {
+			result.Result = "failed"
+			result.Message = "Error removing container: " + removeErr.Error()
+			return result
+		}
+		result.Result = "upgraded"
+		result.Message = "Will be recreated when next started"
+		return result
+	}
+}
+
+// upgradeIdleSessions finds every outdated session and upgrades the idle ones, one at a time, recording progress in
+// the upgrade tracker and the audit log. Returns false if an upgrade run is already in progress; otherwise the
+// upgrades carry on in the background after it returns.
+func upgradeIdleSessions(cli *client.Client, config Config, randomSeed []byte, startedBy AuditActor) (bool, error) {
+	containers, containersErr := cli.ContainerList(context.Background(), client.ContainerListOptions{All: true})
+	if containersErr != nil {
+		return false, containersErr
+	}
+	imageIDs := newImageIDCache(cli, config)
+	var outdatedSessions []container.Summary
+	for _, item := range containers.Items {
+		if imageIDs.isOutdatedSession(item) {
+			outdatedSessions = append(outdatedSessions, item)
+		}
+	}
+	if !sessionUpgrades.begin(len(outdatedSessions)) {
+		return false, nil
+	}
+	go func() {
+		defer sessionUpgrades.finish()
+		for _, item := range outdatedSessions {
+			result := upgradeSession(cli, config, randomSeed, item, startedBy)
+			fmt.Println("Upgrade of " + result.Image + " session for user " + result.Username + ": " + result.Result + " " + result.Message)
+			sessionUpgrades.record(result)
+			sessionAudit.record(AuditEvent{Action: "session-upgrade", Actor: startedBy.Name, Target: result.Username, Image: result.Image, Source: startedBy.Source, Result: result.Result, Detail: result.Message})
+		}
+	}()
+	return true, nil
+}
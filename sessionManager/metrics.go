@@ -0,0 +1,289 @@
+// Prometheus metrics for the Session Manager. The "/metrics" endpoint reports session counts, session start times and
+// failures, auto-start attempts, rclone mount status and host memory and disk use in the Prometheus text exposition
+// format, so the Session Manager can be monitored (and alerted on) alongside everything else. The format is simple
+// enough that we write it out directly rather than pulling in the Prometheus client library.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moby/moby/client"
+)
+
+// The upper bounds, in seconds, of the session start time histogram buckets. Starting an existing container takes a
+// second or two, creating a new one with cloud storage mounts can take a minute or more.
+var startDurationBuckets = []float64{1, 2, 5, 10, 20, 30, 60, 120, 300}
+
+// A histogram of session start times.
+type LatencyHistogram struct {
+	// The number of observations in each bucket, not cumulative - made cumulative when written out.
+	bucketCounts []uint64
+	sum          float64
+	count        uint64
+}
+
+// observe records a single observation, in seconds.
+func (lh *LatencyHistogram) observe(seconds float64) {
+	if lh.bucketCounts == nil {
+		lh.bucketCounts = make([]uint64, len(startDurationBuckets))
+	}
+	for index, upperBound := range startDurationBuckets {
+		if seconds <= upperBound {
+			lh.bucketCounts[index] = lh.bucketCounts[index] + 1
+			break
+		}
+	}
+	lh.sum = lh.sum + seconds
+	lh.count = lh.count + 1
+}
+
+// A pair of label values identifying a counter - the image, and the failure reason or auto-start result.
+type counterLabels struct {
+	image string
+	value string
+}
+
+// SessionMetrics holds the metrics that are counted as things happen, rather than read when "/metrics" is called.
+// Protected by a mutex, as sessions are started from many goroutines.
+type SessionMetrics struct {
+	mu                sync.Mutex
+	startDurations    map[string]*LatencyHistogram
+	startFailures     map[counterLabels]uint64
+	autoStartAttempts map[counterLabels]uint64
+}
+
+// newSessionMetrics initialises a set of metrics with nothing counted yet.
+func newSessionMetrics() *SessionMetrics {
+	return &SessionMetrics{
+		startDurations:    make(map[string]*LatencyHistogram),
+		startFailures:     make(map[counterLabels]uint64),
+		autoStartAttempts: make(map[counterLabels]uint64),
+	}
+}
+
+// The global session metrics.
+var sessionMetrics = newSessionMetrics()
+
+// recordStart records how long a session start took and, if it failed, the reason - the startup state it had got to
+// when it failed (for instance "mounting-rclone", or "queued" if it never got out of the admission queue).
+func (sm *SessionMetrics) recordStart(imageName string, duration time.Duration, failureReason string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if sm.startDurations[imageName] == nil {
+		sm.startDurations[imageName] = &LatencyHistogram{}
+	}
+	sm.startDurations[imageName].observe(duration.Seconds())
+	if failureReason != "" {
+		sm.startFailures[counterLabels{image: imageName, value: failureReason}]++
+	}
+}
+
+// recordAutoStart records an attempt to start (or restart) an auto-start session, and whether it worked.
+func (sm *SessionMetrics) recordAutoStart(imageName string, succeeded bool) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	result := "failure"
+	if succeeded {
+		result = "success"
+	}
+	sm.autoStartAttempts[counterLabels{image: imageName, value: result}]++
+}
+
+// startFailureReason works out why a session start failed, from the startup states it got through - the last state
+// reached is the step that failed.
+func startFailureReason(events []StartupEvent) string {
+	if len(events) == 0 {
+		return "starting"
+	}
+	return events[len(events)-1].State
+}
+
+// A single sample of a metric - its labels (already formatted, or empty for none) and value.
+type metricSample struct {
+	labels string
+	value  float64
+}
+
+// escapeLabelValue escapes a label value for the text exposition format.
+func escapeLabelValue(labelValue string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labelValue)
+}
+
+// formatLabels formats label names and values, given as name, value, name, value..., as "{name="value",...}".
+func formatLabels(namesAndValues ...string) string {
+	var labelPairs []string
+	for index := 0; index+1 < len(namesAndValues); index = index + 2 {
+		labelPairs = append(labelPairs, namesAndValues[index]+`="`+escapeLabelValue(namesAndValues[index+1])+`"`)
+	}
+	return "{" + strings.Join(labelPairs, ",") + "}"
+}
+
+// formatValue formats a metric value, using the shortest representation that round-trips.
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// writeMetric writes out one metric, with its help text and type, and its samples sorted by label.
+func writeMetric(metricsOutput io.Writer, name string, help string, metricType string, samples []metricSample) {
+	fmt.Fprintf(metricsOutput, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+	sort.Slice(samples, func(i, j int) bool { return samples[i].labels < samples[j].labels })
+	for _, sample := range samples {
+		fmt.Fprintf(metricsOutput, "%s%s %s\n", name, sample.labels, formatValue(sample.value))
+	}
+}
+
+// writeCountedMetrics writes out the session start histograms and the failure and auto-start counters.
+func (sm *SessionMetrics) writeCountedMetrics(metricsOutput io.Writer) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	histogramName := "puws_session_start_duration_seconds"
+	fmt.Fprintf(metricsOutput, "# HELP %s Time taken to start (or create) a session, including any time queued.\n# TYPE %s histogram\n", histogramName, histogramName)
+	var imageNames []string
+	for imageName := range sm.startDurations {
+		imageNames = append(imageNames, imageName)
+	}
+	sort.Strings(imageNames)
+	for _, imageName := range imageNames {
+		histogram := sm.startDurations[imageName]
+		var cumulativeCount uint64 = 0
+		for index, upperBound := range startDurationBuckets {
+			cumulativeCount = cumulativeCount + histogram.bucketCounts[index]
+			fmt.Fprintf(metricsOutput, "%s_bucket%s %d\n", histogramName, formatLabels("image", imageName, "le", formatValue(upperBound)), cumulativeCount)
+		}
+		fmt.Fprintf(metricsOutput, "%s_bucket%s %d\n", histogramName, formatLabels("image", imageName, "le", "+Inf"), histogram.count)
+		fmt.Fprintf(metricsOutput, "%s_sum%s %s\n", histogramName, formatLabels("image", imageName), formatValue(histogram.sum))
+		fmt.Fprintf(metricsOutput, "%s_count%s %d\n", histogramName, formatLabels("image", imageName), histogram.count)
+	}
+
+	var failureSamples []metricSample
+	for labels, count := range sm.startFailures {
+		failureSamples = append(failureSamples, metricSample{labels: formatLabels("image", labels.image, "reason", labels.value), value: float64(count)})
+	}
+	writeMetric(metricsOutput, "puws_session_start_failures_total", "Session starts that failed, by the startup state reached when they failed.", "counter", failureSamples)
+
+	var autoStartSamples []metricSample
+	for labels, count := range sm.autoStartAttempts {
+		autoStartSamples = append(autoStartSamples, metricSample{labels: formatLabels("image", labels.image, "result", labels.value), value: float64(count)})
+	}
+	writeMetric(metricsOutput, "puws_autostart_attempts_total", "Attempts to start auto-start sessions that weren't running, including retries.", "counter", autoStartSamples)
+}
+
+// readMountPoints returns the set of mount points listed in /proc/mounts.
+func readMountPoints() (map[string]bool, error) {
+	mountsFile, openErr := os.Open("/proc/mounts")
+	if openErr != nil {
+		return nil, openErr
+	}
+	defer mountsFile.Close()
+	mountPoints := make(map[string]bool)
+	mountsScanner := bufio.NewScanner(mountsFile)
+	for mountsScanner.Scan() {
+		// Each line looks like "rclone-remote: /home/jane.doe/drive fuse.rclone rw,... 0 0".
+		mountFields := strings.Fields(mountsScanner.Text())
+		if len(mountFields) >= 2 {
+			mountPoints[mountFields[1]] = true
+		}
+	}
+	return mountPoints, mountsScanner.Err()
+}
+
+// writeRcloneMountMetrics writes out the state of each rclone mount the mount supervisor looks after - both those
+// from the config file and the remotes users set up themselves - and how many times each has been restarted.
+func writeRcloneMountMetrics(metricsOutput io.Writer, mountStatuses map[string][]MountStatus) {
+	var upSamples, stateSamples, restartSamples []metricSample
+	for username, userMounts := range mountStatuses {
+		for _, mountStatus := range userMounts {
+			mountLabels := []string{"username", username, "mountpoint", mountStatus.Local, "remote", mountStatus.Remote}
+			mountUp := 0.0
+			if mountStatus.State == mountMounted {
+				mountUp = 1
+			}
+			upSamples = append(upSamples, metricSample{labels: formatLabels(mountLabels...), value: mountUp})
+			// One sample per state, 1 for the mount's current state and 0 for the others, so a change of state
+			// doesn't start a new series.
+			for _, state := range []string{mountStarting, mountMounted, mountFailed} {
+				inState := 0.0
+				if mountStatus.State == state {
+					inState = 1
+				}
+				stateSamples = append(stateSamples, metricSample{labels: formatLabels(append(mountLabels, "state", state)...), value: inState})
+			}
+			restartSamples = append(restartSamples, metricSample{labels: formatLabels(mountLabels...), value: float64(mountStatus.Restarts)})
+		}
+	}
+	writeMetric(metricsOutput, "puws_rclone_mount_up", "Whether each supervised rclone mount is mounted (1) or not (0).", "gauge", upSamples)
+	writeMetric(metricsOutput, "puws_rclone_mount_state", "The state of each supervised rclone mount - 1 for its current state (starting, mounted or failed), 0 for the others.", "gauge", stateSamples)
+	writeMetric(metricsOutput, "puws_rclone_mount_restarts_total", "The number of times each supervised rclone mount has been restarted after failing.", "counter", restartSamples)
+}
+
+// writeMetrics writes out every metric, in the Prometheus text exposition format.
+func writeMetrics(metricsOutput io.Writer, cli *client.Client, config Config) error {
+	containers, containersErr := cli.ContainerList(context.Background(), client.ContainerListOptions{All: true})
+	if containersErr != nil {
+		return containersErr
+	}
+	memTotal, memAvailable, swapTotal, swapFree, memErr := readMemoryInfo()
+	if memErr != nil {
+		return memErr
+	}
+	diskTotal, diskAvailable, diskErr := readDiskInfo()
+	if diskErr != nil {
+		return diskErr
+	}
+	// Session counts, by image and container state.
+	sessionCounts := make(map[counterLabels]int)
+	for _, item := range containers.Items {
+		imageName, _, isSession := sessionFromContainer(item)
+		if !isSession {
+			continue
+		}
+		sessionCounts[counterLabels{image: imageName, value: string(item.State)}]++
+	}
+	var sessionSamples []metricSample
+	for labels, count := range sessionCounts {
+		sessionSamples = append(sessionSamples, metricSample{labels: formatLabels("image", labels.image, "state", labels.value), value: float64(count)})
+	}
+
+	writeMetric(metricsOutput, "puws_sessions", "User sessions (containers), by image and container state.", "gauge", sessionSamples)
+	writeMetric(metricsOutput, "puws_session_queue_length", "Session starts waiting in the admission queue.", "gauge", []metricSample{{labels: "", value: float64(len(sessionAdmissions.entries()))}})
+	sessionMetrics.writeCountedMetrics(metricsOutput)
+	writeRcloneMountMetrics(metricsOutput, rcloneMounts.statuses())
+	writeMetric(metricsOutput, "puws_host_memory_total_bytes", "Total memory on the host.", "gauge", []metricSample{{value: float64(memTotal * 1024)}})
+	writeMetric(metricsOutput, "puws_host_memory_available_bytes", "Memory available on the host (MemAvailable).", "gauge", []metricSample{{value: float64(memAvailable * 1024)}})
+	writeMetric(metricsOutput, "puws_host_swap_total_bytes", "Total swap space on the host.", "gauge", []metricSample{{value: float64(swapTotal * 1024)}})
+	writeMetric(metricsOutput, "puws_host_swap_free_bytes", "Free swap space on the host.", "gauge", []metricSample{{value: float64(swapFree * 1024)}})
+	writeMetric(metricsOutput, "puws_host_disk_total_bytes", "Total size of the host's root filesystem.", "gauge", []metricSample{{value: float64(diskTotal)}})
+	writeMetric(metricsOutput, "puws_host_disk_available_bytes", "Space available on the host's root filesystem.", "gauge", []metricSample{{value: float64(diskAvailable)}})
+	var diskUsageSamples []metricSample
+	for _, usage := range diskUsage.all(config) {
+		diskUsageSamples = append(diskUsageSamples,
+			metricSample{labels: formatLabels("username", usage.Username, "folder", "home"), value: float64(usage.Home)},
+			metricSample{labels: formatLabels("username", usage.Username, "folder", "www"), value: float64(usage.WWW)},
+			metricSample{labels: formatLabels("username", usage.Username, "folder", "tasks"), value: float64(usage.Tasks)})
+	}
+	writeMetric(metricsOutput, "puws_user_disk_usage_bytes", "Disk space used by each user's folders, as last counted.", "gauge", diskUsageSamples)
+	return nil
+}
+
+// isValidMetricsToken checks the bearer token presented by a caller (the Prometheus server) against the metrics token
+// in the config file. If no token is set, the metrics endpoint is disabled - fail closed.
+func isValidMetricsToken(r *http.Request, metricsToken string) bool {
+	if metricsToken == "" {
+		return false
+	}
+	token := requestToken(r)
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(metricsToken)) == 1
+}
@@ -0,0 +1,425 @@
+// Bulk user provisioning for the Session Manager. Host accounts are otherwise created the first time a user
+// connects, which is slow for a whole class logging in at once and leaves UIDs to chance. Provisioning takes a CSV
+// file of users - username, display name, groups and image - and sets each user up in advance: their host account
+// (with a UID from a range set in the config file), their www and Web Console tasks folders, and optionally an
+// auto-start entry for their session.
+//
+// Provisioning is idempotent: users already set up as the CSV file says are skipped, and only what differs is
+// changed, so the same file can be provisioned again after adding new users to it. Each user's outcome (created,
+// changed, skipped or failed, with what was done) is reported back. Provisioning can be run from the command line
+// ("-provision users.csv") or through the "/admin/provision" endpoint.
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The range of UIDs given to new host accounts, if not set in the config file - well clear of the UIDs Debian gives
+// to system accounts and to people who log in to the host itself.
+const (
+	defaultMinUID = 10000
+	defaultMaxUID = 59999
+)
+
+// The host's list of accounts.
+const passwdPath = "/etc/passwd"
+
+// The usernames and group names useradd and groupadd accept.
+var accountNamePattern = regexp.MustCompile(`^[a-z_][a-z0-9_.-]{0,31}$`)
+
+// The outcomes of provisioning one user.
+const (
+	provisionCreated = "created"
+	provisionChanged = "changed"
+	provisionSkipped = "skipped"
+	provisionFailed  = "failed"
+)
+
+// Host accounts are created one at a time, so two accounts can't be given the same UID.
+var hostAccountsMu sync.Mutex
+
+// The provisioning settings from the config file.
+type ProvisioningConfig struct {
+	// The range of UIDs (inclusive) given to new host accounts. Defaults to 10000 to 59999.
+	MinUID int `yaml:"minUid"`
+	MaxUID int `yaml:"maxUid"`
+}
+
+// A user to provision, from one line of the CSV file.
+type ProvisionEntry struct {
+	Line        int
+	Username    string
+	DisplayName string
+	Groups      []string
+	Image       string
+	AutoStart   bool
+}
+
+// The outcome of provisioning one user.
+type ProvisionResult struct {
+	Line     int      `json:"line"`
+	Username string   `json:"username"`
+	Result   string   `json:"result"`
+	Changes  []string `json:"changes,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// A host account, from the passwd file.
+type PasswdEntry struct {
+	Username    string
+	UID         int
+	GID         int
+	DisplayName string
+}
+
+// uidRange returns the range of UIDs given to new host accounts.
+func uidRange(provisioningConfig ProvisioningConfig) (int, int) {
+	minUID, maxUID := defaultMinUID, defaultMaxUID
+	if provisioningConfig.MinUID > 0 {
+		minUID = provisioningConfig.MinUID
+	}
+	if provisioningConfig.MaxUID > 0 {
+		maxUID = provisioningConfig.MaxUID
+	}
+	return minUID, maxUID
+}
+
+// readPasswd reads the host accounts from a passwd file, by username.
+func readPasswd(path string) (map[string]PasswdEntry, error) {
+	passwdFile, openErr := os.Open(path)
+	if openErr != nil {
+		return nil, openErr
+	}
+	defer passwdFile.Close()
+	accounts := make(map[string]PasswdEntry)
+	passwdScanner := bufio.NewScanner(passwdFile)
+	for passwdScanner.Scan() {
+		fields := strings.Split(passwdScanner.Text(), ":")
+		if len(fields) < 7 {
+			continue
+		}
+		uid, uidErr := strconv.Atoi(fields[2])
+		if uidErr != nil {
+			continue
+		}
+		gid, _ := strconv.Atoi(fields[3])
+		displayName, _, _ := strings.Cut(fields[4], ",")
+		accounts[fields[0]] = PasswdEntry{Username: fields[0], UID: uid, GID: gid, DisplayName: displayName}
+	}
+	return accounts, passwdScanner.Err()
+}
+
+// nextFreeUID returns the lowest UID in the range that no account is using.
+func nextFreeUID(accounts map[string]PasswdEntry, minUID int, maxUID int) (int, error) {
+	usedUIDs := make(map[int]bool)
+	for _, account := range accounts {
+		usedUIDs[account.UID] = true
+	}
+	for uid := minUID; uid <= maxUID; uid++ {
+		if !usedUIDs[uid] {
+			return uid, nil
+		}
+	}
+	return 0, errors.New("No free UIDs left between " + strconv.Itoa(minUID) + " and " + strconv.Itoa(maxUID))
+}
+
+// createHostAccount creates a host account for a user, with the next free UID in the configured range. Used both by
+// provisioning and when a user who hasn't been provisioned first starts a session. Returns an error message, or ""
+// on success (including when the account already exists).
+func createHostAccount(config Config, username string, displayName string) string {
+	hostAccountsMu.Lock()
+	defer hostAccountsMu.Unlock()
+	accounts, passwdErr := readPasswd(passwdPath)
+	if passwdErr != nil {
+		return "Error reading " + passwdPath + ": " + passwdErr.Error()
+	}
+	if _, exists := accounts[username]; exists {
+		return ""
+	}
+	minUID, maxUID := uidRange(config.Provisioning)
+	uid, uidErr := nextFreeUID(accounts, minUID, maxUID)
+	if uidErr != nil {
+		return uidErr.Error()
+	}
+	useraddArgs := []string{"-m", "-s", "/bin/bash", "-u", strconv.Itoa(uid)}
+	if displayName != "" {
+		useraddArgs = append(useraddArgs, "-c", displayName)
+	}
+	useraddOutput := runShellCommand("useradd", append(useraddArgs, username)...)
+	if _, lookupErr := user.Lookup(username); lookupErr != nil {
+		return useraddOutput
+	}
+	return ""
+}
+
+// parseProvisionCSV reads the users to provision from a CSV file. The first line names the columns: "username"
+// (required), "display name", "groups" (separated by semicolons or spaces), "image" and "autostart" ("yes" to add
+// an auto-start entry for the user's image), in any order.
+func parseProvisionCSV(csvInput io.Reader) ([]ProvisionEntry, error) {
+	csvReader := csv.NewReader(csvInput)
+	csvReader.FieldsPerRecord = -1
+	csvReader.TrimLeadingSpace = true
+	headings, headingsErr := csvReader.Read()
+	if headingsErr == io.EOF {
+		return nil, errors.New("The CSV file is empty")
+	}
+	if headingsErr != nil {
+		return nil, errors.New("Error reading CSV: " + headingsErr.Error())
+	}
+	columns := make(map[string]int)
+	for index, heading := range headings {
+		heading = strings.ToLower(strings.Join(strings.Fields(heading), ""))
+		switch heading {
+		case "displayname", "name":
+			heading = "displayname"
+		case "group":
+			heading = "groups"
+		}
+		columns[heading] = index
+	}
+	if _, hasUsername := columns["username"]; !hasUsername {
+		return nil, errors.New("The CSV file has no \"username\" column")
+	}
+	field := func(record []string, column string) string {
+		if index, exists := columns[column]; exists && index < len(record) {
+			return strings.TrimSpace(record[index])
+		}
+		return ""
+	}
+	var entries []ProvisionEntry
+	for {
+		record, readErr := csvReader.Read()
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return nil, errors.New("Error reading CSV: " + readErr.Error())
+		}
+		if field(record, "username") == "" {
+			continue
+		}
+		line, _ := csvReader.FieldPos(0)
+		autoStart := strings.ToLower(field(record, "autostart"))
+		entries = append(entries, ProvisionEntry{
+			Line:        line,
+			Username:    field(record, "username"),
+			DisplayName: field(record, "displayname"),
+			Groups:      strings.FieldsFunc(field(record, "groups"), func(r rune) bool { return r == ';' || r == ' ' }),
+			Image:       field(record, "image"),
+			AutoStart:   autoStart == "yes" || autoStart == "true" || autoStart == "1",
+		})
+	}
+	return entries, nil
+}
+
+// checkProvisionEntry checks a user to provision, returning an error message, or "" if the entry is valid.
+func checkProvisionEntry(config Config, entry ProvisionEntry) string {
+	if !accountNamePattern.MatchString(entry.Username) {
+		return "Invalid username \"" + entry.Username + "\" - use lower case letters, numbers, \".\", \"_\" and \"-\""
+	}
+	if strings.ContainsAny(entry.DisplayName, ":,\n") {
+		return "The display name can't contain \":\" or \",\""
+	}
+	for _, group := range entry.Groups {
+		if !accountNamePattern.MatchString(group) {
+			return "Invalid group name \"" + group + "\""
+		}
+	}
+	if entry.Image != "" && findCatalogueImage(config, entry.Image) == nil {
+		return "Unknown image \"" + entry.Image + "\" - available images are: " + strings.Join(catalogueImageNames(config), ", ")
+	}
+	if entry.AutoStart && entry.Image == "" {
+		return "An auto-start entry needs an image"
+	}
+	return ""
+}
+
+// supplementaryGroups returns the groups a host account is in, other than its own primary group, sorted.
+func supplementaryGroups(username string) []string {
+	hostUser, lookupErr := user.Lookup(username)
+	if lookupErr != nil {
+		return nil
+	}
+	primaryGroup, _ := user.LookupGroupId(hostUser.Gid)
+	var groups []string
+	for _, group := range userGroups(username) {
+		if primaryGroup == nil || group != primaryGroup.Name {
+			groups = append(groups, group)
+		}
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+// provisionUser sets up one user as the CSV file describes, returning what was done and the (possibly updated)
+// auto-start list.
+func provisionUser(config Config, entry ProvisionEntry, autoStartSessions []AutoStartEntry) (ProvisionResult, []AutoStartEntry) {
+	result := ProvisionResult{Line: entry.Line, Username: entry.Username, Result: provisionSkipped}
+	fail := func(message string) (ProvisionResult, []AutoStartEntry) {
+		result.Result = provisionFailed
+		result.Error = message
+		return result, autoStartSessions
+	}
+	if checkErr := checkProvisionEntry(config, entry); checkErr != "" {
+		return fail(checkErr)
+	}
+
+	// The groups the user should be in have to exist before the account can be added to them.
+	for _, group := range entry.Groups {
+		if _, lookupErr := user.LookupGroup(group); lookupErr != nil {
+			groupaddOutput := runShellCommand("groupadd", group)
+			if _, lookupErr := user.LookupGroup(group); lookupErr != nil {
+				return fail("Error creating group " + group + ": " + groupaddOutput)
+			}
+			result.Changes = append(result.Changes, "created group "+group)
+		}
+	}
+
+	// The host account, with the display name and groups from the CSV file. Existing accounts keep their UID, and
+	// keep their groups if the CSV file doesn't list any.
+	accounts, passwdErr := readPasswd(passwdPath)
+	if passwdErr != nil {
+		return fail("Error reading " + passwdPath + ": " + passwdErr.Error())
+	}
+	account, accountExists := accounts[entry.Username]
+	if !accountExists {
+		if createErr := createHostAccount(config, entry.Username, entry.DisplayName); createErr != "" {
+			return fail("Error creating host account: " + createErr)
+		}
+		result.Result = provisionCreated
+		result.Changes = append(result.Changes, "created host account")
+	} else if entry.DisplayName != "" && account.DisplayName != entry.DisplayName {
+		usermodOutput := runShellCommand("usermod", "-c", entry.DisplayName, entry.Username)
+		if updated, _ := readPasswd(passwdPath); updated[entry.Username].DisplayName != entry.DisplayName {
+			return fail("Error setting display name: " + usermodOutput)
+		}
+		result.Changes = append(result.Changes, "display name \""+account.DisplayName+"\" -> \""+entry.DisplayName+"\"")
+	}
+	if len(entry.Groups) > 0 {
+		wantedGroups := append([]string{}, entry.Groups...)
+		sort.Strings(wantedGroups)
+		currentGroups := supplementaryGroups(entry.Username)
+		if strings.Join(currentGroups, ",") != strings.Join(wantedGroups, ",") {
+			usermodOutput := runShellCommand("usermod", "-G", strings.Join(wantedGroups, ","), entry.Username)
+			if strings.Join(supplementaryGroups(entry.Username), ",") != strings.Join(wantedGroups, ",") {
+				return fail("Error setting groups: " + usermodOutput)
+			}
+			result.Changes = append(result.Changes, "groups ["+strings.Join(currentGroups, ", ")+"] -> ["+strings.Join(wantedGroups, ", ")+"]")
+		}
+	}
+
+	// The folders mounted into the user's sessions.
+	hostUser, lookupErr := user.Lookup(entry.Username)
+	if lookupErr != nil {
+		return fail("Error looking up host account: " + lookupErr.Error())
+	}
+	userUID, _ := strconv.Atoi(hostUser.Uid)
+	userGID, _ := strconv.Atoi(hostUser.Gid)
+	for _, folder := range []string{wwwFoldersRoot + "/" + entry.Username, tasksFoldersRoot + "/" + entry.Username} {
+		if _, statErr := os.Stat(folder); os.IsNotExist(statErr) {
+			if mkdirErr := mkdirChown(folder, userUID, userGID); mkdirErr != "" {
+				return fail(mkdirErr)
+			}
+			result.Changes = append(result.Changes, "created folder "+folder)
+		}
+	}
+
+	// The user's session, if it should be started automatically. The image has to be one the user's groups allow.
+	if entry.Image != "" {
+		if _, imageErr := checkImageAllowed(config, entry.Image, entry.Username); imageErr != nil {
+			return fail(imageErr.Error())
+		}
+	}
+	if entry.AutoStart && !isAutoStartSession(autoStartSessions, entry.Image, entry.Username) {
+		autoStartSessions = append(autoStartSessions, AutoStartEntry{Username: entry.Username, Image: entry.Image})
+		result.Changes = append(result.Changes, "added auto-start entry for "+entry.Image)
+	}
+
+	if result.Result == provisionSkipped && len(result.Changes) > 0 {
+		result.Result = provisionChanged
+	}
+	return result, autoStartSessions
+}
+
+// provisionUsers provisions each user in turn, adding any new auto-start entries to the list once at the end. A long
+// run can take a while, so the entries are added to the list as it is then, not as it was at the start - anything an
+// admin changed in the meantime is kept.
+func provisionUsers(config Config, entries []ProvisionEntry) ([]ProvisionResult, error) {
+	autoStartSessions, autoStartErr := loadAutoStart()
+	if autoStartErr != nil {
+		return nil, errors.New("Error reading auto-start list: " + autoStartErr.Error())
+	}
+	autoStartCount := len(autoStartSessions)
+	var results []ProvisionResult
+	for _, entry := range entries {
+		var result ProvisionResult
+		result, autoStartSessions = provisionUser(config, entry, autoStartSessions)
+		if result.Result != provisionSkipped {
+			fmt.Println("Provisioning user " + entry.Username + ": " + result.Result + " " + strings.Join(result.Changes, ", ") + result.Error)
+		}
+		results = append(results, result)
+	}
+	if len(autoStartSessions) != autoStartCount {
+		addedSessions := autoStartSessions[autoStartCount:]
+		saveErr := updateAutoStart(func(currentSessions []AutoStartEntry) []AutoStartEntry {
+			for _, entry := range addedSessions {
+				if !isAutoStartSession(currentSessions, entry.Image, entry.Username) {
+					currentSessions = append(currentSessions, entry)
+				}
+			}
+			return currentSessions
+		})
+		if saveErr != nil {
+			return results, errors.New("Error saving auto-start list: " + saveErr.Error())
+		}
+	}
+	return results, nil
+}
+
+// provisionFromFile provisions the users in a CSV file, from the command line, printing a report. Returns false if
+// any user couldn't be provisioned.
+func provisionFromFile(config Config, csvPath string) bool {
+	csvFile, openErr := os.Open(csvPath)
+	if openErr != nil {
+		fmt.Println("Error opening " + csvPath + ": " + openErr.Error())
+		return false
+	}
+	defer csvFile.Close()
+	entries, parseErr := parseProvisionCSV(csvFile)
+	if parseErr != nil {
+		fmt.Println(parseErr.Error())
+		return false
+	}
+	results, provisionErr := provisionUsers(config, entries)
+	succeeded := provisionErr == nil
+	counts := make(map[string]int)
+	for _, result := range results {
+		counts[result.Result]++
+		line := "line " + strconv.Itoa(result.Line) + ", " + result.Username + ": " + result.Result
+		if len(result.Changes) > 0 {
+			line = line + " (" + strings.Join(result.Changes, ", ") + ")"
+		}
+		if result.Error != "" {
+			line = line + " - " + result.Error
+			succeeded = false
+		}
+		fmt.Println(line)
+	}
+	if provisionErr != nil {
+		fmt.Println(provisionErr.Error())
+	}
+	fmt.Printf("%d created, %d changed, %d skipped, %d failed.\n", counts[provisionCreated], counts[provisionChanged], counts[provisionSkipped], counts[provisionFailed])
+	return succeeded
+}
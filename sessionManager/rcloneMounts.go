@@ -0,0 +1,487 @@
+// The rclone mount supervisor for the Session Manager. Each cloud storage folder mounted into a user's session is an
+// "rclone mount" process running on the host. The supervisor owns those processes: it waits (for a limited time) for
+// each mount to appear before carrying on with the session start, checks every running mount is still healthy,
+// restarts mounts that crash or hang (backing off if they keep failing), and unmounts a user's folders once they have
+// no session running. The state of each mount is reported to the admin panel via "/admin/status".
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/moby/moby/client"
+)
+
+// How long to wait for a mount to appear, if not set in the config file.
+const defaultRcloneMountTimeout = 60 * time.Second
+
+// How long to wait for "rclone mkdir" to create the remote folder.
+const rcloneMkdirTimeout = 30 * time.Second
+
+// The interval between mount health checks.
+const mountCheckInterval = 15 * time.Second
+
+// How long a mounted folder has to respond to a directory listing before the mount is counted as hung.
+const mountResponseTimeout = 10 * time.Second
+
+// The wait before restarting a failed mount starts at the minimum, and doubles each time it fails again (up to the
+// maximum). It goes back to the minimum once a mount has stayed up for longer than the maximum.
+const mountMinBackoff = 5 * time.Second
+const mountMaxBackoff = 5 * time.Minute
+
+// How long rclone is given to unmount and exit cleanly when asked, before it is killed.
+const rcloneStopTimeout = 10 * time.Second
+
+// The states of a supervised mount.
+const (
+	mountStarting = "starting"
+	mountMounted  = "mounted"
+	// The mount failed, or crashed - it will be restarted after a wait.
+	mountFailed = "failed"
+)
+
+// An rclone mount for a user, with the placeholders filled in.
+type RcloneMountSpec struct {
+	// The user whose session the mount is for.
+	Username string
+	// The Google Workspace user to impersonate, if any.
+	Impersonate string
+	Remote      string
+	Local       string
+	UID         int
+	GID         int
+	// For a remote the user set up themselves, the user's own rclone config file. The rclone process runs as the
+	// user, so it can only read what the user could, and the remote's root folder is mounted as it is.
+	UserConfig string
+}
+
+// The state of a supervised mount, as reported to the admin panel.
+type MountStatus struct {
+	Username string    `json:"username"`
+	Local    string    `json:"local"`
+	Remote   string    `json:"remote"`
+	State    string    `json:"state"`
+	Since    time.Time `json:"since"`
+	Restarts int       `json:"restarts"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// The last part of a process's output, kept to explain why it failed. Protected by a mutex, as the process writes
+// to it while we read it.
+type OutputTail struct {
+	mu     sync.Mutex
+	output []byte
+}
+
+// The number of bytes of output kept.
+const outputTailSize = 2048
+
+// Write keeps the last outputTailSize bytes written.
+func (ot *OutputTail) Write(data []byte) (int, error) {
+	ot.mu.Lock()
+	defer ot.mu.Unlock()
+	ot.output = append(ot.output, data...)
+	if len(ot.output) > outputTailSize {
+		ot.output = ot.output[len(ot.output)-outputTailSize:]
+	}
+	return len(data), nil
+}
+
+// lastLine returns the last non-blank line of output.
+func (ot *OutputTail) lastLine() string {
+	ot.mu.Lock()
+	defer ot.mu.Unlock()
+	outputLines := strings.Split(strings.TrimSpace(string(ot.output)), "\n")
+	return strings.TrimSpace(outputLines[len(outputLines)-1])
+}
+
+// A single supervised mount - the rclone process serving it, and its state.
+type SupervisedMount struct {
+	spec    RcloneMountSpec
+	process *exec.Cmd
+	// Closed when the rclone process exits.
+	exited  chan struct{}
+	output  *OutputTail
+	status  MountStatus
+	backoff time.Duration
+	// When a failed mount is next due to be restarted.
+	retryAt time.Time
+	// Set while the mount is being started (or restarted), so the health check leaves it alone.
+	busy bool
+}
+
+// MountSupervisor holds every supervised mount, keyed by local mount point. Protected by a mutex, as mounts are
+// started from session starts while the health check runs in the background.
+type MountSupervisor struct {
+	mu     sync.Mutex
+	mounts map[string]*SupervisedMount
+}
+
+// newMountSupervisor initialises a mount supervisor with no mounts.
+func newMountSupervisor() *MountSupervisor {
+	return &MountSupervisor{
+		mounts: make(map[string]*SupervisedMount),
+	}
+}
+
+// The global mount supervisor.
+var rcloneMounts = newMountSupervisor()
+
+// rcloneMountTimeout returns how long to wait for a mount to appear, as set in the config file.
+func rcloneMountTimeout(config Config) time.Duration {
+	if config.RcloneMountTimeoutSeconds > 0 {
+		return time.Duration(config.RcloneMountTimeoutSeconds) * time.Second
+	}
+	return defaultRcloneMountTimeout
+}
+
+// nextBackoff returns the wait before the next restart of a mount that has failed again.
+func nextBackoff(backoff time.Duration) time.Duration {
+	if backoff < mountMinBackoff {
+		return mountMinBackoff
+	}
+	if backoff*2 > mountMaxBackoff {
+		return mountMaxBackoff
+	}
+	return backoff * 2
+}
+
+// isMounted reports whether there is a mount at the given folder, according to /proc/mounts.
+func isMounted(local string) bool {
+	mountPoints, mountsErr := readMountPoints()
+	return mountsErr == nil && mountPoints[strings.TrimSuffix(local, "/")]
+}
+
+// mountResponds reports whether a mounted folder can be listed within the time allowed. A FUSE mount whose rclone
+// process has stopped responding (for instance, stuck on a remote that has gone away) blocks anything that touches
+// it, so the listing is done in its own goroutine - it returns once the mount is forcibly unmounted.
+func mountResponds(local string) bool {
+	listed := make(chan error, 1)
+	go func() {
+		_, listErr := os.ReadDir(local)
+		listed <- listErr
+	}()
+	select {
+	case listErr := <-listed:
+		return listErr == nil
+	case <-time.After(mountResponseTimeout):
+		return false
+	}
+}
+
+// forceUnmount unmounts a folder, even if it is busy or its rclone process has gone - a lazy unmount detaches it
+// straight away, and it is cleaned up once nothing is using it.
+func forceUnmount(local string) {
+	if !isMounted(local) {
+		return
+	}
+	if umountOutput := runShellCommand("umount", "-l", local); umountOutput != "" {
+		fmt.Println("umountOutput: " + umountOutput)
+	}
+}
+
+// stopProcess asks a mount's rclone process to unmount and exit, killing it if it doesn't in good time, then makes
+// sure the folder is unmounted.
+func stopProcess(supervisedMount *SupervisedMount) {
+	if supervisedMount.process != nil && supervisedMount.process.Process != nil {
+		supervisedMount.process.Process.Signal(syscall.SIGTERM)
+		select {
+		case <-supervisedMount.exited:
+		case <-time.After(rcloneStopTimeout):
+			supervisedMount.process.Process.Kill()
+			<-supervisedMount.exited
+		}
+	}
+	forceUnmount(supervisedMount.spec.Local)
+}
+
+// startProcess starts rclone mounting a remote, and waits for the mount to appear, up to the given timeout. The
+// remote folder is created first if it doesn't already exist (for admin-defined mounts). Returns an error if the mount
+// doesn't appear in time, or rclone exits before it does.
+func startProcess(supervisedMount *SupervisedMount, timeout time.Duration) error {
+	spec := supervisedMount.spec
+	var impersonate []string
+	if spec.Impersonate != "" {
+		impersonate = []string{"--drive-impersonate", spec.Impersonate}
+	}
+	if spec.UserConfig != "" {
+		impersonate = append(impersonate, "--config", spec.UserConfig)
+	}
+
+	// Make sure the local folder isn't already being used as a mount point (perhaps left over from a crashed rclone),
+	// and that it exists and is owned by the user. This is checked again every time the mount is (re)started, as the
+	// user could have changed their home folder since - a folder in it is created without following any symlinks.
+	forceUnmount(spec.Local)
+	homeFolder := "/home/" + spec.Username
+	if relativePath, relErr := filepath.Rel(homeFolder, spec.Local); spec.Username != "" && relErr == nil && filepath.IsLocal(relativePath) {
+		if mkdirErr := mkdirChownInUserFolder(homeFolder, relativePath, spec.UID, spec.GID); mkdirErr != nil {
+			return mkdirErr
+		}
+	} else if mkdirErr := mkdirChown(spec.Local, spec.UID, spec.GID); mkdirErr != "" {
+		return errors.New(mkdirErr)
+	}
+
+	// Make sure the remote destination exists - create a new, empty folder (using rclone) if not.
+	if spec.UserConfig == "" {
+		mkdirContext, cancelMkdir := context.WithTimeout(context.Background(), rcloneMkdirTimeout)
+		defer cancelMkdir()
+		mkdirOutput, mkdirErr := exec.CommandContext(mkdirContext, "rclone", append(append([]string{"mkdir"}, impersonate...), spec.Remote)...).CombinedOutput()
+		if mkdirErr != nil {
+			fmt.Println("rcloneMkdirOutput: " + strings.TrimSpace(string(mkdirOutput)))
+		}
+	}
+
+	// Mount the remote folder using rclone, keeping hold of the process so we can tell if it exits.
+	supervisedMount.output = &OutputTail{}
+	supervisedMount.process = exec.Command("rclone", append(append([]string{"mount"}, impersonate...), "--vfs-cache-mode", "full", "--allow-other", spec.Remote, spec.Local)...)
+	supervisedMount.process.Stdout = supervisedMount.output
+	supervisedMount.process.Stderr = supervisedMount.output
+	// Don't wait for the output to be closed once rclone has exited, in case something it started still holds it open.
+	supervisedMount.process.WaitDelay = time.Second
+	if spec.UserConfig != "" {
+		supervisedMount.process.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: uint32(spec.UID), Gid: uint32(spec.GID)}}
+		supervisedMount.process.Env = append(os.Environ(), "HOME=/home/"+spec.Username)
+	}
+	fmt.Println("Starting rclone mount " + spec.Remote + " at " + spec.Local)
+	if startErr := supervisedMount.process.Start(); startErr != nil {
+		supervisedMount.process = nil
+		return errors.New("Error starting rclone: " + startErr.Error())
+	}
+	exited := make(chan struct{})
+	supervisedMount.exited = exited
+	go func(process *exec.Cmd) {
+		process.Wait()
+		close(exited)
+	}(supervisedMount.process)
+
+	// Wait for the mount to appear.
+	deadline := time.After(timeout)
+	for !isMounted(spec.Local) {
+		select {
+		case <-exited:
+			return errors.New("rclone exited before the mount was ready: " + supervisedMount.output.lastLine())
+		case <-deadline:
+			stopProcess(supervisedMount)
+			return errors.New("Timed out after " + timeout.String() + " waiting for the mount to be ready")
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+	return nil
+}
+
+// setState records a change in a mount's state. Must be called with the mutex held.
+func (supervisedMount *SupervisedMount) setState(state string, mountErr error) {
+	supervisedMount.status.State = state
+	supervisedMount.status.Since = time.Now()
+	supervisedMount.status.Error = ""
+	if mountErr != nil {
+		supervisedMount.status.Error = mountErr.Error()
+	}
+}
+
+// run starts (or restarts) a supervised mount, recording the outcome. A failed mount is scheduled for a restart
+// after its backoff.
+func (ms *MountSupervisor) run(supervisedMount *SupervisedMount, timeout time.Duration) error {
+	mountErr := startProcess(supervisedMount, timeout)
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	supervisedMount.busy = false
+	if mountErr != nil {
+		supervisedMount.backoff = nextBackoff(supervisedMount.backoff)
+		supervisedMount.retryAt = time.Now().Add(supervisedMount.backoff)
+		supervisedMount.setState(mountFailed, mountErr)
+		log.Println("Error mounting " + supervisedMount.spec.Remote + " at " + supervisedMount.spec.Local + ": " + mountErr.Error())
+		return mountErr
+	}
+	supervisedMount.setState(mountMounted, nil)
+	return nil
+}
+
+// mount makes sure a remote is mounted for a user's session, starting an rclone process to mount it if it isn't
+// already, and waiting for the mount to appear (up to the given timeout). A folder already mounted from the same
+// remote (for instance, for the same user's session of another image) is left as it is, and if the folder is being
+// mounted by another session start, we wait for that instead.
+func (ms *MountSupervisor) mount(spec RcloneMountSpec, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	ms.mu.Lock()
+	supervisedMount, exists := ms.mounts[spec.Local]
+	for exists && supervisedMount.busy {
+		ms.mu.Unlock()
+		if time.Now().After(deadline) {
+			return errors.New("Timed out after " + timeout.String() + " waiting for the mount at " + spec.Local + " to be ready")
+		}
+		time.Sleep(500 * time.Millisecond)
+		ms.mu.Lock()
+		supervisedMount, exists = ms.mounts[spec.Local]
+	}
+	if exists && supervisedMount.spec == spec && supervisedMount.status.State == mountMounted {
+		ms.mu.Unlock()
+		return nil
+	}
+	if !exists {
+		supervisedMount = &SupervisedMount{status: MountStatus{Username: spec.Username, Local: spec.Local, Remote: spec.Remote}}
+		ms.mounts[spec.Local] = supervisedMount
+	}
+	supervisedMount.busy = true
+	supervisedMount.setState(mountStarting, nil)
+	previousSpec := supervisedMount.spec
+	supervisedMount.spec = spec
+	supervisedMount.status.Remote = spec.Remote
+	ms.mu.Unlock()
+
+	// The mount has failed, or its config has changed - start again from scratch.
+	if exists {
+		stopProcess(&SupervisedMount{spec: previousSpec, process: supervisedMount.process, exited: supervisedMount.exited})
+	}
+	return ms.run(supervisedMount, time.Until(deadline))
+}
+
+// has reports whether a folder is being supervised, in whatever state.
+func (ms *MountSupervisor) has(local string) bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	_, exists := ms.mounts[local]
+	return exists
+}
+
+// userRemoteMounts returns the folders mounted from remotes users set up themselves, with the username of each.
+func (ms *MountSupervisor) userRemoteMounts() map[string]string {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	userMounts := make(map[string]string)
+	for local, supervisedMount := range ms.mounts {
+		if supervisedMount.spec.UserConfig != "" {
+			userMounts[local] = supervisedMount.spec.Username
+		}
+	}
+	return userMounts
+}
+
+// unmount stops supervising a folder, stopping its rclone process and unmounting it. A mount that is being started or
+// checked is left for the next time round.
+func (ms *MountSupervisor) unmount(local string) {
+	ms.mu.Lock()
+	supervisedMount, exists := ms.mounts[local]
+	if !exists || supervisedMount.busy {
+		ms.mu.Unlock()
+		return
+	}
+	supervisedMount.busy = true
+	ms.mu.Unlock()
+	stopProcess(supervisedMount)
+	ms.mu.Lock()
+	delete(ms.mounts, local)
+	ms.mu.Unlock()
+}
+
+// statuses returns the state of every supervised mount, grouped by username and sorted by mount point.
+func (ms *MountSupervisor) statuses() map[string][]MountStatus {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	mountStatuses := make(map[string][]MountStatus)
+	for _, supervisedMount := range ms.mounts {
+		mountStatuses[supervisedMount.status.Username] = append(mountStatuses[supervisedMount.status.Username], supervisedMount.status)
+	}
+	for username := range mountStatuses {
+		sort.Slice(mountStatuses[username], func(i, j int) bool { return mountStatuses[username][i].Local < mountStatuses[username][j].Local })
+	}
+	return mountStatuses
+}
+
+// checkHealth reports why a mount is no longer working - its rclone process has exited, or the folder is no longer
+// mounted or has stopped responding - or nil if it is healthy.
+func checkHealth(supervisedMount *SupervisedMount) error {
+	select {
+	case <-supervisedMount.exited:
+		return errors.New("rclone exited: " + supervisedMount.output.lastLine())
+	default:
+	}
+	if !isMounted(supervisedMount.spec.Local) {
+		return errors.New("The folder is no longer mounted")
+	}
+	if !mountResponds(supervisedMount.spec.Local) {
+		return errors.New("The mount stopped responding")
+	}
+	return nil
+}
+
+// check goes through the supervised mounts. Mounts for users with no session running (or hibernated, or starting)
+// are unmounted. Mounts whose rclone process has exited, or that have gone or stopped responding, are marked as
+// failed, and failed mounts due a restart are restarted in the background. Stopping and checking mounts can take a
+// while, so is done without holding the mutex - each mount being dealt with is marked as busy meanwhile.
+func (ms *MountSupervisor) check(cli *client.Client, config Config) {
+	containers, containersErr := cli.ContainerList(context.Background(), client.ContainerListOptions{})
+	if containersErr != nil {
+		log.Println("Error listing containers to check rclone mounts: " + containersErr.Error())
+		return
+	}
+	activeUsers := make(map[string]bool)
+	for _, item := range containers.Items {
+		if _, username, isSession := sessionFromContainer(item); isSession {
+			activeUsers[username] = true
+		}
+	}
+
+	var unusedMounts, runningMounts []*SupervisedMount
+	ms.mu.Lock()
+	for _, supervisedMount := range ms.mounts {
+		if supervisedMount.busy {
+			continue
+		}
+		username := supervisedMount.spec.Username
+		switch {
+		case !activeUsers[username] && !sessionStarts.userStarting(username):
+			supervisedMount.busy = true
+			unusedMounts = append(unusedMounts, supervisedMount)
+		case supervisedMount.status.State == mountMounted:
+			supervisedMount.busy = true
+			runningMounts = append(runningMounts, supervisedMount)
+		case supervisedMount.status.State == mountFailed && !time.Now().Before(supervisedMount.retryAt):
+			supervisedMount.busy = true
+			supervisedMount.status.Restarts = supervisedMount.status.Restarts + 1
+			supervisedMount.setState(mountStarting, nil)
+			go ms.run(supervisedMount, rcloneMountTimeout(config))
+		}
+	}
+	ms.mu.Unlock()
+
+	// Unmount the folders of users with no session.
+	for _, supervisedMount := range unusedMounts {
+		fmt.Println("Unmounting " + supervisedMount.spec.Local + ", user " + supervisedMount.spec.Username + " has no session running")
+		stopProcess(supervisedMount)
+		ms.mu.Lock()
+		delete(ms.mounts, supervisedMount.spec.Local)
+		ms.mu.Unlock()
+	}
+
+	// Check the health of each running mount, stopping any that have failed, ready to be restarted.
+	for _, supervisedMount := range runningMounts {
+		healthErr := checkHealth(supervisedMount)
+		if healthErr != nil {
+			log.Println("rclone mount at " + supervisedMount.spec.Local + " failed: " + healthErr.Error())
+			stopProcess(supervisedMount)
+		}
+		ms.mu.Lock()
+		supervisedMount.busy = false
+		if healthErr != nil {
+			supervisedMount.backoff = nextBackoff(supervisedMount.backoff)
+			supervisedMount.retryAt = time.Now().Add(supervisedMount.backoff)
+			supervisedMount.setState(mountFailed, healthErr)
+		} else if time.Since(supervisedMount.status.Since) > mountMaxBackoff {
+			// Back to the shortest wait before restarting, once the mount has stayed up for a good while.
+			supervisedMount.backoff = 0
+		}
+		ms.mu.Unlock()
+	}
+}
@@ -0,0 +1,181 @@
+// Resource profiles for the Session Manager. Without limits, a single session container can use all the CPU,
+// memory and processes on the host (a fork bomb, or a large Pandas job), starving everyone else's desktops. Resource
+// profiles, defined in the config file, set the limits applied to each session container, selected by the session's
+// image name and the user's (host) groups.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/client"
+)
+
+// A resource profile, as defined in the config file. Sizes are given as a number with an optional "k", "m" or "g"
+// suffix (e.g. "2g"), and any limit left blank (or zero) isn't applied.
+type ResourceProfile struct {
+	Name string `yaml:"name"`
+	// The images and (host) user groups this profile applies to. An empty list matches any image / group.
+	Images []string `yaml:"images"`
+	Groups []string `yaml:"groups"`
+	// The memory limit, and the total memory plus swap limit (defaults to twice the memory limit, as Docker does).
+	Memory     string `yaml:"memory"`
+	MemorySwap string `yaml:"memorySwap"`
+	// The number of CPUs the container can use (e.g. 1.5), and its CPU shares (relative weight, Docker's default is 1024).
+	CPUs      float64 `yaml:"cpus"`
+	CPUShares int64   `yaml:"cpuShares"`
+	// The maximum number of processes (including threads) that can run in the container at once.
+	PidsLimit int64 `yaml:"pidsLimit"`
+	// The size of the container's /dev/shm, which browsers and Python multiprocessing make heavy use of.
+	ShmSize string `yaml:"shmSize"`
+}
+
+// The label used to record which resource profile a session container was created with.
+const sessionResourceProfileLabel = "uk.co.sansay.puws.resourceProfile"
+
+// A size: a number, then at most one "k", "m" or "g" suffix, optionally followed by "b" (e.g. "512m", "1.5gb").
+var byteSizePattern = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)(?:([kmg])b?)?$`)
+
+// The multiplier for each size suffix.
+var byteSizeMultipliers = map[string]int64{"": 1, "k": 1024, "m": 1024 * 1024, "g": 1024 * 1024 * 1024}
+
+// parseByteSize parses a size such as "512m" or "2g" into a number of bytes. A blank string is zero.
+func parseByteSize(theSize string) (int64, error) {
+	theSize = strings.ToLower(strings.TrimSpace(theSize))
+	if theSize == "" {
+		return 0, nil
+	}
+	sizeParts := byteSizePattern.FindStringSubmatch(theSize)
+	if sizeParts == nil {
+		return 0, errors.New("invalid size: " + theSize + " (should be a number, optionally followed by k, m or g, e.g. \"512m\")")
+	}
+	sizeValue, parseErr := strconv.ParseFloat(sizeParts[1], 64)
+	if parseErr != nil {
+		return 0, errors.New("invalid size: " + theSize)
+	}
+	return int64(sizeValue * float64(byteSizeMultipliers[sizeParts[2]])), nil
+}
+
+// listContains reports whether a list of strings contains the given value.
+func listContains(theList []string, theValue string) bool {
+	for _, listValue := range theList {
+		if listValue == theValue {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesImageAndGroups reports whether a config entry with the given image and group lists applies to a session.
+// An empty list matches anything.
+func matchesImageAndGroups(images []string, groups []string, imageName string, userGroups []string) bool {
+	if len(images) > 0 && !listContains(images, imageName) {
+		return false
+	}
+	if len(groups) == 0 {
+		return true
+	}
+	for _, group := range userGroups {
+		if listContains(groups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectResourceProfile returns the first resource profile in the config file that matches the given image and user
+// groups, so more specific profiles should be listed first. Returns nil if no profile matches.
+func selectResourceProfile(profiles []ResourceProfile, imageName string, userGroups []string) *ResourceProfile {
+	for index := range profiles {
+		if matchesImageAndGroups(profiles[index].Images, profiles[index].Groups, imageName, userGroups) {
+			return &profiles[index]
+		}
+	}
+	return nil
+}
+
+// resources converts a resource profile into the Docker resource limits to apply to a container.
+func (profile *ResourceProfile) resources() (container.Resources, error) {
+	var resources container.Resources
+	memory, memoryErr := parseByteSize(profile.Memory)
+	if memoryErr != nil {
+		return resources, errors.New("resource profile " + profile.Name + ", memory: " + memoryErr.Error())
+	}
+	memorySwap, memorySwapErr := parseByteSize(profile.MemorySwap)
+	if memorySwapErr != nil {
+		return resources, errors.New("resource profile " + profile.Name + ", memorySwap: " + memorySwapErr.Error())
+	}
+	// Set the swap limit explicitly when a memory limit is set, so that updating the limits of an existing container
+	// doesn't fail because the old swap limit is lower than the new memory limit.
+	if memory > 0 && memorySwap == 0 {
+		memorySwap = memory * 2
+	}
+	resources.Memory = memory
+	resources.MemorySwap = memorySwap
+	resources.NanoCPUs = int64(profile.CPUs * 1e9)
+	resources.CPUShares = profile.CPUShares
+	if profile.PidsLimit > 0 {
+		pidsLimit := profile.PidsLimit
+		resources.PidsLimit = &pidsLimit
+	}
+	return resources, nil
+}
+
+// resourceProfileChanged reports whether a session container was created with a different resource profile (or
+// none) than it would be now. Docker can't remove a container's limits, or change its labels, once it is created, so
+// such a container is recreated rather than updated - a container created with a profile that no longer matches
+// gets no limits, and no profile label, rather than keeping the old ones.
+func resourceProfileChanged(item container.Summary, profile *ResourceProfile) bool {
+	profileName := ""
+	if profile != nil {
+		profileName = profile.Name
+	}
+	return item.Labels[sessionResourceProfileLabel] != profileName
+}
+
+// applyResourceProfile updates the resource limits of an existing session container to match its current resource
+// profile, so changes to the config file take effect the next time a session is started. The shared memory size
+// can only be set when a container is created, so isn't changed. A container whose profile has changed altogether
+// (see resourceProfileChanged) is recreated instead, so with no profile matching there is nothing to update.
+func applyResourceProfile(cli *client.Client, config Config, containerID string, username string, imageName string) error {
+	profile := selectResourceProfile(config.ResourceProfiles, imageName, userGroups(username))
+	if profile == nil {
+		return nil
+	}
+	resources, resourcesErr := profile.resources()
+	if resourcesErr != nil {
+		return resourcesErr
+	}
+	_, updateErr := cli.ContainerUpdate(context.Background(), containerID, client.ContainerUpdateOptions{Resources: &resources})
+	return updateErr
+}
+
+// describeResources returns the resource limits applied to a session container, as human-readable values for the
+// admin panel. Limits that aren't set are left out.
+func describeResources(hostConfig *container.HostConfig) map[string]string {
+	limits := map[string]string{}
+	if hostConfig == nil {
+		return limits
+	}
+	if hostConfig.Memory > 0 {
+		limits["memoryLimitBytes"] = strconv.FormatInt(hostConfig.Memory, 10)
+	}
+	if hostConfig.NanoCPUs > 0 {
+		limits["cpuLimit"] = strconv.FormatFloat(float64(hostConfig.NanoCPUs)/1e9, 'f', -1, 64)
+	}
+	if hostConfig.CPUShares > 0 {
+		limits["cpuShares"] = strconv.FormatInt(hostConfig.CPUShares, 10)
+	}
+	if hostConfig.PidsLimit != nil && *hostConfig.PidsLimit > 0 {
+		limits["pidsLimit"] = strconv.FormatInt(*hostConfig.PidsLimit, 10)
+	}
+	if hostConfig.ShmSize > 0 {
+		limits["shmSizeBytes"] = strconv.FormatInt(hostConfig.ShmSize, 10)
+	}
+	return limits
+}
@@ -0,0 +1,457 @@
+// Timetable-based session scheduling for the Session Manager. Auto-start entries keep a session running all the time;
+// schedule rules instead start a user's (or a whole group's) sessions at a set time on set days of the week, and stop
+// them again at another - Year 10's desktops from 08:50 to 10:00 on Mondays, say - so they are ready when the class
+// arrives and don't sit running for the rest of the week.
+//
+// The rules are kept in the auto-start config file, along with the school's term dates and holidays: outside term
+// time, and on holidays, scheduled sessions are neither started nor stopped. The auto-start retry loop enforces the
+// timetable - a scheduled session that should be running is started (and restarted if it stops), and is stopped once
+// its time is up, even if the user started it themselves. Outside its scheduled times a session is left alone, so
+// users can still log in to it as normal.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moby/moby/client"
+)
+
+// The formats of dates and times of day in schedule rules, term dates and holidays.
+const (
+	scheduleDateFormat  = "2006-01-02"
+	scheduleClockFormat = "15:04"
+)
+
+// How far ahead to look for a scheduled session's next start or stop - far enough to see past the summer holidays.
+const scheduleLookaheadDays = 400
+
+// The actions scheduled for a session.
+const (
+	scheduleStart = "start"
+	scheduleStop  = "stop"
+)
+
+// The host's list of groups.
+const groupPath = "/etc/group"
+
+// A timetable rule, starting sessions for a user or a group at a set time on set days of the week, and stopping them
+// at another.
+type ScheduleRule struct {
+	// A name for the rule, shown in the admin panel and audit log, e.g. "Year 10 Computing".
+	Name string `yaml:"name" json:"name"`
+	// Who the rule applies to - either one user, or every member of a (host) group.
+	Username string `yaml:"username,omitempty" json:"username,omitempty"`
+	Group    string `yaml:"group,omitempty" json:"group,omitempty"`
+	// The image to start.
+	Image string `yaml:"image" json:"image"`
+	// The days of the week the rule applies on, e.g. ["mon", "wed"].
+	Days []string `yaml:"days" json:"days"`
+	// The times of day (24-hour, server time) to start and stop sessions, e.g. "08:50" and "10:00".
+	Start string `yaml:"start" json:"start"`
+	Stop  string `yaml:"stop" json:"stop"`
+}
+
+// A range of dates, first and last day inclusive, e.g. a term or a holiday.
+type DateRange struct {
+	Name  string `yaml:"name" json:"name"`
+	Start string `yaml:"start" json:"start"`
+	End   string `yaml:"end" json:"end"`
+}
+
+// The next scheduled action for a session, as shown in the admin panel.
+type ScheduledAction struct {
+	Username string    `json:"username"`
+	Image    string    `json:"image"`
+	Rule     string    `json:"rule"`
+	Action   string    `json:"action"`
+	Time     time.Time `json:"time"`
+}
+
+// A schedule rule, checked and ready to use.
+type compiledScheduleRule struct {
+	ScheduleRule
+	days map[time.Weekday]bool
+	// The start and stop times, in minutes after midnight.
+	start int
+	stop  int
+}
+
+// The dates of a DateRange, each at midnight in the server's time zone.
+type compiledDateRange struct {
+	first time.Time
+	last  time.Time
+}
+
+// The timetable, checked and ready to use.
+type compiledSchedule struct {
+	rules    []compiledScheduleRule
+	terms    []compiledDateRange
+	holidays []compiledDateRange
+}
+
+// A session covered by the timetable, and the rules that apply to it.
+type scheduledSession struct {
+	Username string
+	Image    string
+	rules    []compiledScheduleRule
+}
+
+// Keeps track of when the timetable was last enforced, so sessions are stopped only as their scheduled time passes,
+// and of the problems found in the schedule, so each is only logged once.
+type SessionScheduler struct {
+	mu        sync.Mutex
+	lastCheck time.Time
+	problems  []string
+}
+
+// The global session scheduler.
+var sessionSchedule = newSessionScheduler()
+
+func newSessionScheduler() *SessionScheduler {
+	return &SessionScheduler{}
+}
+
+// advance records that the timetable is being enforced now, returning when it last was. The first time round, that
+// is taken to be one retry interval ago, so a stop that fell due while the Session Manager was restarting is still
+// carried out.
+func (scheduler *SessionScheduler) advance(now time.Time) time.Time {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+	lastCheck := scheduler.lastCheck
+	if lastCheck.IsZero() || lastCheck.After(now) {
+		lastCheck = now.Add(-autoStartRetryInterval)
+	}
+	scheduler.lastCheck = now
+	return lastCheck
+}
+
+// setProblems records the problems found in the schedule, logging them if they have changed.
+func (scheduler *SessionScheduler) setProblems(problems []string) {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+	if strings.Join(problems, "\n") != strings.Join(scheduler.problems, "\n") {
+		for _, problem := range problems {
+			log.Println("Problem in session schedule: " + problem)
+		}
+	}
+	scheduler.problems = problems
+}
+
+// currentProblems returns the problems found in the schedule the last time it was enforced.
+func (scheduler *SessionScheduler) currentProblems() []string {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+	return append([]string{}, scheduler.problems...)
+}
+
+// parseWeekday parses a day of the week in a schedule rule - its name, or the name's first three (or more) letters,
+// in any case.
+func parseWeekday(day string) (time.Weekday, bool) {
+	day = strings.ToLower(strings.TrimSpace(day))
+	for weekday := time.Sunday; weekday <= time.Saturday; weekday++ {
+		if len(day) >= 3 && strings.HasPrefix(strings.ToLower(weekday.String()), day) {
+			return weekday, true
+		}
+	}
+	return time.Sunday, false
+}
+
+// parseScheduleClock parses a time of day, returning it in minutes after midnight.
+func parseScheduleClock(clock string) (int, error) {
+	clockTime, parseErr := time.Parse(scheduleClockFormat, clock)
+	if parseErr != nil {
+		return 0, errors.New("\"" + clock + "\" isn't a time of day like \"08:50\"")
+	}
+	return clockTime.Hour()*60 + clockTime.Minute(), nil
+}
+
+// compileDateRanges checks and parses a list of date ranges, returning the problems found in any that are invalid
+// (which are left out).
+func compileDateRanges(field string, dateRanges []DateRange) ([]compiledDateRange, []string) {
+	var compiled []compiledDateRange
+	var problems []string
+	for index, dateRange := range dateRanges {
+		first, firstErr := time.ParseInLocation(scheduleDateFormat, dateRange.Start, time.Local)
+		last, lastErr := time.ParseInLocation(scheduleDateFormat, dateRange.End, time.Local)
+		switch {
+		case firstErr != nil || lastErr != nil:
+			problems = append(problems, field+"["+strconv.Itoa(index)+"]: start and end must be dates like \"2026-09-03\"")
+		case last.Before(first):
+			problems = append(problems, field+"["+strconv.Itoa(index)+"]: ends before it starts")
+		default:
+			compiled = append(compiled, compiledDateRange{first: first, last: last})
+		}
+	}
+	return compiled, problems
+}
+
+// compileSchedule checks and parses the timetable in the auto-start config. Invalid rules and dates are left out,
+// and a problem returned for each.
+func compileSchedule(config Config, autoStartConfig AutoStartConfig) (compiledSchedule, []string) {
+	var schedule compiledSchedule
+	var problems, rangeProblems []string
+	schedule.terms, rangeProblems = compileDateRanges("terms", autoStartConfig.Terms)
+	problems = append(problems, rangeProblems...)
+	schedule.holidays, rangeProblems = compileDateRanges("holidays", autoStartConfig.Holidays)
+	problems = append(problems, rangeProblems...)
+	for index, rule := range autoStartConfig.Schedules {
+		field := "schedules[" + strconv.Itoa(index) + "]"
+		if rule.Name != "" {
+			field = field + " (" + rule.Name + ")"
+		}
+		compiled := compiledScheduleRule{ScheduleRule: rule, days: make(map[time.Weekday]bool)}
+		var ruleProblem string
+		for _, day := range rule.Days {
+			weekday, known := parseWeekday(day)
+			if !known {
+				ruleProblem = "unknown day \"" + day + "\""
+			}
+			compiled.days[weekday] = true
+		}
+		var startErr, stopErr error
+		compiled.start, startErr = parseScheduleClock(rule.Start)
+		compiled.stop, stopErr = parseScheduleClock(rule.Stop)
+		switch {
+		case (rule.Username == "") == (rule.Group == ""):
+			ruleProblem = "set either username or group"
+		case findCatalogueImage(config, rule.Image) == nil:
+			ruleProblem = "unknown image \"" + rule.Image + "\""
+		case len(rule.Days) == 0:
+			ruleProblem = "no days set"
+		case startErr != nil:
+			ruleProblem = "start: " + startErr.Error()
+		case stopErr != nil:
+			ruleProblem = "stop: " + stopErr.Error()
+		case compiled.stop <= compiled.start:
+			ruleProblem = "stops before it starts"
+		}
+		if ruleProblem != "" {
+			problems = append(problems, field+": "+ruleProblem)
+			continue
+		}
+		if compiled.Name == "" {
+			compiled.Name = field
+		}
+		schedule.rules = append(schedule.rules, compiled)
+	}
+	return schedule, problems
+}
+
+// isSchoolDay reports whether the timetable applies on the given day - in term time (if term dates are set) and not
+// on a holiday.
+func (schedule compiledSchedule) isSchoolDay(day time.Time) bool {
+	midnight := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, day.Location())
+	inRange := func(dateRange compiledDateRange) bool {
+		return !midnight.Before(dateRange.first) && !midnight.After(dateRange.last)
+	}
+	inTerm := len(schedule.terms) == 0
+	for _, term := range schedule.terms {
+		inTerm = inTerm || inRange(term)
+	}
+	for _, holiday := range schedule.holidays {
+		if inRange(holiday) {
+			return false
+		}
+	}
+	return inTerm
+}
+
+// window returns the start and stop times of a rule on the given day, if it applies then.
+func (schedule compiledSchedule) window(rule compiledScheduleRule, day time.Time) (time.Time, time.Time, bool) {
+	if !rule.days[day.Weekday()] || !schedule.isSchoolDay(day) {
+		return time.Time{}, time.Time{}, false
+	}
+	start := time.Date(day.Year(), day.Month(), day.Day(), 0, rule.start, 0, 0, day.Location())
+	stop := time.Date(day.Year(), day.Month(), day.Day(), 0, rule.stop, 0, 0, day.Location())
+	return start, stop, true
+}
+
+// isActive reports whether a session covered by the given rules should be running at the given time.
+func (schedule compiledSchedule) isActive(rules []compiledScheduleRule, at time.Time) bool {
+	for _, rule := range rules {
+		if start, stop, applies := schedule.window(rule, at); applies && !at.Before(start) && at.Before(stop) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextChange returns the first start or stop time of any of the given rules after the given time, and the rule it
+// belongs to.
+func (schedule compiledSchedule) nextChange(rules []compiledScheduleRule, after time.Time) (time.Time, string, bool) {
+	var next time.Time
+	nextRule := ""
+	for _, rule := range rules {
+		for dayOffset := 0; dayOffset <= scheduleLookaheadDays; dayOffset++ {
+			day := time.Date(after.Year(), after.Month(), after.Day()+dayOffset, 12, 0, 0, 0, after.Location())
+			if !next.IsZero() && day.After(next.Add(24*time.Hour)) {
+				break
+			}
+			start, stop, applies := schedule.window(rule, day)
+			if !applies {
+				continue
+			}
+			var change time.Time
+			if start.After(after) {
+				change = start
+			} else if stop.After(after) {
+				change = stop
+			} else {
+				continue
+			}
+			if next.IsZero() || change.Before(next) {
+				next, nextRule = change, rule.Name
+			}
+			break
+		}
+	}
+	return next, nextRule, !next.IsZero()
+}
+
+// nextAction returns the next time a session covered by the given rules is due to be started or stopped. Where rules
+// overlap, only the times the session actually changes from stopped to running, or back, count.
+func (schedule compiledSchedule) nextAction(rules []compiledScheduleRule, now time.Time) (string, time.Time, string, bool) {
+	active := schedule.isActive(rules, now)
+	after := now
+	for attempt := 0; attempt < 1000; attempt++ {
+		change, ruleName, found := schedule.nextChange(rules, after)
+		if !found {
+			break
+		}
+		if schedule.isActive(rules, change) != active {
+			if active {
+				return scheduleStop, change, ruleName, true
+			}
+			return scheduleStart, change, ruleName, true
+		}
+		after = change
+	}
+	return "", time.Time{}, "", false
+}
+
+// groupMembers returns the usernames of the members of a host group - those listed in the group file, and those
+// whose primary group it is.
+func groupMembers(groupName string) []string {
+	group, lookupErr := user.LookupGroup(groupName)
+	if lookupErr != nil {
+		return nil
+	}
+	members := make(map[string]bool)
+	if groupFile, openErr := os.Open(groupPath); openErr == nil {
+		groupScanner := bufio.NewScanner(groupFile)
+		for groupScanner.Scan() {
+			// Each line looks like "year10:x:1005:jane.doe,john.smith".
+			fields := strings.Split(groupScanner.Text(), ":")
+			if len(fields) >= 4 && fields[0] == groupName && fields[3] != "" {
+				for _, member := range strings.Split(fields[3], ",") {
+					members[member] = true
+				}
+			}
+		}
+		groupFile.Close()
+	}
+	if accounts, passwdErr := readPasswd(passwdPath); passwdErr == nil {
+		for _, account := range accounts {
+			if strconv.Itoa(account.GID) == group.Gid {
+				members[account.Username] = true
+			}
+		}
+	}
+	var usernames []string
+	for member := range members {
+		usernames = append(usernames, member)
+	}
+	sort.Strings(usernames)
+	return usernames
+}
+
+// scheduledSessions returns the sessions the timetable covers, each with the rules that apply to it, sorted by
+// username and image.
+func scheduledSessions(schedule compiledSchedule, membersOf func(string) []string) []scheduledSession {
+	sessionsByKey := make(map[string]*scheduledSession)
+	for _, rule := range schedule.rules {
+		usernames := []string{rule.Username}
+		if rule.Group != "" {
+			usernames = membersOf(rule.Group)
+		}
+		for _, username := range usernames {
+			key := sessionKey(rule.Image, username)
+			if sessionsByKey[key] == nil {
+				sessionsByKey[key] = &scheduledSession{Username: username, Image: rule.Image}
+			}
+			sessionsByKey[key].rules = append(sessionsByKey[key].rules, rule)
+		}
+	}
+	var sessions []scheduledSession
+	for _, session := range sessionsByKey {
+		sessions = append(sessions, *session)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].Username != sessions[j].Username {
+			return sessions[i].Username < sessions[j].Username
+		}
+		return sessions[i].Image < sessions[j].Image
+	})
+	return sessions
+}
+
+// scheduledActions returns the next scheduled action for each session the timetable covers.
+func scheduledActions(config Config, autoStartConfig AutoStartConfig, now time.Time) []ScheduledAction {
+	schedule, _ := compileSchedule(config, autoStartConfig)
+	var actions []ScheduledAction
+	for _, session := range scheduledSessions(schedule, groupMembers) {
+		if action, actionTime, ruleName, found := schedule.nextAction(session.rules, now); found {
+			actions = append(actions, ScheduledAction{Username: session.Username, Image: session.Image, Rule: ruleName, Action: action, Time: actionTime})
+		}
+	}
+	return actions
+}
+
+// stopScheduledSession stops a session whose scheduled time is up, recording it in the audit log.
+func stopScheduledSession(cli *client.Client, config Config, randomSeed []byte, session scheduledSession) {
+	existingSession, existingErr := findSession(cli, session.Image, session.Username)
+	if existingErr != nil {
+		log.Println("Error finding scheduled session for user " + session.Username + ": " + existingErr.Error())
+		return
+	}
+	if existingSession == nil || (existingSession.State != "running" && existingSession.State != "paused") {
+		return
+	}
+	stopErr := runSessionAction(cli, config, randomSeed, *existingSession, "stop", AuditActor{Name: auditActorSystem, Source: auditSourceSchedule})
+	result, detail := auditResult(stopErr)
+	sessionAudit.record(AuditEvent{Action: "session-stop", Actor: auditActorSystem, Target: session.Username, Image: session.Image, Source: auditSourceSchedule, Result: result, Detail: detail})
+	if stopErr != "" {
+		log.Println("Error stopping scheduled session for user " + session.Username + " (" + session.Image + "): " + stopErr)
+	} else {
+		fmt.Println("Stopped scheduled session for user " + session.Username + " (" + session.Image + ")")
+	}
+}
+
+// enforceSchedule starts the scheduled sessions that should be running now and aren't, and stops those whose
+// scheduled time has ended since the timetable was last enforced. A session that is also in the auto-start list is
+// never stopped.
+func enforceSchedule(cli *client.Client, config Config, randomSeed []byte, autoStartConfig AutoStartConfig, now time.Time) {
+	schedule, problems := compileSchedule(config, autoStartConfig)
+	sessionSchedule.setProblems(problems)
+	lastCheck := sessionSchedule.advance(now)
+	var dueSessions []AutoStartEntry
+	for _, session := range scheduledSessions(schedule, groupMembers) {
+		if schedule.isActive(session.rules, now) {
+			dueSessions = append(dueSessions, AutoStartEntry{Username: session.Username, Image: session.Image})
+		} else if schedule.isActive(session.rules, lastCheck) && !isAutoStartSession(autoStartConfig.Sessions, session.Image, session.Username) {
+			go stopScheduledSession(cli, config, randomSeed, session)
+		}
+	}
+	ensureAutoStartSessions(cli, config, randomSeed, dueSessions, auditSourceSchedule)
+}
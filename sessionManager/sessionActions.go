@@ -0,0 +1,140 @@
+// Admin lifecycle actions for the Session Manager. Lets an administrator stop, restart, pause (hibernate), unpause,
+// remove or recreate a single user session from the admin panel, rather than having to log in to the host and run
+// Docker commands by hand. Only user session containers can be acted on - never the other containers (Pangolin,
+// Guacamole, etc) running on the same host.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/client"
+)
+
+// A request to the "/admin/sessionAction" endpoint.
+type SessionActionRequest struct {
+	// The session's container name, "imageName-username".
+	Name string `json:"name"`
+	// One of sessionActionNames.
+	Action string `json:"action"`
+	// For destructive actions, must be the session's name again, to confirm the action.
+	Confirm string `json:"confirm"`
+}
+
+// The actions that can be taken on a session.
+var sessionActionNames = []string{"stop", "restart", "pause", "unpause", "remove", "recreate"}
+
+// isDestructiveAction reports whether an action throws away the session's container (and so anything the user has
+// changed inside it outside their home folder), needing confirmation before it is carried out.
+func isDestructiveAction(action string) bool {
+	return action == "remove" || action == "recreate"
+}
+
+// checkSessionAction checks an action request is valid, returning an error message (or an empty string if valid).
+func checkSessionAction(actionRequest SessionActionRequest) string {
+	if strings.TrimSpace(actionRequest.Name) == "" {
+		return "Missing session name"
+	}
+	if !listContains(sessionActionNames, actionRequest.Action) {
+		return "Unknown action \"" + actionRequest.Action + "\" - should be one of: " + strings.Join(sessionActionNames, ", ")
+	}
+	if isDestructiveAction(actionRequest.Action) && actionRequest.Confirm != actionRequest.Name {
+		return "The \"" + actionRequest.Action + "\" action removes the session's container - confirm it by passing the session's name as \"confirm\""
+	}
+	return ""
+}
+
+// checkExamSessionAction refuses to restart or unpause an exam session whose candidate's time is up (or whose exam
+// has been cleared away). Exam sessions are locked by pausing them, so either action would give the candidate their
+// desktop back, with any connection they still had open carrying on. Extending the exam unlocks the session properly.
+// Returns an error message, or an empty string if the action can go ahead.
+func checkExamSessionAction(config Config, imageName string, username string, action string, now time.Time) string {
+	if (action != "restart" && action != "unpause") || !isExamImage(config, imageName) {
+		return ""
+	}
+	if _, examErr := examSessions.checkStart(imageName, username, now); examErr != "" {
+		return examErr + " - to give the candidate more time, extend the exam (/admin/exams/extend) rather than using \"" + action + "\""
+	}
+	return ""
+}
+
+// findSessionByName looks for a user session container with the given container name. Returns nil if there isn't
+// one, or if the container with that name isn't a user session.
+func findSessionByName(cli *client.Client, sessionName string) (*container.Summary, error) {
+	containers, containersErr := cli.ContainerList(context.Background(), client.ContainerListOptions{All: true})
+	if containersErr != nil {
+		return nil, containersErr
+	}
+	for _, item := range containers.Items {
+		if len(item.Names) == 0 || strings.TrimPrefix(item.Names[0], "/") != sessionName {
+			continue
+		}
+		if _, _, isSession := sessionFromContainer(item); isSession {
+			return &item, nil
+		}
+		return nil, nil
+	}
+	return nil, nil
+}
+
+// runSessionAction carries out an admin action on a session container. Recreating a session goes through the start
+// coordinator, so a user connecting at the same moment waits for the new container rather than racing it, and the
+// new container's start is recorded in the audit log as done by startedBy. Returns an empty string on success, or an
+// error message.
+func runSessionAction(cli *client.Client, config Config, randomSeed []byte, item container.Summary, action string, startedBy AuditActor) string {
+	imageName, username, _ := sessionFromContainer(item)
+	if examErr := checkExamSessionAction(config, imageName, username, action, time.Now()); examErr != "" {
+		return examErr
+	}
+	switch action {
+	case "stop":
+		if _, stopErr := cli.ContainerStop(context.Background(), item.ID, client.ContainerStopOptions{}); stopErr != nil {
+			return "Error stopping container: " + stopErr.Error()
+		}
+		sessionActivity.forget(imageName, username)
+	case "restart":
+		// A paused container has to be unpaused before Docker will restart it.
+		if item.State == "paused" {
+			if _, unpauseErr := cli.ContainerUnpause(context.Background(), item.ID, client.ContainerUnpauseOptions{}); unpauseErr != nil {
+				return "Error unpausing container: " + unpauseErr.Error()
+			}
+		}
+		if _, restartErr := cli.ContainerRestart(context.Background(), item.ID, client.ContainerRestartOptions{}); restartErr != nil {
+			return "Error restarting container: " + restartErr.Error()
+		}
+		sessionActivity.touch(imageName, username)
+	case "pause":
+		if pauseErr := hibernateSession(cli, item.ID); pauseErr != nil {
+			return "Error pausing container: " + pauseErr.Error()
+		}
+	case "unpause":
+		if _, unpauseErr := cli.ContainerUnpause(context.Background(), item.ID, client.ContainerUnpauseOptions{}); unpauseErr != nil {
+			return "Error unpausing container: " + unpauseErr.Error()
+		}
+		sessionActivity.touch(imageName, username)
+	case "remove":
+		if removeErr := removeSessionContainer(cli, item, true); removeErr != nil {
+			return "Error removing container: " + removeErr.Error()
+		}
+		sessionActivity.forget(imageName, username)
+	case "recreate":
+		recreateErr, _ := sessionStarts.start(imageName, username, startTimeout(config), func() string {
+			if removeErr := removeSessionContainer(cli, item, true); removeErr != nil {
+				return "Error removing container: " + removeErr.Error()
+			}
+			return createOrStartSession(cli, config, randomSeed, username, imageName, startedBy)
+		})
+		if recreateErr != "" {
+			return recreateErr
+		}
+		sessionActivity.touch(imageName, username)
+	default:
+		return "Unknown action \"" + action + "\""
+	}
+	fmt.Println("Admin action: " + action + " session " + imageName + "-" + username)
+	return ""
+}
@@ -0,0 +1,155 @@
+// Session activity tracking for the Session Manager. Records when each user session (Docker container) was last
+// used, so that sessions nobody is using any more can be stopped (or paused) to free up memory on the host.
+//
+// Activity comes from three places: calls to the "/connectToSession" endpoint (a user connecting via Guacamole or
+// the sessionProxy), reports of traffic from the sessionProxy (via the "/sessionActivity" endpoint), and open VNC or
+// SSH connections into the container itself, which we find by looking at the container's TCP connection table.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/client"
+)
+
+// The ports inside a session container that count as "in use" if anything is connected to them - VNC (display :1)
+// and SSH. Guacamole holds one of these open for as long as a user has the session open in their browser.
+var activityPorts = []int{5901, 22}
+
+// The labels added to each session container when it is created, so we can reliably tell user session containers
+// apart from the other containers (Pangolin, Guacamole, etc) running on the same host.
+const sessionUsernameLabel = "uk.co.sansay.puws.username"
+const sessionImageLabel = "uk.co.sansay.puws.image"
+
+// sessionKey returns the key used to identify a session (an image / username pair) in maps.
+func sessionKey(imageName string, username string) string {
+	return imageName + "\x00" + username
+}
+
+// sessionFromContainer works out which image name and username a container belongs to. Containers created by this
+// version of the Session Manager carry labels saying so; for older containers we fall back to checking the container
+// name ("imageName-username") against the image those versions always created containers from. Returns false if the
+// container isn't a user session.
+func sessionFromContainer(item container.Summary) (string, string, bool) {
+	if item.Labels[sessionUsernameLabel] != "" && item.Labels[sessionImageLabel] != "" {
+		return item.Labels[sessionImageLabel], item.Labels[sessionUsernameLabel], true
+	}
+	if len(item.Names) == 0 {
+		return "", "", false
+	}
+	sessionParts := strings.SplitN(strings.TrimPrefix(item.Names[0], "/"), "-", 2)
+	if len(sessionParts) != 2 || sessionParts[0] == "" || sessionParts[1] == "" {
+		return "", "", false
+	}
+	if item.Image != legacySessionImageRef(sessionParts[0]) {
+		return "", "", false
+	}
+	return sessionParts[0], sessionParts[1], true
+}
+
+// ActivityTracker records the last time each session was used. Accessed from HTTP handlers and the background
+// culling loop at the same time, so protected by a mutex.
+type ActivityTracker struct {
+	mu           sync.Mutex
+	lastActivity map[string]time.Time
+}
+
+// newActivityTracker initialises an empty activity tracker.
+func newActivityTracker() *ActivityTracker {
+	return &ActivityTracker{
+		lastActivity: make(map[string]time.Time),
+	}
+}
+
+// touch records that the given session has just been used.
+func (at *ActivityTracker) touch(imageName string, username string) {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	at.lastActivity[sessionKey(imageName, username)] = time.Now()
+}
+
+// lastSeen returns the last time the given session was used, and false if we have no record of it at all.
+func (at *ActivityTracker) lastSeen(imageName string, username string) (time.Time, bool) {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	lastTime, exists := at.lastActivity[sessionKey(imageName, username)]
+	return lastTime, exists
+}
+
+// forget removes the record for the given session, used once a session has been stopped.
+func (at *ActivityTracker) forget(imageName string, username string) {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	delete(at.lastActivity, sessionKey(imageName, username))
+}
+
+// The global activity tracker.
+var sessionActivity = newActivityTracker()
+
+// countEstablishedConnections parses the contents of a Linux /proc/net/tcp (or tcp6) file and returns the number of
+// established connections whose local port is one of the given ports.
+func countEstablishedConnections(procNetTCP string, ports []int) int {
+	connectionCount := 0
+	tcpScanner := bufio.NewScanner(strings.NewReader(procNetTCP))
+	for tcpScanner.Scan() {
+		// Each line looks like "0: 0100007F:170D 0100007F:A2C4 01 ...", the local address (IP:port, in hex), the
+		// remote address and the connection state. The first line is a header, which won't parse, so gets skipped.
+		tcpFields := strings.Fields(tcpScanner.Text())
+		if len(tcpFields) < 4 {
+			continue
+		}
+		// State "01" is TCP_ESTABLISHED.
+		if tcpFields[3] != "01" {
+			continue
+		}
+		localAddress := strings.Split(tcpFields[1], ":")
+		if len(localAddress) != 2 {
+			continue
+		}
+		localPort, parseErr := strconv.ParseInt(localAddress[1], 16, 32)
+		if parseErr != nil {
+			continue
+		}
+		for _, port := range ports {
+			if int(localPort) == port {
+				connectionCount = connectionCount + 1
+			}
+		}
+	}
+	return connectionCount
+}
+
+// countSessionConnections returns the number of VNC / SSH connections currently open to a session container. The
+// container's own network namespace is visible from the host via /proc/PID/net, using the PID of the container's
+// main process.
+func countSessionConnections(cli *client.Client, containerID string) (int, error) {
+	inspectResult, inspectErr := cli.ContainerInspect(context.Background(), containerID, client.ContainerInspectOptions{})
+	if inspectErr != nil {
+		return 0, inspectErr
+	}
+	if inspectResult.Container.State == nil || inspectResult.Container.State.Pid == 0 {
+		return 0, nil
+	}
+	connectionCount := 0
+	for _, tcpFile := range []string{"tcp", "tcp6"} {
+		tcpData, readErr := os.ReadFile(fmt.Sprintf("/proc/%d/net/%s", inspectResult.Container.State.Pid, tcpFile))
+		if readErr != nil {
+			// IPv6 might not be enabled - only report an error if we can't read the IPv4 table either.
+			if tcpFile == "tcp" {
+				return 0, readErr
+			}
+			continue
+		}
+		connectionCount = connectionCount + countEstablishedConnections(string(tcpData), activityPorts)
+	}
+	return connectionCount, nil
+}
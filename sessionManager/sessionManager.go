@@ -6,11 +6,14 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"crypto/rand"
 	"crypto/subtle"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
@@ -45,11 +48,55 @@ type RcloneMount struct {
 	Username string `yaml:"username"`
 	Local    string `yaml:"local"`
 	Remote   string `yaml:"remote"`
+	// Whether a session can't start without this mount. By default a mount that fails is left to the mount
+	// supervisor to restart, and the session starts anyway.
+	Required bool `yaml:"required"`
 }
 type Config struct {
 	RcloneMounts []RcloneMount `yaml:"rcloneMounts"`
+	// How long to wait for each rclone mount to be ready when starting a session, in seconds. Defaults to 60.
+	RcloneMountTimeoutSeconds int `yaml:"rcloneMountTimeoutSeconds"`
+	// Which of the remotes users set up themselves (through the rclone GUI) are mounted in their home folder.
+	UserRemotes UserRemotesConfig `yaml:"userRemotes"`
+	// Limits on the disk space used by each user's folders, selected by the user's groups.
+	DiskQuotas []DiskQuota `yaml:"diskQuotas"`
+	// Where and how often users' home and www folders are backed up, and how long backups are kept.
+	Backups BackupConfig `yaml:"backups"`
+	// Where the folders of deprovisioned users are archived.
+	Deprovision DeprovisionConfig `yaml:"deprovision"`
+	// The range of UIDs given to new host accounts.
+	Provisioning ProvisioningConfig `yaml:"provisioning"`
+	// The images only available during an exam, and the gateway containers their isolated networks connect to.
+	Exams ExamConfig `yaml:"exams"`
+	// Whether each session gets a Docker network of its own, and what it can reach beyond it, by user group.
+	SessionNetworks SessionNetworkConfig `yaml:"sessionNetworks"`
 	// A shared key used to protect the admin-only endpoints (used by the admin control panel). If empty, admin endpoints are disabled.
 	AdminKey string `yaml:"adminKey"`
+	// How long a caller waits for a session to start before giving up, in seconds. Defaults to 300 (five minutes).
+	StartTimeoutSeconds int `yaml:"startTimeoutSeconds"`
+	// Sessions with no activity for this many minutes are culled to free up resources. Zero (the default) disables culling.
+	IdleTimeoutMinutes int `yaml:"idleTimeoutMinutes"`
+	// What to do with an idle session: "stop" (the default) or "hibernate" (pause it, keeping the user's open windows).
+	IdleAction string `yaml:"idleAction"`
+	// The CPU, memory and process limits applied to session containers, selected by image and user group.
+	ResourceProfiles []ResourceProfile `yaml:"resourceProfiles"`
+	// The catalogue of images users can start sessions from. If empty, the images built by the install script are used.
+	Images []CatalogueImage `yaml:"images"`
+	// The components (Guacamole, the session proxy) allowed to call the session endpoints, each with its own token.
+	// If empty, all calls to those endpoints are rejected.
+	Callers []CallerCredential `yaml:"callers"`
+	// Limits on the number of sessions and the free memory kept in reserve - starts beyond them wait in a queue.
+	Admission AdmissionConfig `yaml:"admission"`
+	// When to hibernate sessions because the host is running short of memory.
+	Hibernation HibernationConfig `yaml:"hibernation"`
+	// The bearer token Prometheus presents to scrape the "/metrics" endpoint. If empty, the endpoint is disabled.
+	MetricsToken string `yaml:"metricsToken"`
+	// Where the audit log of session and admin events is written, and when it is rotated.
+	Audit AuditConfig `yaml:"audit"`
+	// Settings kept in the same file by the install script for other components, not used by the Session Manager
+	// itself - the rclone OAuth redirect URL, and the salt the session proxy hashes identity headers with.
+	RcloneOauthRedirectURL string `yaml:"rcloneOauthRedirectUrl"`
+	IdentitySalt           string `yaml:"identitySalt"`
 }
 
 // An entry in the session auto-start list - a user session (Docker container) that should be
@@ -60,9 +107,13 @@ type AutoStartEntry struct {
 	Image    string `yaml:"image" json:"image"`
 }
 
-// The structure of the auto-start list config file.
+// The structure of the auto-start list config file. As well as the sessions kept running all the time, it holds the
+// timetable rules that start and stop sessions at set times, and the term dates and holidays those rules honour.
 type AutoStartConfig struct {
-	Sessions []AutoStartEntry `yaml:"sessions" json:"sessions"`
+	Sessions  []AutoStartEntry `yaml:"sessions" json:"sessions"`
+	Schedules []ScheduleRule   `yaml:"schedules,omitempty" json:"schedules,omitempty"`
+	Terms     []DateRange      `yaml:"terms,omitempty" json:"terms,omitempty"`
+	Holidays  []DateRange      `yaml:"holidays,omitempty" json:"holidays,omitempty"`
 }
 
 func runShellCommand(command string, args ...string) string {
@@ -82,6 +133,50 @@ func startShellCommand(command string, args ...string) string {
 	return ""
 }
 
+// hostUserIDs returns the UID and GID of an existing user on the host.
+func hostUserIDs(username string) (int, int, error) {
+	hostUser, lookupErr := user.Lookup(username)
+	if lookupErr != nil {
+		return 0, 0, lookupErr
+	}
+	userUID, userUIDErr := strconv.Atoi(hostUser.Uid)
+	if userUIDErr != nil {
+		return 0, 0, userUIDErr
+	}
+	userGID, userGIDErr := strconv.Atoi(hostUser.Gid)
+	if userGIDErr != nil {
+		return 0, 0, userGIDErr
+	}
+	return userUID, userGID, nil
+}
+
+// mountRcloneRemotes goes through the config (which is simply empty by default) and uses rclone to mount any remote
+// folders for a session that is starting, whether its container is new or not. The mount supervisor owns each rclone
+// process from here on - restarting it if it fails, and unmounting the folder once the user has no session running.
+// A mount that fails now is already recorded as failed, and will be restarted after its backoff, so the session
+// starts without it unless the config marks it as required. Returns an error message, or "" if the session can
+// start.
+func mountRcloneRemotes(config Config, imageName string, username string, userUID int, userGID int) string {
+	for _, rcloneOptions := range config.RcloneMounts {
+		rcloneSpec := RcloneMountSpec{
+			Username:    username,
+			Impersonate: strings.ReplaceAll(rcloneOptions.Username, "{{USERNAME}}", username),
+			Remote:      strings.ReplaceAll(rcloneOptions.Remote, "{{USERNAME}}", username),
+			Local:       strings.ReplaceAll(rcloneOptions.Local, "{{USERNAME}}", username),
+			UID:         userUID,
+			GID:         userGID,
+		}
+		sessionStartups.report(imageName, username, startupMountingRclone, rcloneSpec.Local)
+		if mountErr := rcloneMounts.mount(rcloneSpec, rcloneMountTimeout(config)); mountErr != nil {
+			if rcloneOptions.Required {
+				return "Error mounting " + rcloneSpec.Remote + " for user " + username + ": " + mountErr.Error()
+			}
+			log.Println("Starting " + imageName + " session for user " + username + " without " + rcloneSpec.Local + ", which will be mounted when it can be: " + mountErr.Error())
+		}
+	}
+	return ""
+}
+
 func mkdirChown(theFolder string, theUserUID int, theUserGID int) string {
 	userDirErr := os.MkdirAll(theFolder, 0700)
 	if userDirErr != nil {
@@ -137,6 +232,27 @@ func readUserList() []string {
 	return users
 }
 
+// userGroups returns the names of the (host) Linux groups the given user belongs to. Used to select settings, such
+// as resource limits, that apply to particular groups of users. A user that doesn't exist yet belongs to no groups.
+func userGroups(username string) []string {
+	groupUser, lookupErr := user.Lookup(username)
+	if lookupErr != nil {
+		return nil
+	}
+	groupIDs, groupIDsErr := groupUser.GroupIds()
+	if groupIDsErr != nil {
+		fmt.Println("Error getting groups for user " + username + ": " + groupIDsErr.Error())
+		return nil
+	}
+	var groupNames []string
+	for _, groupID := range groupIDs {
+		if group, groupErr := user.LookupGroupId(groupID); groupErr == nil {
+			groupNames = append(groupNames, group.Name)
+		}
+	}
+	return groupNames
+}
+
 // Reads the total and available memory and swap from /proc/meminfo, returning the values in kilobytes.
 func readMemoryInfo() (int64, int64, int64, int64, error) {
 	memInfoFile, openErr := os.Open("/proc/meminfo")
@@ -191,30 +307,109 @@ func readDiskInfo() (uint64, uint64, error) {
 // The path of the session auto-start list config file.
 const autoStartPath = "/etc/puws/autostart.yml"
 
-// loadAutoStart reads the session auto-start list from its config file. A missing file simply
-// means no sessions are marked for auto-start, so an empty list is returned.
-func loadAutoStart() ([]AutoStartEntry, error) {
-	autoStartData, autoStartErr := os.ReadFile(autoStartPath)
+// autoStartMu serialises reading and changing the auto-start config file, so one change (an admin saving the list,
+// a provisioning run, a deprovision) can't overwrite another made at the same time.
+var autoStartMu sync.Mutex
+
+// readAutoStartConfig reads the whole auto-start config file at the given path. A missing file simply means no
+// sessions are marked for auto-start and nothing is scheduled, so an empty config is returned.
+func readAutoStartConfig(path string) (AutoStartConfig, error) {
+	autoStartData, autoStartErr := os.ReadFile(path)
 	if autoStartErr != nil {
 		if os.IsNotExist(autoStartErr) {
-			return []AutoStartEntry{}, nil
+			return AutoStartConfig{Sessions: []AutoStartEntry{}}, nil
 		}
-		return nil, autoStartErr
+		return AutoStartConfig{}, autoStartErr
 	}
 	var autoStartConfig AutoStartConfig
 	if unmarshalErr := yaml.Unmarshal(autoStartData, &autoStartConfig); unmarshalErr != nil {
-		return nil, unmarshalErr
+		return AutoStartConfig{}, unmarshalErr
+	}
+	if autoStartConfig.Sessions == nil {
+		autoStartConfig.Sessions = []AutoStartEntry{}
+	}
+	return autoStartConfig, nil
+}
+
+// writeAutoStartSessions replaces the session list in the auto-start config file at the given path. The rest of the
+// file - the schedule rules, term dates and holidays, which are edited by hand - is left as it is, comments and all,
+// by editing the parsed YAML document rather than re-writing the file from scratch. The new file is written alongside
+// the old one then moved into place, so the file is never left half-written.
+func writeAutoStartSessions(path string, sessions []AutoStartEntry) error {
+	var document yaml.Node
+	autoStartData, readErr := os.ReadFile(path)
+	if readErr != nil && !os.IsNotExist(readErr) {
+		return readErr
+	}
+	if unmarshalErr := yaml.Unmarshal(autoStartData, &document); unmarshalErr != nil {
+		return unmarshalErr
+	}
+	if len(document.Content) == 0 {
+		document = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	root := document.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return errors.New(path + " isn't a YAML mapping")
+	}
+	if sessions == nil {
+		sessions = []AutoStartEntry{}
+	}
+	var sessionsNode yaml.Node
+	if encodeErr := sessionsNode.Encode(sessions); encodeErr != nil {
+		return encodeErr
+	}
+	replaced := false
+	for index := 0; index+1 < len(root.Content); index += 2 {
+		if root.Content[index].Value == "sessions" {
+			sessionsNode.LineComment = root.Content[index+1].LineComment
+			root.Content[index+1] = &sessionsNode
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "sessions"}, &sessionsNode)
+	}
+	var output bytes.Buffer
+	encoder := yaml.NewEncoder(&output)
+	encoder.SetIndent(2)
+	if encodeErr := encoder.Encode(&document); encodeErr != nil {
+		return encodeErr
+	}
+	encoder.Close()
+	if writeErr := os.WriteFile(path+".new", output.Bytes(), 0600); writeErr != nil {
+		return writeErr
+	}
+	return os.Rename(path+".new", path)
+}
+
+// loadAutoStartConfig reads the whole auto-start config file.
+func loadAutoStartConfig() (AutoStartConfig, error) {
+	autoStartMu.Lock()
+	defer autoStartMu.Unlock()
+	return readAutoStartConfig(autoStartPath)
+}
+
+// loadAutoStart reads the session auto-start list from its config file.
+func loadAutoStart() ([]AutoStartEntry, error) {
+	autoStartConfig, loadErr := loadAutoStartConfig()
+	if loadErr != nil {
+		return nil, loadErr
 	}
 	return autoStartConfig.Sessions, nil
 }
 
-// saveAutoStart writes the session auto-start list to its config file.
-func saveAutoStart(sessions []AutoStartEntry) error {
-	autoStartData, marshalErr := yaml.Marshal(AutoStartConfig{Sessions: sessions})
-	if marshalErr != nil {
-		return marshalErr
+// updateAutoStart changes the session auto-start list - the update function is given the current list and returns
+// the new one, which is saved to the config file. The whole change is made under the auto-start lock, so changes
+// made at the same time are applied one after the other rather than one being lost.
+func updateAutoStart(update func([]AutoStartEntry) []AutoStartEntry) error {
+	autoStartMu.Lock()
+	defer autoStartMu.Unlock()
+	autoStartConfig, loadErr := readAutoStartConfig(autoStartPath)
+	if loadErr != nil {
+		return loadErr
 	}
-	return os.WriteFile(autoStartPath, autoStartData, 0600)
+	return writeAutoStartSessions(autoStartPath, update(autoStartConfig.Sessions))
 }
 
 // Checks whether a session (an image / username pair) appears in the auto-start list.
@@ -227,11 +422,6 @@ func isAutoStartSession(autoStartSessions []AutoStartEntry, imageName string, us
 	return false
 }
 
-// A mutex and set used to make sure we never try to start the same auto-start session twice at
-// once (for example, from both the periodic retry loop and an admin "save" at the same time).
-var autoStartMu sync.Mutex
-var autoStartStarting = map[string]bool{}
-
 // The interval between checks that make sure all auto-start sessions are running.
 const autoStartRetryInterval = 30 * time.Second
 
@@ -245,34 +435,32 @@ func isSessionRunning(cli *client.Client, imageName string, username string) (bo
 	return existingSession != nil && existingSession.State == "running", nil
 }
 
-// startAutoStartSession starts a session marked for auto-start, guarding against two callers
-// starting the same session at the same time. It logs the result rather than returning it, as it
-// is always called from a background goroutine.
-func startAutoStartSession(cli *client.Client, config Config, randomSeed []byte, username string, imageName string) {
-	sessionKey := imageName + "\x00" + username
-	autoStartMu.Lock()
-	if autoStartStarting[sessionKey] {
-		autoStartMu.Unlock()
+// startAutoStartSession starts a session marked for auto-start (or due to be running by the timetable - the source
+// says which, for the audit log). If the session is already being started (for example, from both the periodic retry
+// loop and an admin "save" at the same time, or because the user has just logged in) it is left to that start. It
+// logs the result rather than returning it, as it is always called from a background goroutine.
+func startAutoStartSession(cli *client.Client, config Config, randomSeed []byte, username string, imageName string, source string) {
+	if sessionStarts.inProgress(imageName, username) {
 		return
 	}
-	autoStartStarting[sessionKey] = true
-	autoStartMu.Unlock()
-
-	if startErr := startSession(cli, config, randomSeed, username, imageName); startErr != "" {
+	startErr, shared := sessionStarts.start(imageName, username, startTimeout(config), func() string {
+		return createOrStartSession(cli, config, randomSeed, username, imageName, AuditActor{Name: auditActorSystem, Source: source})
+	})
+	if shared {
+		return
+	}
+	sessionMetrics.recordAutoStart(imageName, startErr == "")
+	if startErr != "" {
 		log.Println("Error auto-starting session for user " + username + " (" + imageName + "): " + startErr)
 	} else {
 		fmt.Println("Auto-started session for user " + username + " (" + imageName + ")")
 	}
-
-	autoStartMu.Lock()
-	delete(autoStartStarting, sessionKey)
-	autoStartMu.Unlock()
 }
 
 // ensureAutoStartSessions makes sure every session in the given auto-start list that isn't already
 // running gets started, each in its own goroutine so a slow-starting container doesn't hold up the
 // others or the caller. A session that is already running is left alone.
-func ensureAutoStartSessions(cli *client.Client, config Config, randomSeed []byte, sessions []AutoStartEntry) {
+func ensureAutoStartSessions(cli *client.Client, config Config, randomSeed []byte, sessions []AutoStartEntry, source string) {
 	for _, entry := range sessions {
 		if entry.Username == "" || entry.Image == "" {
 			log.Println("Skipping invalid auto-start entry: " + entry.Image + " / " + entry.Username)
@@ -286,19 +474,20 @@ func ensureAutoStartSessions(cli *client.Client, config Config, randomSeed []byt
 		if running {
 			continue
 		}
-		go startAutoStartSession(cli, config, randomSeed, entry.Username, entry.Image)
+		go startAutoStartSession(cli, config, randomSeed, entry.Username, entry.Image, source)
 	}
 }
 
-// findSession looks for an existing container (running or stopped) for the given image and username,
-// named "imageName-username". Returns nil if no matching container is found.
+// findSession looks for an existing container (running or stopped) for the given image and username, named
+// "imageName-username". The image and user are checked against the container's labels too, rather than trusting the
+// name alone. Returns nil if no matching container is found.
 func findSession(cli *client.Client, imageName string, username string) (*container.Summary, error) {
 	containers, containersErr := cli.ContainerList(context.Background(), client.ContainerListOptions{All: true})
 	if containersErr != nil {
 		return nil, containersErr
 	}
 	for _, item := range containers.Items {
-		if strings.TrimPrefix(item.Names[0], "/") == imageName+"-"+username {
+		if sessionImage, sessionUser, isSession := sessionFromContainer(item); isSession && sessionImage == imageName && sessionUser == username {
 			return &item, nil
 		}
 	}
@@ -307,9 +496,55 @@ func findSession(cli *client.Client, imageName string, username string) (*contai
 
 // startSession makes sure a session (Docker container) for the given user and image exists and is
 // running, creating and starting it if necessary. Used both when a user connects to a "/desktop" or
-// "/ssh" endpoint and when automatically starting sessions marked for auto-start.
+// "/ssh" endpoint and when automatically starting sessions marked for auto-start. Goes through the
+// start coordinator, so if the session is already being started the caller waits for (and shares the
+// result of) that start, up to the configured start timeout.
+// The start is recorded in the audit log as done by startedBy.
+// Returns an empty string on success, or an error message.
+func startSession(cli *client.Client, config Config, randomSeed []byte, username string, imageName string, startedBy AuditActor) string {
+	startErr, _ := sessionStarts.start(imageName, username, startTimeout(config), func() string {
+		return createOrStartSession(cli, config, randomSeed, username, imageName, startedBy)
+	})
+	return startErr
+}
+
+// createOrStartSession does the work of starting a session - starting (or un-pausing) an existing
+// container, or creating the user, folders, mounts and container for a new one and waiting for it to
+// be ready. Each step of the start is reported to the startup tracker, so progress can be followed
+// via the "/sessionProgress" endpoint, and the outcome is recorded in the audit log as done by
+// startedBy. Should only be called via the start coordinator (startSession).
 // Returns an empty string on success, or an error message.
-func startSession(cli *client.Client, config Config, randomSeed []byte, username string, imageName string) string {
+func createOrStartSession(cli *client.Client, config Config, randomSeed []byte, username string, imageName string, startedBy AuditActor) (startErr string) {
+	startedAt := time.Now()
+	defer func() {
+		result, detail := auditResult(startErr)
+		sessionAudit.record(AuditEvent{Action: "session-start", Actor: startedBy.Name, Target: username, Image: imageName, Source: startedBy.Source, Result: result, Detail: detail})
+	}()
+
+	// Only images listed in the catalogue can be started, and only by users in the groups allowed to use them.
+	catalogueImage, imageErr := checkImageAllowed(config, imageName, username)
+	if imageErr != nil {
+		sessionMetrics.recordStart(imageName, time.Since(startedAt), "image-not-allowed")
+		return imageErr.Error()
+	}
+
+	// Record the outcome of the start, whichever way we return. A successful start can carry a message for the user
+	// (a warning that they are nearly out of disk space, say).
+	readyMessage := ""
+	sessionStartups.begin(imageName, username)
+	defer func() {
+		failureReason := ""
+		if startErr != "" {
+			failureReason = startFailureReason(sessionStartups.events(imageName, username))
+		}
+		sessionMetrics.recordStart(imageName, time.Since(startedAt), failureReason)
+		if startErr != "" {
+			sessionStartups.report(imageName, username, startupFailed, startErr)
+		} else {
+			sessionStartups.report(imageName, username, startupReady, readyMessage)
+		}
+	}()
+
 	// Generate a unique password for this session, a hash of the random seed and the username.
 	// Generate the Argon2-hashed password. Parameters are: time (in iterations), memory (in bytes), threads, key length.
 	VNCPassword := hex.EncodeToString(argon2.IDKey([]byte(username), randomSeed, 1, 64*1024, 4, 32))
@@ -321,8 +556,83 @@ func startSession(cli *client.Client, config Config, randomSeed []byte, username
 	if existingErr != nil {
 		return "Error listing containers: " + existingErr.Error()
 	}
+	// Exam sessions are only available to candidates in a running exam, until their time is up. A session left from
+	// an earlier exam is replaced with a fresh one.
+	examName := ""
+	if isExamImage(config, imageName) {
+		var examErr string
+		if examName, examErr = examSessions.checkStart(imageName, username, time.Now()); examErr != "" {
+			return examErr
+		}
+		if existingSession != nil && existingSession.Labels[sessionExamLabel] != examName {
+			fmt.Println("Replacing "+imageName+" session from an earlier exam for user: ", username)
+			if removeErr := removeSessionContainer(cli, *existingSession, false); removeErr != nil {
+				return "Error removing container from an earlier exam for user " + username + ": " + removeErr.Error()
+			}
+			existingSession = nil
+		}
+	}
+	if existingSession != nil && existingSession.State == "paused" {
+		// The session was hibernated (by the idle session culling, or to relieve memory pressure), so carry on where it left off.
+		fmt.Println("Waking up hibernated "+imageName+" session for user: ", username)
+		sessionStartups.report(imageName, username, startupStartingContainer, "Waking up hibernated session")
+		_, containerUnpauseErr := cli.ContainerUnpause(context.Background(), existingSession.ID, client.ContainerUnpauseOptions{})
+		if containerUnpauseErr != nil {
+			return "Error unpausing container for user " + username + ": " + containerUnpauseErr.Error()
+		}
+		return ""
+	}
+	// Users over their hard disk limit can't start a session (or get one with a read-only www folder, depending on
+	// their quota). Sessions that are already running are left alone.
+	quotaCheck := checkDiskQuota(config, username)
+	readyMessage = quotaCheck.Message
+	if quotaCheck.refusesStart() && (existingSession == nil || existingSession.State != "running") {
+		return quotaCheck.Message
+	}
+	// A stopped or new session takes up room on the host once started, so wait in the admission queue until there
+	// is room for it (a running or paused session already counts towards the limits).
+	if existingSession == nil || existingSession.State != "running" {
+		admitErr := sessionAdmissions.admit(cli, config, imageName, username, startTimeout(config))
+		if admitErr != nil {
+			return admitErr.Error()
+		}
+		defer sessionAdmissions.finished(imageName, username)
+	}
+	// A stopped session created from an older image than the catalogue now points to is recreated from the current
+	// image, rather than started again. The user's files are in bind-mounted folders on the host, so are kept.
+	// A stopped session whose www folder should now be read-only (or writable again) is recreated the same way, as a
+	// container's mounts are fixed when it is created.
+	// Likewise a stopped session that should now be on a different Docker network, or have different egress or proxy
+	// settings, or a different resource profile (its user has moved to another group, say).
+	networkPlan := planSessionNetwork(config, imageName, username, userGroups(username))
+	resourceProfile := selectResourceProfile(config.ResourceProfiles, imageName, userGroups(username))
+	if existingSession != nil && existingSession.State != "running" && (newImageIDCache(cli, config).isOutdatedSession(*existingSession) || (existingSession.Labels[sessionWWWReadOnlyLabel] == "true") != quotaCheck.wwwReadOnly() || sessionNetworkChanged(*existingSession, networkPlan) || resourceProfileChanged(*existingSession, resourceProfile)) {
+		fmt.Println("Recreating outdated "+imageName+" session for user: ", username)
+		if removeErr := removeSessionContainer(cli, *existingSession, false); removeErr != nil {
+			return "Error removing outdated container for user " + username + ": " + removeErr.Error()
+		}
+		existingSession = nil
+	}
 	if existingSession != nil {
 		fmt.Println("Starting existing "+imageName+" session for user: ", username)
+		sessionStartups.report(imageName, username, startupStartingContainer, "Starting existing session")
+		// Bring the container's resource limits up to date, in case its resource profile has changed since it was created.
+		if resourcesErr := applyResourceProfile(cli, config, existingSession.ID, username, imageName); resourcesErr != nil {
+			log.Println("Error updating resource limits for user " + username + ": " + resourcesErr.Error())
+		}
+		if networkErr := ensureSessionNetwork(cli, networkPlan); networkErr != nil {
+			return networkErr.Error()
+		}
+		// The mount supervisor unmounted the user's remote folders when their session stopped, so mount them again.
+		if len(config.RcloneMounts) > 0 {
+			userUID, userGID, idsErr := hostUserIDs(username)
+			if idsErr != nil {
+				return "Error looking up user " + username + ": " + idsErr.Error()
+			}
+			if mountErr := mountRcloneRemotes(config, imageName, username, userUID, userGID); mountErr != "" {
+				return mountErr
+			}
+		}
 		_, containerStartErr := cli.ContainerStart(context.Background(), existingSession.ID, client.ContainerStartOptions{})
 		if containerStartErr != nil {
 			return "Error starting container for user " + username + ": " + containerStartErr.Error()
@@ -331,6 +641,7 @@ func startSession(cli *client.Client, config Config, randomSeed []byte, username
 	}
 
 	fmt.Println("Starting "+imageName+" session for user: ", username)
+	sessionStartups.report(imageName, username, startupCreatingUser, "")
 
 	// Make sure there is a user with that username on the host machine so that when we create folders to mount in their Docker image they have the appropriate ownership and permissions.
 	userUIDStr := ""
@@ -343,8 +654,8 @@ func startSession(cli *client.Client, config Config, randomSeed []byte, username
 			userUIDStr = desktopUser.Uid
 			userGIDStr = desktopUser.Gid
 		} else {
-			// The user wasn't found - the user doesn't exist, therefore create it.
-			userCreateOutput = runShellCommand("useradd", "-m", "-s", "/bin/bash", username)
+			// The user wasn't found - the user doesn't exist, therefore create it, with a UID from the provisioning range.
+			userCreateOutput = createHostAccount(config, username, "")
 			userTryCount = userTryCount + 1
 		}
 	}
@@ -372,57 +683,54 @@ func startSession(cli *client.Client, config Config, randomSeed []byte, username
 		return mkdirErr
 	}
 
-	// Go through the config (which is simply empty by default) and use rclone to mount any remote folders.
-	for _, rcloneOptions := range config.RcloneMounts {
-		// First, set up the values used in the rclone commands.
-		rcloneUsername := strings.ReplaceAll(rcloneOptions.Username, "{{USERNAME}}", username)
-		rcloneDriveImpersonate := []string{}
-		if rcloneUsername != "" {
-			rcloneDriveImpersonate = []string{"--drive-impersonate", rcloneUsername}
-		}
-		rcloneLocal := strings.ReplaceAll(rcloneOptions.Local, "{{USERNAME}}", username)
-		rcloneRemote := strings.ReplaceAll(rcloneOptions.Remote, "{{USERNAME}}", username)
-
-		// Make sure the local folder isn't already being used as a mount point.
-		umountOutput := runShellCommand("umount", rcloneLocal)
-		if umountOutput != "" {
-			fmt.Println("umountOutput: " + umountOutput)
-		}
-
-		// Make sure the local folder exists and is owned by the user.
-		mkdirErr = mkdirChown(rcloneLocal, userUID, userGID)
-		if mkdirErr != "" {
-			return mkdirErr
-		}
-
-		// Make sure the remote destination exists - create a new, empty folder (using rclone) if not.
-		rcloneMkdirOutput := startShellCommand("rclone", append(append([]string{"mkdir"}, rcloneDriveImpersonate...), []string{rcloneUsername, rcloneRemote}...)...)
-		if rcloneMkdirOutput != "" {
-			fmt.Println("rcloneMkdirOutput: " + rcloneMkdirOutput)
-		}
+	if mountErr := mountRcloneRemotes(config, imageName, username, userUID, userGID); mountErr != "" {
+		return mountErr
+	}
 
-		// Mount the remote folder using rclone.
-		rcloneMountOutput := startShellCommand("rclone", append(append([]string{"mount"}, rcloneDriveImpersonate...), []string{"--vfs-cache-mode", "full", "--allow-other", rcloneRemote, rcloneLocal}...)...)
-		if rcloneMountOutput != "" {
-			fmt.Println("rcloneMountOutput: " + rcloneMountOutput)
+	// Work out the resource limits (CPU, memory, processes) to apply to the container, from the first resource
+	// profile that matches this image and the user's groups. With no matching profile, no limits are applied.
+	containerLabels := map[string]string{
+		sessionUsernameLabel: username,
+		sessionImageLabel:    imageName,
+	}
+	var containerResources container.Resources
+	var containerShmSize int64
+	if resourceProfile != nil {
+		var resourcesErr error
+		containerResources, resourcesErr = resourceProfile.resources()
+		if resourcesErr != nil {
+			return "Error in config file: " + resourcesErr.Error()
 		}
-
-		// Wait for the mount operation to complete.
-		rcloneFolderMounted := false
-		for rcloneFolderMounted == false {
-			// Run "df -h" to see if the folder is mounted okay.
-			for _, line := range strings.Split(runShellCommand("df", "-h"), "\n") {
-				if strings.Contains(line, rcloneLocal) {
-					rcloneFolderMounted = true
-				}
-			}
-			fmt.Println("Waiting for rclone mount " + rcloneLocal + " to complete...")
-			// Pause to make sure(ish) the mount operation is complete.
-			time.Sleep(1 * time.Second)
+		containerShmSize, resourcesErr = parseByteSize(resourceProfile.ShmSize)
+		if resourcesErr != nil {
+			return "Error in config file: resource profile " + resourceProfile.Name + ", shmSize: " + resourcesErr.Error()
 		}
+		containerLabels[sessionResourceProfileLabel] = resourceProfile.Name
+	}
+	if quotaCheck.wwwReadOnly() {
+		containerLabels[sessionWWWReadOnlyLabel] = "true"
+	}
+	if examName != "" {
+		containerLabels[sessionExamLabel] = examName
+	}
+	// Isolated sessions (and exam sessions) get a network of their own, which reaches only its gateways and, depending
+	// on the user's egress policy, the internet or the school's proxy.
+	containerLabels[sessionNetworkLabel] = networkPlan.Name
+	if networkPlan.Egress != "" {
+		containerLabels[sessionEgressLabel] = networkPlan.Egress
+	}
+	if networkPlan.Policy != "" {
+		containerLabels[sessionEgressPolicyLabel] = networkPlan.Policy
+	}
+	if networkPlan.Settings != "" {
+		containerLabels[sessionEgressSettingsLabel] = networkPlan.Settings
+	}
+	if networkErr := ensureSessionNetwork(cli, networkPlan); networkErr != nil {
+		return networkErr.Error()
 	}
 
 	// Create the container that holds the user's VNC session.
+	sessionStartups.report(imageName, username, startupCreatingContainer, "")
 	containerContext := context.Background()
 	exposedPort, _ := network.ParsePort(strconv.Itoa(int(VNCPort)) + "/TCP")
 	resp, containerCreateErr := cli.ContainerCreate(containerContext, client.ContainerCreateOptions{
@@ -430,26 +738,37 @@ func startSession(cli *client.Client, config Config, randomSeed []byte, username
 			// Expose the VNC port number we want to use to connect to the VNC instance running in this container.
 			ExposedPorts: network.PortSet{exposedPort: {}},
 			// Pass in the VNC password and display number to the custom startup script that runs inside the container.
-			Cmd: []string{"bash", "/root/docker-" + imageName + "-root-startup.sh", username, userUIDStr, userGIDStr, VNCPassword, strconv.Itoa(VNCDisplay)},
+			Cmd: []string{"bash", catalogueImage.startupScript(), username, userUIDStr, userGIDStr, VNCPassword, strconv.Itoa(VNCDisplay)},
+			// Pass in the web proxy settings from the user's egress policy, if any.
+			Env: networkPlan.Environment,
 			Tty: false,
+			// Label the container so we can tell it's a user session, and whose, when managing containers later.
+			Labels: containerLabels,
 		},
 		NetworkingConfig: &network.NetworkingConfig{
-			// Join the container to the main network group so the Guacamole gateway can see the VNC instance.
+			// Join the container to the main network group (or its own network) so the Guacamole gateway can see the VNC instance.
 			EndpointsConfig: map[string]*network.EndpointSettings{
-				"pangolin_main": &network.EndpointSettings{},
+				networkPlan.Name: &network.EndpointSettings{},
 			},
 		},
 		HostConfig: &container.HostConfig{
+			// Limit the resources the container can use, so one user can't starve everyone else.
+			Resources: containerResources,
+			ShmSize:   containerShmSize,
 			// Set up mount points in the container. Confusingly, these mount points, in /home/username, will be created before the actual user inside the container.
 			// Therefore, there is a startup script (that runs as root) inside the container that sets up the named user, matching UIDs with the host.
-			Mounts: []mount.Mount{
+			// Any extra mounts listed for the image in the catalogue are added after the standard ones.
+			Mounts: append([]mount.Mount{
 				// We mount the host's user's home folder into the container. We have to match up the UIDs for the host and containers, hence us having to pass in the
 				// host user's UID to the container's startup script.
+				// Mounts made in the home folder after the container has started (remotes the user sets up during the
+				// session, or rclone mounts restarted after a failure) are passed on into the container.
 				mount.Mount{
-					Type:     mount.TypeBind,
-					Source:   "/home/" + username,
-					Target:   "/home/" + username,
-					ReadOnly: false,
+					Type:        mount.TypeBind,
+					Source:      "/home/" + username,
+					Target:      "/home/" + username,
+					ReadOnly:    false,
+					BindOptions: &mount.BindOptions{Propagation: mount.PropagationRSlave},
 				},
 				// We mount the host www folder into the container. This is separate from the user's main home folder, we have a (custom) web server in a separate container
 				// that serves user websites. This means a user doesn't have to have an active desktop session running for their website files to be served.
@@ -457,7 +776,7 @@ func startSession(cli *client.Client, config Config, randomSeed []byte, username
 					Type:     mount.TypeBind,
 					Source:   "/var/www/" + username,
 					Target:   "/home/" + username + "/www",
-					ReadOnly: false,
+					ReadOnly: quotaCheck.wwwReadOnly(),
 				},
 				// We mount the host /etc/webconsole/tasks folder into the container. This lets the user create and edit Web Console Tasks.
 				mount.Mount{
@@ -466,10 +785,10 @@ func startSession(cli *client.Client, config Config, randomSeed []byte, username
 					Target:   "/home/" + username + "/webconsole",
 					ReadOnly: false,
 				},
-			},
+			}, append(catalogueImage.extraMounts(username), networkPlan.Mounts...)...),
 		},
-		// We use our own container image.
-		Image: "sansay.co.uk-docker" + imageName + ":0.1-beta.3",
+		// The container image (including version) comes from the image catalogue.
+		Image: catalogueImage.reference(),
 		// Use a consistant name we can use later for management.
 		Name: imageName + "-" + username,
 	})
@@ -484,31 +803,86 @@ func startSession(cli *client.Client, config Config, randomSeed []byte, username
 		return "Error starting container for user " + username + ", " + containerStartErr.Error()
 	}
 
-	// Get a reader object to read the container logs so we can check to see when the VNC server has started up.
-	logReader, logReaderErr := cli.ContainerLogs(containerContext, resp.ID, client.ContainerLogsOptions{ShowStdout: true, ShowStderr: true, Follow: true, Timestamps: true, Tail: "all"})
+	// Get a reader object to read the container logs so we can check to see when the VNC server has started up. A
+	// container that never gets there would otherwise keep us reading its logs forever - and the start in progress,
+	// with every caller since waiting on it - so give up after the start timeout.
+	sessionStartups.report(imageName, username, startupWaitingForVNC, "")
+	readyTimeout := startTimeout(config)
+	readyContext, cancelReady := context.WithTimeout(containerContext, readyTimeout)
+	defer cancelReady()
+	logReader, logReaderErr := cli.ContainerLogs(readyContext, resp.ID, client.ContainerLogsOptions{ShowStdout: true, ShowStderr: true, Follow: true, Timestamps: true, Tail: "all"})
 	if logReaderErr != nil {
 		return "Error getting reader from container, " + logReaderErr.Error()
 	}
 	defer logReader.Close()
 
-	// Create a new buffered scanner object so we can read the container logs a line at a time, looping until we see the "Starting VNC server" message.
+	// Create a new buffered scanner object so we can read the container logs a line at a time, looping until we see the image's
+	// "ready" message (by default, "Starting VNC server").
 	logScanner := bufio.NewScanner(logReader)
 	logLine := ""
-	// Note that, unless the container terminates early due to some error, logScanner.Scan() should always return true.
-	for logScanner.Scan() && !strings.Contains(logLine, "Starting VNC server") {
+	var recentLogLines []string
+	// Note that, unless the container terminates early due to some error, logScanner.Scan() should always return true. The "ready"
+	// check comes first so we stop as soon as the message arrives, rather than waiting for another line of output.
+	for !strings.Contains(logLine, catalogueImage.readyMarker()) && logScanner.Scan() {
 		logLine = logScanner.Text()
+		recentLogLines = lastLogLines(recentLogLines, logLine, 5)
 		fmt.Println(logLine)
 		time.Sleep(1 * time.Second)
 	}
 
 	// Report any errors during the log reading process.
+	if readyContext.Err() != nil && !strings.Contains(logLine, catalogueImage.readyMarker()) {
+		return "Timed out after " + readyTimeout.String() + " waiting for " + imageName + " session for user " + username + " to be ready: " + strings.Join(recentLogLines, " / ")
+	}
 	if logScannerErr := logScanner.Err(); logScannerErr != nil {
 		return "Error getting reader from container, " + logScannerErr.Error()
 	}
+	// If the logs ended without the "ready" message, the container stopped before the session started up.
+	if !strings.Contains(logLine, catalogueImage.readyMarker()) {
+		return "Container for user " + username + " stopped before the session was ready: " + strings.Join(recentLogLines, " / ")
+	}
 	return ""
 }
 
 func main() {
+	// Command-line options: "-check-config" checks the config file and exits, without starting anything.
+	// "-provision" sets up the users listed in a CSV file, prints a report and exits. "-caller-token" prints the token
+	// of one of the callers in the config file, for the install script.
+	configPathFlag := flag.String("config", defaultConfigPath, "the config file")
+	checkConfigFlag := flag.Bool("check-config", false, "check the config file for problems, then exit")
+	provisionFlag := flag.String("provision", "", "provision the users listed in this CSV file, then exit")
+	callerTokenFlag := flag.String("caller-token", "", "print the token of the named caller in the config file, then exit")
+	flag.Parse()
+	configPath := *configPathFlag
+	if *callerTokenFlag != "" {
+		// Only the token is printed to stdout, so the install script can capture it.
+		tokenConfig, _, problems := loadConfigFile(configPath)
+		if len(problems) > 0 {
+			fmt.Fprintln(os.Stderr, "Problems found in "+configPath+": "+strings.Join(problems, "; "))
+			os.Exit(1)
+		}
+		if !printCallerToken(tokenConfig, *callerTokenFlag) {
+			os.Exit(1)
+		}
+		return
+	}
+	if *checkConfigFlag {
+		if !checkConfigFile(configPath) {
+			os.Exit(1)
+		}
+		return
+	}
+	if *provisionFlag != "" {
+		if !checkConfigFile(configPath) {
+			os.Exit(1)
+		}
+		provisionConfig, _, _ := loadConfigFile(configPath)
+		if !provisionFromFile(provisionConfig, *provisionFlag) {
+			os.Exit(1)
+		}
+		return
+	}
+
 	// We want each desktop instance to have a separate, un-guessable VNC password. However, we also want that password to be consistant so we can easily reconnect a user to their session.
 	// Rather than hold session passwords in memory, we use a hash function to generate a password for each session from the username and a secret seed value.
 	// That seed value is a simple string, stored in a text file at /etc/puws/seed.txt. If that path doesn't already exist, we create it now.
@@ -549,21 +923,20 @@ func main() {
 		return
 	}
 
-	// Create an empty instance of the Config struct...
-	var config Config
-	// ...and read config data - just skip if there's no config file, the config variable will simply remain empty.
-	configPath := "/etc/puws/config.yml"
-	configFile, err := os.ReadFile(configPath)
-	if err == nil {
-		// Parse the YAML bytes into the Config struct instance.
-		err = yaml.Unmarshal(configFile, &config)
-		if err != nil {
-			log.Fatalf("Failed to parse YAML config: %v", err)
-		}
+	// Read and check the config data - just skip if there's no config file, everything will simply be left at its
+	// default. A config file with problems stops us starting, rather than running with something half-configured.
+	loadedConfig, configData, configProblems := loadConfigFile(configPath)
+	if len(configProblems) > 0 {
+		log.Fatalf("Problems found in config file %s: %s", configPath, strings.Join(configProblems, "; "))
+	}
+	if configData != nil {
 		fmt.Println("Config data loaded from " + configPath)
 	} else {
 		fmt.Println("No config file found at " + configPath + ", using default values.")
 	}
+	// Make it the running config (which also starts the audit log), then reload it whenever it changes.
+	applyConfig(loadedConfig, configData)
+	go watchConfig(configPath)
 
 	// Initialize the Docker client. It automatically looks for the Docker socket (unix:///var/run/docker.sock).
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
@@ -572,13 +945,90 @@ func main() {
 	}
 	defer cli.Close()
 
-	// To do: somewhere, add a periodic function that can do things like close sessions that have been disconnected from for a set time.
+	// Clear away any session networks whose containers were removed while the Session Manager wasn't running.
+	sweepSessionNetworks(cli)
+
+	// Periodically check for sessions that haven't been used for a while and stop (or hibernate) them to free up resources.
+	go func() {
+		for {
+			time.Sleep(idleCheckInterval)
+			cullIdleSessions(cli, runningConfig.get())
+		}
+	}()
+
+	// Periodically collect CPU, memory, network and disk stats for each running session, for the admin panel.
+	go func() {
+		for {
+			collectSessionStats(cli)
+			time.Sleep(statsInterval)
+		}
+	}()
+
+	// Periodically count the disk space used by each user's folders, to check against their disk quota.
+	go func() {
+		for {
+			countDiskUsage(runningConfig.get())
+			time.Sleep(diskUsageInterval)
+		}
+	}()
+
+	// Periodically back up users' folders that are due a backup, and delete expired backups.
+	go func() {
+		for {
+			runBackups(runningConfig.get())
+			time.Sleep(backupCheckInterval)
+		}
+	}()
+
+	// Periodically check each rclone mount is still working, restarting any that have failed, and unmount the folders
+	// of users who no longer have a session running. Remotes users have added or deleted themselves are mounted or
+	// unmounted at the same time.
+	go func() {
+		for {
+			time.Sleep(mountCheckInterval)
+			config := runningConfig.get()
+			rcloneMounts.check(cli, config)
+			syncUserRemotes(cli, config)
+		}
+	}()
+
+	// Periodically check whether the host is short of memory, and if so hibernate the least recently used sessions.
+	go func() {
+		for {
+			time.Sleep(memoryPressureCheckInterval)
+			relieveMemoryPressure(cli, runningConfig.get())
+		}
+	}()
+
+	// Periodically stop sessions that have been hibernated for too long.
+	go func() {
+		for {
+			time.Sleep(idleCheckInterval)
+			stopLongHibernatedSessions(cli, runningConfig.get())
+		}
+	}()
+
+	// Pick up any exams that were running when the Session Manager last stopped, then periodically lock the sessions
+	// of candidates whose time is up, and clear away finished exams.
+	if examsErr := examSessions.load(); examsErr != nil {
+		log.Println("Error loading exams: " + examsErr.Error())
+	}
+	go func() {
+		for {
+			checkExams(cli, runningConfig.get(), time.Now())
+			time.Sleep(examCheckInterval)
+		}
+	}()
 
 	// Endpoint connectToSession - returns a port number and password to connect with VNC.
 	// Usage: POST /connectToSession?username=USERNAME&image=IMAGENAME
 	// Returns: JSON { portNumber, password }
 	// If an existing session already exists for the user it returns the details for that, otherwise it starts a new session (container).
+	// The caller must present its token (set in the config file) in an "Authorization: Bearer ..." header.
 	http.HandleFunc("/connectToSession", func(httpResponse http.ResponseWriter, r *http.Request) {
+		// Take a copy of the running config, which stays the same for the whole request even if the config file is
+		// reloaded part way through. Each handler below does the same.
+		config := runningConfig.get()
 		// Parse the HTTP GET/POST request form data.
 		if err := r.ParseForm(); err != nil {
 			http.Error(httpResponse, "Error parsing form", http.StatusBadRequest)
@@ -597,6 +1047,32 @@ func main() {
 			return
 		}
 
+		// Only trusted components, with a token allowing them to use this image, can connect to sessions.
+		caller := checkCaller(httpResponse, r, config, imageName)
+		if caller == nil {
+			return
+		}
+
+		// Reject requests for images that aren't in the catalogue, or that this user isn't allowed to use.
+		if _, imageErr := checkImageAllowed(config, imageName, username); imageErr != nil {
+			log.Println("Rejected request from user " + username + ": " + imageErr.Error())
+			sessionAudit.record(AuditEvent{Action: "session-connect", Actor: username, Target: username, Image: imageName, Source: caller.Name, Result: "denied", Detail: imageErr.Error()})
+			imageErrStatus := http.StatusForbidden
+			if findCatalogueImage(config, imageName) == nil {
+				imageErrStatus = http.StatusBadRequest
+			}
+			http.Error(httpResponse, imageErr.Error(), imageErrStatus)
+			return
+		}
+		// Exam sessions can only be connected to during the user's exam.
+		if isExamImage(config, imageName) {
+			if _, examErr := examSessions.checkStart(imageName, username, time.Now()); examErr != "" {
+				sessionAudit.record(AuditEvent{Action: "session-connect", Actor: username, Target: username, Image: imageName, Source: caller.Name, Result: "denied", Detail: examErr})
+				http.Error(httpResponse, examErr, http.StatusForbidden)
+				return
+			}
+		}
+
 		fmt.Println("Looking for session for user: ", username)
 
 		// Look for an existing (running or stopped) session container for this user.
@@ -610,26 +1086,74 @@ func main() {
 		// Generate the Argon2-hashed password. Parameters are: time (in iterations), memory (in bytes), threads, key length.
 		VNCPassword := hex.EncodeToString(argon2.IDKey([]byte(username), randomSeed, 1, 64*1024, 4, 32))
 
-		// If no running session exists, possibly start one.
+		// If no running session exists, possibly start one. A hibernated (paused) session is always woken up, whether
+		// or not the caller asked for a start, as to the user it was still running.
 		if existingSession == nil || existingSession.State != "running" {
 			// A session isn't running, but we don't want to start one, so return to the caller.
-			if startIfNotRunning != "true" {
+			hibernated := existingSession != nil && existingSession.State == "paused"
+			if startIfNotRunning != "true" && !hibernated {
 				httpResponse.Header().Set("Content-Type", "application/json")
 				fmt.Fprintf(httpResponse, "{\"portNumber\":\"0\", \"password\":\"\"}")
 				return
 			}
-			// Start the session - this creates a new container if one doesn't already exist.
-			if startErr := startSession(cli, config, randomSeed, username, imageName); startErr != "" {
+			// Start (or wake up) the session - this creates a new container if one doesn't already exist.
+			if startErr := startSession(cli, config, randomSeed, username, imageName, AuditActor{Name: username, Source: caller.Name}); startErr != "" {
+				sessionAudit.record(AuditEvent{Action: "session-connect", Actor: username, Target: username, Image: imageName, Source: caller.Name, Result: "failed", Detail: startErr})
 				http.Error(httpResponse, startErr, http.StatusInternalServerError)
 				return
 			}
 		}
 
+		// Connecting to a session counts as activity, so it doesn't get culled as idle.
+		sessionActivity.touch(imageName, username)
+		sessionAudit.record(AuditEvent{Action: "session-connect", Actor: username, Target: username, Image: imageName, Source: caller.Name})
+
 		// If we've got to this point, we should have a running container with a VNC session started up on a known port and with a known password.
 		httpResponse.Header().Set("Content-Type", "application/json")
 		fmt.Fprintf(httpResponse, "{\"portNumber\":\"%s\", \"password\":\"%s\"}", strconv.Itoa(5901), VNCPassword)
 	})
 
+	// Endpoint sessionActivity - records that a user's session is in use, so it doesn't get culled as idle. Called by
+	// the sessionProxy while it is passing traffic through to a user's session. Needs a caller token, as for connectToSession.
+	// Usage: POST /sessionActivity?username=USERNAME&image=IMAGENAME
+	http.HandleFunc("/sessionActivity", func(httpResponse http.ResponseWriter, r *http.Request) {
+		config := runningConfig.get()
+		if err := r.ParseForm(); err != nil {
+			http.Error(httpResponse, "Error parsing form", http.StatusBadRequest)
+			return
+		}
+		username := strings.TrimSpace(r.FormValue("username"))
+		imageName := strings.TrimSpace(r.FormValue("image"))
+		if username == "" || imageName == "" {
+			http.Error(httpResponse, "Missing 'username' or 'image' parameter", http.StatusBadRequest)
+			return
+		}
+		if checkCaller(httpResponse, r, config, imageName) == nil {
+			return
+		}
+		sessionActivity.touch(imageName, username)
+		httpResponse.WriteHeader(http.StatusNoContent)
+	})
+
+	// Endpoint sessionProgress - streams the startup progress of a session as server-sent events, one event per
+	// state (creating-user, mounting-rclone, creating-container, starting-container, waiting-for-vnc, then ready or
+	// failed), each with a timestamp and an optional message. The stream ends once the session is ready or has failed.
+	// Needs a caller token, as for connectToSession.
+	// Usage: GET /sessionProgress?username=USERNAME&image=IMAGENAME
+	http.HandleFunc("/sessionProgress", func(httpResponse http.ResponseWriter, r *http.Request) {
+		config := runningConfig.get()
+		username := strings.TrimSpace(r.FormValue("username"))
+		imageName := strings.TrimSpace(r.FormValue("image"))
+		if username == "" || imageName == "" {
+			http.Error(httpResponse, "Missing 'username' or 'image' parameter", http.StatusBadRequest)
+			return
+		}
+		if checkCaller(httpResponse, r, config, imageName) == nil {
+			return
+		}
+		streamStartupProgress(httpResponse, r, imageName, username)
+	})
+
 	// The following endpoints provide a "control panel" for system administrators, used by the web-based admin panel.
 	// The endpoints are protected by a shared admin key, set in the config file, which the admin panel presents via the "X-Admin-Key" header.
 
@@ -637,6 +1161,7 @@ func main() {
 	// Usage: GET /admin/status
 	// Returns: JSON with a list of sessions (including stopped ones, marked if they're selected for auto-start) and host resource usage values.
 	http.HandleFunc("/admin/status", func(httpResponse http.ResponseWriter, r *http.Request) {
+		config := runningConfig.get()
 		// Check the caller is presenting the correct admin key.
 		if !isValidAdminKey(r, config.AdminKey) {
 			http.Error(httpResponse, "Unauthorized", http.StatusUnauthorized)
@@ -661,37 +1186,107 @@ func main() {
 			return
 		}
 
-		// Load the current auto-start list, so we can mark which sessions have been selected for it.
-		autoStartSessions, autoStartErr := loadAutoStart()
+		// Load the current auto-start list, so we can mark which sessions have been selected for it, and each
+		// scheduled session's next start or stop.
+		autoStartConfig, autoStartErr := loadAutoStartConfig()
 		if autoStartErr != nil {
 			http.Error(httpResponse, "Error loading auto-start list: "+autoStartErr.Error(), http.StatusInternalServerError)
 			return
 		}
+		autoStartSessions := autoStartConfig.Sessions
+		nextActions := scheduledActions(config, autoStartConfig, time.Now())
+		nextActionsBySession := make(map[string]ScheduledAction)
+		for _, nextAction := range nextActions {
+			nextActionsBySession[sessionKey(nextAction.Image, nextAction.Username)] = nextAction
+		}
 
 		// Go through the containers, adding the important details of each one to our response.
+		imageIDs := newImageIDCache(cli, config)
+		sessionStatsHistory := make(map[string][]StatsSample)
 		var sessions []map[string]string
 		for _, item := range containers.Items {
-			// The container name is "imageName-username" - split it into its two parts.
+			// The session's image and user come from the container's labels (or, for older containers, its name).
 			sessionName := strings.TrimPrefix(item.Names[0], "/")
-			sessionParts := strings.SplitN(sessionName, "-", 2)
-			imageName := ""
-			username := ""
-			if len(sessionParts) == 2 {
-				imageName = sessionParts[0]
-				username = sessionParts[1]
+			imageName, username, isSession := sessionFromContainer(item)
+			// When the session was last used, if we know.
+			lastActivity := ""
+			if lastTime, seen := sessionActivity.lastSeen(imageName, username); seen {
+				lastActivity = lastTime.Format(time.RFC3339)
 			}
-			sessions = append(sessions, map[string]string{
-				"name":      sessionName,
-				"image":     item.Image,
-				"imageName": imageName,
-				"username":  username,
-				"state":     string(item.State),
-				"status":    item.Status,
-				"autoStart": strconv.FormatBool(isAutoStartSession(autoStartSessions, imageName, username)),
-			})
+			sessionData := map[string]string{
+				"name":         sessionName,
+				"image":        item.Image,
+				"imageName":    imageName,
+				"username":     username,
+				"state":        string(item.State),
+				"status":       item.Status,
+				"autoStart":    strconv.FormatBool(isAutoStartSession(autoStartSessions, imageName, username)),
+				"lastActivity": lastActivity,
+			}
+			// For user sessions, add the latest startup state, the resource profile and the limits actually applied to the container.
+			if isSession {
+				sessionData["isSession"] = "true"
+				if startupEvents := sessionStartups.events(imageName, username); len(startupEvents) > 0 {
+					sessionData["startupState"] = startupEvents[len(startupEvents)-1].State
+				}
+				sessionData["resourceProfile"] = item.Labels[sessionResourceProfileLabel]
+				sessionData["network"] = containerNetwork(item)
+				sessionData["egress"] = item.Labels[sessionEgressLabel]
+				sessionData["egressPolicy"] = item.Labels[sessionEgressPolicyLabel]
+				sessionData["egressSettings"] = item.Labels[sessionEgressSettingsLabel]
+				if nextAction, scheduled := nextActionsBySession[sessionKey(imageName, username)]; scheduled {
+					sessionData["scheduledAction"] = nextAction.Action
+					sessionData["scheduledTime"] = nextAction.Time.Format(time.RFC3339)
+				}
+				sessionData["outdated"] = strconv.FormatBool(imageIDs.isOutdatedSession(item))
+				// The latest resource use figures, plus the peak memory use over the stats history.
+				if statsHistory := sessionStats.history(imageName, username); len(statsHistory) > 0 {
+					latestStats := statsHistory[len(statsHistory)-1]
+					var memoryPeak uint64 = 0
+					for _, sample := range statsHistory {
+						memoryPeak = max(memoryPeak, sample.MemoryBytes)
+					}
+					sessionData["cpuPercent"] = strconv.FormatFloat(latestStats.CPUPercent, 'f', 1, 64)
+					sessionData["memoryBytes"] = strconv.FormatUint(latestStats.MemoryBytes, 10)
+					sessionData["memoryPeakBytes"] = strconv.FormatUint(memoryPeak, 10)
+					sessionData["memoryUsageLimitBytes"] = strconv.FormatUint(latestStats.MemoryLimitBytes, 10)
+					sessionData["networkRxBytes"] = strconv.FormatUint(latestStats.NetworkRxBytes, 10)
+					sessionData["networkTxBytes"] = strconv.FormatUint(latestStats.NetworkTxBytes, 10)
+					sessionData["blockReadBytes"] = strconv.FormatUint(latestStats.BlockReadBytes, 10)
+					sessionData["blockWriteBytes"] = strconv.FormatUint(latestStats.BlockWriteBytes, 10)
+					sessionStatsHistory[sessionName] = statsHistory
+				}
+				inspectResult, inspectErr := cli.ContainerInspect(context.Background(), item.ID, client.ContainerInspectOptions{})
+				if inspectErr == nil {
+					for limitName, limitValue := range describeResources(inspectResult.Container.HostConfig) {
+						sessionData[limitName] = limitValue
+					}
+				}
+			}
+			sessions = append(sessions, sessionData)
 		}
 		responseData["sessions"] = sessions
+		responseData["stats"] = sessionStatsHistory
 		responseData["autostart"] = autoStartSessions
+		responseData["schedule"] = nextActions
+		responseData["scheduleProblems"] = sessionSchedule.currentProblems()
+		responseData["exams"] = examSessions.list()
+		responseData["images"] = catalogueImageNames(config)
+
+		// The sessions recently stopped or paused for being idle.
+		responseData["idleTimeoutMinutes"] = config.IdleTimeoutMinutes
+		responseData["culled"] = sessionCulls.list()
+		responseData["maxSessions"] = config.Admission.MaxSessions
+		responseData["queue"] = sessionAdmissions.entries()
+		responseData["upgrade"] = sessionUpgrades.current()
+
+		// The state of each user's rclone mounts.
+		responseData["mounts"] = rcloneMounts.statuses()
+		responseData["rejectedRemotes"] = userRemotes.rejectedRemotes()
+		responseData["diskUsage"] = diskUsage.all(config)
+		if config.Backups.Target != "" {
+			responseData["backups"] = sessionBackups.status()
+		}
 
 		// The list of Linux users (UID 1001+) the admin can pick from when adding to the auto-start list.
 		responseData["users"] = readUserList()
@@ -726,11 +1321,563 @@ func main() {
 		httpResponse.Write(jsonData)
 	})
 
+	// Endpoint /admin/sessionAction - stops, restarts, pauses, unpauses, removes or recreates a single user session.
+	// Destructive actions (remove and recreate) must be confirmed by passing the session's name again as "confirm".
+	// Requires the admin key.
+	// Usage: POST /admin/sessionAction - accepts { "name": "desktop-jane.doe", "action": "stop", "confirm": "" }
+	// Returns: JSON { "name": "...", "action": "...", "result": "ok" }
+	http.HandleFunc("/admin/sessionAction", func(httpResponse http.ResponseWriter, r *http.Request) {
+		config := runningConfig.get()
+		// Check the caller is presenting the correct admin key.
+		if !isValidAdminKey(r, config.AdminKey) {
+			http.Error(httpResponse, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(httpResponse, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var actionRequest SessionActionRequest
+		if decoderErr := json.NewDecoder(r.Body).Decode(&actionRequest); decoderErr != nil {
+			http.Error(httpResponse, "Error parsing request: "+decoderErr.Error(), http.StatusBadRequest)
+			return
+		}
+		actionRequest.Name = strings.TrimSpace(actionRequest.Name)
+		if checkErr := checkSessionAction(actionRequest); checkErr != "" {
+			http.Error(httpResponse, checkErr, http.StatusBadRequest)
+			return
+		}
+		session, sessionErr := findSessionByName(cli, actionRequest.Name)
+		if sessionErr != nil {
+			http.Error(httpResponse, "Error listing containers: "+sessionErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		if session == nil {
+			http.Error(httpResponse, "No session named \""+actionRequest.Name+"\"", http.StatusNotFound)
+			return
+		}
+		// Leave a session that is in the middle of starting alone, rather than pulling the container out from under the start.
+		imageName, username, _ := sessionFromContainer(*session)
+		if sessionStarts.inProgress(imageName, username) {
+			http.Error(httpResponse, "Session \""+actionRequest.Name+"\" is starting - try again once it has started", http.StatusConflict)
+			return
+		}
+		actor := AuditActor{Name: adminActor(r), Source: auditSourceAdminPanel}
+		// A locked exam session stays locked until the exam is extended.
+		if examErr := checkExamSessionAction(config, imageName, username, actionRequest.Action, time.Now()); examErr != "" {
+			sessionAudit.record(AuditEvent{Action: "session-" + actionRequest.Action, Actor: actor.Name, Target: username, Image: imageName, Source: actor.Source, Result: "denied", Detail: examErr})
+			http.Error(httpResponse, examErr, http.StatusConflict)
+			return
+		}
+		actionErr := runSessionAction(cli, config, randomSeed, *session, actionRequest.Action, actor)
+		result, detail := auditResult(actionErr)
+		sessionAudit.record(AuditEvent{Action: "session-" + actionRequest.Action, Actor: actor.Name, Target: username, Image: imageName, Source: actor.Source, Result: result, Detail: detail})
+		if actionErr != "" {
+			http.Error(httpResponse, actionErr, http.StatusInternalServerError)
+			return
+		}
+
+		jsonData, jsonErr := json.Marshal(map[string]string{"name": actionRequest.Name, "action": actionRequest.Action, "result": "ok"})
+		if jsonErr != nil {
+			http.Error(httpResponse, "Error encoding JSON: "+jsonErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		httpResponse.Header().Set("Content-Type", "application/json")
+		httpResponse.Write(jsonData)
+	})
+
+	// Endpoint /metrics - reports session counts, start times and failures, auto-start attempts, rclone mount status
+	// and host memory and disk use in the Prometheus text exposition format. Requires the metrics token from the config
+	// file, presented in an "Authorization: Bearer ..." header.
+	// Usage: GET /metrics
+	http.HandleFunc("/metrics", func(httpResponse http.ResponseWriter, r *http.Request) {
+		config := runningConfig.get()
+		if !isValidMetricsToken(r, config.MetricsToken) {
+			http.Error(httpResponse, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		// Build the whole response first, so an error part way through can still be reported properly.
+		var metricsOutput strings.Builder
+		if metricsErr := writeMetrics(&metricsOutput, cli, config); metricsErr != nil {
+			http.Error(httpResponse, "Error gathering metrics: "+metricsErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		httpResponse.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		fmt.Fprint(httpResponse, metricsOutput.String())
+	})
+
+	// Endpoint /admin/sessionLogs - streams a user session's stdout and stderr as server-sent events: a "log" event
+	// (JSON { stream, time, text }) for each line, then an "end" event once there is nothing more to send. Requires the
+	// admin key.
+	// Usage: GET /admin/sessionLogs?name=SESSIONNAME&tail=200&follow=true
+	// "tail" is the number of lines to send from the end of the log (default 200), or "all". If "follow" is "true", new
+	// output is sent as it is written, until the container stops or the caller goes away.
+	http.HandleFunc("/admin/sessionLogs", func(httpResponse http.ResponseWriter, r *http.Request) {
+		config := runningConfig.get()
+		// Check the caller is presenting the correct admin key.
+		if !isValidAdminKey(r, config.AdminKey) {
+			http.Error(httpResponse, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		sessionName := strings.TrimSpace(r.URL.Query().Get("name"))
+		if sessionName == "" {
+			http.Error(httpResponse, "Missing 'name' parameter", http.StatusBadRequest)
+			return
+		}
+		tail, tailErr := logTailOption(r.URL.Query().Get("tail"))
+		if tailErr != nil {
+			http.Error(httpResponse, tailErr.Error(), http.StatusBadRequest)
+			return
+		}
+		session, sessionErr := findSessionByName(cli, sessionName)
+		if sessionErr != nil {
+			http.Error(httpResponse, "Error listing containers: "+sessionErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		if session == nil {
+			http.Error(httpResponse, "No session named \""+sessionName+"\"", http.StatusNotFound)
+			return
+		}
+		streamSessionLogs(httpResponse, r, cli, session.ID, tail, r.URL.Query().Get("follow") == "true")
+	})
+
+	// Endpoint /admin/upgradeSessions - upgrades every idle session running an outdated image, or reports the progress
+	// of the current (or most recent) upgrade run. Requires the admin key.
+	// Usage: POST /admin/upgradeSessions to start an upgrade run, GET /admin/upgradeSessions for its progress.
+	// Returns: JSON { running, startedAt, finishedAt, total, done, results }
+	http.HandleFunc("/admin/upgradeSessions", func(httpResponse http.ResponseWriter, r *http.Request) {
+		config := runningConfig.get()
+		// Check the caller is presenting the correct admin key.
+		if !isValidAdminKey(r, config.AdminKey) {
+			http.Error(httpResponse, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			// Nothing to do but report the progress, below.
+		case http.MethodPost:
+			started, upgradeErr := upgradeIdleSessions(cli, config, randomSeed, AuditActor{Name: adminActor(r), Source: auditSourceAdminPanel})
+			if upgradeErr != nil {
+				http.Error(httpResponse, "Error listing containers: "+upgradeErr.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !started {
+				http.Error(httpResponse, "An upgrade is already in progress", http.StatusConflict)
+				return
+			}
+		default:
+			http.Error(httpResponse, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		jsonData, jsonErr := json.Marshal(sessionUpgrades.current())
+		if jsonErr != nil {
+			http.Error(httpResponse, "Error encoding JSON: "+jsonErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		httpResponse.Header().Set("Content-Type", "application/json")
+		httpResponse.Write(jsonData)
+	})
+
+	// Endpoint /admin/audit - searches the audit log (including rotated files) for session and admin events. All
+	// parameters are optional: "user" matches events where that user is the actor or the target, "action" an action
+	// such as "session-start", and "from" and "to" are dates ("2026-03-02") or times ("2026-03-02T09:00:00Z"),
+	// inclusive. At most "limit" events (default 1000) are returned, the most recent ones. Requires the admin key.
+	// Usage: GET /admin/audit?user=USERNAME&action=ACTION&from=DATE&to=DATE&limit=NUMBER
+	// Returns: JSON { "events": [ { time, action, actor, target, image, source, result, detail }, ... ] }
+	http.HandleFunc("/admin/audit", func(httpResponse http.ResponseWriter, r *http.Request) {
+		config := runningConfig.get()
+		// Check the caller is presenting the correct admin key.
+		if !isValidAdminKey(r, config.AdminKey) {
+			http.Error(httpResponse, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(httpResponse, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		auditFilter, filterErr := auditFilterFromRequest(r)
+		if filterErr != nil {
+			http.Error(httpResponse, filterErr.Error(), http.StatusBadRequest)
+			return
+		}
+		auditEvents, searchErr := sessionAudit.search(auditFilter)
+		if searchErr != nil {
+			http.Error(httpResponse, "Error reading audit log: "+searchErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		if auditEvents == nil {
+			auditEvents = []AuditEvent{}
+		}
+		jsonData, jsonErr := json.Marshal(map[string][]AuditEvent{"events": auditEvents})
+		if jsonErr != nil {
+			http.Error(httpResponse, "Error encoding JSON: "+jsonErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		httpResponse.Header().Set("Content-Type", "application/json")
+		httpResponse.Write(jsonData)
+	})
+
+	// Endpoint /admin/backups - lists the backups ("snapshots") of a user's home and www folders, newest first.
+	// Requires the admin key.
+	// Usage: GET /admin/backups?username=USERNAME
+	// Returns: JSON { "snapshots": [ { id, folder, time, kind, size }, ... ] }
+	http.HandleFunc("/admin/backups", func(httpResponse http.ResponseWriter, r *http.Request) {
+		config := runningConfig.get()
+		// Check the caller is presenting the correct admin key.
+		if !isValidAdminKey(r, config.AdminKey) {
+			http.Error(httpResponse, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(httpResponse, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if config.Backups.Target == "" {
+			http.Error(httpResponse, "Backups are not enabled", http.StatusNotFound)
+			return
+		}
+		username := strings.TrimSpace(r.URL.Query().Get("username"))
+		if !isValidBackupUsername(username) {
+			http.Error(httpResponse, "Invalid username", http.StatusBadRequest)
+			return
+		}
+		snapshots, listErr := listUserSnapshots(config.Backups, username)
+		if listErr != nil {
+			http.Error(httpResponse, "Error listing backups: "+listErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		if snapshots == nil {
+			snapshots = []Snapshot{}
+		}
+		jsonData, jsonErr := json.Marshal(map[string][]Snapshot{"snapshots": snapshots})
+		if jsonErr != nil {
+			http.Error(httpResponse, "Error encoding JSON: "+jsonErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		httpResponse.Header().Set("Content-Type", "application/json")
+		httpResponse.Write(jsonData)
+	})
+
+	// Endpoint /admin/restore - restores one of a user's folders ("home" or "www"), or a single file or folder within
+	// it, as it was at the given snapshot. Files are restored into "restored/<snapshot ID>" in the user's folder, so
+	// nothing is overwritten. Requires the admin key.
+	// Usage: POST /admin/restore with JSON { "username": "...", "folder": "home", "snapshot": "...", "path": "Documents/essay.odt" }
+	// Returns: JSON { "restoredTo": "/home/username/restored/<snapshot ID>" }
+	http.HandleFunc("/admin/restore", func(httpResponse http.ResponseWriter, r *http.Request) {
+		config := runningConfig.get()
+		// Check the caller is presenting the correct admin key.
+		if !isValidAdminKey(r, config.AdminKey) {
+			http.Error(httpResponse, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(httpResponse, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if config.Backups.Target == "" {
+			http.Error(httpResponse, "Backups are not enabled", http.StatusNotFound)
+			return
+		}
+		var restoreRequest RestoreRequest
+		if decoderErr := json.NewDecoder(r.Body).Decode(&restoreRequest); decoderErr != nil {
+			http.Error(httpResponse, "Error parsing request: "+decoderErr.Error(), http.StatusBadRequest)
+			return
+		}
+		if checkErr := checkRestoreRequest(restoreRequest); checkErr != "" {
+			http.Error(httpResponse, checkErr, http.StatusBadRequest)
+			return
+		}
+		restoredTo, restoreErr := restoreSnapshot(config.Backups, restoreRequest)
+		restoreMessage := ""
+		if restoreErr != nil {
+			restoreMessage = restoreErr.Error()
+		}
+		result, detail := auditResult(restoreMessage)
+		if restoreErr == nil {
+			detail = "restored " + restoreRequest.Folder + "/" + restoreRequest.Path + " from " + restoreRequest.Snapshot + " to " + restoredTo
+		}
+		sessionAudit.record(AuditEvent{Action: "backup-restore", Actor: adminActor(r), Target: restoreRequest.Username, Source: auditSourceAdminPanel, Result: result, Detail: detail})
+		if restoreErr != nil {
+			http.Error(httpResponse, "Error restoring backup: "+restoreErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		jsonData, jsonErr := json.Marshal(map[string]string{"restoredTo": restoredTo})
+		if jsonErr != nil {
+			http.Error(httpResponse, "Error encoding JSON: "+jsonErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		httpResponse.Header().Set("Content-Type", "application/json")
+		httpResponse.Write(jsonData)
+	})
+
+	// Endpoint /admin/deprovision - removes everything set up for a user who has left: their auto-start entries,
+	// session containers and rclone mounts, and their home, www and Web Console tasks folders (after archiving them to
+	// a dated tarball), and optionally their host account. With "dryRun", nothing is changed - the steps that would
+	// be carried out are returned. Otherwise "confirm" must repeat the username. Requires the admin key.
+	// Usage: POST /admin/deprovision with JSON { "username": "...", "dryRun": true, "deleteAccount": false, "confirm": "..." }
+	// Returns: JSON { "steps": [ { action, target, detail, result, error }, ... ] }
+	http.HandleFunc("/admin/deprovision", func(httpResponse http.ResponseWriter, r *http.Request) {
+		config := runningConfig.get()
+		// Check the caller is presenting the correct admin key.
+		if !isValidAdminKey(r, config.AdminKey) {
+			http.Error(httpResponse, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(httpResponse, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var deprovisionRequest DeprovisionRequest
+		if decoderErr := json.NewDecoder(r.Body).Decode(&deprovisionRequest); decoderErr != nil {
+			http.Error(httpResponse, "Error parsing request: "+decoderErr.Error(), http.StatusBadRequest)
+			return
+		}
+		deprovisionRequest.Username = strings.TrimSpace(deprovisionRequest.Username)
+		if checkErr := checkDeprovisionRequest(deprovisionRequest); checkErr != "" {
+			http.Error(httpResponse, checkErr, http.StatusBadRequest)
+			return
+		}
+		steps, deprovisionErr := deprovisionUser(cli, config, deprovisionRequest)
+		if deprovisionErr != nil {
+			http.Error(httpResponse, deprovisionErr.Error(), http.StatusConflict)
+			return
+		}
+		if !deprovisionRequest.DryRun {
+			result, detail := "ok", describeDeprovisionSteps(steps)
+			for _, step := range steps {
+				if step.Result == "failed" {
+					result = "failed"
+				}
+			}
+			sessionAudit.record(AuditEvent{Action: "user-deprovision", Actor: adminActor(r), Target: deprovisionRequest.Username, Source: auditSourceAdminPanel, Result: result, Detail: detail})
+		}
+		if steps == nil {
+			steps = []DeprovisionStep{}
+		}
+		jsonData, jsonErr := json.Marshal(map[string][]DeprovisionStep{"steps": steps})
+		if jsonErr != nil {
+			http.Error(httpResponse, "Error encoding JSON: "+jsonErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		httpResponse.Header().Set("Content-Type", "application/json")
+		httpResponse.Write(jsonData)
+	})
+
+	// Endpoint /admin/provision - sets up the users listed in a CSV file before they first log in: their host
+	// accounts, www and Web Console tasks folders and, optionally, auto-start entries. Users already set up as listed
+	// are skipped. Requires the admin key.
+	// Usage: POST /admin/provision with a CSV body, first line "username,display name,groups,image,autostart"
+	// Returns: JSON { "results": [ { line, username, result, changes, error }, ... ] }
+	http.HandleFunc("/admin/provision", func(httpResponse http.ResponseWriter, r *http.Request) {
+		config := runningConfig.get()
+		// Check the caller is presenting the correct admin key.
+		if !isValidAdminKey(r, config.AdminKey) {
+			http.Error(httpResponse, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(httpResponse, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		entries, parseErr := parseProvisionCSV(r.Body)
+		if parseErr != nil {
+			http.Error(httpResponse, parseErr.Error(), http.StatusBadRequest)
+			return
+		}
+		results, provisionErr := provisionUsers(config, entries)
+		counts := make(map[string]int)
+		for _, result := range results {
+			counts[result.Result]++
+		}
+		result, detail := "ok", fmt.Sprintf("%d created, %d changed, %d skipped, %d failed", counts[provisionCreated], counts[provisionChanged], counts[provisionSkipped], counts[provisionFailed])
+		if provisionErr != nil {
+			result, detail = "failed", detail+"; "+provisionErr.Error()
+		} else if counts[provisionFailed] > 0 {
+			result = "failed"
+		}
+		sessionAudit.record(AuditEvent{Action: "user-provision", Actor: adminActor(r), Target: strconv.Itoa(len(entries)) + " users", Source: auditSourceAdminPanel, Result: result, Detail: detail})
+		if provisionErr != nil {
+			http.Error(httpResponse, provisionErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		if results == nil {
+			results = []ProvisionResult{}
+		}
+		jsonData, jsonErr := json.Marshal(map[string][]ProvisionResult{"results": results})
+		if jsonErr != nil {
+			http.Error(httpResponse, "Error encoding JSON: "+jsonErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		httpResponse.Header().Set("Content-Type", "application/json")
+		httpResponse.Write(jsonData)
+	})
+
+	// Endpoint /admin/exams - lists the running (and recently finished) exams, with each candidate's end time and
+	// whether their session has been locked. Requires the admin key.
+	// Usage: GET /admin/exams
+	// Returns: JSON { "exams": [ { name, group, image, startedBy, started, candidates: [ { username, endTime, locked, lockedAt }, ... ] }, ... ] }
+	http.HandleFunc("/admin/exams", func(httpResponse http.ResponseWriter, r *http.Request) {
+		config := runningConfig.get()
+		// Check the caller is presenting the correct admin key.
+		if !isValidAdminKey(r, config.AdminKey) {
+			http.Error(httpResponse, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(httpResponse, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		jsonData, jsonErr := json.Marshal(map[string][]Exam{"exams": examSessions.list()})
+		if jsonErr != nil {
+			http.Error(httpResponse, "Error encoding JSON: "+jsonErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		httpResponse.Header().Set("Content-Type", "application/json")
+		httpResponse.Write(jsonData)
+	})
+
+	// Endpoint /admin/exams/start - starts an exam for every member of a group, starting each candidate's session on
+	// its own isolated network. Each candidate's session is locked once the duration is up. Requires the admin key.
+	// Usage: POST /admin/exams/start with JSON { "name": "...", "group": "...", "image": "exams", "durationMinutes": 90 }
+	// Returns: JSON { name, group, image, startedBy, started, candidates: [ ... ] }
+	http.HandleFunc("/admin/exams/start", func(httpResponse http.ResponseWriter, r *http.Request) {
+		config := runningConfig.get()
+		// Check the caller is presenting the correct admin key.
+		if !isValidAdminKey(r, config.AdminKey) {
+			http.Error(httpResponse, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(httpResponse, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var examRequest ExamStartRequest
+		if decoderErr := json.NewDecoder(r.Body).Decode(&examRequest); decoderErr != nil {
+			http.Error(httpResponse, "Error parsing request: "+decoderErr.Error(), http.StatusBadRequest)
+			return
+		}
+		examRequest.Name = strings.TrimSpace(examRequest.Name)
+		examRequest.Group = strings.TrimSpace(examRequest.Group)
+		if examRequest.Image == "" {
+			examRequest.Image = examImages(config.Exams)[0]
+		}
+		if checkErr := checkExamStartRequest(config, examRequest); checkErr != "" {
+			http.Error(httpResponse, checkErr, http.StatusBadRequest)
+			return
+		}
+		exam, startErr := startExam(cli, config, randomSeed, examRequest, adminActor(r), time.Now())
+		result, detail := auditResult("")
+		if startErr != nil {
+			result, detail = auditResult(startErr.Error())
+		} else {
+			detail = fmt.Sprintf("%s, group %s, %d candidates, %d minutes", examRequest.Name, examRequest.Group, len(exam.Candidates), examRequest.DurationMinutes)
+		}
+		sessionAudit.record(AuditEvent{Action: "exam-start", Actor: adminActor(r), Target: examRequest.Group, Image: examRequest.Image, Source: auditSourceAdminPanel, Result: result, Detail: detail})
+		if startErr != nil {
+			http.Error(httpResponse, startErr.Error(), http.StatusConflict)
+			return
+		}
+		jsonData, jsonErr := json.Marshal(exam)
+		if jsonErr != nil {
+			http.Error(httpResponse, "Error encoding JSON: "+jsonErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		httpResponse.Header().Set("Content-Type", "application/json")
+		httpResponse.Write(jsonData)
+	})
+
+	// Endpoint /admin/exams/extend - gives a candidate (or, with no username, every candidate) extra time. A candidate
+	// whose session has already been locked gets the extra time from now, and their session is unlocked. Requires the
+	// admin key.
+	// Usage: POST /admin/exams/extend with JSON { "name": "...", "username": "...", "minutes": 10 }
+	http.HandleFunc("/admin/exams/extend", func(httpResponse http.ResponseWriter, r *http.Request) {
+		config := runningConfig.get()
+		// Check the caller is presenting the correct admin key.
+		if !isValidAdminKey(r, config.AdminKey) {
+			http.Error(httpResponse, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(httpResponse, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var extendRequest ExamExtendRequest
+		if decoderErr := json.NewDecoder(r.Body).Decode(&extendRequest); decoderErr != nil {
+			http.Error(httpResponse, "Error parsing request: "+decoderErr.Error(), http.StatusBadRequest)
+			return
+		}
+		if extendRequest.Minutes < 1 || extendRequest.Minutes > maxExamMinutes {
+			http.Error(httpResponse, "The extra time must be between 1 and "+strconv.Itoa(maxExamMinutes)+" minutes", http.StatusBadRequest)
+			return
+		}
+		imageName, unlocked, extendErr := examSessions.extend(extendRequest.Name, strings.TrimSpace(extendRequest.Username), extendRequest.Minutes, time.Now())
+		if extendErr != nil {
+			http.Error(httpResponse, extendErr.Error(), http.StatusNotFound)
+			return
+		}
+		var unlockErrs []string
+		for _, username := range unlocked {
+			if unlockErr := unlockExamSession(cli, imageName, username); unlockErr != "" {
+				unlockErrs = append(unlockErrs, username+": "+unlockErr)
+			}
+		}
+		result, detail := auditResult(strings.Join(unlockErrs, "; "))
+		if detail == "" {
+			detail = fmt.Sprintf("%s, %d minutes", extendRequest.Name, extendRequest.Minutes)
+		}
+		target := extendRequest.Username
+		if target == "" {
+			target = "all candidates"
+		}
+		sessionAudit.record(AuditEvent{Action: "exam-extend", Actor: adminActor(r), Target: target, Image: imageName, Source: auditSourceAdminPanel, Result: result, Detail: detail})
+		if len(unlockErrs) > 0 {
+			http.Error(httpResponse, "Error unlocking sessions: "+strings.Join(unlockErrs, "; "), http.StatusInternalServerError)
+			return
+		}
+		httpResponse.WriteHeader(http.StatusNoContent)
+	})
+
+	// Endpoint /admin/exams/end - ends an exam early for a candidate (or, with no username, everyone), locking their
+	// sessions straight away. Requires the admin key.
+	// Usage: POST /admin/exams/end with JSON { "name": "...", "username": "..." }
+	http.HandleFunc("/admin/exams/end", func(httpResponse http.ResponseWriter, r *http.Request) {
+		config := runningConfig.get()
+		// Check the caller is presenting the correct admin key.
+		if !isValidAdminKey(r, config.AdminKey) {
+			http.Error(httpResponse, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(httpResponse, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var endRequest ExamEndRequest
+		if decoderErr := json.NewDecoder(r.Body).Decode(&endRequest); decoderErr != nil {
+			http.Error(httpResponse, "Error parsing request: "+decoderErr.Error(), http.StatusBadRequest)
+			return
+		}
+		endRequest.Username = strings.TrimSpace(endRequest.Username)
+		if endErr := examSessions.end(endRequest.Name, endRequest.Username, time.Now()); endErr != nil {
+			http.Error(httpResponse, endErr.Error(), http.StatusNotFound)
+			return
+		}
+		target := endRequest.Username
+		if target == "" {
+			target = "all candidates"
+		}
+		sessionAudit.record(AuditEvent{Action: "exam-end", Actor: adminActor(r), Target: target, Source: auditSourceAdminPanel, Result: "ok", Detail: endRequest.Name})
+		checkExams(cli, config, time.Now())
+		httpResponse.WriteHeader(http.StatusNoContent)
+	})
+
 	// Endpoint /admin/autostart - reads or updates the session auto-start list, the sessions that
 	// should be started automatically when the server (re)boots.
-	// Usage: GET /admin/autostart - returns { "sessions": [ { "username": "...", "image": "..." }, ... ] }
-	//        PUT /admin/autostart - accepts { "sessions": [ ... ] } and replaces the stored list.
+	// Usage: GET /admin/autostart - returns { "sessions": [ { "username": "...", "image": "..." }, ... ], "schedules": [ ... ], "terms": [ ... ], "holidays": [ ... ] }
+	//        PUT /admin/autostart - accepts { "sessions": [ ... ] } and replaces the stored list. The schedule rules, term dates and holidays are kept.
 	http.HandleFunc("/admin/autostart", func(httpResponse http.ResponseWriter, r *http.Request) {
+		config := runningConfig.get()
 		// Check the caller is presenting the correct admin key.
 		if !isValidAdminKey(r, config.AdminKey) {
 			http.Error(httpResponse, "Unauthorized", http.StatusUnauthorized)
@@ -739,13 +1886,13 @@ func main() {
 
 		switch r.Method {
 		case http.MethodGet:
-			// Load the current auto-start list and return it to the caller.
-			autoStartSessions, autoStartErr := loadAutoStart()
+			// Load the current auto-start list and timetable and return them to the caller.
+			autoStartConfig, autoStartErr := loadAutoStartConfig()
 			if autoStartErr != nil {
 				http.Error(httpResponse, "Error loading auto-start list: "+autoStartErr.Error(), http.StatusInternalServerError)
 				return
 			}
-			jsonData, jsonErr := json.Marshal(AutoStartConfig{Sessions: autoStartSessions})
+			jsonData, jsonErr := json.Marshal(autoStartConfig)
 			if jsonErr != nil {
 				http.Error(httpResponse, "Error encoding JSON: "+jsonErr.Error(), http.StatusInternalServerError)
 				return
@@ -761,6 +1908,7 @@ func main() {
 				return
 			}
 			// Check each entry has a username and an image, ignoring any that don't, and removing duplicates.
+			// An image that isn't in the image catalogue is an error.
 			var validSessions []AutoStartEntry
 			seenSessions := make(map[string]bool)
 			for _, entry := range newConfig.Sessions {
@@ -769,22 +1917,36 @@ func main() {
 				if username == "" || imageName == "" {
 					continue
 				}
-				sessionKey := imageName + "\x00" + username
-				if seenSessions[sessionKey] {
+				if findCatalogueImage(config, imageName) == nil {
+					http.Error(httpResponse, "Unknown image \""+imageName+"\" in auto-start list", http.StatusBadRequest)
+					return
+				}
+				if seenSessions[sessionKey(imageName, username)] {
 					continue
 				}
-				seenSessions[sessionKey] = true
+				seenSessions[sessionKey(imageName, username)] = true
 				validSessions = append(validSessions, AutoStartEntry{Username: username, Image: imageName})
 			}
-			// Save the new list to the config file.
-			if saveErr := saveAutoStart(validSessions); saveErr != nil {
+			// Save the new list to the config file, recording what changed in the audit log.
+			var oldSessions []AutoStartEntry
+			saveErr := updateAutoStart(func(currentSessions []AutoStartEntry) []AutoStartEntry {
+				oldSessions = currentSessions
+				return validSessions
+			})
+			auditEvent := AuditEvent{Action: "autostart-update", Actor: adminActor(r), Source: auditSourceAdminPanel, Detail: describeAutoStartChanges(oldSessions, validSessions)}
+			if saveErr != nil {
+				auditEvent.Result = "failed"
+				auditEvent.Detail = saveErr.Error()
+			}
+			sessionAudit.record(auditEvent)
+			if saveErr != nil {
 				http.Error(httpResponse, "Error saving auto-start list: "+saveErr.Error(), http.StatusInternalServerError)
 				return
 			}
 			// Start any auto-start sessions that aren't already running, so the admin's selection takes
 			// effect straight away. Each is started in its own goroutine so the request can return before
 			// the container finishes booting up.
-			ensureAutoStartSessions(cli, config, randomSeed, validSessions)
+			ensureAutoStartSessions(cli, config, randomSeed, validSessions, auditSourceAutoStart)
 			// Return the saved list to the caller.
 			jsonData, jsonErr := json.Marshal(AutoStartConfig{Sessions: validSessions})
 			if jsonErr != nil {
@@ -802,14 +1964,17 @@ func main() {
 	// don't have to log in to a "/desktop" or "/ssh" endpoint first. Auto-start is attempted straight
 	// away at startup, then retried periodically, because a transient failure (such as the container
 	// image not being ready yet) could otherwise leave a session permanently down. Done in the
-	// background so it doesn't hold up the server while each container boots up.
+	// background so it doesn't hold up the server while each container boots up. The same loop starts
+	// and stops the sessions in the timetable.
 	go func() {
 		for {
-			autoStartSessions, autoStartErr := loadAutoStart()
+			autoStartConfig, autoStartErr := loadAutoStartConfig()
 			if autoStartErr != nil {
 				log.Println("Error loading auto-start list: " + autoStartErr.Error())
 			} else {
-				ensureAutoStartSessions(cli, config, randomSeed, autoStartSessions)
+				config := runningConfig.get()
+				ensureAutoStartSessions(cli, config, randomSeed, autoStartConfig.Sessions, auditSourceAutoStart)
+				enforceSchedule(cli, config, randomSeed, autoStartConfig, time.Now())
 			}
 			time.Sleep(autoStartRetryInterval)
 		}
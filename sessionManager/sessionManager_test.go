@@ -0,0 +1,1491 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/moby/moby/api/types/container"
+)
+
+// Only established connections to one of the watched ports should be counted - listening sockets, other states and
+// other ports are ignored, as is the header line.
+func TestCountEstablishedConnections(t *testing.T) {
+	procNetTCP := `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:170D 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1001        0 12345 1
+   1: 0200120A:170D 0300120A:C350 01 00000000:00000000 00:00000000 00000000  1001        0 12346 1
+   2: 0200120A:0016 0300120A:C351 01 00000000:00000000 00:00000000 00000000     0        0 12347 1
+   3: 0200120A:1F90 0300120A:C352 01 00000000:00000000 00:00000000 00000000  1001        0 12348 1
+   4: 0200120A:170D 0300120A:C353 06 00000000:00000000 00:00000000 00000000  1001        0 12349 1
+`
+	if got := countEstablishedConnections(procNetTCP, []int{5901, 22}); got != 2 {
+		t.Fatalf("expected 2 established VNC / SSH connections, got %d", got)
+	}
+	if got := countEstablishedConnections(procNetTCP, []int{5000}); got != 0 {
+		t.Fatalf("expected no connections on an unused port, got %d", got)
+	}
+}
+
+// Session containers are recognised by their labels, or (for older containers) by a name matching the image they
+// were created from. Other containers on the host, even ones with a "-" in their name, aren't sessions.
+func TestSessionFromContainer(t *testing.T) {
+	labelled := container.Summary{
+		Names:  []string{"/desktop-jane.doe"},
+		Image:  "some-other-image:latest",
+		Labels: map[string]string{sessionUsernameLabel: "jane.doe", sessionImageLabel: "desktop"},
+	}
+	if imageName, username, ok := sessionFromContainer(labelled); !ok || imageName != "desktop" || username != "jane.doe" {
+		t.Fatalf("expected labelled container to be desktop / jane.doe, got %q / %q (%v)", imageName, username, ok)
+	}
+
+	unlabelled := container.Summary{Names: []string{"/calc-john.doe"}, Image: legacySessionImageRef("calc")}
+	if imageName, username, ok := sessionFromContainer(unlabelled); !ok || imageName != "calc" || username != "john.doe" {
+		t.Fatalf("expected unlabelled container to be calc / john.doe, got %q / %q (%v)", imageName, username, ok)
+	}
+
+	other := container.Summary{Names: []string{"/cloudflared-tunnel"}, Image: "cloudflare/cloudflared:latest"}
+	if _, _, ok := sessionFromContainer(other); ok {
+		t.Fatalf("expected cloudflared-tunnel not to be treated as a session")
+	}
+
+	// Image names can't contain "-", so container names can't be shared between two users' sessions.
+	for _, imageName := range []string{"desktop-v2", "Desktop", "desk top"} {
+		if problems := validateConfig(Config{Images: []CatalogueImage{{Name: imageName}}}); len(problems) == 0 {
+			t.Fatalf("expected image name %q to be refused", imageName)
+		}
+	}
+	if problems := validateConfig(Config{Images: []CatalogueImage{{Name: "desktop_v2"}}}); len(problems) != 0 {
+		t.Fatalf("unexpected problems %v", problems)
+	}
+}
+
+// Sizes in the config file can be plain bytes or use a k / m / g suffix, with or without a trailing "b".
+func TestParseByteSize(t *testing.T) {
+	testCases := map[string]int64{
+		"":      0,
+		"100":   100,
+		"512m":  512 * 1024 * 1024,
+		"2g":    2 * 1024 * 1024 * 1024,
+		"1.5GB": 1536 * 1024 * 1024,
+		"64k":   64 * 1024,
+	}
+	for theSize, expected := range testCases {
+		got, parseErr := parseByteSize(theSize)
+		if parseErr != nil || got != expected {
+			t.Fatalf("parseByteSize(%q): expected %d, got %d (%v)", theSize, expected, got, parseErr)
+		}
+	}
+	for _, theSize := range []string{"lots", "2mg", "2gg", "2kb5", "-1g", "1.g", "b"} {
+		if _, parseErr := parseByteSize(theSize); parseErr == nil {
+			t.Fatalf("expected an error for the invalid size %q", theSize)
+		}
+	}
+}
+
+// The first profile matching both the image and one of the user's groups should be chosen, with empty lists
+// matching anything.
+func TestSelectResourceProfile(t *testing.T) {
+	profiles := []ResourceProfile{
+		{Name: "sixth-form-desktop", Images: []string{"desktop"}, Groups: []string{"year12", "year13"}},
+		{Name: "desktop", Images: []string{"desktop"}},
+		{Name: "staff", Groups: []string{"staff"}},
+	}
+	if profile := selectResourceProfile(profiles, "desktop", []string{"pupils", "year12"}); profile == nil || profile.Name != "sixth-form-desktop" {
+		t.Fatalf("expected sixth-form-desktop profile, got %v", profile)
+	}
+	if profile := selectResourceProfile(profiles, "desktop", []string{"year7"}); profile == nil || profile.Name != "desktop" {
+		t.Fatalf("expected desktop profile, got %v", profile)
+	}
+	if profile := selectResourceProfile(profiles, "calc", []string{"staff"}); profile == nil || profile.Name != "staff" {
+		t.Fatalf("expected staff profile, got %v", profile)
+	}
+	if profile := selectResourceProfile(profiles, "calc", []string{"year7"}); profile != nil {
+		t.Fatalf("expected no profile, got %v", profile.Name)
+	}
+
+	// A container created with a profile that no longer matches (or with none, when one now does) is recreated.
+	profile := &ResourceProfile{Name: "default"}
+	if resourceProfileChanged(container.Summary{Labels: map[string]string{sessionResourceProfileLabel: "default"}}, profile) || resourceProfileChanged(container.Summary{Labels: map[string]string{}}, nil) {
+		t.Fatal("expected a container with its current profile to be left alone")
+	}
+	if !resourceProfileChanged(container.Summary{Labels: map[string]string{sessionResourceProfileLabel: "default"}}, nil) || !resourceProfileChanged(container.Summary{Labels: map[string]string{}}, profile) {
+		t.Fatal("expected a change of profile to be noticed")
+	}
+}
+
+// With no catalogue in the config file, the images built by the install script are available, using the same image
+// references older versions of the Session Manager did. Anything else is rejected.
+func TestImageCatalogue(t *testing.T) {
+	var config Config
+	desktopImage, imageErr := checkImageAllowed(config, "desktop", "nobody-in-particular")
+	if imageErr != nil {
+		t.Fatalf("expected desktop to be in the default catalogue: %v", imageErr)
+	}
+	if desktopImage.reference() != legacySessionImageRef("desktop") {
+		t.Fatalf("expected default desktop reference %q, got %q", legacySessionImageRef("desktop"), desktopImage.reference())
+	}
+	if desktopImage.startupScript() != "/root/docker-desktop-root-startup.sh" || desktopImage.readyMarker() != "Starting VNC server" {
+		t.Fatalf("unexpected defaults: %q / %q", desktopImage.startupScript(), desktopImage.readyMarker())
+	}
+	if _, imageErr := checkImageAllowed(config, "bitcoin-miner", "nobody-in-particular"); imageErr == nil {
+		t.Fatalf("expected an unknown image to be rejected")
+	}
+
+	config.Images = []CatalogueImage{
+		{Name: "desktop", Image: "registry.example.com/puws/desktop", Version: "2.0", Mounts: []CatalogueMount{{Source: "/srv/shared/{{USERNAME}}", Target: "/home/{{USERNAME}}/shared", ReadOnly: true}}},
+		{Name: "exams", Groups: []string{"a-group-nobody-is-in"}},
+	}
+	desktopImage = findCatalogueImage(config, "desktop")
+	if desktopImage.reference() != "registry.example.com/puws/desktop:2.0" {
+		t.Fatalf("unexpected image reference %q", desktopImage.reference())
+	}
+	extraMounts := desktopImage.extraMounts("jane.doe")
+	if len(extraMounts) != 1 || extraMounts[0].Source != "/srv/shared/jane.doe" || extraMounts[0].Target != "/home/jane.doe/shared" || !extraMounts[0].ReadOnly {
+		t.Fatalf("unexpected extra mounts %+v", extraMounts)
+	}
+	if _, imageErr := checkImageAllowed(config, "exams", "nobody-in-particular"); imageErr == nil {
+		t.Fatalf("expected a user outside the image's groups to be rejected")
+	}
+	if _, imageErr := checkImageAllowed(config, "calc", "nobody-in-particular"); imageErr == nil {
+		t.Fatalf("expected an image missing from the configured catalogue to be rejected")
+	}
+}
+
+// Only a request with a known bearer token should be matched to a caller, and each caller is limited to its images.
+func TestAuthenticateCaller(t *testing.T) {
+	callers := []CallerCredential{
+		{Name: "guacamole", Token: "guacamole-token", Images: []string{"*"}},
+		{Name: "sessionproxy", Token: "sessionproxy-token", Images: []string{"desktop"}},
+		{Name: "unconfigured", Token: "", Images: []string{"*"}},
+	}
+	newRequest := func(authHeader string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/connectToSession", nil)
+		if authHeader != "" {
+			req.Header.Set("Authorization", authHeader)
+		}
+		return req
+	}
+
+	if caller := authenticateCaller(newRequest(""), callers); caller != nil {
+		t.Fatalf("expected a request without a token to be rejected, got %q", caller.Name)
+	}
+	if caller := authenticateCaller(newRequest("Bearer wrong-token"), callers); caller != nil {
+		t.Fatalf("expected an unknown token to be rejected, got %q", caller.Name)
+	}
+	if caller := authenticateCaller(newRequest("Bearer "), callers); caller != nil {
+		t.Fatalf("expected a blank token not to match a caller with no token set, got %q", caller.Name)
+	}
+
+	sessionProxyCaller := authenticateCaller(newRequest("Bearer sessionproxy-token"), callers)
+	if sessionProxyCaller == nil || sessionProxyCaller.Name != "sessionproxy" {
+		t.Fatalf("expected the sessionproxy caller, got %v", sessionProxyCaller)
+	}
+	if !sessionProxyCaller.allowsImage("desktop") || sessionProxyCaller.allowsImage("exams") {
+		t.Fatalf("expected the sessionproxy caller to be limited to the desktop image")
+	}
+	guacamoleCaller := authenticateCaller(newRequest("bearer guacamole-token"), callers)
+	if guacamoleCaller == nil || !guacamoleCaller.allowsImage("exams") {
+		t.Fatalf("expected the guacamole caller to be allowed any image, got %v", guacamoleCaller)
+	}
+	if !printCallerToken(Config{Callers: callers}, "guacamole") || printCallerToken(Config{Callers: callers}, "pangolin") || printCallerToken(Config{Callers: []CallerCredential{{Name: "guacamole"}}}, "guacamole") {
+		t.Fatalf("expected only a listed caller with a token to have its token printed")
+	}
+}
+
+// A caller watching a session start should get the states already reached, then new ones as they happen, with the
+// stream ending once the session is ready.
+func TestStreamStartupProgress(t *testing.T) {
+	sessionStartups.begin("desktop", "progress.user")
+	sessionStartups.report("desktop", "progress.user", startupCreatingUser, "")
+	sessionStartups.report("desktop", "progress.user", startupCreatingContainer, "")
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		streamStartupProgress(w, r, "desktop", "progress.user")
+	}))
+	defer testServer.Close()
+
+	streamResponse, streamErr := http.Get(testServer.URL)
+	if streamErr != nil {
+		t.Fatal(streamErr)
+	}
+	defer streamResponse.Body.Close()
+	if contentType := streamResponse.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %q", contentType)
+	}
+
+	// The past states have been sent by the time the headers arrive, so report the rest of the start now.
+	sessionStartups.report("desktop", "progress.user", startupWaitingForVNC, "")
+	sessionStartups.report("desktop", "progress.user", startupReady, "")
+
+	streamBody, readErr := io.ReadAll(streamResponse.Body)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	var states []string
+	for _, line := range strings.Split(string(streamBody), "\n") {
+		if strings.HasPrefix(line, "event: ") {
+			states = append(states, strings.TrimPrefix(line, "event: "))
+		}
+	}
+	expected := []string{startupCreatingUser, startupCreatingContainer, startupWaitingForVNC, startupReady}
+	if strings.Join(states, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected states %v, got %v", expected, states)
+	}
+}
+
+// A finished start's states are only replayed for a short while. After that, a watcher waits for the next start
+// (ignoring anything from earlier ones), and the finished start is forgotten once no-one is watching.
+func TestStartupProgressExpiry(t *testing.T) {
+	tracker := newStartupTracker()
+	tracker.begin("desktop", "jane.doe")
+	tracker.report("desktop", "jane.doe", startupReady, "")
+	if pastEvents, _, generation, unsubscribe := tracker.subscribe("desktop", "jane.doe"); len(pastEvents) != 1 || generation != 1 {
+		t.Fatalf("expected a recently finished start to be replayed, got %+v (generation %d)", pastEvents, generation)
+	} else {
+		unsubscribe()
+	}
+
+	tracker.reportEvent("desktop", "jane.doe", StartupEvent{State: startupReady, Time: time.Now().Add(-2 * finishedStartupTTL)})
+	pastEvents, subscriber, generation, unsubscribe := tracker.subscribe("desktop", "jane.doe")
+	if len(pastEvents) != 0 || len(tracker.events("desktop", "jane.doe")) != 0 {
+		t.Fatalf("expected an old start not to be replayed, got %+v (generation %d)", pastEvents, generation)
+	}
+	tracker.begin("desktop", "jane.doe")
+	tracker.report("desktop", "jane.doe", startupCreatingUser, "")
+	if event := <-subscriber; event.State != startupCreatingUser || event.generation != generation {
+		t.Fatalf("expected the new start's first state, got %+v", event)
+	}
+	unsubscribe()
+
+	tracker.reportEvent("desktop", "jane.doe", StartupEvent{State: startupFailed, Time: time.Now().Add(-2 * finishedStartupTTL)})
+	tracker.begin("desktop", "john.smith")
+	if _, exists := tracker.sessions[sessionKey("desktop", "jane.doe")]; exists {
+		t.Fatal("expected the finished start to have been forgotten")
+	}
+}
+
+// Concurrent starts of the same session should run the start once, with every caller getting its result (including
+// an error), while a caller that waits too long gets a timeout error.
+func TestStartCoordinator(t *testing.T) {
+	coordinator := newStartCoordinator()
+	var startCount int
+	var startCountMu sync.Mutex
+	releaseStart := make(chan struct{})
+	startFunc := func() string {
+		startCountMu.Lock()
+		startCount = startCount + 1
+		startCountMu.Unlock()
+		<-releaseStart
+		return "Error creating container"
+	}
+
+	var waitGroup sync.WaitGroup
+	var enteredGroup sync.WaitGroup
+	results := make([]string, 5)
+	for index := range results {
+		waitGroup.Add(1)
+		enteredGroup.Add(1)
+		go func(index int) {
+			defer waitGroup.Done()
+			enteredGroup.Done()
+			results[index], _ = coordinator.start("desktop", "jane.doe", time.Minute, startFunc)
+		}(index)
+	}
+	// Wait for every caller to be waiting on the start, then check a caller with a short timeout gives up.
+	enteredGroup.Wait()
+	time.Sleep(50 * time.Millisecond)
+	if timeoutResult, shared := coordinator.start("desktop", "jane.doe", 10*time.Millisecond, startFunc); !shared || !strings.HasPrefix(timeoutResult, "Timed out") {
+		t.Fatalf("expected a shared timeout, got %q (shared: %v)", timeoutResult, shared)
+	}
+	close(releaseStart)
+	waitGroup.Wait()
+
+	if startCount != 1 {
+		t.Fatalf("expected the session to be started once, got %d", startCount)
+	}
+	for _, result := range results {
+		if result != "Error creating container" {
+			t.Fatalf("expected every caller to get the start's error, got %q", result)
+		}
+	}
+	if coordinator.inProgress("desktop", "jane.doe") {
+		t.Fatalf("expected no start in progress once finished")
+	}
+}
+
+// Sessions should be admitted up to the maximum, with each group's reserved sessions kept free for its members.
+func TestCanAdmit(t *testing.T) {
+	admissionConfig := AdmissionConfig{
+		MaxSessions:  4,
+		Reservations: []GroupReservation{{Group: "year11", Sessions: 2}},
+	}
+	tests := []struct {
+		name          string
+		sessionGroups [][]string
+		newUserGroups []string
+		expected      bool
+	}{
+		{"empty host", nil, []string{"staff"}, true},
+		{"shared sessions free", [][]string{{"staff"}}, []string{"staff"}, true},
+		{"shared sessions used up", [][]string{{"staff"}, {"staff"}}, []string{"staff"}, false},
+		{"reserved session free", [][]string{{"staff"}, {"staff"}}, []string{"year11"}, true},
+		{"reserved sessions used up, shared free", [][]string{{"year11"}, {"year11"}}, []string{"year11"}, true},
+		{"everything used up", [][]string{{"staff"}, {"staff"}, {"year11"}, {"year11"}}, []string{"year11"}, false},
+		{"overflow from reserved group uses shared", [][]string{{"year11"}, {"year11"}, {"year11"}, {"year11"}}, []string{"staff"}, false},
+	}
+	for _, test := range tests {
+		if result := canAdmit(admissionConfig, test.sessionGroups, test.newUserGroups); result != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, result)
+		}
+	}
+	if !canAdmit(AdmissionConfig{}, [][]string{{"staff"}, {"staff"}}, nil) {
+		t.Errorf("expected no limit when maxSessions isn't set")
+	}
+}
+
+// Sessions admitted in an earlier pass of the queue, but still starting, should count against the free memory, so a
+// burst of logins processed one at a time isn't all admitted against the same free memory.
+func TestAdmitWaitingMemory(t *testing.T) {
+	config := Config{
+		Admission:        AdmissionConfig{MinFreeMemory: "1g"},
+		ResourceProfiles: []ResourceProfile{{Name: "desktop", Memory: "2g"}},
+	}
+	queue := newAdmissionQueue()
+	memAvailable := int64(3 * 1024 * 1024 * 1024)
+	first := &AdmissionTicket{imageName: "desktop", username: "admit.first", admitted: make(chan struct{})}
+	queue.waiting = []*AdmissionTicket{first}
+	queue.admitWaiting(config, map[string][]string{}, memAvailable)
+	select {
+	case <-first.admitted:
+	default:
+		t.Fatal("expected the first start to be admitted")
+	}
+	second := &AdmissionTicket{imageName: "desktop", username: "admit.second", admitted: make(chan struct{})}
+	queue.waiting = []*AdmissionTicket{second}
+	queue.admitWaiting(config, map[string][]string{sessionKey("desktop", "admit.first"): nil}, memAvailable)
+	select {
+	case <-second.admitted:
+		t.Fatal("expected the second start to wait while the first is still starting")
+	default:
+	}
+	queue.finished("desktop", "admit.first")
+	queue.admitWaiting(config, map[string][]string{sessionKey("desktop", "admit.first"): nil}, memAvailable)
+	select {
+	case <-second.admitted:
+	default:
+		t.Fatal("expected the second start to be admitted once the first has finished starting")
+	}
+
+	// A start expected to use more memory than is spare above the reserve waits, even though some memory is spare.
+	third := &AdmissionTicket{imageName: "desktop", username: "admit.third", admitted: make(chan struct{})}
+	queue = newAdmissionQueue()
+	queue.waiting = []*AdmissionTicket{third}
+	queue.admitWaiting(config, map[string][]string{}, int64(2560*1024*1024))
+	select {
+	case <-third.admitted:
+		t.Fatal("expected a start needing 2g to wait with only 1.5g spare")
+	default:
+	}
+}
+
+// Queue positions should only be reported to the startup tracker when they change.
+func TestReportQueued(t *testing.T) {
+	tracker := newStartupTracker()
+	tracker.begin("desktop", "jane.doe")
+	tracker.reportQueued("desktop", "jane.doe", 3)
+	tracker.reportQueued("desktop", "jane.doe", 3)
+	tracker.reportQueued("desktop", "jane.doe", 2)
+	events := tracker.events("desktop", "jane.doe")
+	if len(events) != 2 || events[0].QueuePosition != 3 || events[1].QueuePosition != 2 || events[1].State != startupQueued {
+		t.Fatalf("expected queued events at positions 3 then 2, got %+v", events)
+	}
+}
+
+// The least recently used session should be picked for hibernation, skipping any used too recently.
+func TestLeastRecentlyUsed(t *testing.T) {
+	now := time.Now()
+	candidates := []HibernationCandidate{
+		{ContainerID: "a", LastActivity: now.Add(-10 * time.Minute)},
+		{ContainerID: "b", LastActivity: now.Add(-30 * time.Minute)},
+		{ContainerID: "c", LastActivity: now.Add(-1 * time.Minute)},
+	}
+	if candidate := leastRecentlyUsed(candidates, 5*time.Minute, now); candidate == nil || candidate.ContainerID != "b" {
+		t.Fatalf("expected session b, got %+v", candidate)
+	}
+	if candidate := leastRecentlyUsed(candidates, time.Hour, now); candidate != nil {
+		t.Fatalf("expected no session to be eligible, got %+v", candidate)
+	}
+}
+
+// A hibernated session's time is counted from when it was first seen paused, until it is woken up.
+func TestHibernationTracker(t *testing.T) {
+	tracker := newHibernationTracker()
+	start := time.Now()
+	tracker.update([]string{"a"}, start)
+	pausedSince := tracker.update([]string{"a", "b"}, start.Add(time.Minute))
+	if !pausedSince["a"].Equal(start) || !pausedSince["b"].Equal(start.Add(time.Minute)) {
+		t.Fatalf("unexpected hibernation times %v", pausedSince)
+	}
+	tracker.update([]string{"b"}, start.Add(2*time.Minute))
+	if pausedSince := tracker.update([]string{"a", "b"}, start.Add(3*time.Minute)); !pausedSince["a"].Equal(start.Add(3*time.Minute)) || !pausedSince["b"].Equal(start.Add(time.Minute)) {
+		t.Fatalf("expected a session woken up and hibernated again to be counted afresh, got %v", pausedSince)
+	}
+}
+
+// A session is only outdated if we know the current image and the container was created from a different one.
+func TestIsOutdatedImage(t *testing.T) {
+	if !isOutdatedImage("sha256:old", "sha256:new") {
+		t.Errorf("expected a container on an older image to be outdated")
+	}
+	if isOutdatedImage("sha256:new", "sha256:new") {
+		t.Errorf("expected a container on the current image not to be outdated")
+	}
+	if isOutdatedImage("sha256:old", "") {
+		t.Errorf("expected a container not to be outdated when the current image isn't known")
+	}
+}
+
+// Only one upgrade run should happen at a time, with its progress recorded as it goes.
+func TestUpgradeTracker(t *testing.T) {
+	tracker := &UpgradeTracker{}
+	if !tracker.begin(2) {
+		t.Fatalf("expected the first upgrade run to begin")
+	}
+	if tracker.begin(1) {
+		t.Fatalf("expected a second upgrade run not to begin while the first is running")
+	}
+	tracker.record(UpgradeResult{Username: "jane.doe", Image: "desktop", Result: "upgraded"})
+	if status := tracker.current(); !status.Running || status.Total != 2 || status.Done != 1 || len(status.Results) != 1 {
+		t.Fatalf("unexpected progress %+v", status)
+	}
+	tracker.finish()
+	if status := tracker.current(); status.Running || status.FinishedAt.IsZero() {
+		t.Fatalf("expected the upgrade run to be finished, got %+v", status)
+	}
+	if !tracker.begin(0) {
+		t.Fatalf("expected a new upgrade run to begin once the last one finished")
+	}
+}
+
+// Admin session actions should be checked for a known action, with destructive actions needing confirmation.
+func TestCheckSessionAction(t *testing.T) {
+	tests := []struct {
+		actionRequest SessionActionRequest
+		valid         bool
+	}{
+		{SessionActionRequest{Name: "desktop-jane.doe", Action: "stop"}, true},
+		{SessionActionRequest{Name: "desktop-jane.doe", Action: "pause"}, true},
+		{SessionActionRequest{Name: "", Action: "stop"}, false},
+		{SessionActionRequest{Name: "desktop-jane.doe", Action: "explode"}, false},
+		{SessionActionRequest{Name: "desktop-jane.doe", Action: "remove"}, false},
+		{SessionActionRequest{Name: "desktop-jane.doe", Action: "remove", Confirm: "desktop-john.doe"}, false},
+		{SessionActionRequest{Name: "desktop-jane.doe", Action: "recreate", Confirm: "desktop-jane.doe"}, true},
+	}
+	for _, test := range tests {
+		if checkErr := checkSessionAction(test.actionRequest); (checkErr == "") != test.valid {
+			t.Errorf("%+v: expected valid %v, got %q", test.actionRequest, test.valid, checkErr)
+		}
+	}
+}
+
+// The "tail" option should accept a number of lines or "all", defaulting to the last 200 lines.
+func TestLogTailOption(t *testing.T) {
+	tests := map[string]string{"": "200", "all": "all", "50": "50", " 10 ": "10"}
+	for tail, expected := range tests {
+		if result, tailErr := logTailOption(tail); tailErr != nil || result != expected {
+			t.Errorf("%q: expected %q, got %q (%v)", tail, expected, result, tailErr)
+		}
+	}
+	for _, tail := range []string{"-1", "lots", "1; rm"} {
+		if _, tailErr := logTailOption(tail); tailErr == nil {
+			t.Errorf("%q: expected an error", tail)
+		}
+	}
+}
+
+// Log lines fetched with timestamps should be split into the time and the text.
+func TestParseLogLine(t *testing.T) {
+	logLine := parseLogLine("stderr", "2026-03-02T09:15:04.123456789Z Starting VNC server on :1")
+	if logLine.Stream != "stderr" || logLine.Text != "Starting VNC server on :1" || logLine.Time.Hour() != 9 {
+		t.Fatalf("unexpected log line %+v", logLine)
+	}
+	if logLine := parseLogLine("stdout", "no timestamp here"); logLine.Text != "no timestamp here" || !logLine.Time.IsZero() {
+		t.Fatalf("expected a line without a timestamp to be kept as it is, got %+v", logLine)
+	}
+}
+
+// Stats samples should work out CPU use from the change since the previous stats, and leave file cache out of memory use.
+func TestStatsSample(t *testing.T) {
+	previousStats := container.StatsResponse{CPUStats: container.CPUStats{CPUUsage: container.CPUUsage{TotalUsage: 1000}, SystemUsage: 10000, OnlineCPUs: 4}}
+	rawStats := container.StatsResponse{
+		CPUStats:    container.CPUStats{CPUUsage: container.CPUUsage{TotalUsage: 3000}, SystemUsage: 20000, OnlineCPUs: 4},
+		MemoryStats: container.MemoryStats{Usage: 6000, Limit: 8000, Stats: map[string]uint64{"inactive_file": 1000}},
+		Networks:    map[string]container.NetworkStats{"eth0": {RxBytes: 100, TxBytes: 10}, "eth1": {RxBytes: 50, TxBytes: 5}},
+		BlkioStats: container.BlkioStats{IoServiceBytesRecursive: []container.BlkioStatEntry{
+			{Op: "read", Value: 300}, {Op: "write", Value: 200}, {Op: "Read", Value: 30}, {Op: "total", Value: 530},
+		}},
+	}
+	sample := statsSample(rawStats, &previousStats)
+	if sample.CPUPercent != 80 {
+		t.Errorf("expected 80%% CPU, got %v", sample.CPUPercent)
+	}
+	if sample.MemoryBytes != 5000 || sample.MemoryLimitBytes != 8000 {
+		t.Errorf("expected 5000 of 8000 bytes of memory, got %d of %d", sample.MemoryBytes, sample.MemoryLimitBytes)
+	}
+	if sample.NetworkRxBytes != 150 || sample.NetworkTxBytes != 15 {
+		t.Errorf("expected 150 / 15 network bytes, got %d / %d", sample.NetworkRxBytes, sample.NetworkTxBytes)
+	}
+	if sample.BlockReadBytes != 330 || sample.BlockWriteBytes != 200 {
+		t.Errorf("expected 330 / 200 block I/O bytes, got %d / %d", sample.BlockReadBytes, sample.BlockWriteBytes)
+	}
+	if firstSample := statsSample(rawStats, nil); firstSample.CPUPercent != 0 {
+		t.Errorf("expected no CPU figure without previous stats, got %v", firstSample.CPUPercent)
+	}
+}
+
+// The stats history should keep only the most recent samples, and forget sessions that have stopped.
+func TestStatsHistory(t *testing.T) {
+	history := newStatsHistory()
+	for index := 0; index < maxStatsSamples+5; index++ {
+		history.add("desktop", "jane.doe", container.StatsResponse{MemoryStats: container.MemoryStats{Usage: uint64(index)}})
+	}
+	samples := history.history("desktop", "jane.doe")
+	if len(samples) != maxStatsSamples || samples[len(samples)-1].MemoryBytes != maxStatsSamples+4 {
+		t.Fatalf("expected the last %d samples, got %d ending %+v", maxStatsSamples, len(samples), samples[len(samples)-1])
+	}
+	history.keepOnly(map[string]bool{sessionKey("desktop", "john.doe"): true})
+	if len(history.history("desktop", "jane.doe")) != 0 {
+		t.Fatalf("expected a stopped session's stats to be forgotten")
+	}
+}
+
+// Session start times and failures should be written out as a cumulative histogram and a counter, by image.
+func TestWriteCountedMetrics(t *testing.T) {
+	metrics := newSessionMetrics()
+	metrics.recordStart("desktop", 500*time.Millisecond, "")
+	metrics.recordStart("desktop", 15*time.Second, "")
+	metrics.recordStart("desktop", 400*time.Second, startFailureReason([]StartupEvent{{State: startupQueued}}))
+	metrics.recordAutoStart("desktop", true)
+	var metricsOutput strings.Builder
+	metrics.writeCountedMetrics(&metricsOutput)
+	for _, expectedLine := range []string{
+		`puws_session_start_duration_seconds_bucket{image="desktop",le="1"} 1`,
+		`puws_session_start_duration_seconds_bucket{image="desktop",le="20"} 2`,
+		`puws_session_start_duration_seconds_bucket{image="desktop",le="300"} 2`,
+		`puws_session_start_duration_seconds_bucket{image="desktop",le="+Inf"} 3`,
+		`puws_session_start_duration_seconds_sum{image="desktop"} 415.5`,
+		`puws_session_start_duration_seconds_count{image="desktop"} 3`,
+		`puws_session_start_failures_total{image="desktop",reason="queued"} 1`,
+		`puws_autostart_attempts_total{image="desktop",result="success"} 1`,
+	} {
+		if !strings.Contains(metricsOutput.String(), expectedLine+"\n") {
+			t.Errorf("expected line %q in:\n%s", expectedLine, metricsOutput.String())
+		}
+	}
+}
+
+// Each supervised rclone mount, including users' own remotes, should be reported with its state and restart count.
+func TestWriteRcloneMountMetrics(t *testing.T) {
+	var metricsOutput strings.Builder
+	writeRcloneMountMetrics(&metricsOutput, map[string][]MountStatus{"jane.doe": {
+		{Username: "jane.doe", Local: "/home/jane.doe/drive", Remote: "drive:", State: mountMounted},
+		{Username: "jane.doe", Local: "/home/jane.doe/Cloud/onedrive", Remote: "onedrive:", State: mountFailed, Restarts: 3},
+	}})
+	for _, expectedLine := range []string{
+		`puws_rclone_mount_up{username="jane.doe",mountpoint="/home/jane.doe/drive",remote="drive:"} 1`,
+		`puws_rclone_mount_up{username="jane.doe",mountpoint="/home/jane.doe/Cloud/onedrive",remote="onedrive:"} 0`,
+		`puws_rclone_mount_state{username="jane.doe",mountpoint="/home/jane.doe/Cloud/onedrive",remote="onedrive:",state="failed"} 1`,
+		`puws_rclone_mount_state{username="jane.doe",mountpoint="/home/jane.doe/Cloud/onedrive",remote="onedrive:",state="mounted"} 0`,
+		`puws_rclone_mount_restarts_total{username="jane.doe",mountpoint="/home/jane.doe/Cloud/onedrive",remote="onedrive:"} 3`,
+	} {
+		if !strings.Contains(metricsOutput.String(), expectedLine+"\n") {
+			t.Errorf("expected line %q in:\n%s", expectedLine, metricsOutput.String())
+		}
+	}
+}
+
+// Label values should be escaped for the text exposition format.
+func TestFormatLabels(t *testing.T) {
+	if labels := formatLabels("username", `jane "j" doe\`, "mountpoint", "/home/jane"); labels != `{username="jane \"j\" doe\\",mountpoint="/home/jane"}` {
+		t.Fatalf("unexpected labels %s", labels)
+	}
+}
+
+// Audit log searches should match the user as either actor or target, the action and the date range, and return the
+// most recent events if more match than the limit.
+func TestAuditLogSearch(t *testing.T) {
+	auditLog := newAuditLog()
+	auditLog.configure(AuditConfig{Path: t.TempDir() + "/audit.jsonl"})
+	auditLog.record(AuditEvent{Action: "session-connect", Actor: "jane.doe", Target: "jane.doe", Image: "desktop", Source: "guacamole"})
+	auditLog.record(AuditEvent{Action: "session-stop", Actor: "admin.user", Target: "jane.doe", Image: "desktop", Source: auditSourceAdminPanel})
+	auditLog.record(AuditEvent{Action: "session-connect", Actor: "john.doe", Target: "john.doe", Image: "desktop", Source: "guacamole", Result: "failed", Detail: "Error"})
+
+	for _, test := range []struct {
+		filter   AuditFilter
+		expected int
+	}{
+		{AuditFilter{}, 3},
+		{AuditFilter{User: "jane.doe"}, 2},
+		{AuditFilter{User: "admin.user"}, 1},
+		{AuditFilter{Action: "session-connect"}, 2},
+		{AuditFilter{User: "jane.doe", Action: "session-connect"}, 1},
+		{AuditFilter{From: time.Now().Add(time.Hour)}, 0},
+		{AuditFilter{To: time.Now().Add(-time.Hour)}, 0},
+		{AuditFilter{Limit: 1}, 1},
+	} {
+		events, searchErr := auditLog.search(test.filter)
+		if searchErr != nil {
+			t.Fatalf("unexpected error: %v", searchErr)
+		}
+		if len(events) != test.expected {
+			t.Errorf("filter %+v: expected %d events, got %d", test.filter, test.expected, len(events))
+		}
+	}
+	latest, _ := auditLog.search(AuditFilter{Limit: 1})
+	if len(latest) != 1 || latest[0].Actor != "john.doe" || latest[0].Result != "failed" {
+		t.Fatalf("expected the most recent event, got %+v", latest)
+	}
+	latestTwo, _ := auditLog.search(AuditFilter{Limit: 2})
+	if len(latestTwo) != 2 || latestTwo[0].Action != "session-stop" || latestTwo[1].Actor != "john.doe" {
+		t.Fatalf("expected the two most recent events, oldest first, got %+v", latestTwo)
+	}
+}
+
+// The audit log should be rotated once it gets too big, keeping only the configured number of old files, and searches
+// should still find events in the rotated files.
+func TestAuditLogRotation(t *testing.T) {
+	auditPath := t.TempDir() + "/audit.jsonl"
+	auditLog := newAuditLog()
+	auditLog.configure(AuditConfig{Path: auditPath, MaxSizeMB: 1, MaxFiles: 2})
+	bigDetail := strings.Repeat("x", 400*1024)
+	for index := 0; index < 10; index++ {
+		auditLog.record(AuditEvent{Action: "session-start", Actor: auditActorSystem, Target: "jane.doe", Source: auditSourceAutoStart, Detail: bigDetail})
+	}
+	rotatedFiles, _ := filepath.Glob(rotatedPattern(auditPath))
+	if len(rotatedFiles) != 2 {
+		t.Fatalf("expected 2 rotated files, got %v", rotatedFiles)
+	}
+	events, searchErr := auditLog.search(AuditFilter{User: "jane.doe"})
+	if searchErr != nil {
+		t.Fatalf("unexpected error: %v", searchErr)
+	}
+	// Two events fit in each 1 MB file, so the two rotated files and the current one hold the last 6 events.
+	if len(events) != 6 {
+		t.Fatalf("expected 6 events still on disk, got %d", len(events))
+	}
+}
+
+// Audit search dates can be plain dates, meaning the whole day, or exact times.
+func TestParseAuditTime(t *testing.T) {
+	from, _ := parseAuditTime("2026-03-02", false)
+	to, _ := parseAuditTime("2026-03-02", true)
+	if from.Day() != 2 || from.Hour() != 0 || to.Day() != 2 || to.Hour() != 23 {
+		t.Fatalf("unexpected day range %v - %v", from, to)
+	}
+	exact, exactErr := parseAuditTime("2026-03-02T09:30:00Z", true)
+	if exactErr != nil || !exact.Equal(time.Date(2026, 3, 2, 9, 30, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected time %v (%v)", exact, exactErr)
+	}
+	if _, badErr := parseAuditTime("yesterday", false); badErr == nil {
+		t.Fatalf("expected an error for an unrecognised date")
+	}
+}
+
+// Changes to the auto-start list should be described as the sessions added and removed.
+func TestDescribeAutoStartChanges(t *testing.T) {
+	oldSessions := []AutoStartEntry{{Username: "jane.doe", Image: "desktop"}, {Username: "john.doe", Image: "desktop"}}
+	newSessions := []AutoStartEntry{{Username: "jane.doe", Image: "desktop"}, {Username: "joe.bloggs", Image: "desktop"}}
+	if changes := describeAutoStartChanges(oldSessions, newSessions); changes != "added desktop-joe.bloggs; removed desktop-john.doe" {
+		t.Fatalf("unexpected description %q", changes)
+	}
+	if changes := describeAutoStartChanges(oldSessions, oldSessions); changes != "no changes" {
+		t.Fatalf("unexpected description %q", changes)
+	}
+}
+
+// A config file like the one the install script writes should be valid, and unknown keys, missing required fields,
+// bad sizes and unknown placeholders should all be reported together.
+func TestParseConfig(t *testing.T) {
+	_, problems := parseConfig([]byte(`
+rcloneOauthRedirectUrl: https://example.com
+adminKey: 0123
+identitySalt: 4567
+callers:
+  - name: guacamole
+    token: 89ab
+    images: ["*"]
+rcloneMounts:
+  - username: "{{USERNAME}}"
+    local: /home/{{USERNAME}}/drive
+    remote: "drive:"
+`))
+	if len(problems) != 0 {
+		t.Fatalf("expected a valid config, got %v", problems)
+	}
+	if _, emptyProblems := parseConfig([]byte("")); len(emptyProblems) != 0 {
+		t.Fatalf("expected an empty config to be valid, got %v", emptyProblems)
+	}
+
+	_, problems = parseConfig([]byte(`
+adminkey: 0123
+callers:
+  - name: guacamole
+rcloneMounts:
+  - local: /home/{{USER}}/drive
+    remote: "drive:{{USERNAME}"
+admission:
+  minFreeMemory: lots
+`))
+	for _, expectedProblem := range []string{`line 2: unknown key "adminkey"`, "callers[0].token: missing", "rcloneMounts[0].local: unknown placeholder {{USER}}", "rcloneMounts[0].remote: badly formed placeholder", "admission.minFreeMemory: invalid size"} {
+		found := false
+		for _, problem := range problems {
+			found = found || strings.Contains(problem, expectedProblem)
+		}
+		if !found {
+			t.Errorf("expected a problem containing %q, got %v", expectedProblem, problems)
+		}
+	}
+}
+
+// The config store should tell whether the config file has changed since it was loaded, or was last rejected.
+func TestConfigStoreSeen(t *testing.T) {
+	configStore := newConfigStore()
+	configStore.set(Config{AdminKey: "0123"}, []byte("adminKey: 0123\n"))
+	if loaded, rejected := configStore.seen([]byte("adminKey: 0123\n")); !loaded || rejected {
+		t.Fatalf("expected the loaded config to be seen")
+	}
+	configStore.reject([]byte("adminKey: [\n"))
+	if loaded, rejected := configStore.seen([]byte("adminKey: [\n")); loaded || !rejected {
+		t.Fatalf("expected the rejected config to be seen as rejected")
+	}
+	if loaded, rejected := configStore.seen([]byte("adminKey: 4567\n")); loaded || rejected {
+		t.Fatalf("expected a changed config not to be seen")
+	}
+	if configStore.get().AdminKey != "0123" {
+		t.Fatalf("expected the running config to be kept")
+	}
+}
+
+// The wait before restarting a failed mount should double each time, up to the maximum.
+func TestNextBackoff(t *testing.T) {
+	backoff := time.Duration(0)
+	var waits []time.Duration
+	for index := 0; index < 8; index++ {
+		backoff = nextBackoff(backoff)
+		waits = append(waits, backoff)
+	}
+	if waits[0] != mountMinBackoff || waits[1] != 2*mountMinBackoff || waits[len(waits)-1] != mountMaxBackoff {
+		t.Fatalf("unexpected backoff sequence %v", waits)
+	}
+}
+
+// A mount whose rclone process exits straight away should fail with rclone's last line of output, and one that never
+// appears should time out rather than hang the session start.
+func TestStartProcessFailures(t *testing.T) {
+	binFolder := t.TempDir()
+	fakeRclone := "#!/bin/sh\nif [ \"$1\" = mount ]; then\n  if [ -f " + binFolder + "/hang ]; then sleep 30; fi\n  echo 'Failed to create file system: bad remote' >&2\n  exit 1\nfi\n"
+	if writeErr := os.WriteFile(binFolder+"/rclone", []byte(fakeRclone), 0755); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	t.Setenv("PATH", binFolder+":"+os.Getenv("PATH"))
+	spec := RcloneMountSpec{Username: "jane.doe", Remote: "drive:", Local: t.TempDir() + "/drive", UID: os.Getuid(), GID: os.Getgid()}
+
+	exitErr := startProcess(&SupervisedMount{spec: spec}, 5*time.Second)
+	if exitErr == nil || !strings.Contains(exitErr.Error(), "bad remote") {
+		t.Fatalf("expected rclone's error, got %v", exitErr)
+	}
+
+	os.WriteFile(binFolder+"/hang", []byte{}, 0644)
+	startedAt := time.Now()
+	timeoutErr := startProcess(&SupervisedMount{spec: spec}, time.Second)
+	if timeoutErr == nil || !strings.Contains(timeoutErr.Error(), "Timed out") {
+		t.Fatalf("expected a timeout, got %v", timeoutErr)
+	}
+	if time.Since(startedAt) > rcloneStopTimeout {
+		t.Fatalf("expected the hung rclone to be stopped promptly, took %v", time.Since(startedAt))
+	}
+}
+
+func TestParseRcloneConfig(t *testing.T) {
+	remotes, parseErr := parseRcloneConfig([]byte("# Remotes\n[work drive]\ntype = drive\ntoken = {\"a\":1}\n\n[photos]\n; comment\ntype=dropbox\n[empty]\n"))
+	if parseErr != nil {
+		t.Fatal(parseErr)
+	}
+	want := []RcloneRemote{{Name: "work drive", Type: "drive"}, {Name: "photos", Type: "dropbox"}, {Name: "empty"}}
+	if !reflect.DeepEqual(remotes, want) {
+		t.Fatalf("got %+v, want %+v", remotes, want)
+	}
+	if _, parseErr := parseRcloneConfig([]byte("# Encrypted rclone configuration File\n\nRCLONE_ENCRYPT_V0:\nabc\n")); parseErr == nil {
+		t.Fatal("expected an encrypted config file to be reported")
+	}
+}
+
+// Remotes should be mounted in config file order, skipping disallowed types and unusable names, up to the limit.
+func TestSelectRemotes(t *testing.T) {
+	remotes := []RcloneRemote{
+		{Name: "drive1", Type: "drive"},
+		{Name: "../escape", Type: "drive"},
+		{Name: "disk", Type: "local"},
+		{Name: "box", Type: "Dropbox"},
+		{Name: "drive2", Type: "drive"},
+	}
+	accepted, rejected := selectRemotes(remotes, UserRemotesConfig{AllowedTypes: []string{"drive", "dropbox"}, MaxMounts: 2})
+	if len(accepted) != 2 || accepted[0].Name != "drive1" || accepted[1].Name != "box" {
+		t.Fatalf("unexpected accepted remotes %+v", accepted)
+	}
+	var rejectedNames []string
+	for _, remote := range rejected {
+		rejectedNames = append(rejectedNames, remote.Name)
+	}
+	if !reflect.DeepEqual(rejectedNames, []string{"../escape", "disk", "drive2"}) {
+		t.Fatalf("unexpected rejected remotes %+v", rejected)
+	}
+	if accepted, _ := selectRemotes(remotes, UserRemotesConfig{}); len(accepted) != 0 {
+		t.Fatalf("expected nothing mounted with no allowed types, got %+v", accepted)
+	}
+}
+
+// Symlinks anywhere in a path in a user's home folder should be refused.
+func TestCheckUserPath(t *testing.T) {
+	homeFolder := t.TempDir()
+	os.MkdirAll(filepath.Join(homeFolder, ".config", "rclone"), 0700)
+	os.WriteFile(filepath.Join(homeFolder, ".config", "rclone", "rclone.conf"), []byte("[a]\n"), 0600)
+	os.Symlink("/etc", filepath.Join(homeFolder, "Cloud"))
+	if pathErr := checkUserPath(homeFolder, userRcloneConfigPath, false); pathErr != nil {
+		t.Fatalf("unexpected error %v", pathErr)
+	}
+	if pathErr := checkUserPath(homeFolder, "Missing/folder", true); pathErr != nil {
+		t.Fatalf("unexpected error for a missing folder %v", pathErr)
+	}
+	if pathErr := checkUserPath(homeFolder, "Cloud", true); pathErr == nil {
+		t.Fatal("expected a symlinked folder to be refused")
+	}
+	if pathErr := checkUserPath(homeFolder, ".config/rclone/rclone.conf/x", true); pathErr == nil {
+		t.Fatal("expected a file in the middle of a path to be refused")
+	}
+}
+
+// Folders created in a user's home folder as root should never be created, or chowned, through a symlink.
+func TestMkdirChownInUserFolder(t *testing.T) {
+	homeFolder := t.TempDir()
+	outside := t.TempDir()
+	os.Symlink(outside, filepath.Join(homeFolder, "Cloud"))
+	if mkdirErr := mkdirChownInUserFolder(homeFolder, "Cloud/drive", os.Getuid(), os.Getgid()); mkdirErr == nil {
+		t.Fatal("expected a symlinked folder to be refused")
+	}
+	if _, statErr := os.Stat(filepath.Join(outside, "drive")); !os.IsNotExist(statErr) {
+		t.Fatal("expected nothing to be created through the symlink")
+	}
+	if mkdirErr := mkdirChownInUserFolder(homeFolder, "Remotes/drive", os.Getuid(), os.Getgid()); mkdirErr != nil {
+		t.Fatalf("unexpected error %v", mkdirErr)
+	}
+	if info, statErr := os.Lstat(filepath.Join(homeFolder, "Remotes", "drive")); statErr != nil || !info.IsDir() {
+		t.Fatal("expected the folder to be created")
+	}
+	if mkdirErr := mkdirChownInUserFolder(homeFolder, "../escape", os.Getuid(), os.Getgid()); mkdirErr == nil {
+		t.Fatal("expected a path climbing out of the folder to be refused")
+	}
+}
+
+// The first quota matching the user's groups should apply, with the hard limit taking priority over the soft limit.
+func TestDiskQuotas(t *testing.T) {
+	quotas := []DiskQuota{
+		{Groups: []string{"staff"}, SoftLimit: "20g"},
+		{Groups: []string{"pupils"}, SoftLimit: "1m", HardLimit: "2m", HardLimitAction: hardLimitReadOnlyWWW},
+		{SoftLimit: "1m", HardLimit: "2m"},
+	}
+	if quota := selectDiskQuota(quotas, []string{"pupils", "staff"}); quota != &quotas[0] {
+		t.Fatalf("expected the staff quota, got %+v", quota)
+	}
+	if quota := selectDiskQuota(quotas, []string{"visitors"}); quota != &quotas[2] {
+		t.Fatalf("expected the catch-all quota, got %+v", quota)
+	}
+	for _, test := range []struct {
+		total int64
+		state string
+	}{{512 * 1024, diskUsageOK}, {1024 * 1024, diskUsageOverSoft}, {3 * 1024 * 1024, diskUsageOverHard}} {
+		if usage := withQuota(UserDiskUsage{Total: test.total}, &quotas[1]); usage.State != test.state || usage.HardLimit != 2*1024*1024 {
+			t.Fatalf("usage %d: got %+v, want state %s", test.total, usage, test.state)
+		}
+	}
+	if usage := withQuota(UserDiskUsage{Total: 1 << 40}, nil); usage.State != diskUsageOK {
+		t.Fatalf("expected no limits without a quota, got %+v", usage)
+	}
+
+	// Unknown users have no groups, so get the catch-all quota.
+	config := Config{DiskQuotas: quotas}
+	if quotaCheck := checkDiskQuota(config, "quota.test.user"); quotaCheck.State != diskUsageOK || quotaCheck.refusesStart() {
+		t.Fatalf("expected a user not yet counted to be let through, got %+v", quotaCheck)
+	}
+	diskUsage.set(UserDiskUsage{Username: "quota.test.user", Total: 3 * 1024 * 1024})
+	defer func() { delete(diskUsage.users, "quota.test.user") }()
+	if quotaCheck := checkDiskQuota(config, "quota.test.user"); !quotaCheck.refusesStart() || quotaCheck.wwwReadOnly() || !strings.Contains(quotaCheck.Message, "3.0 MB") {
+		t.Fatalf("expected the start to be refused, got %+v", quotaCheck)
+	}
+	config.DiskQuotas[2].HardLimitAction = hardLimitReadOnlyWWW
+	if quotaCheck := checkDiskQuota(config, "quota.test.user"); quotaCheck.refusesStart() || !quotaCheck.wwwReadOnly() {
+		t.Fatalf("expected a read-only www folder, got %+v", quotaCheck)
+	}
+}
+
+// Files with several hard links should only be counted once, and a missing folder should use no space.
+func TestFolderUsage(t *testing.T) {
+	folder := t.TempDir()
+	os.MkdirAll(filepath.Join(folder, "videos"), 0700)
+	if writeErr := os.WriteFile(filepath.Join(folder, "videos", "big.mp4"), make([]byte, 256*1024), 0600); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	before, usageErr := folderUsage(folder)
+	if usageErr != nil || before < 256*1024 {
+		t.Fatalf("got %d, %v", before, usageErr)
+	}
+	if linkErr := os.Link(filepath.Join(folder, "videos", "big.mp4"), filepath.Join(folder, "copy.mp4")); linkErr != nil {
+		t.Fatal(linkErr)
+	}
+	if after, _ := folderUsage(folder); after != before {
+		t.Fatalf("hard link counted twice: %d then %d", before, after)
+	}
+	if missing, missingErr := folderUsage(filepath.Join(folder, "missing")); missing != 0 || missingErr != nil {
+		t.Fatalf("got %d, %v for a missing folder", missing, missingErr)
+	}
+}
+
+// Incremental backups should take a full backup every so often, and expired backups should only be deleted a whole
+// chain (a full backup and the incremental backups after it) at a time, never the latest one.
+func TestBackupSchedule(t *testing.T) {
+	backupConfig := BackupConfig{Incremental: true, IntervalHours: 24, FullEveryDays: 7, KeepDays: 10}
+	start := time.Date(2026, 1, 1, 2, 0, 0, 0, time.UTC)
+	var snapshots []Snapshot
+	for day := 0; day < 30; day++ {
+		now := start.Add(time.Duration(day) * 24 * time.Hour)
+		if kind := nextSnapshotKind(backupConfig, snapshots, now); kind != "" {
+			snapshots = append(snapshots, Snapshot{ID: now.Format("20060102-150405") + "-" + kind, Time: now, Kind: kind})
+		}
+		if kind := nextSnapshotKind(backupConfig, snapshots, now.Add(time.Hour)); kind != "" {
+			t.Fatalf("day %d: backup due again an hour later", day)
+		}
+	}
+	if len(snapshots) != 30 || snapshots[0].Kind != snapshotFull || snapshots[1].Kind != snapshotIncremental || snapshots[7].Kind != snapshotFull {
+		t.Fatalf("unexpected snapshots %+v", snapshots)
+	}
+	expired := expiredSnapshots(backupConfig, snapshots, start.Add(29*24*time.Hour))
+	if len(expired) != 14 || expired[0].ID != snapshots[0].ID || expired[13].ID != snapshots[13].ID {
+		t.Fatalf("expected the first two weeks to expire, got %+v", expired)
+	}
+	if expired := expiredSnapshots(backupConfig, snapshots[:3], start.Add(365*24*time.Hour)); len(expired) != 0 {
+		t.Fatalf("the latest chain should never expire, got %+v", expired)
+	}
+
+	chain, chainErr := restoreChain(snapshots, snapshots[9].ID)
+	if chainErr != nil || len(chain) != 3 || chain[0].ID != snapshots[7].ID {
+		t.Fatalf("unexpected restore chain %+v, %v", chain, chainErr)
+	}
+	if _, chainErr := restoreChain(snapshots[1:5], snapshots[3].ID); chainErr == nil {
+		t.Fatal("expected an error restoring without the full backup")
+	}
+	if nextSnapshotKind(BackupConfig{}, snapshots, start.Add(30*24*time.Hour)) != snapshotFull {
+		t.Fatal("expected only full backups when not incremental")
+	}
+}
+
+func TestCheckRestoreRequest(t *testing.T) {
+	valid := RestoreRequest{Username: "jane.doe", Folder: "home", Snapshot: "20260101-020000-full", Path: "Documents/essay.odt"}
+	if checkErr := checkRestoreRequest(valid); checkErr != "" {
+		t.Fatalf("unexpected error %s", checkErr)
+	}
+	for _, invalid := range []RestoreRequest{
+		{Username: "../root", Folder: "home", Snapshot: valid.Snapshot},
+		{Username: "jane.doe", Folder: "etc", Snapshot: valid.Snapshot},
+		{Username: "jane.doe", Folder: "www", Snapshot: "../../x"},
+		{Username: "jane.doe", Folder: "www", Snapshot: valid.Snapshot, Path: "../../etc/passwd"},
+		{Username: "jane.doe", Folder: "www", Snapshot: valid.Snapshot, Path: "/etc/passwd"},
+	} {
+		if checkRestoreRequest(invalid) == "" {
+			t.Fatalf("expected %+v to be rejected", invalid)
+		}
+	}
+}
+
+// A file deleted after the full backup should come back when restoring the full backup, and stay deleted when
+// restoring the incremental one, both into the "restored" folder.
+func TestBackupAndRestore(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("restoring runs tar as the user, which needs root")
+	}
+	if _, tarErr := exec.LookPath("tar"); tarErr != nil {
+		t.Skip("tar isn't installed")
+	}
+	currentUser, _ := user.Current()
+	homeRoot := t.TempDir()
+	defer func(previous string) { backupFolders["home"] = previous }(backupFolders["home"])
+	backupFolders["home"] = homeRoot
+	userFolder := filepath.Join(homeRoot, currentUser.Username)
+	os.MkdirAll(filepath.Join(userFolder, "Documents"), 0700)
+	os.WriteFile(filepath.Join(userFolder, "Documents", "essay.txt"), []byte("draft"), 0600)
+	os.WriteFile(filepath.Join(userFolder, "notes.txt"), []byte("notes"), 0600)
+	backupConfig := BackupConfig{Target: t.TempDir(), Incremental: true}
+
+	if backupErr := backupFolder(backupConfig, currentUser.Username, "home", snapshotFull); backupErr != nil {
+		t.Fatal(backupErr)
+	}
+	// tar decides what goes in an incremental backup by comparing file times with when the last backup started, so
+	// wait past the timestamp granularity before changing anything, and make sure the rewritten file's time is clearly
+	// after the full backup.
+	time.Sleep(1100 * time.Millisecond)
+	os.Remove(filepath.Join(userFolder, "notes.txt"))
+	essayPath := filepath.Join(userFolder, "Documents", "essay.txt")
+	os.WriteFile(essayPath, []byte("final"), 0600)
+	os.Chtimes(essayPath, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	if backupErr := backupFolder(backupConfig, currentUser.Username, "home", snapshotIncremental); backupErr != nil {
+		t.Fatal(backupErr)
+	}
+	snapshots, _ := listSnapshots(backupConfig, currentUser.Username, "home")
+	if len(snapshots) != 2 || snapshots[0].Kind != snapshotFull || snapshots[1].Kind != snapshotIncremental {
+		t.Fatalf("unexpected snapshots %+v", snapshots)
+	}
+
+	restoredTo, restoreErr := restoreSnapshot(backupConfig, RestoreRequest{Username: currentUser.Username, Folder: "home", Snapshot: snapshots[0].ID})
+	if restoreErr != nil {
+		t.Fatal(restoreErr)
+	}
+	if notes, _ := os.ReadFile(filepath.Join(restoredTo, "notes.txt")); string(notes) != "notes" {
+		t.Fatalf("expected notes.txt restored from the full backup, got %q", notes)
+	}
+	restoredTo, restoreErr = restoreSnapshot(backupConfig, RestoreRequest{Username: currentUser.Username, Folder: "home", Snapshot: snapshots[1].ID, Path: "Documents/essay.txt"})
+	if restoreErr != nil {
+		t.Fatal(restoreErr)
+	}
+	if essay, _ := os.ReadFile(filepath.Join(restoredTo, "Documents", "essay.txt")); string(essay) != "final" {
+		t.Fatalf("expected the final essay, got %q", essay)
+	}
+	if _, statErr := os.Stat(filepath.Join(restoredTo, "notes.txt")); statErr == nil {
+		t.Fatal("expected only the requested path to be restored")
+	}
+	if _, restoreErr := restoreSnapshot(backupConfig, RestoreRequest{Username: currentUser.Username, Folder: "home", Snapshot: snapshots[1].ID}); restoreErr == nil {
+		t.Fatal("expected an error restoring over an earlier restore")
+	}
+}
+
+func TestCheckDeprovisionRequest(t *testing.T) {
+	if checkErr := checkDeprovisionRequest(DeprovisionRequest{Username: "jane.doe", DryRun: true}); checkErr != "" {
+		t.Fatalf("unexpected error for a dry run: %s", checkErr)
+	}
+	if checkDeprovisionRequest(DeprovisionRequest{Username: "jane.doe"}) == "" {
+		t.Fatal("expected a deprovision without confirmation to be refused")
+	}
+	if checkErr := checkDeprovisionRequest(DeprovisionRequest{Username: "jane.doe", Confirm: "jane.doe"}); checkErr != "" {
+		t.Fatalf("unexpected error: %s", checkErr)
+	}
+	if checkDeprovisionRequest(DeprovisionRequest{Username: "..", DryRun: true}) == "" {
+		t.Fatal("expected an invalid username to be refused")
+	}
+	steps := []DeprovisionStep{
+		{Action: deprovisionArchive, Target: "/archive/jane.doe.tar.gz", Result: "ok"},
+		{Action: deprovisionDeleteFolder, Target: "/home/jane.doe", Result: "failed", Error: "/home/jane.doe/Cloud/x is still mounted"},
+	}
+	if description := describeDeprovisionSteps(steps); description != "archive /archive/jane.doe.tar.gz ok; delete-folder /home/jane.doe failed: /home/jane.doe/Cloud/x is still mounted" {
+		t.Fatalf("unexpected description %q", description)
+	}
+}
+
+// A user's folders should be archived with their full paths, and deleted afterwards.
+func TestArchiveUserFolders(t *testing.T) {
+	if _, tarErr := exec.LookPath("tar"); tarErr != nil {
+		t.Skip("tar isn't installed")
+	}
+	root := t.TempDir()
+	homeFolder := filepath.Join(root, "home", "jane.doe")
+	os.MkdirAll(homeFolder, 0700)
+	os.WriteFile(filepath.Join(homeFolder, "essay.txt"), []byte("essay"), 0600)
+	archivePath := filepath.Join(root, "archive", "jane.doe.tar.gz")
+	if archiveErr := archiveUserFolders(archivePath, []string{homeFolder}); archiveErr != nil {
+		t.Fatal(archiveErr)
+	}
+	listing, listErr := exec.Command("tar", "--list", "--gzip", "--file", archivePath).Output()
+	if listErr != nil || !strings.Contains(string(listing), strings.TrimPrefix(homeFolder, "/")+"/essay.txt") {
+		t.Fatalf("unexpected archive contents %q, %v", listing, listErr)
+	}
+	if deleteErr := deleteUserFolder(homeFolder); deleteErr != nil {
+		t.Fatal(deleteErr)
+	}
+	if _, statErr := os.Stat(homeFolder); !os.IsNotExist(statErr) {
+		t.Fatal("expected the folder to be deleted")
+	}
+	if archiveErr := archiveUserFolders(filepath.Join(root, "archive", "missing.tar.gz"), []string{filepath.Join(root, "missing")}); archiveErr == nil {
+		t.Fatal("expected an error archiving a missing folder")
+	}
+}
+
+// A provisioning CSV file's columns should be found by their headings, in any order, with blank lines skipped.
+func TestParseProvisionCSV(t *testing.T) {
+	csvInput := "Username, Display Name, Groups, Image, Autostart\n" +
+		"jane.doe,Jane Doe,year12;art,desktop,yes\n" +
+		"\n" +
+		"john.smith,\"Smith, John\",year13 music,,\n"
+	entries, parseErr := parseProvisionCSV(strings.NewReader(csvInput))
+	if parseErr != nil {
+		t.Fatalf("unexpected error: %v", parseErr)
+	}
+	expected := []ProvisionEntry{
+		{Line: 2, Username: "jane.doe", DisplayName: "Jane Doe", Groups: []string{"year12", "art"}, Image: "desktop", AutoStart: true},
+		{Line: 4, Username: "john.smith", DisplayName: "Smith, John", Groups: []string{"year13", "music"}},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+	if _, parseErr := parseProvisionCSV(strings.NewReader("name,groups\nJane Doe,year12\n")); parseErr == nil {
+		t.Fatal("expected a CSV file without a username column to be refused")
+	}
+
+	config := Config{Images: []CatalogueImage{{Name: "desktop"}}}
+	if checkErr := checkProvisionEntry(config, entries[0]); checkErr != "" {
+		t.Fatalf("unexpected error: %s", checkErr)
+	}
+	// "Smith, John" would split the passwd file's comment field.
+	if checkProvisionEntry(config, entries[1]) == "" {
+		t.Fatal("expected a display name with a comma to be refused")
+	}
+	for _, entry := range []ProvisionEntry{
+		{Username: "Jane"},
+		{Username: "jane", Groups: []string{"year 12"}},
+		{Username: "jane", Image: "unknown"},
+		{Username: "jane", AutoStart: true},
+	} {
+		if checkProvisionEntry(config, entry) == "" {
+			t.Fatalf("expected entry %+v to be refused", entry)
+		}
+	}
+}
+
+// New host accounts should get the lowest free UID in the configured range.
+func TestNextFreeUID(t *testing.T) {
+	passwdFile := filepath.Join(t.TempDir(), "passwd")
+	os.WriteFile(passwdFile, []byte("root:x:0:0:root:/root:/bin/bash\n"+
+		"jane.doe:x:10000:10000:Jane Doe,,,:/home/jane.doe:/bin/bash\n"+
+		"john.smith:x:10001:10001::/home/john.smith:/bin/bash\n"), 0644)
+	accounts, passwdErr := readPasswd(passwdFile)
+	if passwdErr != nil {
+		t.Fatalf("unexpected error: %v", passwdErr)
+	}
+	if accounts["jane.doe"].DisplayName != "Jane Doe" || accounts["john.smith"].UID != 10001 {
+		t.Fatalf("unexpected accounts %+v", accounts)
+	}
+	minUID, maxUID := uidRange(ProvisioningConfig{})
+	if uid, uidErr := nextFreeUID(accounts, minUID, maxUID); uidErr != nil || uid != 10002 {
+		t.Fatalf("expected UID 10002, got %d (%v)", uid, uidErr)
+	}
+	if _, uidErr := nextFreeUID(accounts, 10000, 10001); uidErr == nil {
+		t.Fatal("expected an error when the range is full")
+	}
+	if problems := validateConfig(Config{Provisioning: ProvisioningConfig{MinUID: 20000, MaxUID: 19999}}); len(problems) == 0 {
+		t.Fatal("expected an empty UID range to be a problem")
+	}
+}
+
+// Schedule rules should only apply on their days, in term time and outside holidays, and invalid rules should be
+// left out with a problem reported.
+func TestSchedule(t *testing.T) {
+	config := Config{Images: []CatalogueImage{{Name: "desktop"}}}
+	autoStartConfig := AutoStartConfig{
+		Schedules: []ScheduleRule{
+			{Name: "Year 10 Computing", Group: "year10", Image: "desktop", Days: []string{"Mon", "wednesday"}, Start: "08:50", Stop: "10:00"},
+			{Name: "Jane's extra lesson", Username: "jane.doe", Image: "desktop", Days: []string{"mon"}, Start: "09:30", Stop: "11:00"},
+			{Name: "no-one", Image: "desktop", Days: []string{"mon"}, Start: "08:50", Stop: "10:00"},
+			{Name: "backwards", Username: "jane.doe", Image: "desktop", Days: []string{"mon"}, Start: "10:00", Stop: "08:50"},
+			{Name: "bad day", Username: "jane.doe", Image: "desktop", Days: []string{"mo"}, Start: "08:50", Stop: "10:00"},
+		},
+		Terms:    []DateRange{{Name: "Autumn", Start: "2026-09-03", End: "2026-12-18"}},
+		Holidays: []DateRange{{Name: "Half term", Start: "2026-10-26", End: "2026-10-30"}, {Name: "broken", Start: "2026-11-02", End: "2026-11-01"}},
+	}
+	schedule, problems := compileSchedule(config, autoStartConfig)
+	if len(schedule.rules) != 2 || len(problems) != 4 {
+		t.Fatalf("expected 2 valid rules and 4 problems, got %d rules and problems %v", len(schedule.rules), problems)
+	}
+
+	sessions := scheduledSessions(schedule, func(group string) []string { return []string{"jane.doe", "john.smith"} })
+	if len(sessions) != 2 || sessions[0].Username != "jane.doe" || len(sessions[0].rules) != 2 || len(sessions[1].rules) != 1 {
+		t.Fatalf("unexpected scheduled sessions %+v", sessions)
+	}
+	jane, john := sessions[0].rules, sessions[1].rules
+	at := func(date string, clock string) time.Time {
+		parsed, _ := time.ParseInLocation("2006-01-02 15:04", date+" "+clock, time.Local)
+		return parsed
+	}
+	for _, check := range []struct {
+		rules    []compiledScheduleRule
+		at       time.Time
+		expected bool
+	}{
+		{john, at("2026-10-19", "08:49"), false},
+		{john, at("2026-10-19", "08:50"), true},
+		{john, at("2026-10-19", "10:00"), false},
+		{jane, at("2026-10-19", "10:30"), true},
+		// Tuesday, then half term, then the summer holidays (outside any term).
+		{john, at("2026-10-20", "09:00"), false},
+		{john, at("2026-10-26", "09:00"), false},
+		{john, at("2027-08-02", "09:00"), false},
+	} {
+		if active := schedule.isActive(check.rules, check.at); active != check.expected {
+			t.Fatalf("expected active %v at %v, got %v", check.expected, check.at, active)
+		}
+	}
+
+	// Jane's overlapping lessons run on from 08:50 to 11:00, so there is no stop at 10:00 or start at 09:30.
+	if action, actionTime, _, _ := schedule.nextAction(jane, at("2026-10-19", "09:00")); action != scheduleStop || !actionTime.Equal(at("2026-10-19", "11:00")) {
+		t.Fatalf("expected a stop at 11:00, got %s at %v", action, actionTime)
+	}
+	// After Monday's lessons, the next is on Wednesday.
+	if action, actionTime, ruleName, _ := schedule.nextAction(john, at("2026-10-19", "10:00")); action != scheduleStart || !actionTime.Equal(at("2026-10-21", "08:50")) || ruleName != "Year 10 Computing" {
+		t.Fatalf("expected a start on Wednesday at 08:50, got %s at %v (%s)", action, actionTime, ruleName)
+	}
+	// Half term is skipped.
+	if action, actionTime, _, _ := schedule.nextAction(john, at("2026-10-23", "12:00")); action != scheduleStart || !actionTime.Equal(at("2026-11-02", "08:50")) {
+		t.Fatalf("expected a start after half term, got %s at %v", action, actionTime)
+	}
+	// Nothing is scheduled once the last term has ended.
+	if _, _, _, found := schedule.nextAction(john, at("2026-12-19", "12:00")); found {
+		t.Fatal("expected nothing scheduled after the last term")
+	}
+
+	scheduler := newSessionScheduler()
+	now := at("2026-10-19", "10:00")
+	if lastCheck := scheduler.advance(now); !lastCheck.Equal(now.Add(-autoStartRetryInterval)) {
+		t.Fatalf("unexpected first check time %v", lastCheck)
+	}
+	if lastCheck := scheduler.advance(now.Add(time.Minute)); !lastCheck.Equal(now) {
+		t.Fatalf("unexpected check time %v", lastCheck)
+	}
+}
+
+// Saving the auto-start list should only change the session list, keeping the hand-edited schedule and its comments.
+func TestWriteAutoStartSessions(t *testing.T) {
+	autoStartFile := filepath.Join(t.TempDir(), "autostart.yml")
+	os.WriteFile(autoStartFile, []byte(`# Sessions kept running all the time.
+sessions:
+  - username: jane.doe
+    image: desktop
+# Year 10 have Computing first thing on Mondays.
+schedules:
+  - name: Year 10 Computing # ask Mr Smith before changing
+    group: year10
+    image: desktop
+    days: [mon]
+    start: "08:50"
+    stop: "10:00"
+`), 0600)
+	if writeErr := writeAutoStartSessions(autoStartFile, []AutoStartEntry{{Username: "john.smith", Image: "desktop"}}); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	written, _ := os.ReadFile(autoStartFile)
+	for _, expected := range []string{"# Sessions kept running all the time.", "# Year 10 have Computing first thing on Mondays.", "# ask Mr Smith before changing"} {
+		if !strings.Contains(string(written), expected) {
+			t.Fatalf("expected comment %q to be kept, got:\n%s", expected, written)
+		}
+	}
+	autoStartConfig, readErr := readAutoStartConfig(autoStartFile)
+	if readErr != nil || len(autoStartConfig.Sessions) != 1 || autoStartConfig.Sessions[0].Username != "john.smith" || len(autoStartConfig.Schedules) != 1 || autoStartConfig.Schedules[0].Start != "08:50" {
+		t.Fatalf("unexpected auto-start config %+v (%v)", autoStartConfig, readErr)
+	}
+
+	// A missing file is created, and an empty list is saved as an empty list.
+	newFile := filepath.Join(t.TempDir(), "autostart.yml")
+	if writeErr := writeAutoStartSessions(newFile, nil); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	if autoStartConfig, readErr := readAutoStartConfig(newFile); readErr != nil || autoStartConfig.Sessions == nil || len(autoStartConfig.Sessions) != 0 {
+		t.Fatalf("unexpected auto-start config %+v (%v)", autoStartConfig, readErr)
+	}
+}
+
+// Exam candidates should only be able to start their session until their time is up, extra time should unlock a
+// locked candidate, and exams should survive a restart.
+func TestExamRegistry(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "exams.json")
+	registry := newExamRegistry(statePath)
+	now := time.Date(2026, 6, 1, 9, 0, 0, 0, time.UTC)
+	if _, examErr := registry.checkStart("exams", "jane.doe", now); examErr == "" {
+		t.Fatal("expected an exam session to be refused with no exam running")
+	}
+	exam := &Exam{Name: "Maths Paper 1", Group: "year11", Image: "exams", Started: now, Candidates: []*ExamCandidate{
+		{Username: "jane.doe", EndTime: now.Add(90 * time.Minute)},
+		{Username: "john.smith", EndTime: now.Add(90 * time.Minute)},
+	}}
+	if startErr := registry.start(exam); startErr != nil {
+		t.Fatalf("unexpected error: %v", startErr)
+	}
+	if examName, examErr := registry.checkStart("exams", "jane.doe", now.Add(time.Hour)); examErr != "" || examName != "Maths Paper 1" {
+		t.Fatalf("expected jane.doe to be sitting the exam, got %q (%s)", examName, examErr)
+	}
+	if registry.start(&Exam{Name: "Maths Paper 1", Image: "exams", Started: now}) == nil {
+		t.Fatal("expected a running exam not to be started again")
+	}
+
+	// John finishes early; Jane's time runs out and she is given ten minutes more.
+	if endErr := registry.end("Maths Paper 1", "john.smith", now.Add(time.Hour)); endErr != nil {
+		t.Fatalf("unexpected error: %v", endErr)
+	}
+	if due := registry.due(now.Add(time.Hour)); !reflect.DeepEqual(due, [][2]string{{"exams", "john.smith"}}) {
+		t.Fatalf("unexpected due candidates %v", due)
+	}
+	registry.setLocked("exams", "john.smith", now.Add(time.Hour))
+	registry.setLocked("exams", "jane.doe", now.Add(90*time.Minute))
+	if _, examErr := registry.checkStart("exams", "jane.doe", now.Add(91*time.Minute)); examErr == "" {
+		t.Fatal("expected a locked candidate to be refused")
+	}
+	imageName, unlocked, extendErr := registry.extend("Maths Paper 1", "jane.doe", 10, now.Add(95*time.Minute))
+	if extendErr != nil || imageName != "exams" || !reflect.DeepEqual(unlocked, []string{"jane.doe"}) {
+		t.Fatalf("unexpected extend result %q %v %v", imageName, unlocked, extendErr)
+	}
+	if !registry.isSitting("exams", "jane.doe", now.Add(104*time.Minute)) || registry.isSitting("exams", "jane.doe", now.Add(105*time.Minute)) {
+		t.Fatal("expected the extra time to run from when it was given")
+	}
+	if _, _, extendErr := registry.extend("Maths Paper 1", "nobody", 10, now); extendErr == nil {
+		t.Fatal("expected extra time for someone not sitting the exam to be refused")
+	}
+
+	// The exam is saved, and is cleared away a day after the last candidate was locked.
+	reloaded := newExamRegistry(statePath)
+	if loadErr := reloaded.load(); loadErr != nil {
+		t.Fatalf("unexpected error: %v", loadErr)
+	}
+	if exams := reloaded.list(); len(exams) != 1 || len(exams[0].Candidates) != 2 || exams[0].Candidates[0].EndTime.IsZero() {
+		t.Fatalf("unexpected reloaded exams %+v", exams)
+	}
+	reloaded.setLocked("exams", "jane.doe", now.Add(105*time.Minute))
+	if expired := reloaded.expired(now.Add(24 * time.Hour)); len(expired) != 0 {
+		t.Fatalf("expected the exam to be kept for a day, got %+v", expired)
+	}
+	if expired := reloaded.expired(now.Add(26 * time.Hour)); len(expired) != 1 || len(reloaded.list()) != 0 {
+		t.Fatalf("expected the exam to be cleared away, got %+v", expired)
+	}
+}
+
+// An exam session that isn't part of a running exam can't be restarted or unpaused by an admin, but can be stopped,
+// and other sessions are unaffected.
+func TestCheckExamSessionAction(t *testing.T) {
+	config := Config{Images: []CatalogueImage{{Name: "desktop"}, {Name: "exams"}}}
+	now := time.Now()
+	for _, action := range []string{"restart", "unpause"} {
+		if examErr := checkExamSessionAction(config, "exams", "locked.candidate", action, now); !strings.Contains(examErr, "/admin/exams/extend") {
+			t.Fatalf("expected %s of a locked exam session to be refused, got %q", action, examErr)
+		}
+	}
+	if checkExamSessionAction(config, "exams", "locked.candidate", "stop", now) != "" || checkExamSessionAction(config, "desktop", "locked.candidate", "unpause", now) != "" {
+		t.Fatal("expected other actions, and other sessions, to be allowed")
+	}
+}
+
+// Exams can only be started with an exam image, and for a sensible length of time.
+func TestCheckExamStartRequest(t *testing.T) {
+	config := Config{Images: []CatalogueImage{{Name: "desktop"}, {Name: "exams"}}}
+	if checkErr := checkExamStartRequest(config, ExamStartRequest{Name: "Maths Paper 1", Group: "year11", Image: "exams", DurationMinutes: 90}); checkErr != "" {
+		t.Fatalf("unexpected error: %s", checkErr)
+	}
+	for _, examRequest := range []ExamStartRequest{
+		{Name: "", Group: "year11", Image: "exams", DurationMinutes: 90},
+		{Name: "Maths", Group: "Year 11", Image: "exams", DurationMinutes: 90},
+		{Name: "Maths", Group: "year11", Image: "desktop", DurationMinutes: 90},
+		{Name: "Maths", Group: "year11", Image: "exams", DurationMinutes: 0},
+	} {
+		if checkExamStartRequest(config, examRequest) == "" {
+			t.Fatalf("expected %+v to be refused", examRequest)
+		}
+	}
+}
+
+// Sessions share the main network unless isolated, and isolated sessions get the egress of their user's first
+// matching policy. Exam sessions are always isolated, with egress blocked.
+func TestPlanSessionNetwork(t *testing.T) {
+	config := Config{Images: []CatalogueImage{{Name: "desktop"}, {Name: "exams"}}}
+	if plan := planSessionNetwork(config, "desktop", "jane.doe", nil); plan.Name != defaultSessionNetwork || plan.Egress != "" {
+		t.Fatalf("expected the main network, got %+v", plan)
+	}
+	examPlan := planSessionNetwork(config, "exams", "jane.doe", nil)
+	if examPlan.Name != "puws-session-exams-jane.doe" || !examPlan.Internal || examPlan.Egress != egressBlocked || !reflect.DeepEqual(examPlan.Gateways, []string{"guacd"}) {
+		t.Fatalf("expected an isolated exam network, got %+v", examPlan)
+	}
+
+	config.SessionNetworks = SessionNetworkConfig{Isolated: true, Egress: []EgressPolicy{
+		{Name: "juniors", Groups: []string{"year7", "year8"}, Egress: egressBlocked},
+		{Name: "filtered", Groups: []string{"pupils"}, Egress: egressProxied, ProxyContainer: "squid"},
+	}}
+	if plan := planSessionNetwork(config, "desktop", "jane.doe", []string{"pupils", "year8"}); plan.Policy != "juniors" || !plan.Internal || !reflect.DeepEqual(plan.Gateways, []string{"guacd", "sessionproxy"}) {
+		t.Fatalf("expected the juniors policy, got %+v", plan)
+	}
+	if plan := planSessionNetwork(config, "desktop", "jane.doe", []string{"pupils"}); plan.Egress != egressProxied || !reflect.DeepEqual(plan.Gateways, []string{"guacd", "sessionproxy", "squid"}) {
+		t.Fatalf("expected the filtered policy, got %+v", plan)
+	}
+	plan := planSessionNetwork(config, "desktop", "mr.smith", []string{"staff"})
+	if plan.Name != "puws-session-desktop-mr.smith" || plan.Internal || plan.Egress != egressAllowed || plan.Policy != "" {
+		t.Fatalf("expected egress allowed with no policy, got %+v", plan)
+	}
+	if !sessionNetworkChanged(container.Summary{Labels: map[string]string{}}, plan) {
+		t.Fatal("expected a session on the main network to need recreating")
+	}
+	if sessionNetworkChanged(container.Summary{Labels: map[string]string{sessionNetworkLabel: plan.Name, sessionEgressLabel: egressAllowed}}, plan) {
+		t.Fatal("expected a session on its planned network to be left alone")
+	}
+
+	// Only session networks no container is on any more are swept away at startup.
+	containers := []container.Summary{{Labels: map[string]string{sessionNetworkLabel: plan.Name}}, {Labels: map[string]string{}}}
+	networkNames := []string{defaultSessionNetwork, plan.Name, "puws-session-exams-jane.doe", "bridge"}
+	if orphaned := orphanedSessionNetworks(networkNames, containers); !reflect.DeepEqual(orphaned, []string{"puws-session-exams-jane.doe"}) {
+		t.Fatalf("unexpected orphaned networks %v", orphaned)
+	}
+}
+
+// An egress policy's proxy settings are passed to sessions as environment variables (with the CA certificate
+// mounted), whether or not sessions are isolated, and a change to them is noticed.
+func TestEgressProxySettings(t *testing.T) {
+	policy := EgressPolicy{Name: "filtered", Groups: []string{"pupils"}, HTTPProxy: "http://filter:3128", NoProxy: []string{".school.internal"}, CACertificate: "/etc/puws/filter-ca.crt"}
+	expected := []string{
+		"HTTP_PROXY=http://filter:3128", "http_proxy=http://filter:3128",
+		"HTTPS_PROXY=http://filter:3128", "https_proxy=http://filter:3128",
+		"NO_PROXY=localhost,127.0.0.1,::1,.school.internal", "no_proxy=localhost,127.0.0.1,::1,.school.internal",
+		"NODE_EXTRA_CA_CERTS=" + egressCACertificatePath, "REQUESTS_CA_BUNDLE=" + systemCABundlePath,
+	}
+	if environment := policy.environment(); !reflect.DeepEqual(environment, expected) {
+		t.Fatalf("unexpected environment: %v", environment)
+	}
+	if mounts := policy.mounts(); len(mounts) != 1 || mounts[0].Source != "/etc/puws/filter-ca.crt" || mounts[0].Target != egressCACertificatePath || !mounts[0].ReadOnly {
+		t.Fatalf("unexpected mounts: %+v", mounts)
+	}
+	if (&EgressPolicy{Name: "open"}).settingsFingerprint() != "" {
+		t.Fatal("expected no fingerprint for a policy without proxy settings")
+	}
+
+	config := Config{Images: []CatalogueImage{{Name: "desktop"}, {Name: "exams"}}, SessionNetworks: SessionNetworkConfig{Egress: []EgressPolicy{policy}}}
+	plan := planSessionNetwork(config, "desktop", "jane.doe", []string{"pupils"})
+	if plan.Name != defaultSessionNetwork || plan.Policy != "filtered" || plan.Settings == "" || len(plan.Environment) != len(expected) {
+		t.Fatalf("expected the policy's proxy settings on the main network, got %+v", plan)
+	}
+	if examPlan := planSessionNetwork(config, "exams", "jane.doe", []string{"pupils"}); examPlan.Policy != "" || len(examPlan.Environment) != 0 {
+		t.Fatalf("expected no proxy settings for an exam session, got %+v", examPlan)
+	}
+	created := container.Summary{Labels: map[string]string{sessionEgressPolicyLabel: plan.Policy, sessionEgressSettingsLabel: plan.Settings}}
+	if sessionNetworkChanged(created, plan) {
+		t.Fatal("expected a session with the current proxy settings to be left alone")
+	}
+	config.SessionNetworks.Egress[0].HTTPProxy = "http://filter2:3128"
+	if !sessionNetworkChanged(created, planSessionNetwork(config, "desktop", "jane.doe", []string{"pupils"})) {
+		t.Fatal("expected a change of proxy to be noticed")
+	}
+
+	if checkProxyURL("http://filter:3128") != nil || checkProxyURL("filter:3128") == nil || checkProxyURL("ftp://filter") == nil {
+		t.Fatal("unexpected proxy URL check results")
+	}
+	certificatePath := filepath.Join(t.TempDir(), "ca.crt")
+	os.WriteFile(certificatePath, []byte("-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n"), 0644)
+	if checkCACertificate(certificatePath) != nil || checkCACertificate("ca.crt") == nil || checkCACertificate(certificatePath+".missing") == nil {
+		t.Fatal("unexpected CA certificate check results")
+	}
+}
@@ -0,0 +1,258 @@
+// Session network isolation for the Session Manager. By default every session container joins the main Docker
+// network ("pangolin_main"), along with Pangolin, guacd and everyone else's sessions, so a pupil's desktop can reach
+// any of them directly. With isolation turned on, each session gets a Docker network of its own, connected only to
+// the gateway containers it needs (guacd, for the desktop itself, and the session proxy, for apps and rclone), and
+// so can't see other pupils' sessions at all.
+//
+// What a session can reach beyond that - its egress - is set per (host) user group, by egress policies in the config
+// file:
+//   - "allowed" - the session's network is an ordinary bridge network, with a route out to the internet.
+//   - "proxied" - the network is internal (no route out of the host), but the school's proxy container is connected
+//     to it, so web traffic can go out through the proxy and nothing else can.
+//   - "blocked" - the network is internal, reaching nothing but the gateways.
+//
+// Egress policies can also give sessions web proxy settings (see egressProxy.go). Exam sessions are always isolated,
+// with egress blocked.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/api/types/mount"
+	"github.com/moby/moby/client"
+)
+
+// The network session containers join, unless they are isolated.
+const defaultSessionNetwork = "pangolin_main"
+
+// Isolated sessions' networks are named after the session's container, e.g. "puws-session-desktop-jane.doe".
+const sessionNetworkPrefix = "puws-session-"
+
+// The labels recording which Docker network a session container was created on, its egress, and the egress policy
+// that set it.
+const sessionNetworkLabel = "uk.co.sansay.puws.network"
+const sessionEgressLabel = "uk.co.sansay.puws.egress"
+const sessionEgressPolicyLabel = "uk.co.sansay.puws.egressPolicy"
+
+// The egress an isolated session can be given.
+const (
+	egressAllowed = "allowed"
+	egressProxied = "proxied"
+	egressBlocked = "blocked"
+)
+
+// The session network settings from the config file.
+type SessionNetworkConfig struct {
+	// Whether each session gets a network of its own. Off by default, when sessions share the main network.
+	Isolated bool `yaml:"isolated"`
+	// The containers (by name) connected to each isolated session's network, so they can reach the session.
+	// Defaults to "guacd" and "sessionproxy".
+	Gateways []string `yaml:"gateways"`
+	// The egress policies, giving isolated sessions their egress, and any session its web proxy settings. The first
+	// policy matching one of the user's groups is used, so more specific policies should be listed first. Sessions no
+	// policy matches have egress allowed, and no proxy settings.
+	Egress []EgressPolicy `yaml:"egress"`
+}
+
+// An egress policy, as defined in the config file.
+type EgressPolicy struct {
+	Name string `yaml:"name"`
+	// The (host) user groups this policy applies to. An empty list matches everyone.
+	Groups []string `yaml:"groups"`
+	// "allowed" (the default), "proxied" or "blocked". Only applies to isolated sessions.
+	Egress string `yaml:"egress"`
+	// The proxy container (by name) connected to the session's network, for "proxied" egress.
+	ProxyContainer string `yaml:"proxyContainer"`
+	// The web proxy passed to the session as HTTP_PROXY / HTTPS_PROXY, e.g. "http://filter.school.internal:3128".
+	// The HTTPS proxy defaults to the HTTP proxy.
+	HTTPProxy  string `yaml:"httpProxy"`
+	HTTPSProxy string `yaml:"httpsProxy"`
+	// Hosts and domains reached directly rather than through the proxy, passed to the session as NO_PROXY.
+	NoProxy []string `yaml:"noProxy"`
+	// A CA certificate (a PEM file on the host) for the proxy's TLS inspection, added to the session's trust store.
+	CACertificate string `yaml:"caCertificate"`
+}
+
+// Where a session container goes - its network, whether that network has a route out of the host, and the
+// containers connected to it - and the egress policy it gets, if any.
+type SessionNetworkPlan struct {
+	Name     string
+	Internal bool
+	Egress   string
+	Policy   string
+	Gateways []string
+	// The policy's proxy settings (as a fingerprint), environment variables and CA certificate mount.
+	Settings    string
+	Environment []string
+	Mounts      []mount.Mount
+}
+
+// sessionNetworkGateways returns the containers connected to each isolated session's network.
+func sessionNetworkGateways(networkConfig SessionNetworkConfig) []string {
+	if len(networkConfig.Gateways) > 0 {
+		return networkConfig.Gateways
+	}
+	return []string{"guacd", "sessionproxy"}
+}
+
+// selectEgressPolicy returns the first egress policy in the config file that matches one of the given user groups.
+// Returns nil if no policy matches.
+func selectEgressPolicy(policies []EgressPolicy, userGroups []string) *EgressPolicy {
+	for index := range policies {
+		if matchesImageAndGroups(nil, policies[index].Groups, "", userGroups) {
+			return &policies[index]
+		}
+	}
+	return nil
+}
+
+// planSessionNetwork works out which network a session container should be created on, and the egress policy it
+// gets, given the user's groups.
+func planSessionNetwork(config Config, imageName string, username string, groups []string) SessionNetworkPlan {
+	networkName := sessionNetworkPrefix + imageName + "-" + username
+	if isExamImage(config, imageName) {
+		return SessionNetworkPlan{Name: networkName, Internal: true, Egress: egressBlocked, Gateways: examGateways(config.Exams)}
+	}
+	plan := SessionNetworkPlan{Name: defaultSessionNetwork}
+	policy := selectEgressPolicy(config.SessionNetworks.Egress, groups)
+	if policy != nil {
+		plan.Policy = policy.Name
+		plan.Settings = policy.settingsFingerprint()
+		plan.Environment = policy.environment()
+		plan.Mounts = policy.mounts()
+	}
+	if !config.SessionNetworks.Isolated {
+		return plan
+	}
+	plan.Name = networkName
+	plan.Egress = egressAllowed
+	plan.Gateways = sessionNetworkGateways(config.SessionNetworks)
+	if policy != nil && policy.Egress != "" {
+		plan.Egress = policy.Egress
+		if policy.Egress == egressProxied {
+			plan.Gateways = append(append([]string{}, plan.Gateways...), policy.ProxyContainer)
+		}
+	}
+	plan.Internal = plan.Egress != egressAllowed
+	return plan
+}
+
+// containerNetwork returns the Docker network a session container was created on. Containers created before the
+// network was recorded are all on the default network.
+func containerNetwork(item container.Summary) string {
+	if networkName := item.Labels[sessionNetworkLabel]; networkName != "" {
+		return networkName
+	}
+	return defaultSessionNetwork
+}
+
+// sessionNetworkChanged reports whether a session container was created on a different network, or with different
+// egress or proxy settings, than it would be now.
+func sessionNetworkChanged(item container.Summary, plan SessionNetworkPlan) bool {
+	return containerNetwork(item) != plan.Name || item.Labels[sessionEgressLabel] != plan.Egress || item.Labels[sessionEgressPolicyLabel] != plan.Policy || item.Labels[sessionEgressSettingsLabel] != plan.Settings
+}
+
+// ensureSessionNetwork makes sure a session's network exists, with the right egress, and that each of its gateway
+// containers is connected to it (a gateway recreated by Docker Compose comes back connected to the main network
+// only). A network left from a different egress policy is replaced - the session's own container must already have
+// been removed from it. The default network is left alone.
+func ensureSessionNetwork(cli *client.Client, plan SessionNetworkPlan) error {
+	if plan.Name == defaultSessionNetwork {
+		return nil
+	}
+	connected := make(map[string]bool)
+	inspectResult, inspectErr := cli.NetworkInspect(context.Background(), plan.Name, client.NetworkInspectOptions{})
+	if inspectErr == nil && (inspectResult.Network.Internal != plan.Internal || inspectResult.Network.Labels[sessionEgressLabel] != plan.Egress) {
+		if removeErr := removeSessionNetwork(cli, plan.Name); removeErr != nil {
+			return errors.New("Error replacing network " + plan.Name + ": " + removeErr.Error())
+		}
+		inspectErr = errors.New("removed")
+	}
+	if inspectErr != nil {
+		if _, createErr := cli.NetworkCreate(context.Background(), plan.Name, client.NetworkCreateOptions{
+			Driver:   "bridge",
+			Internal: plan.Internal,
+			Labels:   map[string]string{sessionNetworkLabel: plan.Name, sessionEgressLabel: plan.Egress},
+		}); createErr != nil {
+			return errors.New("Error creating network " + plan.Name + ": " + createErr.Error())
+		}
+	} else {
+		for _, endpoint := range inspectResult.Network.Containers {
+			connected[endpoint.Name] = true
+		}
+	}
+	for _, gateway := range plan.Gateways {
+		if connected[gateway] {
+			continue
+		}
+		if _, connectErr := cli.NetworkConnect(context.Background(), plan.Name, client.NetworkConnectOptions{Container: gateway}); connectErr != nil {
+			return errors.New("Error connecting " + gateway + " to network " + plan.Name + ": " + connectErr.Error())
+		}
+	}
+	return nil
+}
+
+// removeSessionNetwork disconnects everything still connected to a session's network (its gateways) and removes it.
+// Only session networks are removed, never the default one.
+func removeSessionNetwork(cli *client.Client, networkName string) error {
+	if !strings.HasPrefix(networkName, sessionNetworkPrefix) {
+		return nil
+	}
+	inspectResult, inspectErr := cli.NetworkInspect(context.Background(), networkName, client.NetworkInspectOptions{})
+	if inspectErr != nil {
+		return nil
+	}
+	for _, endpoint := range inspectResult.Network.Containers {
+		cli.NetworkDisconnect(context.Background(), networkName, client.NetworkDisconnectOptions{Container: endpoint.Name, Force: true})
+	}
+	_, removeErr := cli.NetworkRemove(context.Background(), networkName, client.NetworkRemoveOptions{})
+	return removeErr
+}
+
+// orphanedSessionNetworks returns the session networks (from the given network names) that no session container is
+// on any more.
+func orphanedSessionNetworks(networkNames []string, containers []container.Summary) []string {
+	inUse := make(map[string]bool)
+	for _, item := range containers {
+		inUse[containerNetwork(item)] = true
+	}
+	var orphaned []string
+	for _, networkName := range networkNames {
+		if strings.HasPrefix(networkName, sessionNetworkPrefix) && !inUse[networkName] {
+			orphaned = append(orphaned, networkName)
+		}
+	}
+	return orphaned
+}
+
+// sweepSessionNetworks removes session networks left behind by containers removed some other way (by hand, say, or
+// while the Session Manager wasn't running). Called at startup, before any session is started.
+func sweepSessionNetworks(cli *client.Client) {
+	networks, networksErr := cli.NetworkList(context.Background(), client.NetworkListOptions{Filters: make(client.Filters).Add("name", sessionNetworkPrefix)})
+	if networksErr != nil {
+		log.Println("Error listing networks: " + networksErr.Error())
+		return
+	}
+	containers, containersErr := cli.ContainerList(context.Background(), client.ContainerListOptions{All: true})
+	if containersErr != nil {
+		log.Println("Error listing containers: " + containersErr.Error())
+		return
+	}
+	var networkNames []string
+	for _, item := range networks.Items {
+		networkNames = append(networkNames, item.Name)
+	}
+	for _, networkName := range orphanedSessionNetworks(networkNames, containers.Items) {
+		if removeErr := removeSessionNetwork(cli, networkName); removeErr != nil {
+			log.Println("Error removing network " + networkName + ": " + removeErr.Error())
+			continue
+		}
+		fmt.Println("Removed unused session network: " + networkName)
+	}
+}
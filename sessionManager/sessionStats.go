@@ -0,0 +1,176 @@
+// Per-session resource statistics for the Session Manager. The host-wide memory and disk figures in the admin panel
+// show when the server is busy, but not which session is making it busy. A background loop collects Docker's stats for
+// each running session - CPU use, memory use against the container's limit, network traffic and disk I/O - and keeps
+// a short history of them in memory, reported to the admin panel via "/admin/status".
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/client"
+)
+
+// The interval between collections of session stats.
+const statsInterval = 30 * time.Second
+
+// The number of samples kept for each session - 40 samples, 30 seconds apart, is the last 20 minutes.
+const maxStatsSamples = 40
+
+// One sample of a session's resource use. Network and disk figures are totals since the container started.
+type StatsSample struct {
+	Time             time.Time `json:"time"`
+	CPUPercent       float64   `json:"cpuPercent"`
+	MemoryBytes      uint64    `json:"memoryBytes"`
+	MemoryLimitBytes uint64    `json:"memoryLimitBytes"`
+	NetworkRxBytes   uint64    `json:"networkRxBytes"`
+	NetworkTxBytes   uint64    `json:"networkTxBytes"`
+	BlockReadBytes   uint64    `json:"blockReadBytes"`
+	BlockWriteBytes  uint64    `json:"blockWriteBytes"`
+	Pids             uint64    `json:"pids"`
+}
+
+// StatsHistory holds the recent stats samples for each running session, plus the last raw stats Docker gave us for
+// each (needed to work out CPU use, which Docker reports as a running total). Protected by a mutex, as the stats are
+// collected in the background while the admin panel reads them.
+type StatsHistory struct {
+	mu      sync.Mutex
+	samples map[string][]StatsSample
+	lastRaw map[string]container.StatsResponse
+}
+
+// newStatsHistory initialises an empty stats history.
+func newStatsHistory() *StatsHistory {
+	return &StatsHistory{
+		samples: make(map[string][]StatsSample),
+		lastRaw: make(map[string]container.StatsResponse),
+	}
+}
+
+// The global stats history.
+var sessionStats = newStatsHistory()
+
+// add records a new set of raw stats for a session, working out the sample from it (and the previous set, if any)
+// and dropping the oldest sample if the history is full.
+func (sh *StatsHistory) add(imageName string, username string, rawStats container.StatsResponse) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	statsKey := sessionKey(imageName, username)
+	var previousStats *container.StatsResponse
+	if lastStats, exists := sh.lastRaw[statsKey]; exists {
+		previousStats = &lastStats
+	}
+	sh.lastRaw[statsKey] = rawStats
+	sh.samples[statsKey] = append(sh.samples[statsKey], statsSample(rawStats, previousStats))
+	if len(sh.samples[statsKey]) > maxStatsSamples {
+		sh.samples[statsKey] = sh.samples[statsKey][len(sh.samples[statsKey])-maxStatsSamples:]
+	}
+}
+
+// history returns a copy of the recent stats samples for a session, oldest first.
+func (sh *StatsHistory) history(imageName string, username string) []StatsSample {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return append([]StatsSample{}, sh.samples[sessionKey(imageName, username)]...)
+}
+
+// keepOnly forgets the stats of any session not in the given set, used to drop sessions that have stopped.
+func (sh *StatsHistory) keepOnly(runningSessions map[string]bool) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	for statsKey := range sh.samples {
+		if !runningSessions[statsKey] {
+			delete(sh.samples, statsKey)
+			delete(sh.lastRaw, statsKey)
+		}
+	}
+}
+
+// statsSample works out a stats sample from a set of Docker's raw stats. CPU use is the share of the host's CPU time
+// used since the previous set of stats, scaled so 100% is one whole CPU (as "docker stats" shows it) - it is zero
+// for the first sample, with nothing to compare against. Memory use leaves out inactive file cache, which the kernel
+// can reclaim, again matching "docker stats".
+func statsSample(rawStats container.StatsResponse, previousStats *container.StatsResponse) StatsSample {
+	sample := StatsSample{Time: rawStats.Read, MemoryLimitBytes: rawStats.MemoryStats.Limit, Pids: rawStats.PidsStats.Current}
+	if sample.Time.IsZero() {
+		sample.Time = time.Now()
+	}
+
+	if previousStats != nil {
+		cpuDelta := float64(rawStats.CPUStats.CPUUsage.TotalUsage) - float64(previousStats.CPUStats.CPUUsage.TotalUsage)
+		systemDelta := float64(rawStats.CPUStats.SystemUsage) - float64(previousStats.CPUStats.SystemUsage)
+		onlineCPUs := float64(rawStats.CPUStats.OnlineCPUs)
+		if onlineCPUs == 0 {
+			onlineCPUs = float64(len(rawStats.CPUStats.CPUUsage.PercpuUsage))
+		}
+		if cpuDelta > 0 && systemDelta > 0 {
+			sample.CPUPercent = cpuDelta / systemDelta * onlineCPUs * 100
+		}
+	}
+
+	sample.MemoryBytes = rawStats.MemoryStats.Usage
+	// cgroup v2 calls the reclaimable file cache "inactive_file", cgroup v1 "total_inactive_file".
+	for _, cacheStat := range []string{"inactive_file", "total_inactive_file"} {
+		if inactiveFile, exists := rawStats.MemoryStats.Stats[cacheStat]; exists && inactiveFile < sample.MemoryBytes {
+			sample.MemoryBytes = sample.MemoryBytes - inactiveFile
+			break
+		}
+	}
+
+	for _, networkStats := range rawStats.Networks {
+		sample.NetworkRxBytes = sample.NetworkRxBytes + networkStats.RxBytes
+		sample.NetworkTxBytes = sample.NetworkTxBytes + networkStats.TxBytes
+	}
+	for _, blkioEntry := range rawStats.BlkioStats.IoServiceBytesRecursive {
+		switch strings.ToLower(blkioEntry.Op) {
+		case "read":
+			sample.BlockReadBytes = sample.BlockReadBytes + blkioEntry.Value
+		case "write":
+			sample.BlockWriteBytes = sample.BlockWriteBytes + blkioEntry.Value
+		}
+	}
+	return sample
+}
+
+// readContainerStats fetches a single set of raw stats for a container from Docker.
+func readContainerStats(cli *client.Client, containerID string) (container.StatsResponse, error) {
+	var rawStats container.StatsResponse
+	statsResult, statsErr := cli.ContainerStats(context.Background(), containerID, client.ContainerStatsOptions{})
+	if statsErr != nil {
+		return rawStats, statsErr
+	}
+	defer statsResult.Body.Close()
+	decodeErr := json.NewDecoder(statsResult.Body).Decode(&rawStats)
+	return rawStats, decodeErr
+}
+
+// collectSessionStats records a stats sample for every running session, and forgets the stats of sessions that are
+// no longer running (including hibernated sessions, which aren't doing anything).
+func collectSessionStats(cli *client.Client) {
+	containers, containersErr := cli.ContainerList(context.Background(), client.ContainerListOptions{})
+	if containersErr != nil {
+		log.Println("Error listing containers to collect session stats: " + containersErr.Error())
+		return
+	}
+	runningSessions := make(map[string]bool)
+	for _, item := range containers.Items {
+		imageName, username, isSession := sessionFromContainer(item)
+		if !isSession || item.State != "running" {
+			continue
+		}
+		runningSessions[sessionKey(imageName, username)] = true
+		rawStats, statsErr := readContainerStats(cli, item.ID)
+		if statsErr != nil {
+			log.Println("Error reading stats for session " + imageName + "-" + username + ": " + statsErr.Error())
+			continue
+		}
+		sessionStats.add(imageName, username, rawStats)
+	}
+	sessionStats.keepOnly(runningSessions)
+}
@@ -0,0 +1,98 @@
+// The session start coordinator for the Session Manager. A user opening "/desktop" and "/rclone" at the same time (or
+// an auto-start happening just as the user logs in) would otherwise start the same session twice in parallel, with
+// the second container create failing on a name conflict. Every session start goes through the coordinator, which
+// runs only one start per session at a time - anyone else asking for the same session waits for that start and gets
+// its result, including any error.
+
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// The default time a caller will wait for a session to start before giving up, if not set in the config file.
+const defaultStartTimeout = 5 * time.Minute
+
+// An in-flight session start.
+type StartCall struct {
+	done   chan struct{}
+	result string
+}
+
+// StartCoordinator tracks the session starts currently in progress, protected by a mutex.
+type StartCoordinator struct {
+	mu    sync.Mutex
+	calls map[string]*StartCall
+}
+
+// newStartCoordinator initialises a start coordinator with no starts in progress.
+func newStartCoordinator() *StartCoordinator {
+	return &StartCoordinator{
+		calls: make(map[string]*StartCall),
+	}
+}
+
+// start runs startFunc to start the given session, unless a start of that session is already in progress, in which
+// case it waits for that start instead. Either way, it waits at most the given timeout for the result. Returns the
+// result of the start (an empty string on success, or an error message), and true if the result came from a start
+// begun by another caller.
+//
+// The start itself runs in its own goroutine, so a caller that times out (or goes away) doesn't cancel it - later
+// callers carry on waiting for the same start rather than beginning a second one alongside it.
+func (sc *StartCoordinator) start(imageName string, username string, timeout time.Duration, startFunc func() string) (string, bool) {
+	callKey := sessionKey(imageName, username)
+	sc.mu.Lock()
+	startCall, shared := sc.calls[callKey]
+	if !shared {
+		startCall = &StartCall{done: make(chan struct{})}
+		sc.calls[callKey] = startCall
+		go func() {
+			startCall.result = startFunc()
+			sc.mu.Lock()
+			delete(sc.calls, callKey)
+			sc.mu.Unlock()
+			close(startCall.done)
+		}()
+	}
+	sc.mu.Unlock()
+
+	select {
+	case <-startCall.done:
+		return startCall.result, shared
+	case <-time.After(timeout):
+		return "Timed out after " + timeout.String() + " waiting for " + imageName + " session for user " + username + " to start", shared
+	}
+}
+
+// userStarting reports whether a start of any of the given user's sessions is currently in progress.
+func (sc *StartCoordinator) userStarting(username string) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for callKey := range sc.calls {
+		if strings.HasSuffix(callKey, "\x00"+username) {
+			return true
+		}
+	}
+	return false
+}
+
+// inProgress reports whether a start of the given session is currently in progress.
+func (sc *StartCoordinator) inProgress(imageName string, username string) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	_, exists := sc.calls[sessionKey(imageName, username)]
+	return exists
+}
+
+// The global start coordinator.
+var sessionStarts = newStartCoordinator()
+
+// startTimeout returns how long callers wait for a session to start, as set in the config file.
+func startTimeout(config Config) time.Duration {
+	if config.StartTimeoutSeconds > 0 {
+		return time.Duration(config.StartTimeoutSeconds) * time.Second
+	}
+	return defaultStartTimeout
+}
@@ -0,0 +1,257 @@
+// Session startup progress tracking for the Session Manager. Starting a session can take 30 seconds or more (creating
+// the user, mounting cloud storage, creating the container and waiting for the VNC server), so each start is tracked
+// as a series of states, each with a timestamp. The "/sessionProgress" endpoint streams those states to callers as
+// server-sent events, so a loading page can show the user real progress (and real errors) rather than a blank screen.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The states a session goes through while starting up.
+const (
+	startupQueued            = "queued"
+	startupCreatingUser      = "creating-user"
+	startupMountingRclone    = "mounting-rclone"
+	startupCreatingContainer = "creating-container"
+	startupStartingContainer = "starting-container"
+	startupWaitingForVNC     = "waiting-for-vnc"
+	startupReady             = "ready"
+	startupFailed            = "failed"
+)
+
+// The interval between keep-alive comments sent on an otherwise quiet event stream, so proxies don't time it out.
+const progressKeepAliveInterval = 15 * time.Second
+
+// How long the states of a finished start are kept - replayed to a progress stream opened just after the start
+// finished, and shown in the control panel - before they are forgotten. A stream opened later waits for the next
+// start instead, rather than getting the old result.
+const finishedStartupTTL = 1 * time.Minute
+
+// A change in a session's startup state.
+type StartupEvent struct {
+	State   string    `json:"state"`
+	Time    time.Time `json:"time"`
+	Message string    `json:"message,omitempty"`
+	// The session's position in the admission queue, for "queued" events.
+	QueuePosition int `json:"queuePosition,omitempty"`
+	// The start the event belongs to (see StartupProgress).
+	generation int
+}
+
+// isFinal reports whether an event ends a session start (successfully or not).
+func (event StartupEvent) isFinal() bool {
+	return event.State == startupReady || event.State == startupFailed
+}
+
+// The progress of the most recent start of one session, and the channels of any callers watching it.
+type StartupProgress struct {
+	events      []StartupEvent
+	subscribers map[chan StartupEvent]bool
+	// Counts the session's starts, so a watcher can tell the events of a new start from those of an earlier one.
+	generation int
+	// When the most recent start began and finished. finishedAt is zero while the start is still in progress.
+	begunAt    time.Time
+	finishedAt time.Time
+}
+
+// current reports whether the recorded events are of a start still in progress, or one that finished recently
+// enough to report.
+func (sessionProgress *StartupProgress) current(now time.Time) bool {
+	if sessionProgress.begunAt.IsZero() {
+		return false
+	}
+	return sessionProgress.finishedAt.IsZero() || now.Sub(sessionProgress.finishedAt) < finishedStartupTTL
+}
+
+// StartupTracker holds the startup progress of each session, protected by a mutex as sessions are started from
+// HTTP handlers and background goroutines at the same time.
+type StartupTracker struct {
+	mu       sync.Mutex
+	sessions map[string]*StartupProgress
+}
+
+// newStartupTracker initialises an empty startup tracker.
+func newStartupTracker() *StartupTracker {
+	return &StartupTracker{
+		sessions: make(map[string]*StartupProgress),
+	}
+}
+
+// progress returns the progress record for a session, creating it if needed. Must be called with the mutex held.
+func (st *StartupTracker) progress(imageName string, username string) *StartupProgress {
+	sessionProgress, exists := st.sessions[sessionKey(imageName, username)]
+	if !exists {
+		sessionProgress = &StartupProgress{subscribers: make(map[chan StartupEvent]bool)}
+		st.sessions[sessionKey(imageName, username)] = sessionProgress
+	}
+	return sessionProgress
+}
+
+// expire forgets the progress of sessions whose last start finished too long ago, and that no-one is watching. Must
+// be called with the mutex held.
+func (st *StartupTracker) expire(now time.Time) {
+	for key, sessionProgress := range st.sessions {
+		if len(sessionProgress.subscribers) == 0 && !sessionProgress.current(now) {
+			delete(st.sessions, key)
+		}
+	}
+}
+
+// begin clears the history of any previous start of the session, ready for a new one.
+func (st *StartupTracker) begin(imageName string, username string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.expire(time.Now())
+	sessionProgress := st.progress(imageName, username)
+	sessionProgress.generation = sessionProgress.generation + 1
+	sessionProgress.events = nil
+	sessionProgress.begunAt = time.Now()
+	sessionProgress.finishedAt = time.Time{}
+}
+
+// report records a new startup state for a session and passes it on to anyone watching.
+func (st *StartupTracker) report(imageName string, username string, state string, message string) {
+	st.reportEvent(imageName, username, StartupEvent{State: state, Time: time.Now(), Message: message})
+}
+
+// reportEvent records a new startup event for a session and passes it on to anyone watching.
+func (st *StartupTracker) reportEvent(imageName string, username string, event StartupEvent) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	sessionProgress := st.progress(imageName, username)
+	if sessionProgress.begunAt.IsZero() {
+		sessionProgress.begunAt = event.Time
+	}
+	event.generation = sessionProgress.generation
+	sessionProgress.events = append(sessionProgress.events, event)
+	if event.isFinal() {
+		sessionProgress.finishedAt = event.Time
+	}
+	for subscriber := range sessionProgress.subscribers {
+		// Subscriber channels are buffered, and a start only has a handful of states, so this shouldn't block - but
+		// don't let one slow watcher hold up the session start if it does.
+		select {
+		case subscriber <- event:
+		default:
+		}
+	}
+}
+
+// events returns a copy of the states recorded so far for the most recent start of a session, if it is still in
+// progress or finished recently.
+func (st *StartupTracker) events(imageName string, username string) []StartupEvent {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	sessionProgress, exists := st.sessions[sessionKey(imageName, username)]
+	if !exists || !sessionProgress.current(time.Now()) {
+		return []StartupEvent{}
+	}
+	return append([]StartupEvent{}, sessionProgress.events...)
+}
+
+// subscribe returns the states recorded so far for a session's current start (see current), plus a channel that
+// receives any new states and the generation of the start being watched - states from earlier starts should be
+// ignored. If the last start finished too long ago, its states aren't returned, and the next start is watched
+// instead. The returned function must be called to stop watching.
+func (st *StartupTracker) subscribe(imageName string, username string) ([]StartupEvent, chan StartupEvent, int, func()) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	now := time.Now()
+	st.expire(now)
+	sessionProgress := st.progress(imageName, username)
+	subscriber := make(chan StartupEvent, 16)
+	sessionProgress.subscribers[subscriber] = true
+	unsubscribe := func() {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		delete(sessionProgress.subscribers, subscriber)
+	}
+	if !sessionProgress.current(now) {
+		return []StartupEvent{}, subscriber, sessionProgress.generation + 1, unsubscribe
+	}
+	return append([]StartupEvent{}, sessionProgress.events...), subscriber, sessionProgress.generation, unsubscribe
+}
+
+// The global startup tracker.
+var sessionStartups = newStartupTracker()
+
+// writeStartupEvent writes a startup state to an event stream, in server-sent event format.
+func writeStartupEvent(httpResponse http.ResponseWriter, event StartupEvent) error {
+	eventData, jsonErr := json.Marshal(event)
+	if jsonErr != nil {
+		return jsonErr
+	}
+	_, writeErr := fmt.Fprintf(httpResponse, "event: %s\ndata: %s\n\n", event.State, eventData)
+	return writeErr
+}
+
+// streamStartupProgress streams the startup states of a session to the caller as server-sent events. States already
+// reached are sent straight away, then new ones as they happen, until the session is ready, fails to start, or the
+// caller goes away. If no start is in progress (or finished within the last minute), the stream waits for one to
+// begin.
+func streamStartupProgress(httpResponse http.ResponseWriter, r *http.Request, imageName string, username string) {
+	flusher, canFlush := httpResponse.(http.Flusher)
+	if !canFlush {
+		http.Error(httpResponse, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	pastEvents, subscriber, generation, unsubscribe := sessionStartups.subscribe(imageName, username)
+	defer unsubscribe()
+
+	httpResponse.Header().Set("Content-Type", "text/event-stream")
+	httpResponse.Header().Set("Cache-Control", "no-cache")
+	httpResponse.Header().Set("Connection", "keep-alive")
+	httpResponse.WriteHeader(http.StatusOK)
+
+	for _, event := range pastEvents {
+		if writeStartupEvent(httpResponse, event) != nil {
+			return
+		}
+	}
+	flusher.Flush()
+	// A start that has already finished has nothing more to report.
+	if len(pastEvents) > 0 && pastEvents[len(pastEvents)-1].isFinal() {
+		return
+	}
+
+	keepAlive := time.NewTicker(progressKeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, writeErr := fmt.Fprint(httpResponse, ": keep-alive\n\n"); writeErr != nil {
+				return
+			}
+			flusher.Flush()
+		case event := <-subscriber:
+			if event.generation < generation {
+				continue
+			}
+			if writeStartupEvent(httpResponse, event) != nil {
+				return
+			}
+			flusher.Flush()
+			if event.isFinal() {
+				return
+			}
+		}
+	}
+}
+
+// lastLogLines keeps the last few lines of a container's log output, to explain why a session failed to start.
+func lastLogLines(logLines []string, logLine string, maxLines int) []string {
+	logLines = append(logLines, strings.TrimSpace(logLine))
+	if len(logLines) > maxLines {
+		logLines = logLines[len(logLines)-maxLines:]
+	}
+	return logLines
+}
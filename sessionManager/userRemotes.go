@@ -0,0 +1,336 @@
+// Automatic mounting of the cloud storage remotes users set up themselves, through the rclone web GUI in their
+// session. The GUI runs as the user inside their desktop container, so it saves the user's remotes to the rclone
+// config file in their home folder - which is the same folder on the host. The Session Manager reads each user's
+// config file every time it checks the rclone mounts, mounts any new remotes in a folder of their own in the user's
+// home folder ("~/Cloud/<remote name>" by default), and unmounts remotes the user has deleted.
+//
+// Only remotes of backend types the admin has allowed are mounted, up to a limit per user. Remotes that can't be
+// mounted are reported to the admin panel along with the reason. User remotes are mounted by an rclone process running
+// as the user, reading the user's own config file, so a user can't use a remote to reach anything they couldn't
+// already.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/moby/moby/client"
+)
+
+// Where user remotes are mounted, under the user's home folder, if not set in the config file.
+const defaultUserRemotesFolder = "Cloud"
+
+// How many remotes each user can have mounted, if not set in the config file.
+const defaultMaxUserMounts = 5
+
+// Where the rclone GUI saves a user's remotes, relative to their home folder.
+const userRcloneConfigPath = ".config/rclone/rclone.conf"
+
+// The names we are happy to use as a folder name. rclone itself allows a few more characters than this (spaces, for
+// instance), but nothing that could be used to climb out of the mount folder.
+var remoteNamePattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.@+-]*$`)
+
+// The user remote settings from the config file.
+type UserRemotesConfig struct {
+	// The rclone backend types (e.g. "drive", "onedrive", "dropbox") users' own remotes can be. If empty, the
+	// remotes users set up themselves aren't mounted.
+	AllowedTypes []string `yaml:"allowedTypes"`
+	// How many of their own remotes each user can have mounted. Defaults to 5.
+	MaxMounts int `yaml:"maxMounts"`
+	// The folder, in the user's home folder, remotes are mounted in. Defaults to "Cloud".
+	Folder string `yaml:"folder"`
+}
+
+// A remote found in a user's rclone config file.
+type RcloneRemote struct {
+	Name string
+	Type string
+}
+
+// A remote a user set up that isn't being mounted, and why.
+type RejectedRemote struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+// UserRemoteRegistry keeps the remotes from each user's config file that aren't being mounted, for the admin panel.
+// Written by the mount check loop and read by HTTP handlers, so protected by a mutex.
+type UserRemoteRegistry struct {
+	mu       sync.Mutex
+	rejected map[string][]RejectedRemote
+}
+
+var userRemotes = newUserRemoteRegistry()
+
+func newUserRemoteRegistry() *UserRemoteRegistry {
+	return &UserRemoteRegistry{rejected: make(map[string][]RejectedRemote)}
+}
+
+// setRejected records the rejected remotes of each user checked, replacing the last lot.
+func (ur *UserRemoteRegistry) setRejected(rejected map[string][]RejectedRemote) {
+	ur.mu.Lock()
+	defer ur.mu.Unlock()
+	ur.rejected = rejected
+}
+
+// rejectedRemotes returns the rejected remotes, by username.
+func (ur *UserRemoteRegistry) rejectedRemotes() map[string][]RejectedRemote {
+	ur.mu.Lock()
+	defer ur.mu.Unlock()
+	rejected := make(map[string][]RejectedRemote, len(ur.rejected))
+	for username, remotes := range ur.rejected {
+		rejected[username] = remotes
+	}
+	return rejected
+}
+
+// userRemotesFolder returns the folder, relative to the user's home folder, remotes are mounted in.
+func userRemotesFolder(remotesConfig UserRemotesConfig) string {
+	if remotesConfig.Folder != "" {
+		return remotesConfig.Folder
+	}
+	return defaultUserRemotesFolder
+}
+
+// maxUserMounts returns how many remotes each user can have mounted.
+func maxUserMounts(remotesConfig UserRemotesConfig) int {
+	if remotesConfig.MaxMounts > 0 {
+		return remotesConfig.MaxMounts
+	}
+	return defaultMaxUserMounts
+}
+
+// parseRcloneConfig reads the remotes, in order, from an rclone config file - an INI file with a section per remote,
+// each with a "type" key giving the backend. Encrypted config files can't be read without the user's password, so
+// are reported as an error.
+func parseRcloneConfig(configData []byte) ([]RcloneRemote, error) {
+	var remotes []RcloneRemote
+	scanner := bufio.NewScanner(bytes.NewReader(configData))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "RCLONE_ENCRYPT_V0:"):
+			return nil, errors.New("The rclone config file is encrypted")
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";"):
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			remotes = append(remotes, RcloneRemote{Name: strings.TrimSpace(line[1 : len(line)-1])})
+		case len(remotes) > 0:
+			if key, value, found := strings.Cut(line, "="); found && strings.TrimSpace(key) == "type" {
+				remotes[len(remotes)-1].Type = strings.TrimSpace(value)
+			}
+		}
+	}
+	if scanErr := scanner.Err(); scanErr != nil {
+		return nil, errors.New("Error reading the rclone config file: " + scanErr.Error())
+	}
+	return remotes, nil
+}
+
+// selectRemotes splits a user's remotes into those to mount - the first ones, in config file order, of an allowed
+// backend type with a usable name, up to the per-user limit - and the rest, each with the reason it isn't mounted.
+func selectRemotes(remotes []RcloneRemote, remotesConfig UserRemotesConfig) ([]RcloneRemote, []RejectedRemote) {
+	var accepted []RcloneRemote
+	var rejected []RejectedRemote
+	maxMounts := maxUserMounts(remotesConfig)
+	for _, remote := range remotes {
+		allowed := false
+		for _, allowedType := range remotesConfig.AllowedTypes {
+			if strings.EqualFold(remote.Type, allowedType) {
+				allowed = true
+			}
+		}
+		switch {
+		case !remoteNamePattern.MatchString(remote.Name):
+			rejected = append(rejected, RejectedRemote{Name: remote.Name, Type: remote.Type, Reason: "The name can't be used as a folder name"})
+		case !allowed:
+			rejected = append(rejected, RejectedRemote{Name: remote.Name, Type: remote.Type, Reason: "Remotes of type \"" + remote.Type + "\" aren't allowed"})
+		case len(accepted) >= maxMounts:
+			rejected = append(rejected, RejectedRemote{Name: remote.Name, Type: remote.Type, Reason: "Over the limit of " + strconv.Itoa(maxMounts) + " mounted remotes per user"})
+		default:
+			accepted = append(accepted, remote)
+		}
+	}
+	return accepted, rejected
+}
+
+// checkUserPath makes sure a path in a user's home folder, as far as it exists, is made of real files and folders
+// rather than symlinks - the Session Manager runs as root, so following a link the user made could let them reach
+// anything.
+func checkUserPath(homeFolder string, relativePath string, wantFolder bool) error {
+	path := homeFolder
+	parts := strings.Split(relativePath, "/")
+	for index, part := range parts {
+		path = filepath.Join(path, part)
+		info, statErr := os.Lstat(path)
+		last := index == len(parts)-1
+		switch {
+		case os.IsNotExist(statErr):
+			return nil
+		case statErr != nil:
+			return statErr
+		case info.Mode()&os.ModeSymlink != 0:
+			return errors.New(path + " is a symbolic link")
+		case (!last || wantFolder) && !info.IsDir():
+			return errors.New(path + " isn't a folder")
+		case last && !wantFolder && !info.Mode().IsRegular():
+			return errors.New(path + " isn't a regular file")
+		}
+	}
+	return nil
+}
+
+// mkdirChownInUserFolder creates a folder (and any missing parent folders) inside a folder belonging to a user, and
+// gives the user ownership of each folder created and of the folder itself. Each step is made relative to the folder
+// above it, opened without following symlinks, and ownership is changed through the open folder rather than by path,
+// so a user can't swap part of the path for a link (between a check and the chown, say) to have root hand them
+// something outside their own folder. Fails if any part of the path is a symlink, or isn't a folder.
+func mkdirChownInUserFolder(userFolder string, relativePath string, userUID int, userGID int) error {
+	folderFD, openErr := syscall.Open(userFolder, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if openErr != nil {
+		return errors.New("Error opening " + userFolder + ": " + openErr.Error())
+	}
+	path := userFolder
+	parts := strings.Split(filepath.Clean(relativePath), "/")
+	for index, part := range parts {
+		if part == "" || part == "." || part == ".." {
+			syscall.Close(folderFD)
+			return errors.New("Invalid folder " + relativePath)
+		}
+		path = filepath.Join(path, part)
+		mkdirErr := syscall.Mkdirat(folderFD, part, 0700)
+		if mkdirErr != nil && mkdirErr != syscall.EEXIST {
+			syscall.Close(folderFD)
+			return errors.New("Error creating directory " + path + ": " + mkdirErr.Error())
+		}
+		childFD, childErr := syscall.Openat(folderFD, part, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+		syscall.Close(folderFD)
+		if childErr == syscall.ELOOP || childErr == syscall.ENOTDIR {
+			return errors.New(path + " isn't a folder (or is a symbolic link)")
+		} else if childErr != nil {
+			return errors.New("Error opening " + path + ": " + childErr.Error())
+		}
+		folderFD = childFD
+		if mkdirErr == nil || index == len(parts)-1 {
+			if chownErr := syscall.Fchown(folderFD, userUID, userGID); chownErr != nil {
+				syscall.Close(folderFD)
+				return errors.New("Error assigning directory " + path + " to user: " + chownErr.Error())
+			}
+		}
+	}
+	syscall.Close(folderFD)
+	return nil
+}
+
+// userRemoteSpecs works out the mounts wanted for a user's own remotes, along with the remotes that won't be mounted.
+func userRemoteSpecs(username string, remotesConfig UserRemotesConfig) ([]RcloneMountSpec, []RejectedRemote, error) {
+	homeFolder := "/home/" + username
+	configPath := filepath.Join(homeFolder, userRcloneConfigPath)
+	if pathErr := checkUserPath(homeFolder, userRcloneConfigPath, false); pathErr != nil {
+		return nil, nil, pathErr
+	}
+	configData, readErr := os.ReadFile(configPath)
+	if os.IsNotExist(readErr) {
+		return nil, nil, nil
+	} else if readErr != nil {
+		return nil, nil, readErr
+	}
+	remotes, parseErr := parseRcloneConfig(configData)
+	if parseErr != nil {
+		return nil, nil, parseErr
+	}
+	accepted, rejected := selectRemotes(remotes, remotesConfig)
+	if len(accepted) == 0 {
+		return nil, rejected, nil
+	}
+
+	hostUser, lookupErr := user.Lookup(username)
+	if lookupErr != nil {
+		return nil, nil, lookupErr
+	}
+	userUID, _ := strconv.Atoi(hostUser.Uid)
+	userGID, _ := strconv.Atoi(hostUser.Gid)
+	mountFolder := filepath.Join(homeFolder, userRemotesFolder(remotesConfig))
+	if mkdirErr := mkdirChownInUserFolder(homeFolder, userRemotesFolder(remotesConfig), userUID, userGID); mkdirErr != nil {
+		return nil, nil, mkdirErr
+	}
+	var specs []RcloneMountSpec
+	for _, remote := range accepted {
+		spec := RcloneMountSpec{
+			Username:   username,
+			Remote:     remote.Name + ":",
+			Local:      filepath.Join(mountFolder, remote.Name),
+			UID:        userUID,
+			GID:        userGID,
+			UserConfig: configPath,
+		}
+		// A folder already mounted isn't looked at again - that could hang, if its mount has stopped responding.
+		if !rcloneMounts.has(spec.Local) {
+			if pathErr := checkUserPath(mountFolder, remote.Name, true); pathErr != nil {
+				rejected = append(rejected, RejectedRemote{Name: remote.Name, Type: remote.Type, Reason: pathErr.Error()})
+				continue
+			}
+		}
+		specs = append(specs, spec)
+	}
+	return specs, rejected, nil
+}
+
+// syncUserRemotes mounts any new remotes users with a session running have set up, and unmounts remotes they have
+// deleted (or that are no longer allowed). Mounts for users with no session running are left to the mount supervisor
+// to unmount.
+func syncUserRemotes(cli *client.Client, config Config) {
+	containers, containersErr := cli.ContainerList(context.Background(), client.ContainerListOptions{})
+	if containersErr != nil {
+		log.Println("Error listing containers to check user rclone remotes: " + containersErr.Error())
+		return
+	}
+	activeUsers := make(map[string]bool)
+	for _, item := range containers.Items {
+		if _, username, isSession := sessionFromContainer(item); isSession {
+			activeUsers[username] = true
+		}
+	}
+
+	wanted := make(map[string]bool)
+	rejected := make(map[string][]RejectedRemote)
+	if len(config.UserRemotes.AllowedTypes) > 0 {
+		for username := range activeUsers {
+			specs, userRejected, specsErr := userRemoteSpecs(username, config.UserRemotes)
+			if specsErr != nil {
+				userRejected = append(userRejected, RejectedRemote{Reason: specsErr.Error()})
+			}
+			if len(userRejected) > 0 {
+				rejected[username] = userRejected
+			}
+			for _, spec := range specs {
+				wanted[spec.Local] = true
+				if !rcloneMounts.has(spec.Local) {
+					fmt.Println("Mounting rclone remote " + spec.Remote + " set up by user " + username)
+					go rcloneMounts.mount(spec, rcloneMountTimeout(config))
+				}
+			}
+		}
+	}
+	userRemotes.setRejected(rejected)
+
+	for local, username := range rcloneMounts.userRemoteMounts() {
+		if activeUsers[username] && !wanted[local] {
+			fmt.Println("Unmounting " + local + ", the remote is no longer set up (or allowed) for user " + username)
+			rcloneMounts.unmount(local)
+		}
+	}
+}
@@ -42,6 +42,11 @@ var identitySalt = func() string {
 	return "per-user-web-server-identity-salt"
 }()
 
+// The token this proxy presents to the Session Manager, which only accepts calls from trusted components. Read from
+// the "SESSION_MANAGER_TOKEN" environment variable, which is set by the install script to match the "sessionproxy"
+// caller in the Session Manager's config file.
+var sessionManagerToken = os.Getenv("SESSION_MANAGER_TOKEN")
+
 // Obfuscates an identity header value (username / email / name) into a salted SHA-256 digest. The same input always
 // produces the same digest, so an app can still recognise a returning user, but can't learn their real identity.
 func obfuscateIdentityValue(theValue string) string {
@@ -95,8 +100,7 @@ func (pr *ProxyRegistry) get(username string) (*httputil.ReverseProxy, string, b
 }
 
 // Call the connectToSession endpoint on the host's Session Manager to ensure that a "desktop" instance (which runs the rclone GUI server) is running for this user. That endpoint returns the user's generated password
-// which we can use for connections.
-// To do: Check the session manager is only accepting calls from this container (and the guacAutoConnect client) so users can't call it to create other users' sessions.
+// which we can use for connections. The Session Manager only accepts calls presenting a known token, so users can't call it themselves to create other users' sessions.
 func connectToSession(username string, startIfNotRunning bool) string {
 	// Define our form data to pass via POST to the sessionManager server, using url.Values...
 	sessionManagerData := url.Values{}
@@ -118,8 +122,9 @@ func connectToSession(username string, startIfNotRunning bool) string {
 		return ""
 	}
 
-	// Set the correct Content-Type header.
+	// Set the correct Content-Type header, and our token so the Session Manager knows the request is from us.
 	sessionManagerRequest.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	sessionManagerRequest.Header.Set("Authorization", "Bearer "+sessionManagerToken)
 
 	// Execute the (POST) request.
 	sessionManagerResponse, err := sessionManagerClient.Do(sessionManagerRequest)
@@ -128,6 +133,10 @@ func connectToSession(username string, startIfNotRunning bool) string {
 		return ""
 	}
 	defer sessionManagerResponse.Body.Close()
+	if sessionManagerResponse.StatusCode != http.StatusOK {
+		log.Printf("Session Manager returned status %d for user %s\n", sessionManagerResponse.StatusCode, username)
+		return ""
+	}
 
 	// The response should be a string in JSON format, {"port":"..", "password":"..."}, decode that string...
 	var responseData map[string]any
@@ -138,6 +147,64 @@ func connectToSession(username string, startIfNotRunning bool) string {
 	return password
 }
 
+// The minimum interval between reports to the Session Manager that a user's session is in use. Traffic through the
+// proxy can be many requests a second, but the Session Manager only needs to know a session is still in use now and
+// then so it doesn't get culled as idle.
+const activityReportInterval = 1 * time.Minute
+
+// Records when each session's activity was last reported to the Session Manager, protected by a mutex as requests
+// are handled concurrently.
+var activityReportMu sync.Mutex
+var activityReported = map[string]time.Time{}
+
+// shouldReportActivity returns true if activity for the given user hasn't been reported within the last
+// activityReportInterval, marking it as reported now if so. Users whose last report is older than that are forgotten
+// at the same time, as they would be reported again anyway, so the map doesn't grow with every user ever seen.
+func shouldReportActivity(username string, now time.Time) bool {
+	activityReportMu.Lock()
+	defer activityReportMu.Unlock()
+	if lastReported, exists := activityReported[username]; exists && now.Sub(lastReported) < activityReportInterval {
+		return false
+	}
+	for reportedUsername, lastReported := range activityReported {
+		if now.Sub(lastReported) >= activityReportInterval {
+			delete(activityReported, reportedUsername)
+		}
+	}
+	activityReported[username] = now
+	return true
+}
+
+// Tells the Session Manager that the given user's "desktop" session is in use, so it isn't culled as idle while the
+// user is busy with their rclone GUI or apps. Reports are throttled and sent in the background, so they don't slow
+// down the request being proxied.
+func reportSessionActivity(username string) {
+	if username == "" || !shouldReportActivity(username, time.Now()) {
+		return
+	}
+	go func() {
+		sessionManagerData := url.Values{}
+		sessionManagerData.Set("username", username)
+		sessionManagerData.Set("image", "desktop")
+		sessionManagerClient := &http.Client{
+			Timeout: 10 * time.Second,
+		}
+		sessionManagerRequest, err := http.NewRequest("POST", "http://host.docker.internal:8091/sessionActivity", strings.NewReader(sessionManagerData.Encode()))
+		if err != nil {
+			log.Printf("Error creating request: %v\n", err)
+			return
+		}
+		sessionManagerRequest.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		sessionManagerRequest.Header.Set("Authorization", "Bearer "+sessionManagerToken)
+		sessionManagerResponse, err := sessionManagerClient.Do(sessionManagerRequest)
+		if err != nil {
+			log.Printf("Error reporting session activity: %v\n", err)
+			return
+		}
+		sessionManagerResponse.Body.Close()
+	}()
+}
+
 // Adds or updates a proxy in the global dictionary.
 func (pr *ProxyRegistry) set(username string, password string, targetURLStr string, rewriteHTML bool) error {
 	// Now we have the password to use when we create the new Proxy object. First we have to create a URL...
@@ -511,6 +578,7 @@ func main() {
 		}
 
 		log.Printf("Re-written rclone request: %s %s", r.Method, r.URL.Path)
+		reportSessionActivity(username)
 		guiProxy.ServeHTTP(w, r)
 	})
 
@@ -531,6 +599,7 @@ func main() {
 			rcProxy, _, _ = rcloneRCProxies.get(username)
 		}
 
+		reportSessionActivity(username)
 		rcProxy.ServeHTTP(w, r)
 	})
 
@@ -594,6 +663,7 @@ func main() {
 			obfuscateIdentityHeaders(r)
 
 			log.Printf("Re-written app request: %s %s", r.Method, r.URL.Path)
+			reportSessionActivity(URLUsername)
 			proxy.ServeHTTP(w, r)
 		} else {
 			http.Error(w, "Endpoint not found - app routing requested, but not enough parts to URL.", http.StatusNotFound)
@@ -9,6 +9,7 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 // Without a Remote-User header (which Pangolin injects) we can't know whose container to route the OAuth
@@ -260,3 +261,30 @@ func TestObfuscateIdentityHeaders(t *testing.T) {
 		t.Fatalf("unrelated header was modified: %q", got)
 	}
 }
+
+// Activity reports to the Session Manager should be throttled per user - the first request is reported, repeats
+// within the interval aren't, and one after the interval has passed is reported again.
+func TestShouldReportActivity(t *testing.T) {
+	start := time.Now()
+	if !shouldReportActivity("throttle.user", start) {
+		t.Fatalf("expected first activity to be reported")
+	}
+	if shouldReportActivity("throttle.user", start.Add(10*time.Second)) {
+		t.Fatalf("expected repeat activity within the interval not to be reported")
+	}
+	if !shouldReportActivity("other.user", start.Add(10*time.Second)) {
+		t.Fatalf("expected a different user's activity to be reported")
+	}
+	if !shouldReportActivity("throttle.user", start.Add(activityReportInterval)) {
+		t.Fatalf("expected activity after the interval to be reported")
+	}
+	if !shouldReportActivity("third.user", start.Add(2*activityReportInterval)) {
+		t.Fatalf("expected a new user's activity to be reported")
+	}
+	activityReportMu.Lock()
+	_, otherKept := activityReported["other.user"]
+	activityReportMu.Unlock()
+	if otherKept {
+		t.Fatalf("expected a user last reported longer ago than the interval to be forgotten")
+	}
+}